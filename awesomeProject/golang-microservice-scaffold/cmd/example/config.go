@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"example/internal/conf"
+	"example/internal/server"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/config/env"
+	"github.com/go-kratos/kratos/v2/config/file"
+	etcdclient "go.etcd.io/etcd/client/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The configuration is loaded in layers, where each one overrides the ones before it:
+//
+//  1. the defaults embedded into the binary
+//  2. the configuration file given by -conf
+//  3. the configuration shared in etcd under registry.config_key
+//  4. the environment variables prefixed with APP_, e.g. APP_DATA_DATABASE_SOURCE for data.database.source
+//  5. the flags -set path=value, e.g. -set server.http.addr=0.0.0.0:8080
+//
+// A setting which is given without a value, e.g. a key without a value in YAML, leaves the one beneath it. Any string
+// setting may refer to a file by ${file:/run/secrets/db}, which is replaced with the content of the file.
+
+// envPrefix is the prefix of the environment variables overriding the settings
+const envPrefix = "APP_"
+
+// etcdTimeout bounds the reads of the shared configuration
+const etcdTimeout = 5 * time.Second
+
+//go:embed defaults.yaml
+var defaults []byte
+
+// secrets are the settings redacted as the configuration is printed, along with the ones read from files
+var secrets = []string{
+	"registry.password",
+	"server.mqtt.password",
+	"data.database.source",
+	"alert.notification.smtp.password",
+}
+
+// settings are the settings given by the flags in the form of path=value
+type settings []string
+
+func (s *settings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *settings) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("%q is not in the form of path=value", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// configLoader loads the configuration by all the layers. The etcd client reading the shared configuration is kept
+// across the loads, i.e. on start and on the reloads, until the loader is closed.
+type configLoader struct {
+	etcd *etcdclient.Client
+}
+
+// load loads the configuration into bc. It returns the paths of the settings read from the files as well, which are
+// secrets.
+func (l *configLoader) load(bc *conf.Bootstrap) (config.Config, []string, error) {
+	base := []config.Source{
+		&bytesSource{key: "defaults.yaml", data: defaults},
+		file.NewSource(flagconf),
+	}
+	overrides := []config.Source{
+		&overrideSource{key: "env", prefix: envPrefix, settings: envSettings},
+		&overrideSource{key: "flags", settings: flagSettings},
+	}
+	// The key of the shared configuration is given by the other layers
+	c, files, err := newConfig(append(append([]config.Source{}, base...), overrides...), bc)
+	if err != nil || bc.GetRegistry().GetConfigKey() == "" {
+		return c, files, err
+	}
+	_ = c.Close()
+	dialed := l.etcd == nil
+	if dialed {
+		// The client is closed by the loader rather than by the cleanup of the constructor
+		if l.etcd, _, err = server.NewEtcdClient(bc.GetRegistry()); err != nil {
+			l.etcd = nil
+			return nil, nil, err
+		}
+	}
+	shared := &etcdSource{client: l.etcd, key: bc.GetRegistry().GetConfigKey()}
+	c, files, err = newConfig(append(append(base, shared), overrides...), bc)
+	if err != nil && dialed {
+		// The client is dialed again on the next load, whose settings may have been corrected
+		_ = l.etcd.Close()
+		l.etcd = nil
+	}
+	return c, files, err
+}
+
+// Close closes the etcd client, which must be called after the configurations loaded are closed
+func (l *configLoader) Close() error {
+	if l.etcd == nil {
+		return nil
+	}
+	return l.etcd.Close()
+}
+
+func newConfig(sources []config.Source, bc *conf.Bootstrap) (config.Config, []string, error) {
+	r := &fileResolver{}
+	c := config.New(
+		config.WithSource(sources...),
+		config.WithResolver(r.resolve),
+		config.WithMergeFunc(mergeLayer),
+	)
+	if err := c.Load(); err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+	if err := c.Scan(bc); err != nil {
+		_ = c.Close()
+		return nil, nil, err
+	}
+	return c, r.files(), nil
+}
+
+// mergeLayer merges the settings of a layer into the ones beneath it
+func mergeLayer(dst, src interface{}) error {
+	mergeMap(*dst.(*map[string]interface{}), src.(map[string]interface{}))
+	return nil
+}
+
+func mergeMap(dst, src map[string]interface{}) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			if sub, ok := dst[k].(map[string]interface{}); ok {
+				mergeMap(sub, v)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+var fileReference = regexp.MustCompile(`\$\{file:([^}]+)}`)
+
+// fileResolver replaces the references to the files with their contents. The other placeholders are left as they
+// are.
+type fileResolver struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (r *fileResolver) resolve(values map[string]interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths = nil
+	return r.resolveMap("", values)
+}
+
+func (r *fileResolver) resolveMap(prefix string, values map[string]interface{}) error {
+	for k, v := range values {
+		resolved, err := r.resolveValue(prefix+k, v)
+		if err != nil {
+			return err
+		}
+		values[k] = resolved
+	}
+	return nil
+}
+
+func (r *fileResolver) resolveValue(path string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if !fileReference.MatchString(v) {
+			return v, nil
+		}
+		r.paths = append(r.paths, path)
+		var err error
+		resolved := fileReference.ReplaceAllStringFunc(v, func(ref string) string {
+			name := fileReference.FindStringSubmatch(ref)[1]
+			content, readErr := os.ReadFile(name)
+			if readErr != nil && err == nil {
+				err = fmt.Errorf("%s: %w", path, readErr)
+			}
+			// Secrets are usually written with a trailing line break
+			return strings.TrimRight(string(content), "\r\n")
+		})
+		return resolved, err
+	case map[string]interface{}:
+		return v, r.resolveMap(path+".", v)
+	case []interface{}:
+		for i, e := range v {
+			resolved, err := r.resolveValue(path, e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return v, nil
+}
+
+func (r *fileResolver) files() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paths
+}
+
+// bytesSource is the configuration in memory, which never changes
+type bytesSource struct {
+	key  string
+	data []byte
+}
+
+func (s *bytesSource) Load() ([]*config.KeyValue, error) {
+	return []*config.KeyValue{{Key: s.key, Value: s.data, Format: formatOf(s.key)}}, nil
+}
+
+func (s *bytesSource) Watch() (config.Watcher, error) {
+	return env.NewWatcher()
+}
+
+// formatOf returns the format of the configuration by the extension of its name, YAML if absent
+func formatOf(name string) string {
+	if ext := strings.TrimPrefix(filepath.Ext(name), "."); ext != "" {
+		return ext
+	}
+	return "yaml"
+}
+
+// overrideSource overrides the settings one by one, which are given by their paths and values as text. The words of
+// the paths are separated by dots or underscores, and matched against the names of the settings.
+type overrideSource struct {
+	key string
+	// prefix is stripped from the paths
+	prefix   string
+	settings func() map[string]string
+}
+
+func envSettings() map[string]string {
+	settings := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if name, value, _ := strings.Cut(kv, "="); strings.HasPrefix(name, envPrefix) {
+			settings[name] = value
+		}
+	}
+	return settings
+}
+
+func flagSettings() map[string]string {
+	settings := make(map[string]string, len(flagset))
+	for _, s := range flagset {
+		path, value, _ := strings.Cut(s, "=")
+		settings[path] = value
+	}
+	return settings
+}
+
+func (s *overrideSource) Load() ([]*config.KeyValue, error) {
+	values := make(map[string]interface{})
+	md := (&conf.Bootstrap{}).ProtoReflect().Descriptor()
+	for name, text := range s.settings() {
+		words := strings.FieldsFunc(strings.ToLower(strings.TrimPrefix(name, s.prefix)), func(r rune) bool {
+			return r == '.' || r == '_'
+		})
+		fields := fieldsOf(md, words)
+		if fields == nil {
+			// The environment variables of the other programs may share the prefix
+			if s.prefix != "" {
+				continue
+			}
+			return nil, fmt.Errorf("%s does not match any setting", name)
+		}
+		value, err := valueOf(fields[len(fields)-1], text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		m := values
+		for _, f := range fields[:len(fields)-1] {
+			sub, ok := m[string(f.Name())].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[string(f.Name())] = sub
+			}
+			m = sub
+		}
+		m[string(fields[len(fields)-1].Name())] = value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return []*config.KeyValue{{Key: s.key, Value: data, Format: "json"}}, nil
+}
+
+func (s *overrideSource) Watch() (config.Watcher, error) {
+	return env.NewWatcher()
+}
+
+// isSetting tells whether the field is a setting rather than a section of the settings
+func isSetting(f protoreflect.FieldDescriptor) bool {
+	return f.Kind() != protoreflect.MessageKind || f.IsList() || f.IsMap() ||
+		f.Message().FullName() == "google.protobuf.Duration"
+}
+
+// fieldsOf finds the fields on the path to the setting named by the words, preferring the longer names as some of
+// them consist of several words. It returns nil if there is no such setting.
+func fieldsOf(md protoreflect.MessageDescriptor, words []string) []protoreflect.FieldDescriptor {
+	for i := len(words); i > 0; i-- {
+		f := md.Fields().ByName(protoreflect.Name(strings.Join(words[:i], "_")))
+		switch {
+		case f == nil:
+			continue
+		case i == len(words) && isSetting(f):
+			return []protoreflect.FieldDescriptor{f}
+		case i < len(words) && !isSetting(f):
+			if rest := fieldsOf(f.Message(), words[i:]); rest != nil {
+				return append([]protoreflect.FieldDescriptor{f}, rest...)
+			}
+		}
+	}
+	return nil
+}
+
+// valueOf parses the text of the setting, where the elements of a list are separated by commas
+func valueOf(f protoreflect.FieldDescriptor, text string) (interface{}, error) {
+	if f.IsMap() {
+		return nil, fmt.Errorf("%s is a map, which cannot be given as text", f.Name())
+	}
+	if f.IsList() {
+		elements := strings.Split(text, ",")
+		values := make([]interface{}, 0, len(elements))
+		for _, e := range elements {
+			v, err := scalarOf(f, strings.TrimSpace(e))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	return scalarOf(f, text)
+}
+
+func scalarOf(f protoreflect.FieldDescriptor, text string) (interface{}, error) {
+	switch f.Kind() {
+	case protoreflect.BoolKind:
+		return strconv.ParseBool(text)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.ParseInt(text, 10, 64)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.ParseUint(text, 10, 64)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return strconv.ParseFloat(text, 64)
+	default:
+		// Strings, enums by their names and durations such as 1.5s
+		return text, nil
+	}
+}
+
+// etcdSource is the configuration shared in a key of etcd, whose format follows the extension of the key. The
+// client is owned by the loader rather than the source.
+type etcdSource struct {
+	client *etcdclient.Client
+	key    string
+}
+
+func (s *etcdSource) Load() ([]*config.KeyValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("registry.config_key: there is no such key %s in etcd", s.key)
+	}
+	return []*config.KeyValue{{Key: s.key, Value: resp.Kvs[0].Value, Format: formatOf(s.key)}}, nil
+}
+
+func (s *etcdSource) Watch() (config.Watcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdWatcher{source: s, ch: s.client.Watch(ctx, s.key), ctx: ctx, cancel: cancel}, nil
+}
+
+// etcdWatcher watches the shared configuration until it stops
+type etcdWatcher struct {
+	source *etcdSource
+	ch     etcdclient.WatchChan
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *etcdWatcher) Next() ([]*config.KeyValue, error) {
+	select {
+	case resp, ok := <-w.ch:
+		if !ok {
+			return nil, context.Canceled
+		}
+		if err := resp.Err(); err != nil {
+			return nil, err
+		}
+		// A deleted key leaves the settings as they are
+		var kvs []*config.KeyValue
+		for _, event := range resp.Events {
+			if event.Type == etcdclient.EventTypePut {
+				kvs = append(kvs[:0], &config.KeyValue{
+					Key: w.source.key, Value: event.Kv.Value, Format: formatOf(w.source.key)})
+			}
+		}
+		return kvs, nil
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	}
+}
+
+func (w *etcdWatcher) Stop() error {
+	w.cancel()
+	return nil
+}
+
+// redacted replaces the secrets as the configuration is printed
+const redacted = "******"
+
+// printConfig prints the effective configuration in JSON, where the secrets are redacted
+func printConfig(bc *conf.Bootstrap, files []string) error {
+	m := bc.ProtoReflect()
+	for _, path := range append(append([]string{}, secrets...), files...) {
+		redact(m, strings.Split(path, "."))
+	}
+	data, err := protojson.MarshalOptions{Multiline: true, UseProtoNames: true}.Marshal(bc)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// redact replaces the string setting at the path unless it is empty
+func redact(m protoreflect.Message, path []string) {
+	f := m.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	switch {
+	case f == nil || !m.Has(f):
+		return
+	case len(path) > 1:
+		if !isSetting(f) {
+			redact(m.Mutable(f).Message(), path[1:])
+		}
+	case f.Kind() != protoreflect.StringKind || f.IsMap():
+		return
+	case f.IsList():
+		list := m.Mutable(f).List()
+		for i := 0; i < list.Len(); i++ {
+			list.Set(i, protoreflect.ValueOfString(redacted))
+		}
+	default:
+		m.Set(f, protoreflect.ValueOfString(redacted))
+	}
+}
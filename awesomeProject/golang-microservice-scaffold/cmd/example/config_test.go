@@ -0,0 +1,225 @@
+package main
+
+import (
+	"example/internal/conf"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/config"
+)
+
+func TestMergeLayer(t *testing.T) {
+	tests := []struct {
+		name           string
+		dst, src, want map[string]interface{}
+	}{
+		{
+			name: "override",
+			dst:  map[string]interface{}{"a": 1, "b": 2},
+			src:  map[string]interface{}{"a": 3},
+			want: map[string]interface{}{"a": 3, "b": 2},
+		},
+		{
+			name: "empty value",
+			dst:  map[string]interface{}{"a": 1, "b": 2},
+			src:  map[string]interface{}{"a": nil, "c": nil},
+			want: map[string]interface{}{"a": 1, "b": 2},
+		},
+		{
+			name: "nested",
+			dst:  map[string]interface{}{"a": map[string]interface{}{"x": 1, "y": 2}},
+			src:  map[string]interface{}{"a": map[string]interface{}{"x": nil, "y": 3, "z": 4}},
+			want: map[string]interface{}{"a": map[string]interface{}{"x": 1, "y": 3, "z": 4}},
+		},
+		{
+			name: "empty section",
+			dst:  map[string]interface{}{"a": map[string]interface{}{"x": 1}},
+			src:  map[string]interface{}{"a": nil},
+			want: map[string]interface{}{"a": map[string]interface{}{"x": 1}},
+		},
+		{
+			name: "section over value",
+			dst:  map[string]interface{}{"a": 1},
+			src:  map[string]interface{}{"a": map[string]interface{}{"x": 1}},
+			want: map[string]interface{}{"a": map[string]interface{}{"x": 1}},
+		},
+		// The lists are replaced as a whole
+		{
+			name: "list",
+			dst:  map[string]interface{}{"a": []interface{}{1, 2}},
+			src:  map[string]interface{}{"a": []interface{}{3}},
+			want: map[string]interface{}{"a": []interface{}{3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := mergeLayer(&tt.dst, tt.src); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.dst, tt.want) {
+				t.Errorf("got %v, want %v", tt.dst, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConfigKeepsEmptySettings(t *testing.T) {
+	base := "data:\n  database:\n    driver: mysql\n    source: root@tcp(db)/app\nregistry:\n  username: app\n"
+	// A key without a value, as left by a template, leaves the setting beneath it
+	layer := "data:\n  database:\n    source:\nregistry:\n  username: admin\n"
+	bc := &conf.Bootstrap{}
+	c, _, err := newConfig([]config.Source{
+		&bytesSource{key: "base.yaml", data: []byte(base)},
+		&bytesSource{key: "layer.yaml", data: []byte(layer)},
+	}, bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := bc.GetData().GetDatabase().GetSource(); got != "root@tcp(db)/app" {
+		t.Errorf("got source %q, want the one of the base", got)
+	}
+	if got := bc.GetData().GetDatabase().GetDriver(); got != "mysql" {
+		t.Errorf("got driver %q, want mysql", got)
+	}
+	if got := bc.GetRegistry().GetUsername(); got != "admin" {
+		t.Errorf("got username %q, want admin", got)
+	}
+}
+
+func TestFieldsOf(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "DATA_DATABASE_SOURCE", want: "data.database.source"},
+		{name: "data.database.source", want: "data.database.source"},
+		{name: "REGISTRY_CONFIG_KEY", want: "registry.config_key"},
+		{name: "REGISTRY_DIAL_KEEP_ALIVE_TIMEOUT", want: "registry.dial_keep_alive_timeout"},
+		{name: "SERVER_MQTT_CLIENT_ID", want: "server.mqtt.client_id"},
+		// Both the section and the setting consist of several words
+		{name: "SERVER_RATE_LIMIT_CPU_QUOTA", want: "server.rate_limit.cpu_quota"},
+		{name: "server.rate_limit.cpu_quota", want: "server.rate_limit.cpu_quota"},
+		{name: "TERMINAL_OFFLINE_SWEEP_INTERVAL", want: "terminal.offline_sweep_interval"},
+		{name: "TERMINAL_CAMPAIGN_SWEEP_INTERVAL", want: "terminal.campaign.sweep_interval"},
+		{name: "REGISTRY_ENDPOINTS", want: "registry.endpoints"},
+		// A section is not a setting
+		{name: "DATA_DATABASE"},
+		{name: "DATA_DATABASE_NOPE"},
+		{name: "DATA_DATABASE_SOURCE_EXTRA"},
+		{name: "PATH"},
+	}
+	md := (&conf.Bootstrap{}).ProtoReflect().Descriptor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			words := strings.FieldsFunc(strings.ToLower(tt.name), func(r rune) bool { return r == '.' || r == '_' })
+			fields := fieldsOf(md, words)
+			names := make([]string, 0, len(fields))
+			for _, f := range fields {
+				names = append(names, string(f.Name()))
+			}
+			if got := strings.Join(names, "."); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{
+		"registry": map[string]interface{}{
+			"password":  "${file:" + secret + "}",
+			"endpoints": []interface{}{"${file:" + secret + "}", "etcd:2379"},
+		},
+		"data": map[string]interface{}{
+			"database": map[string]interface{}{"source": "app:${file:" + secret + "}@tcp(db)/app"},
+		},
+		// The other placeholders are left as they are
+		"server": map[string]interface{}{"http": map[string]interface{}{"addr": "${HOST}:8000", "timeout": 1}},
+	}
+	r := &fileResolver{}
+	if err := r.resolve(values); err != nil {
+		t.Fatal(err)
+	}
+	registry := values["registry"].(map[string]interface{})
+	if got := registry["password"]; got != "s3cret" {
+		t.Errorf("got password %q, want the content of the file without the line break", got)
+	}
+	if got := registry["endpoints"]; !reflect.DeepEqual(got, []interface{}{"s3cret", "etcd:2379"}) {
+		t.Errorf("got endpoints %v", got)
+	}
+	if got := values["data"].(map[string]interface{})["database"].(map[string]interface{})["source"]; got !=
+		"app:s3cret@tcp(db)/app" {
+		t.Errorf("got source %q", got)
+	}
+	if got := values["server"].(map[string]interface{})["http"].(map[string]interface{})["addr"]; got != "${HOST}:8000" {
+		t.Errorf("got addr %q, want it left as it is", got)
+	}
+	files := r.files()
+	sort.Strings(files)
+	if want := []string{"data.database.source", "registry.endpoints", "registry.password"}; !reflect.DeepEqual(
+		files, want) {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+
+	missing := map[string]interface{}{"registry": map[string]interface{}{
+		"password": "${file:" + filepath.Join(dir, "missing") + "}"}}
+	if err := r.resolve(missing); err == nil || !strings.HasPrefix(err.Error(), "registry.password: ") {
+		t.Errorf("got error %v, want one naming the setting", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	bc := &conf.Bootstrap{
+		Registry: &conf.Registry{
+			Endpoints: []string{"etcd-1:2379", "etcd-2:2379"},
+			Username:  "app",
+			Password:  "etcd-password",
+		},
+		Server: &conf.Server{
+			Http: &conf.Server_HTTP{Addr: "0.0.0.0:8000"},
+			Mqtt: &conf.Server_MQTT{Broker: "tcp://mqtt:1883", Password: "mqtt-password"},
+		},
+		Data: &conf.Data{Database: &conf.Data_Database{Driver: "mysql", Source: "root:pw@tcp(db)/app"}},
+		// The empty password and the absent section are left as they are
+		Alert: &conf.Alert{Notification: &conf.Alert_Notification{Smtp: &conf.Alert_Notification_SMTP{}}},
+	}
+	// The settings read from the files, one of which is a list and another is not a string
+	files := []string{"registry.endpoints", "server.http.addr", "server.http.timeout", "sensor.ingest.nope"}
+	m := bc.ProtoReflect()
+	for _, path := range append(append([]string{}, secrets...), files...) {
+		redact(m, strings.Split(path, "."))
+	}
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{name: "registry.password", got: bc.Registry.Password, want: redacted},
+		{name: "server.mqtt.password", got: bc.Server.Mqtt.Password, want: redacted},
+		{name: "data.database.source", got: bc.Data.Database.Source, want: redacted},
+		{name: "alert.notification.smtp.password", got: bc.Alert.Notification.Smtp.Password, want: ""},
+		{name: "registry.endpoints", got: bc.Registry.Endpoints, want: []string{redacted, redacted}},
+		{name: "server.http.addr", got: bc.Server.Http.Addr, want: redacted},
+		{name: "server.http.timeout", got: bc.Server.Http.Timeout == nil, want: true},
+		{name: "registry.username", got: bc.Registry.Username, want: "app"},
+		{name: "server.mqtt.broker", got: bc.Server.Mqtt.Broker, want: "tcp://mqtt:1883"},
+		{name: "data.database.driver", got: bc.Data.Database.Driver, want: "mysql"},
+		{name: "sensor", got: bc.Sensor == nil, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"example/internal/conf"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var droppedLogs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "log_dropped_entries_total",
+	Help: "Number of the log entries dropped as the output is unavailable",
+}, []string{"driver"})
+
+const (
+	defaultLogMaxSize = 100 << 20
+	// backupTimeFormat names the rotated files, so that they are sorted by their names in the order of time
+	backupTimeFormat = "20060102T150405.000"
+)
+
+// rotatingFile is the log file which is rotated as it grows beyond the size or gets older than the interval. The
+// rotated files are named after the time of the rotation, and compressed and expired in the background.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	compress   bool
+
+	// mu guards the current file
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// cleaning serializes the compression and the expiration of the rotated files
+	cleaning sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func openRotatingFile(path string, c *conf.Log_Rotation) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(c.GetMaxSize()) << 20,
+		interval:   c.GetInterval().AsDuration(),
+		maxBackups: int(c.GetMaxBackups()),
+		maxAge:     c.GetMaxAge().AsDuration(),
+		compress:   c.GetCompress(),
+	}
+	if f.maxSize <= 0 {
+		f.maxSize = defaultLogMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file for appending. The age of an existing file is counted from now on.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && (f.size+int64(len(p)) > f.maxSize || f.interval > 0 && time.Since(f.opened) >= f.interval) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file after the time, and opens a new one. The file keeps being written if it cannot
+// be renamed, e.g. it has been removed by hand.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format(backupTimeFormat) + ext
+	renamed := os.Rename(f.path, backup) == nil
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renamed {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.clean(backup)
+		}()
+	}
+	return nil
+}
+
+// clean compresses the rotated file if requested, and removes the rotated files beyond the limits
+func (f *rotatingFile) clean(backup string) {
+	f.cleaning.Lock()
+	defer f.cleaning.Unlock()
+	if f.compress {
+		_ = compressFile(backup)
+	}
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext) + "-"
+	matches, err := filepath.Glob(base + "*" + ext + "*")
+	if err != nil {
+		return
+	}
+	// The other files sharing the prefix, e.g. the log file of another service named after this one, are kept
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(m, base), ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// The newest come first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		expired := f.maxBackups > 0 && i >= f.maxBackups
+		if info, err := os.Stat(b); err == nil && f.maxAge > 0 && time.Since(info.ModTime()) > f.maxAge {
+			expired = true
+		}
+		if expired {
+			_ = os.Remove(b)
+		}
+	}
+}
+
+// compressFile replaces the file with its gzip-compressed copy
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(path + ".gz")
+		}
+	}()
+	w := gzip.NewWriter(dst)
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (f *rotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+// Close closes the current file after the rotated files are cleaned
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wg.Wait()
+	return f.file.Close()
+}
+
+const (
+	logDialTimeout   = 3 * time.Second
+	logWriteTimeout  = 3 * time.Second
+	logRetryInterval = 5 * time.Second
+)
+
+// tcpWriter sends the logs to a collector over TCP. The logs are dropped rather than blocking the service while
+// there is no connection, which is dialed in the background and retried after a while if it fails.
+type tcpWriter struct {
+	addr string
+	// mu guards the connection, and is never held while dialing
+	mu      sync.Mutex
+	conn    net.Conn
+	dialing bool
+	retryAt time.Time
+	closed  bool
+}
+
+// newTCPWriter starts dialing the collector, so that the connection is likely ready by the first logs
+func newTCPWriter(addr string) *tcpWriter {
+	w := &tcpWriter{addr: addr}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dial()
+	return w
+}
+
+// dial connects to the collector in the background, unless it is being dialed or has failed a moment ago. It must
+// be called with the lock held.
+func (w *tcpWriter) dial() {
+	if w.dialing || w.closed || time.Now().Before(w.retryAt) {
+		return
+	}
+	w.dialing = true
+	go func() {
+		conn, err := net.DialTimeout("tcp", w.addr, logDialTimeout)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.dialing = false
+		switch {
+		case err != nil:
+			w.retryAt = time.Now().Add(logRetryInterval)
+		case w.closed:
+			_ = conn.Close()
+		default:
+			w.conn = conn
+		}
+	}()
+}
+
+func (w *tcpWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		w.dial()
+		droppedLogs.WithLabelValues("tcp").Inc()
+		return len(p), nil
+	}
+	_ = w.conn.SetWriteDeadline(time.Now().Add(logWriteTimeout))
+	if _, err := w.conn.Write(p); err != nil {
+		// A partially written line is terminated by the collector as the connection is closed
+		_ = w.conn.Close()
+		w.conn = nil
+		w.retryAt = time.Now().Add(logRetryInterval)
+		droppedLogs.WithLabelValues("tcp").Inc()
+	}
+	return len(p), nil
+}
+
+func (w *tcpWriter) Sync() error {
+	return nil
+}
+
+func (w *tcpWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+}
@@ -0,0 +1,74 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogCore writes the logs to syslog with the severities of their levels
+type syslogCore struct {
+	zapcore.LevelEnabler
+	encoder zapcore.Encoder
+	w       *syslog.Writer
+}
+
+// newSyslogCore connects to the syslog server at the address such as udp://127.0.0.1:514, or the local one if the
+// address is empty
+func newSyslogCore(encoder zapcore.Encoder, addr string) (zapcore.Core, func(), error) {
+	var network, raddr string
+	if addr != "" {
+		var ok bool
+		if network, raddr, ok = strings.Cut(addr, "://"); !ok {
+			network, raddr = "udp", addr
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &syslogCore{LevelEnabler: logLevel, encoder: encoder, w: w}, func() { _ = w.Close() }, nil
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	encoder := c.encoder.Clone()
+	for _, f := range fields {
+		f.AddTo(encoder)
+	}
+	return &syslogCore{LevelEnabler: c.LevelEnabler, encoder: encoder, w: c.w}
+}
+
+func (c *syslogCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.encoder.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	switch e.Level {
+	case zapcore.DebugLevel:
+		return c.w.Debug(msg)
+	case zapcore.InfoLevel:
+		return c.w.Info(msg)
+	case zapcore.WarnLevel:
+		return c.w.Warning(msg)
+	case zapcore.ErrorLevel:
+		return c.w.Err(msg)
+	default:
+		return c.w.Crit(msg)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogCore(zapcore.Encoder, string) (zapcore.Core, func(), error) {
+	return nil, nil, errors.New("telemetry.log.driver: syslog is not supported on this platform")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"example/internal/conf"
 	"fmt"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware/tracing"
@@ -12,85 +13,176 @@ import (
 	kratoszap "github.com/go-kratos/kratos/contrib/log/zap/v2"
 )
 
-// NewLogger creates a logger based on the configuration
+// logLevel is the minimum level of the logs, which follows telemetry.log.level as it is reloaded
+var logLevel = zap.NewAtomicLevel()
+
+// levelOf converts the configured level of the logs
+func levelOf(level conf.Log_Level) zapcore.Level {
+	switch level {
+	case conf.Log_Info:
+		return zapcore.InfoLevel
+	case conf.Log_Warn:
+		return zapcore.WarnLevel
+	case conf.Log_Error:
+		return zapcore.ErrorLevel
+	case conf.Log_Fatal:
+		return zapcore.FatalLevel
+	default:
+		return zapcore.DebugLevel
+	}
+}
+
+// NewLogger creates a logger based on the configuration, along with the function flushing and closing its output
 //
-// Note that the logger should typically write multiple logs simultaneously to different
-// outputs (Standard Output [os.Stdout], Log files, or Log collectors like logstash, filebeat, etc.).
-func NewLogger(driver, addr string) log.Logger {
-	return log.With(
-		kratoszap.NewLogger(
-			zap.New(
-				zapcore.NewTee(
-					zapcore.NewCore(
-						zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
-							CallerKey:        "caller",
-							LevelKey:         "level",
-							MessageKey:       "msg",
-							TimeKey:          "ts",
-							StacktraceKey:    "st",
-							LineEnding:       zapcore.DefaultLineEnding,
-							ConsoleSeparator: " ",
-							EncodeCaller: func(caller zapcore.EntryCaller, encoder zapcore.PrimitiveArrayEncoder) {
-								encoder.AppendString(
-									fmt.Sprintf(
-										"\033[36m%s:%d\033[0m",
-										caller.File,
-										caller.Line,
-									),
-								)
-							},
-							// Print out the timestamp with customized formatting
-							EncodeTime: func(t time.Time, encoder zapcore.PrimitiveArrayEncoder) {
-								encoder.AppendString(t.Format(timeFormat))
-							},
-							// Print out different levels using different colors
-							EncodeLevel: func(level zapcore.Level, encoder zapcore.PrimitiveArrayEncoder) {
-								switch level {
-								case zapcore.DebugLevel:
-									encoder.AppendString("\033[37;1mDEBUG\033[0m")
-								case zapcore.InfoLevel:
-									encoder.AppendString("\033[36;1mINFO\033[0m")
-								case zapcore.WarnLevel:
-									encoder.AppendString("\033[33;1mWARN\033[0m")
-								case zapcore.ErrorLevel:
-									encoder.AppendString("\033[31;1mERROR\033[0m")
-								case zapcore.DPanicLevel:
-									encoder.AppendString("\033[31;1mDPANIC\033[0m")
-								case zapcore.PanicLevel:
-									encoder.AppendString("\033[31;1mPANIC\033[0m")
-								case zapcore.FatalLevel:
-									encoder.AppendString("\033[31;1mFATAL\033[0m")
-								case zapcore.InvalidLevel:
-									encoder.AppendString("\033[31;1mINVALID\033[0m")
-								}
-								encoder.AppendString(fmt.Sprintf("\033[35m[%s]\033[0m", id))
-							},
-						}),
-						// We need to tell the zap core that we want the log message to be printed to the console
-						zapcore.AddSync(os.Stdout),
-						// All the log messages whose level is beyond [zapcore.DebugLevel] are printed
-						zapcore.DebugLevel,
-					),
-					// You can add one more output path as well by uncommenting the following lines.
-					//zapcore.NewCore(
-					//	zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-					//	zapcore.AddSync(logOutput),
-					//	zapcore.DebugLevel,
-					//),
-				),
-				// Print out the exact location of the caller
-				zap.WithCaller(true),
-				// Print out the stack trace when the level is greater than or equal to [zap.WarnLevel]
-				zap.AddStacktrace(zap.WarnLevel),
-				zap.Fields(
-					zap.String("service.id", id),
-					zap.String("service.name", Name),
-					zap.String("service.version", Version),
-				),
-			),
+// The driver selects where the logs are written:
+//   - console: the standard output, colored if it is a terminal unless configured otherwise
+//   - file: the file at the address in JSON lines, which is rotated by its size and age
+//   - syslog: the syslog server at the address, or the local one if the address is empty
+//   - tcp: the collector at the address in JSON lines, e.g. logstash with the json_lines codec
+func NewLogger(c *conf.Log) (log.Logger, func(), error) {
+	core, closeOutput, err := newLogCore(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger := zap.New(
+		core,
+		// Print out the exact location of the caller
+		zap.WithCaller(true),
+		// Print out the stack trace when the level is greater than or equal to [zap.WarnLevel]
+		zap.AddStacktrace(zap.WarnLevel),
+		zap.Fields(
+			zap.String("service.id", id),
+			zap.String("service.name", Name),
+			zap.String("service.version", Version),
 		),
+	)
+	cleanup := func() {
+		_ = logger.Sync()
+		closeOutput()
+	}
+	return log.With(
+		kratoszap.NewLogger(logger),
 		// Each call to the service should have its tracing id, so we also need print it out.
 		"trace.id", tracing.TraceID(),
 		"span.id", tracing.SpanID(),
-	)
+	), cleanup, nil
+}
+
+// newLogCore creates the core writing the logs to the output selected by the driver
+func newLogCore(c *conf.Log) (zapcore.Core, func(), error) {
+	switch c.GetDriver() {
+	case "", "console":
+		encoder, err := newLogEncoder(c, "console", isTerminal(os.Stdout))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), logLevel), func() {}, nil
+	case "file":
+		encoder, err := newLogEncoder(c, "json", false)
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := openRotatingFile(c.GetAddr(), c.GetRotation())
+		if err != nil {
+			return nil, nil, err
+		}
+		return zapcore.NewCore(encoder, file, logLevel), func() { _ = file.Close() }, nil
+	case "syslog":
+		encoder, err := newLogEncoder(c, "json", false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newSyslogCore(encoder, c.GetAddr())
+	case "tcp":
+		encoder, err := newLogEncoder(c, "json", false)
+		if err != nil {
+			return nil, nil, err
+		}
+		w := newTCPWriter(c.GetAddr())
+		return zapcore.NewCore(encoder, w, logLevel), w.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("telemetry.log.driver: unknown driver %q", c.GetDriver())
+	}
+}
+
+// isTerminal tells whether the file is a terminal, where the escape codes are rendered as colors
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// newLogEncoder creates the encoder of the configured format, or the default one of the driver. The console format
+// is colored as configured, or if the output is a terminal.
+func newLogEncoder(c *conf.Log, format string, terminal bool) (zapcore.Encoder, error) {
+	if c.GetFormat() != "" {
+		format = c.GetFormat()
+	}
+	var colored bool
+	switch c.GetColor() {
+	case "", "auto":
+		_, noColor := os.LookupEnv("NO_COLOR")
+		colored = terminal && !noColor
+	case "always":
+		colored = true
+	case "never":
+	default:
+		return nil, fmt.Errorf("telemetry.log.color: unknown mode %q", c.GetColor())
+	}
+	switch format {
+	case "console":
+		return zapcore.NewConsoleEncoder(consoleEncoderConfig(colored)), nil
+	case "json":
+		config := zap.NewProductionEncoderConfig()
+		config.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+		config.EncodeDuration = zapcore.StringDurationEncoder
+		return zapcore.NewJSONEncoder(config), nil
+	default:
+		return nil, fmt.Errorf("telemetry.log.format: unknown format %q", format)
+	}
+}
+
+// levelColors are the escape codes of the levels printed on the console
+var levelColors = map[zapcore.Level]string{
+	zapcore.DebugLevel:  "\033[37;1m",
+	zapcore.InfoLevel:   "\033[36;1m",
+	zapcore.WarnLevel:   "\033[33;1m",
+	zapcore.ErrorLevel:  "\033[31;1m",
+	zapcore.DPanicLevel: "\033[31;1m",
+	zapcore.PanicLevel:  "\033[31;1m",
+	zapcore.FatalLevel:  "\033[31;1m",
+}
+
+// consoleEncoderConfig is the human-readable encoding of the logs, which is colored by the escape codes if requested
+func consoleEncoderConfig(colored bool) zapcore.EncoderConfig {
+	paint := func(code, s string) string {
+		if !colored {
+			return s
+		}
+		return code + s + "\033[0m"
+	}
+	return zapcore.EncoderConfig{
+		CallerKey:        "caller",
+		LevelKey:         "level",
+		MessageKey:       "msg",
+		TimeKey:          "ts",
+		StacktraceKey:    "st",
+		LineEnding:       zapcore.DefaultLineEnding,
+		ConsoleSeparator: " ",
+		EncodeCaller: func(caller zapcore.EntryCaller, encoder zapcore.PrimitiveArrayEncoder) {
+			encoder.AppendString(paint("\033[36m", fmt.Sprintf("%s:%d", caller.File, caller.Line)))
+		},
+		// Print out the timestamp with customized formatting
+		EncodeTime: func(t time.Time, encoder zapcore.PrimitiveArrayEncoder) {
+			encoder.AppendString(t.Format(timeFormat))
+		},
+		// Print out different levels using different colors
+		EncodeLevel: func(level zapcore.Level, encoder zapcore.PrimitiveArrayEncoder) {
+			code, ok := levelColors[level]
+			if !ok {
+				code = "\033[31;1m"
+			}
+			encoder.AppendString(paint(code, level.CapitalString()))
+			encoder.AppendString(paint("\033[35m", "["+id+"]"))
+		},
+	}
 }
@@ -4,15 +4,16 @@ import (
 	"flag"
 	"fmt"
 	"github.com/go-kratos/kratos/v2/registry"
+	"github.com/go-kratos/kratos/v2/transport"
 	"os"
 	"strings"
 	"time"
 
 	"example/internal/conf"
+	"example/internal/server"
 
 	"github.com/go-kratos/kratos/v2"
 	"github.com/go-kratos/kratos/v2/config"
-	"github.com/go-kratos/kratos/v2/config/file"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/transport/grpc"
 	"github.com/go-kratos/kratos/v2/transport/http"
@@ -45,6 +46,10 @@ var (
 
 	// flagconf is the config flag, which specifies the location of the configuration file
 	flagconf string
+	// flagset overrides the settings of the configuration by their paths
+	flagset settings
+	// flagprint prints the effective configuration with the secrets redacted instead of running the service
+	flagprint bool
 	// We adopt the hostname as the identifier of the service
 	id, _ = os.Hostname()
 
@@ -58,6 +63,8 @@ var (
 func init() {
 	// Declare a flag '-conf' so that the user can pass a config file with the argument
 	flag.StringVar(&flagconf, "conf", "../../configs", "config path, eg: -conf config.yaml")
+	flag.Var(&flagset, "set", "override a setting, which may be repeated, eg: -set server.http.addr=0.0.0.0:8080")
+	flag.BoolVar(&flagprint, "print-config", false, "print the effective config with the secrets redacted and exit")
 }
 
 // newApp initializes all the dependencies that the service requires and then creates the service instance
@@ -78,7 +85,9 @@ func init() {
 //   - Authorization: Json Web Token
 //
 // DO NOT HARD CODE CONFIG OR DEPENDENCIES
-func newApp(logger log.Logger, reg registry.Registrar, gs *grpc.Server, hs *http.Server) *kratos.App {
+func newApp(
+	logger log.Logger, reg registry.Registrar, gs *grpc.Server, hs *http.Server, ws server.Workers,
+	h *server.Health) *kratos.App {
 	return kratos.New(
 		kratos.ID(id),           // A service ID should be unique in the global scope
 		kratos.Name(Name),       // A service name should be human-readable and clear enough to ensure maintainability
@@ -88,9 +97,13 @@ func newApp(logger log.Logger, reg registry.Registrar, gs *grpc.Server, hs *http
 		}),
 		kratos.Logger(logger),
 		kratos.Server( // The service runs both HTTP and GRPC server simultaneously.
-			gs, hs, // Intro-service calls should utilize GRPC server while the front end uses HTTP server
+			// Intro-service calls should utilize GRPC server while the front end uses HTTP server.
+			// Background workers share the lifecycle of the servers.
+			append([]transport.Server{gs, hs}, ws...)...,
 		),
 		kratos.Registrar(reg), // Tell the Kratos to use the client as its registrar
+		// The load balancers are given the time to take the instance out of rotation before the servers stop
+		kratos.BeforeStop(h.Drain),
 	)
 }
 
@@ -98,47 +111,63 @@ func newApp(logger log.Logger, reg registry.Registrar, gs *grpc.Server, hs *http
 func main() {
 	// Parse arguments from the command line
 	flag.Parse()
-	// Initialize the config with the source
-	// Note that a source may on the local disk, but it can also be fetched from remote one
-	c := config.New(
-		config.WithSource(
-			file.NewSource(flagconf),
-		),
-	)
+	// Load the config in layers, i.e. the defaults, the file, the one shared in etcd, the environment variables
+	// and the flags, where each one overrides the ones before it
+	// Bootstrap is the configuration structure of the config file
+	var bc conf.Bootstrap
+	loader := &configLoader{}
+	defer loader.Close() // The etcd client is closed after the config sources
+	c, files, err := loader.load(&bc)
+	if err != nil {
+		panic(err)
+	}
 	defer func(c config.Config) {
 		err := c.Close()
 		if err != nil {
 			log.Warn(err)
 		}
-	}(c) // We should make sure the config file would finally be closed
+	}(c) // We should make sure the config sources would finally be closed
 
-	if err := c.Load(); err != nil { // Try to load the config file from the given source
-		panic(err)
+	if flagprint {
+		if err = printConfig(&bc, files); err != nil {
+			panic(err)
+		}
+		return
 	}
 
-	// Bootstrap is the configuration structure of the config file
-	var bc conf.Bootstrap
-	if err := c.Scan(&bc); err != nil { // Try to deserialize the config into the corresponding structure
+	// A few settings are reloaded at runtime, which the components read from the live configuration
+	live := conf.NewLive(&bc)
+	logLevel.SetLevel(levelOf(bc.Telemetry.GetLog().GetLevel()))
+	live.Observe(func(_, next *conf.Bootstrap) {
+		logLevel.SetLevel(levelOf(next.GetTelemetry().GetLog().GetLevel()))
+	})
+
+	logger, closeLogger, err := NewLogger(bc.Telemetry.GetLog())
+	if err != nil {
 		panic(err)
 	}
-
-	logger := NewLogger(bc.Telemetry.Log.Driver, bc.Telemetry.Log.Addr)
+	defer closeLogger() // Flush the logs before exits
 	log.SetLogger(logger)
 
 	// Inject dependencies into the service
-	app, cleanup, err := wireApp(bc.Registry, bc.Server, bc.Data, bc.Telemetry, logger)
+	app, cleanup, err := wireApp(
+		bc.Registry, bc.Server, bc.Data, bc.Telemetry, bc.Terminal, bc.Sensor, bc.Alert, live, logger)
 	if err != nil {
 		panic(err)
 	}
 	defer cleanup() // Clean up the injected dependencies before exits
 
+	// Reload the configuration as the file changes or on SIGHUP
+	stop := watchConfig(c, loader, live, logger)
+	defer stop()
+
 	builder := strings.Builder{}
-	builder.WriteString(
-		fmt.Sprintf(
-			"\n    \033[36;1m%s\033[0m \033[96m%s\033[0m  ready in \033[33;1m%v\033[0m\n",
-			Name, Version, time.Now().Sub(startTime),
-		),
-	)
+	banner := "\n    \033[36;1m%s\033[0m \033[96m%s\033[0m  ready in \033[33;1m%v\033[0m\n"
+	if !isTerminal(os.Stdout) {
+		// The escape codes are noises in the log pipelines
+		banner = "\n    %s %s  ready in %v\n"
+	}
+	builder.WriteString(fmt.Sprintf(banner, Name, Version, time.Now().Sub(startTime)))
 	fmt.Println(builder.String())
 
 	// start and wait for stop signal
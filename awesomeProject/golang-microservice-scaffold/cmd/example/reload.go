@@ -0,0 +1,126 @@
+package main
+
+import (
+	"example/internal/conf"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "Number of the reloads of the configuration by their results",
+	}, []string{"result"})
+	configChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_changes_total",
+		Help: "Number of the changed settings, which are either applied or require a restart",
+	}, []string{"setting", "result"})
+)
+
+// watchedKeys are the top-level keys of the configuration, whose changes trigger the reloads
+var watchedKeys = []string{"registry", "server", "data", "telemetry", "terminal", "sensor", "alert"}
+
+// reloadDelay is how long the configuration is left unchanged before it is reloaded, so that the changes of
+// several keys, several writes of the file and a SIGHUP along with them are reloaded at once
+const reloadDelay = 500 * time.Millisecond
+
+// reloader reloads the configuration as the file or the one shared in etcd changes, or on SIGHUP. All the layers
+// are loaded again, since a changed layer is merged on top of the others by the watchers.
+type reloader struct {
+	loader *configLoader
+	live   *conf.Live
+	log    *log.Helper
+}
+
+// watchConfig reloads the configuration by the loader until the returned function is called
+func watchConfig(c config.Config, loader *configLoader, live *conf.Live, logger log.Logger) (stop func()) {
+	r := &reloader{loader: loader, live: live, log: log.NewHelper(log.With(logger, "module", "main/reload"))}
+	// A change is pending already if the channel is full, and the reload is yet to read it
+	changes := make(chan struct{}, 1)
+	for _, key := range watchedKeys {
+		// The missing keys are not watched, so adding one takes a SIGHUP
+		err := c.Watch(key, func(string, config.Value) {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			r.log.Debugf("%s of the configuration is not watched: %v", key, err)
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var triggers []string
+		var due <-chan time.Time
+		trigger := func(t string) {
+			if !slices.Contains(triggers, t) {
+				triggers = append(triggers, t)
+			}
+			due = time.After(reloadDelay)
+		}
+		for {
+			select {
+			case <-changes:
+				trigger("change")
+			case <-signals:
+				trigger("SIGHUP")
+			case <-due:
+				r.reload(strings.Join(triggers, " and "))
+				triggers, due = nil, nil
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+		// The loader is closed after the reload in progress
+		<-stopped
+	}
+}
+
+// reload applies the reloadable settings of the configuration. The changes of the other settings are reported
+// without their values, which may be secrets.
+func (r *reloader) reload(trigger string) {
+	var next conf.Bootstrap
+	c, _, err := r.loader.load(&next)
+	if err != nil {
+		configReloads.WithLabelValues("rejected").Inc()
+		r.log.Errorf("failed to reload the configuration on %s: %v", trigger, err)
+		return
+	}
+	_ = c.Close()
+	applied, restart, err := r.live.Reload(&next)
+	for _, path := range restart {
+		configChanges.WithLabelValues(path, "restart_required").Inc()
+		r.log.Warnf("%s has changed, which takes effect on the next start", path)
+	}
+	switch {
+	case err != nil:
+		configReloads.WithLabelValues("rejected").Inc()
+		r.log.Errorf("failed to reload the configuration on %s: %v", trigger, err)
+		return
+	case len(applied) == 0:
+		configReloads.WithLabelValues("unchanged").Inc()
+		return
+	}
+	configReloads.WithLabelValues("applied").Inc()
+	for _, path := range applied {
+		configChanges.WithLabelValues(path, "applied").Inc()
+		r.log.Infof("%s is reloaded on %s as %q", path, trigger, conf.Lookup(&next, path))
+	}
+}
@@ -0,0 +1,690 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/alert/v1"
+	"example/internal/conf"
+	"example/internal/constant"
+	"example/internal/ent"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AlertRule is a condition on the readings of a sensor or on the status of a terminal
+type AlertRule = v1.AlertRule
+
+// Alert is an occurrence of the condition of a rule
+type Alert = v1.Alert
+
+// Silence marks the alerts fired within its time range as silenced
+type Silence = v1.Silence
+
+// RuleState is an enabled rule along with the state of its evaluation
+type RuleState struct {
+	Rule *AlertRule
+	// PendingSince is the time since which the condition holds, nil if it does not hold
+	PendingSince *time.Time
+	// LastValue and LastTime are of the latest reading evaluated
+	LastValue *float64
+	LastTime  *time.Time
+}
+
+// RuleStateQuery finds the enabled rules matching all the given conditions. An empty condition matches all of them.
+type RuleStateQuery struct {
+	Kinds       []v1.AlertRule_Kind
+	SensorIds   []int
+	TerminalIds []int
+}
+
+// AlertQuery finds the alerts matching all the given conditions from the newest to the oldest
+type AlertQuery struct {
+	Statuses        []v1.Alert_Status
+	RuleId          int
+	IncludeSilenced bool
+	Offset          int
+	Limit           int
+}
+
+// AlertRepository stores the alert rules along with their states, the alerts and the silences
+type AlertRepository interface {
+	AddRule(ctx context.Context, rule *AlertRule) (*AlertRule, error)
+	FindRuleById(ctx context.Context, id int) (*AlertRule, error)
+	ListRules(ctx context.Context, offset, limit int) ([]*AlertRule, int, error)
+	// UpdateRule replaces the definition of the rule and clears the state of its evaluation
+	UpdateRule(ctx context.Context, rule *AlertRule) (*AlertRule, error)
+	// DeleteRule deletes the rule along with its alerts and silences
+	DeleteRule(ctx context.Context, id int) error
+	FindStates(ctx context.Context, query *RuleStateQuery) ([]*RuleState, error)
+	// SaveState stores the state of the evaluation of the rule
+	SaveState(ctx context.Context, state *RuleState) error
+	// Fire creates a firing alert of the rule unless the rule has one, in which case the firing alert is refreshed
+	// with the value and the message instead. It reports whether the alert is created.
+	Fire(ctx context.Context, alert *Alert) (*Alert, bool, error)
+	// Resolve resolves the firing alert of the rule at the time, and returns nil if the rule has none
+	Resolve(ctx context.Context, ruleId int, at time.Time) (*Alert, error)
+	FindAlertById(ctx context.Context, id int) (*Alert, error)
+	ListAlerts(ctx context.Context, query *AlertQuery) ([]*Alert, int, error)
+	Acknowledge(ctx context.Context, id int, by, comment string) (*Alert, error)
+	// DeleteAlert deletes the alert if it is resolved, and reports whether it is deleted
+	DeleteAlert(ctx context.Context, id int) (bool, error)
+	AddSilence(ctx context.Context, silence *Silence) (*Silence, error)
+	ListSilences(ctx context.Context, includeExpired bool, offset, limit int) ([]*Silence, int, error)
+	DeleteSilence(ctx context.Context, id int) error
+	// IsSilenced reports whether any silence of the rule, or of all the rules, is in effect at the time
+	IsSilenced(ctx context.Context, ruleId int, at time.Time) (bool, error)
+}
+
+// AlertObserver is notified of the alerts once they fire or are resolved, along with their rules
+type AlertObserver func(ctx context.Context, alert *Alert, rule *AlertRule)
+
+const (
+	// defaultAlertPageSize is the page size of the rules, the alerts and the silences if it is not given
+	defaultAlertPageSize = 50
+	// defaultAlertQueue is the capacity of the queue of the evaluations if it is not configured
+	defaultAlertQueue = 1000
+)
+
+var droppedAlertEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "alert_dropped_evaluations_total",
+	Help: "Number of the readings, anomaly scores and status changes which are not evaluated since the queue is full",
+}, []string{"kind"})
+
+// AlertManager evaluates the alert rules as the sensors write their readings and as the terminals change their
+// status. The conditions which hold for a duration, or which hold due to the absence of the readings, are
+// evaluated periodically by [AlertManager.Evaluate].
+//
+// The evaluations read and write the states of the rules, so they all run one by one on the goroutine of
+// [AlertManager.Run]. The readings, the scores and the status changes are queued for it without blocking their
+// writers, while the changes of the rules and the periodic evaluation wait for it to take their turn.
+type AlertManager struct {
+	repo      AlertRepository
+	sensors   *SensorManager
+	anomalies *AnomalyManager
+	terminals *TerminalManager
+	observers []AlertObserver
+	log       *log.Helper
+	// queue holds the evaluations of the readings, the scores and the status changes
+	queue chan func(ctx context.Context)
+	// calls holds the evaluations and the changes of the rules whose callers wait for them
+	calls chan func()
+}
+
+func NewAlertManager(
+	c *conf.Alert, repo AlertRepository, sensors *SensorManager, anomalies *AnomalyManager,
+	terminals *TerminalManager, logger log.Logger) *AlertManager {
+	queueSize := int(c.GetQueueSize())
+	if queueSize <= 0 {
+		queueSize = defaultAlertQueue
+	}
+	m := &AlertManager{
+		repo:      repo,
+		sensors:   sensors,
+		anomalies: anomalies,
+		terminals: terminals,
+		log:       log.NewHelper(log.With(logger, "module", "biz/alert")),
+		queue:     make(chan func(ctx context.Context), queueSize),
+		calls:     make(chan func()),
+	}
+	sensors.ObserveReadings(m.onReadings)
+	anomalies.ObserveScores(m.onScores)
+	terminals.ObserveStatus(m.onStatus)
+	return m
+}
+
+// ObserveAlerts registers the observer of the alerts. It must be called before any rule is evaluated, i.e. while
+// the application is being initialized.
+func (m *AlertManager) ObserveAlerts(o AlertObserver) {
+	m.observers = append(m.observers, o)
+}
+
+// Run evaluates the queued readings, scores and status changes, as well as the calls waiting for their turn, until
+// the context is done. The evaluations queued by then are run before it returns.
+func (m *AlertManager) Run(ctx context.Context) error {
+	// An evaluation in progress is never aborted, otherwise the state of the rule would be left half advanced
+	evalCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case evaluate := <-m.queue:
+			evaluate(evalCtx)
+		case call := <-m.calls:
+			call()
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(evalCtx, drainTimeout)
+			defer cancel()
+			for {
+				select {
+				case evaluate := <-m.queue:
+					evaluate(drainCtx)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// enqueue queues the evaluation of n readings, scores or status changes of the kind, which are dropped if the queue
+// is full
+func (m *AlertManager) enqueue(kind string, n int, evaluate func(ctx context.Context)) {
+	select {
+	case m.queue <- evaluate:
+	default:
+		droppedAlertEvaluations.WithLabelValues(kind).Add(float64(n))
+	}
+}
+
+// call runs the function on the goroutine of [AlertManager.Run] and waits for its result
+func (m *AlertManager) call(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	select {
+	case m.calls <- func() { done <- fn() }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify tells the observers that the alert of the rule has fired or has been resolved
+func (m *AlertManager) notify(ctx context.Context, alert *Alert, rule *AlertRule) {
+	for _, o := range m.observers {
+		o(ctx, alert, rule)
+	}
+}
+
+// resolve resolves the firing alert of the rule at the time if there is one
+func (m *AlertManager) resolve(ctx context.Context, rule *AlertRule, at time.Time) error {
+	alert, err := m.repo.Resolve(ctx, int(rule.Id), at)
+	if err != nil || alert == nil {
+		return err
+	}
+	m.notify(ctx, alert, rule)
+	return nil
+}
+
+// checkRule makes sure the rule watches an existing sensor or terminal with the fields its kind requires, and
+// clears the fields its kind ignores
+func (m *AlertManager) checkRule(ctx context.Context, rule *AlertRule) error {
+	if rule.Severity == v1.AlertRule_SEVERITY_UNSPECIFIED {
+		rule.Severity = v1.AlertRule_WARNING
+	}
+	switch rule.Kind {
+	case v1.AlertRule_TERMINAL_OFFLINE:
+		if rule.TerminalId <= 0 {
+			return v1.ErrorMalformedInput("A terminal is required by the rule of kind %v", rule.Kind)
+		}
+		rule.SensorId, rule.Operator, rule.Threshold = 0, v1.AlertRule_OPERATOR_UNSPECIFIED, 0
+		_, err := m.terminals.GetTerminalById(ctx, int(rule.TerminalId))
+		return err
+	case v1.AlertRule_NO_DATA:
+		if rule.Duration.AsDuration() <= 0 {
+			return v1.ErrorMalformedInput("A positive duration is required by the rule of kind %v", rule.Kind)
+		}
+		rule.Operator, rule.Threshold = v1.AlertRule_OPERATOR_UNSPECIFIED, 0
+	case v1.AlertRule_ANOMALY:
+		if rule.Operator == v1.AlertRule_OPERATOR_UNSPECIFIED {
+			rule.Operator = v1.AlertRule_GTE
+		}
+	default:
+		if rule.Operator == v1.AlertRule_OPERATOR_UNSPECIFIED {
+			return v1.ErrorMalformedInput("An operator is required by the rule of kind %v", rule.Kind)
+		}
+	}
+	if rule.SensorId <= 0 {
+		return v1.ErrorMalformedInput("A sensor is required by the rule of kind %v", rule.Kind)
+	}
+	rule.TerminalId = 0
+	_, err := m.sensors.GetById(ctx, int(rule.SensorId))
+	return err
+}
+
+func (m *AlertManager) CreateRule(ctx context.Context, rule *AlertRule) (*AlertRule, error) {
+	if err := m.checkRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	return m.repo.AddRule(ctx, rule)
+}
+
+func (m *AlertManager) GetRule(ctx context.Context, id int) (rule *AlertRule, err error) {
+	if rule, err = m.repo.FindRuleById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorRuleNotFound("There is no such alert rule id %v", id)
+	}
+	return
+}
+
+func (m *AlertManager) ListRules(ctx context.Context, offset, limit int) ([]*AlertRule, int, error) {
+	if limit <= 0 {
+		limit = defaultAlertPageSize
+	}
+	return m.repo.ListRules(ctx, offset, limit)
+}
+
+// UpdateRule replaces the definition of the rule. The evaluation starts over, so the firing alert of the rule is
+// resolved right away.
+func (m *AlertManager) UpdateRule(ctx context.Context, rule *AlertRule) (*AlertRule, error) {
+	if _, err := m.GetRule(ctx, int(rule.Id)); err != nil {
+		return nil, err
+	}
+	if err := m.checkRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	var updated *AlertRule
+	err := m.call(ctx, func() (err error) {
+		updated, err = m.repo.UpdateRule(ctx, rule)
+		if ent.IsNotFound(err) {
+			return v1.ErrorRuleNotFound("There is no such alert rule id %v", rule.Id)
+		}
+		if err != nil {
+			return err
+		}
+		return m.resolve(ctx, updated, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteRule deletes the rule along with its alerts and silences
+func (m *AlertManager) DeleteRule(ctx context.Context, id int) error {
+	return m.call(ctx, func() error {
+		err := m.repo.DeleteRule(ctx, id)
+		if ent.IsNotFound(err) {
+			return v1.ErrorRuleNotFound("There is no such alert rule id %v", id)
+		}
+		return err
+	})
+}
+
+func (m *AlertManager) GetAlert(ctx context.Context, id int) (alert *Alert, err error) {
+	if alert, err = m.repo.FindAlertById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorAlertNotFound("There is no such alert id %v", id)
+	}
+	return
+}
+
+func (m *AlertManager) ListAlerts(ctx context.Context, query *AlertQuery) ([]*Alert, int, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAlertPageSize
+	}
+	return m.repo.ListAlerts(ctx, query)
+}
+
+// Acknowledge records who has taken care of the alert. The alert keeps firing until its condition no longer holds.
+func (m *AlertManager) Acknowledge(ctx context.Context, id int, by, comment string) (*Alert, error) {
+	alert, err := m.GetAlert(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if alert.Acknowledged {
+		return nil, v1.ErrorInvalidAlertState("Alert %v has been acknowledged by %v", id, alert.AckBy)
+	}
+	if alert, err = m.repo.Acknowledge(ctx, id, by, comment); ent.IsNotFound(err) {
+		return nil, v1.ErrorAlertNotFound("There is no such alert id %v", id)
+	}
+	return alert, err
+}
+
+// DeleteAlert deletes the alert once it is resolved
+func (m *AlertManager) DeleteAlert(ctx context.Context, id int) error {
+	if _, err := m.GetAlert(ctx, id); err != nil {
+		return err
+	}
+	deleted, err := m.repo.DeleteAlert(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return v1.ErrorInvalidAlertState("Alert %v is firing", id)
+	}
+	return nil
+}
+
+// CreateSilence silences the alerts of the rule, or of all the rules if the rule is absent, which fire within the
+// time range of the silence. The silence starts right now if its start is absent.
+func (m *AlertManager) CreateSilence(ctx context.Context, silence *Silence) (*Silence, error) {
+	if silence.StartTime == nil {
+		silence.StartTime = timestamppb.Now()
+	}
+	if !silence.EndTime.AsTime().After(silence.StartTime.AsTime()) {
+		return nil, v1.ErrorMalformedInput("The silence ends before it starts")
+	}
+	if silence.RuleId != nil {
+		if _, err := m.GetRule(ctx, int(*silence.RuleId)); err != nil {
+			return nil, err
+		}
+	}
+	return m.repo.AddSilence(ctx, silence)
+}
+
+func (m *AlertManager) ListSilences(
+	ctx context.Context, includeExpired bool, offset, limit int) ([]*Silence, int, error) {
+	if limit <= 0 {
+		limit = defaultAlertPageSize
+	}
+	return m.repo.ListSilences(ctx, includeExpired, offset, limit)
+}
+
+func (m *AlertManager) DeleteSilence(ctx context.Context, id int) error {
+	err := m.repo.DeleteSilence(ctx, id)
+	if ent.IsNotFound(err) {
+		return v1.ErrorSilenceNotFound("There is no such silence id %v", id)
+	}
+	return err
+}
+
+// onReadings queues the evaluation of the rules of the sensors against their readings
+func (m *AlertManager) onReadings(_ context.Context, readings []*SensorReading) {
+	m.enqueue("readings", len(readings), func(ctx context.Context) { m.evaluateAllReadings(ctx, readings) })
+}
+
+// evaluateAllReadings evaluates the rules of the sensors against their readings in the order of time. The readings
+// older than the latest one evaluated are ignored, since the rates of change would make no sense otherwise.
+func (m *AlertManager) evaluateAllReadings(ctx context.Context, readings []*SensorReading) {
+	bySensor := make(map[int][]*SensorReading)
+	for _, r := range readings {
+		bySensor[r.SensorId] = append(bySensor[r.SensorId], r)
+	}
+	ids := make([]int, 0, len(bySensor))
+	for id, rs := range bySensor {
+		ids = append(ids, id)
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Timestamp.Before(rs[j].Timestamp) })
+	}
+	states, err := m.repo.FindStates(ctx, &RuleStateQuery{
+		Kinds:     []v1.AlertRule_Kind{v1.AlertRule_THRESHOLD, v1.AlertRule_NO_DATA, v1.AlertRule_RATE_OF_CHANGE},
+		SensorIds: ids,
+	})
+	if err != nil {
+		m.log.Errorf("failed to find the alert rules of %d sensors: %v", len(ids), err)
+		return
+	}
+	for _, s := range states {
+		if err = m.evaluateReadings(ctx, s, bySensor[int(s.Rule.SensorId)]); err != nil {
+			m.log.Errorf("failed to evaluate alert rule %v: %v", s.Rule.Id, err)
+		}
+	}
+}
+
+// evaluateReadings advances the state of the rule of the sensor by its readings in the order of time
+func (m *AlertManager) evaluateReadings(ctx context.Context, s *RuleState, readings []*SensorReading) error {
+	for _, r := range readings {
+		if s.LastTime != nil && !r.Timestamp.After(*s.LastTime) {
+			continue
+		}
+		if err := m.evaluateReading(ctx, s, r); err != nil {
+			return err
+		}
+	}
+	return m.repo.SaveState(ctx, s)
+}
+
+// evaluateReading advances the state of the rule of the sensor by a new reading
+func (m *AlertManager) evaluateReading(ctx context.Context, s *RuleState, r *SensorReading) (err error) {
+	rule := s.Rule
+	switch rule.Kind {
+	case v1.AlertRule_THRESHOLD:
+		err = m.check(ctx, s, compare(r.Value, rule.Operator, rule.Threshold), r.Timestamp, r.Timestamp,
+			&r.Value, m.describe(fmt.Sprintf("The reading of sensor %v", rule.SensorId), &r.Value, rule))
+	case v1.AlertRule_RATE_OF_CHANGE:
+		// The first reading has nothing to change from
+		if s.LastTime != nil {
+			rate := (r.Value - *s.LastValue) / r.Timestamp.Sub(*s.LastTime).Seconds()
+			err = m.check(ctx, s, compare(rate, rule.Operator, rule.Threshold), r.Timestamp, r.Timestamp,
+				&rate, m.describe(fmt.Sprintf("The change of sensor %v per second", rule.SensorId), &rate, rule))
+		}
+	case v1.AlertRule_NO_DATA:
+		err = m.check(ctx, s, false, r.Timestamp, r.Timestamp, nil, "")
+	}
+	value, at := r.Value, r.Timestamp
+	s.LastValue, s.LastTime = &value, &at
+	return
+}
+
+// onScores queues the evaluation of the anomaly rules of the sensors against the scores of their readings
+func (m *AlertManager) onScores(_ context.Context, scores []*AnomalyScore) {
+	m.enqueue("scores", len(scores), func(ctx context.Context) { m.evaluateAllScores(ctx, scores) })
+}
+
+// evaluateAllScores evaluates the anomaly rules of the sensors against the scores of their readings in the order of
+// time
+func (m *AlertManager) evaluateAllScores(ctx context.Context, scores []*AnomalyScore) {
+	bySensor := make(map[int][]*AnomalyScore)
+	for _, s := range scores {
+		bySensor[s.SensorId] = append(bySensor[s.SensorId], s)
+	}
+	ids := make([]int, 0, len(bySensor))
+	for id, ss := range bySensor {
+		ids = append(ids, id)
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Timestamp.Before(ss[j].Timestamp) })
+	}
+	states, err := m.repo.FindStates(ctx, &RuleStateQuery{
+		Kinds:     []v1.AlertRule_Kind{v1.AlertRule_ANOMALY},
+		SensorIds: ids,
+	})
+	if err != nil {
+		m.log.Errorf("failed to find the anomaly rules of %d sensors: %v", len(ids), err)
+		return
+	}
+	for _, s := range states {
+		if err = m.evaluateScores(ctx, s, bySensor[int(s.Rule.SensorId)]); err != nil {
+			m.log.Errorf("failed to evaluate alert rule %v: %v", s.Rule.Id, err)
+		}
+	}
+}
+
+// evaluateScores advances the state of the anomaly rule of the sensor by the scores of its readings
+func (m *AlertManager) evaluateScores(ctx context.Context, s *RuleState, scores []*AnomalyScore) error {
+	rule := s.Rule
+	for _, score := range scores {
+		if s.LastTime != nil && !score.Timestamp.After(*s.LastTime) {
+			continue
+		}
+		value, at := score.Score, score.Timestamp
+		if err := m.check(ctx, s, compare(value, rule.Operator, m.thresholdOf(rule)), at, at, &value,
+			m.describe(fmt.Sprintf("The anomaly score of the reading %v of sensor %v", score.Value, rule.SensorId),
+				&value, rule)); err != nil {
+			return err
+		}
+		s.LastValue, s.LastTime = &value, &at
+	}
+	return m.repo.SaveState(ctx, s)
+}
+
+// onStatus queues the evaluation of the rules of the terminal against its new status
+func (m *AlertManager) onStatus(_ context.Context, id int, status string, at time.Time) {
+	m.enqueue("status", 1, func(ctx context.Context) { m.evaluateStatusChange(ctx, id, status, at) })
+}
+
+// evaluateStatusChange evaluates the rules of the terminal against its new status
+func (m *AlertManager) evaluateStatusChange(ctx context.Context, id int, status string, at time.Time) {
+	states, err := m.repo.FindStates(ctx, &RuleStateQuery{
+		Kinds:       []v1.AlertRule_Kind{v1.AlertRule_TERMINAL_OFFLINE},
+		TerminalIds: []int{id},
+	})
+	if err != nil {
+		m.log.Errorf("failed to find the alert rules of terminal %v: %v", id, err)
+		return
+	}
+	for _, s := range states {
+		if err = m.evaluateStatus(ctx, s, status, at, at); err != nil {
+			m.log.Errorf("failed to evaluate alert rule %v: %v", s.Rule.Id, err)
+		}
+	}
+}
+
+// evaluateStatus advances the state of the rule of the terminal by its status at the time. The terminal is
+// regarded to have been offline since the given time unless the rule knows it earlier.
+func (m *AlertManager) evaluateStatus(ctx context.Context, s *RuleState, status string, since, at time.Time) error {
+	pending, start := s.PendingSince, since
+	if pending != nil {
+		start = *pending
+	}
+	message := fmt.Sprintf("Terminal %v has been offline since %v", s.Rule.TerminalId, start.Format(time.RFC3339))
+	if err := m.check(ctx, s, status == constant.TerminalStatusOffline, since, at, nil, message); err != nil {
+		return err
+	}
+	if pending == s.PendingSince {
+		return nil
+	}
+	return m.repo.SaveState(ctx, s)
+}
+
+// Evaluate evaluates the conditions which hold over time rather than on a reading or a status change, i.e. the
+// durations of the conditions, the missing readings and the terminals timing out. It should be run periodically.
+func (m *AlertManager) Evaluate(ctx context.Context) error {
+	return m.call(ctx, func() error { return m.evaluateAll(ctx) })
+}
+
+// evaluateAll advances the states of all the rules to the current time
+func (m *AlertManager) evaluateAll(ctx context.Context) error {
+	states, err := m.repo.FindStates(ctx, &RuleStateQuery{})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range states {
+		if err = m.evaluate(ctx, s, now); err != nil {
+			m.log.Errorf("failed to evaluate alert rule %v: %v", s.Rule.Id, err)
+		}
+	}
+	return nil
+}
+
+// evaluate advances the state of the rule to the time
+func (m *AlertManager) evaluate(ctx context.Context, s *RuleState, now time.Time) error {
+	rule := s.Rule
+	pending := s.PendingSince
+	switch rule.Kind {
+	case v1.AlertRule_TERMINAL_OFFLINE:
+		terminal, err := m.terminals.GetTerminalById(ctx, int(rule.TerminalId))
+		if err != nil {
+			return err
+		}
+		// A terminal goes offline either as it reports so, or as it times out
+		since := terminal.LastUpdated.AsTime()
+		if terminal.Status != constant.TerminalStatusOffline {
+			since = since.Add(m.terminals.timeoutOf(terminal))
+		}
+		return m.evaluateStatus(ctx, s, m.terminals.statusOf(terminal), since, now)
+	case v1.AlertRule_NO_DATA:
+		since := rule.UpdateTime.AsTime()
+		if s.LastTime != nil && s.LastTime.After(since) {
+			since = *s.LastTime
+		}
+		message := fmt.Sprintf("Sensor %v has not reported since %v", rule.SensorId, since.Format(time.RFC3339))
+		if err := m.check(ctx, s, now.Sub(since) >= rule.Duration.AsDuration(), since, now, nil, message); err != nil {
+			return err
+		}
+	default:
+		// The condition on the readings is still regarded to hold until another reading tells otherwise
+		if s.PendingSince == nil {
+			return nil
+		}
+		var value *float64
+		subject := fmt.Sprintf("The change of sensor %v per second", rule.SensorId)
+		switch rule.Kind {
+		case v1.AlertRule_THRESHOLD:
+			value, subject = s.LastValue, fmt.Sprintf("The reading of sensor %v", rule.SensorId)
+		case v1.AlertRule_ANOMALY:
+			value, subject = s.LastValue, fmt.Sprintf("The anomaly score of sensor %v", rule.SensorId)
+		}
+		if err := m.check(ctx, s, true, now, now, value, m.describe(subject, value, rule)); err != nil {
+			return err
+		}
+	}
+	if pending == s.PendingSince {
+		return nil
+	}
+	return m.repo.SaveState(ctx, s)
+}
+
+// check advances the state of the rule by whether its condition holds at the time, where the condition is regarded
+// to have held since the given time unless it is pending already. The alert of the rule fires once the condition
+// has held for the duration of the rule, and it is resolved as soon as the condition no longer holds.
+func (m *AlertManager) check(
+	ctx context.Context, s *RuleState, holds bool, since, at time.Time, value *float64, message string) error {
+	rule := s.Rule
+	if !holds {
+		if s.PendingSince == nil {
+			return nil
+		}
+		s.PendingSince = nil
+		return m.resolve(ctx, rule, at)
+	}
+	if s.PendingSince == nil {
+		s.PendingSince = &since
+	}
+	if at.Sub(*s.PendingSince) < rule.Duration.AsDuration() {
+		return nil
+	}
+	silenced, err := m.repo.IsSilenced(ctx, int(rule.Id), at)
+	if err != nil {
+		return err
+	}
+	alert, fired, err := m.repo.Fire(ctx, &Alert{
+		RuleId:    rule.Id,
+		Severity:  rule.Severity,
+		Value:     value,
+		Message:   message,
+		StartTime: timestamppb.New(*s.PendingSince),
+		Silenced:  silenced,
+	})
+	if err != nil {
+		return err
+	}
+	if fired {
+		m.log.Infof("alert %v of rule %v fired: %v", alert.Id, rule.Id, message)
+		m.notify(ctx, alert, rule)
+	}
+	return nil
+}
+
+// compare compares the value with the threshold by the operator
+func compare(value float64, op v1.AlertRule_Operator, threshold float64) bool {
+	switch op {
+	case v1.AlertRule_GT:
+		return value > threshold
+	case v1.AlertRule_GTE:
+		return value >= threshold
+	case v1.AlertRule_LT:
+		return value < threshold
+	case v1.AlertRule_LTE:
+		return value <= threshold
+	}
+	return false
+}
+
+// comparisons describe the operators in the messages of the alerts
+var comparisons = map[v1.AlertRule_Operator]string{
+	v1.AlertRule_GT:  "above",
+	v1.AlertRule_GTE: "at or above",
+	v1.AlertRule_LT:  "below",
+	v1.AlertRule_LTE: "at or below",
+}
+
+// thresholdOf returns the threshold of the rule. The anomaly rules without their own thresholds follow the default
+// threshold of the anomaly detection as it is reloaded.
+func (m *AlertManager) thresholdOf(rule *AlertRule) float64 {
+	if rule.Kind == v1.AlertRule_ANOMALY && rule.Threshold == 0 {
+		return m.anomalies.DefaultThreshold()
+	}
+	return rule.Threshold
+}
+
+// describe describes the violation of the threshold of the rule by the subject, whose value may be unknown
+func (m *AlertManager) describe(subject string, value *float64, rule *AlertRule) string {
+	if value == nil {
+		return fmt.Sprintf("%v is %v %v", subject, comparisons[rule.Operator], m.thresholdOf(rule))
+	}
+	return fmt.Sprintf("%v is %v, %v %v", subject, *value, comparisons[rule.Operator], m.thresholdOf(rule))
+}
@@ -0,0 +1,52 @@
+package biz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAlertQueue(t *testing.T) {
+	m := &AlertManager{queue: make(chan func(ctx context.Context), 1), calls: make(chan func())}
+	evaluated := make(chan int, 2)
+	dropped := testutil.ToFloat64(droppedAlertEvaluations.WithLabelValues("readings"))
+
+	// The writers are never blocked by a full queue
+	m.enqueue("readings", 2, func(context.Context) { evaluated <- 1 })
+	m.enqueue("readings", 3, func(context.Context) { evaluated <- 2 })
+	if got := testutil.ToFloat64(droppedAlertEvaluations.WithLabelValues("readings")) - dropped; got != 3 {
+		t.Errorf("got %v dropped readings, want 3", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = m.Run(ctx)
+	}()
+	select {
+	case n := <-evaluated:
+		if n != 1 {
+			t.Errorf("got evaluation %d, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the evaluation")
+	}
+	called := false
+	if err := m.call(context.Background(), func() error { called = true; return nil }); err != nil || !called {
+		t.Errorf("got call %v with error %v, want it run", called, err)
+	}
+
+	// The evaluations queued by the time the evaluator stops are still run
+	cancel()
+	<-done
+	m.enqueue("status", 1, func(context.Context) { evaluated <- 3 })
+	if err := m.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-evaluated; n != 3 {
+		t.Errorf("got evaluation %d, want 3", n)
+	}
+}
@@ -14,4 +14,18 @@ import "github.com/google/wire"
 // ProviderSet is biz providers.
 var ProviderSet = wire.NewSet(
 	NewUserManager,
+	NewTerminalManager,
+	NewTerminalGroupManager,
+	NewCommandManager,
+	NewSensorManager,
+	NewFirmwareManager,
+	NewShadowManager,
+	NewSensorTypeManager,
+	NewSensorExportManager,
+	NewAnomalyManager,
+	NewCalibrationManager,
+	NewVirtualSensorManager,
+	NewServerManager,
+	NewAlertManager,
+	NewNotificationManager,
 )
@@ -0,0 +1,352 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/conf"
+	"example/internal/ent"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Command is an instruction queued for a terminal, e.g. reboot, set config or run diagnostics.
+//
+// A command goes through the following states:
+//
+//	pending -> delivered -> succeeded / failed
+//	    \          \
+//	     +----------+-----> expired
+//
+// A delivered command goes back to pending if the terminal does not acknowledge it in time, and it fails once the
+// retries are exhausted.
+type Command = v1.Command
+
+// CommandFilter narrows down the commands listed by [CommandRepository.FindByTerminal]
+type CommandFilter struct {
+	// Status lists the states of the commands to find, and all the commands are found if it is empty
+	Status []v1.Command_Status
+	Offset int
+	Limit  int
+}
+
+// CommandRepository stores the commands queued for the terminals.
+//
+// The state transitions are guarded by the current state of the command, so that concurrent deliveries from
+// multiple instances of the service never hand out the same command twice. A transition which does not match the
+// current state results in an error satisfying [ent.IsNotFound].
+type CommandRepository interface {
+	Add(ctx context.Context, cmd *Command) (*Command, error)
+	FindById(ctx context.Context, id int64) (*Command, error)
+	// FindByTerminal lists the commands of a terminal from the newest to the oldest and counts all the matches
+	FindByTerminal(ctx context.Context, terminalId int, filter *CommandFilter) ([]*Command, int, error)
+	// ClaimPending marks at most limit unexpired pending commands of the terminal as delivered and returns them
+	ClaimPending(ctx context.Context, terminalId int, limit int) ([]*Command, error)
+	Acknowledge(ctx context.Context, id int64) error
+	// Requeue moves an unacknowledged delivered command back to pending
+	Requeue(ctx context.Context, id int64) error
+	// Complete moves a pending or delivered command to a final state
+	Complete(ctx context.Context, id int64, status v1.Command_Status, result string) error
+	// FindUnacknowledged finds the delivered commands which have not been acknowledged since the given time
+	FindUnacknowledged(ctx context.Context, deliveredBefore time.Time) ([]*Command, error)
+	// ExpireOverdue moves all the overdue pending or delivered commands to expired and returns the number of them
+	ExpireOverdue(ctx context.Context) (int, error)
+}
+
+const (
+	defaultCommandTTL         = 24 * time.Hour
+	defaultCommandAckTimeout  = 30 * time.Second
+	defaultCommandPollTimeout = 30 * time.Second
+	defaultCommandPollLimit   = 10
+	defaultCommandPageSize    = 50
+	// Pollers check the repository periodically, since the commands may be queued by another instance of the service
+	commandRecheckInterval = 5 * time.Second
+	// A long polling request returns slightly before its deadline so that the empty reply reaches the terminal
+	commandPollMargin = 500 * time.Millisecond
+)
+
+// CommandManager queues the commands for the terminals and tracks their delivery.
+type CommandManager struct {
+	repo      CommandRepository
+	terminals TerminalRepository
+	hub       *commandHub
+	log       *log.Helper
+
+	ttl            time.Duration
+	maxRetries     int32
+	ackTimeout     time.Duration
+	pollTimeout    time.Duration
+	maxPollTimeout time.Duration
+}
+
+func NewCommandManager(
+	c *conf.Terminal, repo CommandRepository, terminals TerminalRepository, logger log.Logger) *CommandManager {
+	cc := c.GetCommand()
+	return &CommandManager{
+		repo:           repo,
+		terminals:      terminals,
+		hub:            newCommandHub(),
+		log:            log.NewHelper(log.With(logger, "module", "biz/command")),
+		ttl:            durationOr(cc.GetTtl(), defaultCommandTTL),
+		maxRetries:     cc.GetMaxRetries(),
+		ackTimeout:     durationOr(cc.GetAckTimeout(), defaultCommandAckTimeout),
+		pollTimeout:    durationOr(cc.GetPollTimeout(), defaultCommandPollTimeout),
+		maxPollTimeout: durationOr(cc.GetMaxPollTimeout(), 2*defaultCommandPollTimeout),
+	}
+}
+
+// durationOr returns the duration if it is set to a positive value, otherwise the default value
+func durationOr(d *durationpb.Duration, def time.Duration) time.Duration {
+	if d == nil || d.AsDuration() <= 0 {
+		return def
+	}
+	return d.AsDuration()
+}
+
+// Send queues a command for the terminal and wakes up the terminal if it is waiting for commands. Decommissioned
+// terminals do not accept commands.
+func (m *CommandManager) Send(ctx context.Context, req *v1.SendCommandRequest) (cmd *Command, err error) {
+	var ext bool
+	if ext, err = m.terminals.IsTerminalExist(ctx, int(req.TerminalId)); err != nil {
+		return
+	}
+	if !ext {
+		return nil, v1.ErrorTerminalNotFound("There is no such Terminal id %v", req.TerminalId)
+	}
+	var terminal *Terminal
+	if terminal, err = m.terminals.GetTerminalByID(ctx, int(req.TerminalId)); err != nil {
+		return
+	}
+	if terminal.DecommissionTime != nil {
+		return nil, v1.ErrorTerminalDecommissioned("Terminal %v has been decommissioned", req.TerminalId)
+	}
+	ttl := m.ttl
+	if req.Ttl != nil {
+		ttl = req.Ttl.AsDuration()
+	}
+	maxRetries := m.maxRetries
+	if req.MaxRetries != nil {
+		maxRetries = *req.MaxRetries
+	}
+	cmd = &Command{
+		TerminalId: req.TerminalId,
+		Name:       req.Name,
+		Payload:    req.Payload,
+		MaxRetries: maxRetries,
+		ExpireTime: timestamppb.New(time.Now().Add(ttl)),
+	}
+	if cmd, err = m.repo.Add(ctx, cmd); err != nil {
+		return
+	}
+	m.hub.notify(int(cmd.TerminalId))
+	return
+}
+
+func (m *CommandManager) GetById(ctx context.Context, id int64) (cmd *Command, err error) {
+	if cmd, err = m.repo.FindById(ctx, id); err != nil {
+		if ent.IsNotFound(err) {
+			return nil, v1.ErrorCommandNotFound("There is no such command id %v", id)
+		}
+	}
+	return
+}
+
+// List returns a page of the command history of the terminal along with the total number of the matches
+func (m *CommandManager) List(ctx context.Context, terminalId int, filter *CommandFilter) ([]*Command, int, error) {
+	ext, err := m.terminals.IsTerminalExist(ctx, terminalId)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ext {
+		return nil, 0, v1.ErrorTerminalNotFound("There is no such Terminal id %v", terminalId)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultCommandPageSize
+	}
+	return m.repo.FindByTerminal(ctx, terminalId, filter)
+}
+
+// Poll delivers the pending commands of the terminal. If there is none, it waits until a command is queued or the
+// wait duration elapses, whichever comes first. A non-positive wait duration falls back to the configured default.
+func (m *CommandManager) Poll(ctx context.Context, terminalId int, wait time.Duration, limit int) ([]*Command, error) {
+	if wait <= 0 {
+		wait = m.pollTimeout
+	}
+	if wait > m.maxPollTimeout {
+		wait = m.maxPollTimeout
+	}
+	// The request may be bounded by the server timeout as well
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline) - commandPollMargin; left < wait {
+			wait = left
+		}
+	}
+	if limit <= 0 {
+		limit = defaultCommandPollLimit
+	}
+	notify, cancel := m.hub.subscribe(terminalId)
+	defer cancel()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	recheck := time.NewTicker(commandRecheckInterval)
+	defer recheck.Stop()
+	for {
+		cmds, err := m.repo.ClaimPending(ctx, terminalId, limit)
+		if err != nil || len(cmds) > 0 {
+			return cmds, err
+		}
+		select {
+		case <-notify:
+		case <-recheck.C:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Claim delivers the pending commands of the terminal without waiting
+func (m *CommandManager) Claim(ctx context.Context, terminalId int, limit int) ([]*Command, error) {
+	if limit <= 0 {
+		limit = defaultCommandPollLimit
+	}
+	return m.repo.ClaimPending(ctx, terminalId, limit)
+}
+
+// Watch returns a channel receiving a value whenever a command is queued for the terminal on this instance, and a
+// function releasing the channel. The channel is not closed, and the caller should recheck the repository
+// periodically since commands may also be queued by other instances.
+func (m *CommandManager) Watch(terminalId int) (<-chan struct{}, func()) {
+	return m.hub.subscribe(terminalId)
+}
+
+// RecheckInterval is how often the watchers should look for the commands queued by other instances
+func (m *CommandManager) RecheckInterval() time.Duration {
+	return commandRecheckInterval
+}
+
+// findForTerminal finds a command sent to the terminal. Commands of other terminals are reported as not found.
+func (m *CommandManager) findForTerminal(ctx context.Context, terminalId int, id int64) (*Command, error) {
+	cmd, err := m.GetById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.TerminalId != int64(terminalId) {
+		return nil, v1.ErrorCommandNotFound("There is no such command id %v for terminal %v", id, terminalId)
+	}
+	return cmd, nil
+}
+
+// Acknowledge records that the terminal has received the delivered command
+func (m *CommandManager) Acknowledge(ctx context.Context, terminalId int, id int64) error {
+	cmd, err := m.findForTerminal(ctx, terminalId, id)
+	if err != nil {
+		return err
+	}
+	if cmd.Status != v1.Command_DELIVERED {
+		return v1.ErrorInvalidCommandState("Command %v is %v and cannot be acknowledged", id, cmd.Status)
+	}
+	if err = m.repo.Acknowledge(ctx, id); ent.IsNotFound(err) {
+		return v1.ErrorInvalidCommandState("Command %v is no longer delivered", id)
+	}
+	return err
+}
+
+// Report records the result of the command executed by the terminal. A result implies the receipt of the command,
+// so an unacknowledged command can be completed directly.
+func (m *CommandManager) Report(ctx context.Context, terminalId int, id int64, success bool, result string) error {
+	cmd, err := m.findForTerminal(ctx, terminalId, id)
+	if err != nil {
+		return err
+	}
+	if cmd.Status != v1.Command_DELIVERED {
+		return v1.ErrorInvalidCommandState("Command %v is %v and cannot be completed", id, cmd.Status)
+	}
+	status := v1.Command_FAILED
+	if success {
+		status = v1.Command_SUCCEEDED
+	}
+	if err = m.repo.Complete(ctx, id, status, result); ent.IsNotFound(err) {
+		return v1.ErrorInvalidCommandState("Command %v is no longer delivered", id)
+	}
+	return err
+}
+
+// Maintain expires the overdue commands and redelivers the commands that have not been acknowledged in time.
+// It should be run periodically.
+func (m *CommandManager) Maintain(ctx context.Context) error {
+	expired, err := m.repo.ExpireOverdue(ctx)
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		m.log.Infof("%d commands expired", expired)
+	}
+	var cmds []*Command
+	if cmds, err = m.repo.FindUnacknowledged(ctx, time.Now().Add(-m.ackTimeout)); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		// The first delivery is not a retry
+		if cmd.Attempts <= cmd.MaxRetries {
+			err = m.repo.Requeue(ctx, cmd.Id)
+			if err == nil {
+				m.hub.notify(int(cmd.TerminalId))
+			}
+		} else {
+			err = m.repo.Complete(ctx, cmd.Id, v1.Command_FAILED, "not acknowledged by the terminal")
+		}
+		// The command has been acknowledged or completed in the meantime
+		if ent.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandHub notifies the pollers and streams of the terminals waiting for commands on this instance
+type commandHub struct {
+	mu   sync.Mutex
+	subs map[int]map[chan struct{}]struct{}
+}
+
+func newCommandHub() *commandHub {
+	return &commandHub{subs: make(map[int]map[chan struct{}]struct{})}
+}
+
+func (h *commandHub) subscribe(terminalId int) (chan struct{}, func()) {
+	// The channel is buffered so that a notification sent between two checks of the subscriber is not lost
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[terminalId] == nil {
+		h.subs[terminalId] = make(map[chan struct{}]struct{})
+	}
+	h.subs[terminalId][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[terminalId], ch)
+		if len(h.subs[terminalId]) == 0 {
+			delete(h.subs, terminalId)
+		}
+	}
+}
+
+func (h *commandHub) notify(terminalId int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[terminalId] {
+		select {
+		case ch <- struct{}{}:
+		default: // A notification is already pending
+		}
+	}
+}
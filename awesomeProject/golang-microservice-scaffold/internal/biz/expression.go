@@ -0,0 +1,330 @@
+package biz
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxExpressionDepth bounds the nesting of the expressions, so that a malicious one cannot exhaust the stack
+	maxExpressionDepth = 32
+	// maxExpressionLength bounds the length of the expressions in bytes, so that evaluating one is cheap
+	maxExpressionLength = 1024
+)
+
+// expression is a compiled arithmetic expression over the named variables. It is safe to evaluate untrusted
+// expressions, since they can do nothing but compute a number from the variables.
+type expression struct {
+	// variables are the names of the variables in the order of the values passed to eval
+	variables []string
+	eval      func(values []float64) float64
+}
+
+// expressionFunc is a function callable from the expressions
+type expressionFunc struct {
+	// minArgs and maxArgs bound the number of the arguments, the latter of which is unbounded if negative
+	minArgs, maxArgs int
+	call             func(args []float64) float64
+}
+
+func unary(f func(float64) float64) expressionFunc {
+	return expressionFunc{minArgs: 1, maxArgs: 1, call: func(args []float64) float64 { return f(args[0]) }}
+}
+
+var expressionFuncs = map[string]expressionFunc{
+	"abs":   unary(math.Abs),
+	"sqrt":  unary(math.Sqrt),
+	"exp":   unary(math.Exp),
+	"ln":    unary(math.Log),
+	"log10": unary(math.Log10),
+	"round": unary(math.Round),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"pow": {minArgs: 2, maxArgs: 2, call: func(args []float64) float64 {
+		return math.Pow(args[0], args[1])
+	}},
+	"min": {minArgs: 1, maxArgs: -1, call: func(args []float64) float64 {
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Min(m, a)
+		}
+		return m
+	}},
+	"max": {minArgs: 1, maxArgs: -1, call: func(args []float64) float64 {
+		m := args[0]
+		for _, a := range args[1:] {
+			m = math.Max(m, a)
+		}
+		return m
+	}},
+	"avg": {minArgs: 1, maxArgs: -1, call: func(args []float64) float64 {
+		sum := 0.0
+		for _, a := range args {
+			sum += a
+		}
+		return sum / float64(len(args))
+	}},
+	"clamp": {minArgs: 3, maxArgs: 3, call: func(args []float64) float64 {
+		return math.Max(args[1], math.Min(args[0], args[2]))
+	}},
+	"dew_point": {minArgs: 2, maxArgs: 2, call: func(args []float64) float64 {
+		return dewPoint(args[0], args[1])
+	}},
+}
+
+// dewPoint computes the dew point in degrees Celsius from the temperature in degrees Celsius and the relative
+// humidity in percent by the Magnus formula with the coefficients of Sonntag, which is accurate within 0.35 degrees
+// between -45 and 60 degrees
+func dewPoint(temperature, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*temperature/(c+temperature)
+	return c * gamma / (b - gamma)
+}
+
+// compileExpression parses the expression, whose variables must be among the given ones. The variables actually
+// referred to are collected in the order of their first occurrences.
+func compileExpression(source string, variables map[string]struct{}) (*expression, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("the expression is longer than %d bytes", maxExpressionLength)
+	}
+	p := &expressionParser{source: source, variables: variables, index: make(map[string]int)}
+	p.next()
+	eval, err := p.parseSum(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		return nil, p.errorf("unexpected %q", p.token)
+	}
+	return &expression{variables: p.names, eval: eval}, nil
+}
+
+// expressionParser is a recursive descent parser of the expressions:
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = ("+" | "-") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | name | name "(" sum { "," sum } ")" | "(" sum ")"
+//
+// The exponentiation is right-associative and binds tighter than the negation, e.g. -2^2 is -4.
+type expressionParser struct {
+	source    string
+	variables map[string]struct{}
+	// pos is the position after the current token
+	pos   int
+	token string
+	// start is the position of the current token
+	start int
+	names []string
+	index map[string]int
+}
+
+func (p *expressionParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at %d: %s", p.start+1, fmt.Sprintf(format, args...))
+}
+
+// next scans the next token, which is empty at the end of the source
+func (p *expressionParser) next() {
+	for p.pos < len(p.source) && unicode.IsSpace(rune(p.source[p.pos])) {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos == len(p.source) {
+		p.token = ""
+		return
+	}
+	c := p.source[p.pos]
+	switch {
+	case isNameByte(c, true):
+		for p.pos < len(p.source) && isNameByte(p.source[p.pos], false) {
+			p.pos++
+		}
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.source) && (isNumberByte(p.source[p.pos]) || isExponentSign(p.source, p.pos)) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.token = p.source[p.start:p.pos]
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E'
+}
+
+// isExponentSign tells whether the byte at the position is the sign of the exponent of a number
+func isExponentSign(source string, pos int) bool {
+	return (source[pos] == '+' || source[pos] == '-') && (source[pos-1] == 'e' || source[pos-1] == 'E')
+}
+
+type evaluator = func(values []float64) float64
+
+func (p *expressionParser) parseSum(depth int) (evaluator, error) {
+	if depth > maxExpressionDepth {
+		return nil, p.errorf("the expression is nested too deeply")
+	}
+	left, err := p.parseProduct(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "+" || p.token == "-" {
+		op := p.token
+		p.next()
+		right, err := p.parseProduct(depth)
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(v []float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v []float64) float64 { return l(v) - right(v) }
+		}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseProduct(depth int) (evaluator, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "*" || p.token == "/" || p.token == "%" {
+		op := p.token
+		p.next()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case "*":
+			left = func(v []float64) float64 { return l(v) * right(v) }
+		case "/":
+			left = func(v []float64) float64 { return l(v) / right(v) }
+		default:
+			left = func(v []float64) float64 { return math.Mod(l(v), right(v)) }
+		}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseUnary(depth int) (evaluator, error) {
+	if depth > maxExpressionDepth {
+		return nil, p.errorf("the expression is nested too deeply")
+	}
+	switch p.token {
+	case "-":
+		p.next()
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(v []float64) float64 { return -operand(v) }, nil
+	case "+":
+		p.next()
+		return p.parseUnary(depth + 1)
+	}
+	return p.parsePower(depth)
+}
+
+func (p *expressionParser) parsePower(depth int) (evaluator, error) {
+	base, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "^" {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	return func(v []float64) float64 { return math.Pow(base(v), exponent(v)) }, nil
+}
+
+func (p *expressionParser) parsePrimary(depth int) (evaluator, error) {
+	token := p.token
+	switch {
+	case token == "":
+		return nil, p.errorf("unexpected end of the expression")
+	case token == "(":
+		p.next()
+		inner, err := p.parseSum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, p.errorf("missing )")
+		}
+		p.next()
+		return inner, nil
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil || math.IsInf(value, 0) {
+			return nil, p.errorf("malformed number %q", token)
+		}
+		p.next()
+		return func([]float64) float64 { return value }, nil
+	case isNameByte(token[0], true):
+		p.next()
+		if p.token == "(" {
+			return p.parseCall(token, depth)
+		}
+		if _, ok := p.variables[token]; !ok {
+			return nil, p.errorf("unknown variable %q", token)
+		}
+		i, ok := p.index[token]
+		if !ok {
+			i = len(p.names)
+			p.index[token] = i
+			p.names = append(p.names, token)
+		}
+		return func(v []float64) float64 { return v[i] }, nil
+	}
+	return nil, p.errorf("unexpected %q", token)
+}
+
+// parseCall parses the arguments of the function, whose name has been scanned
+func (p *expressionParser) parseCall(name string, depth int) (evaluator, error) {
+	f, ok := expressionFuncs[strings.ToLower(name)]
+	if !ok {
+		return nil, p.errorf("unknown function %q", name)
+	}
+	p.next()
+	var args []evaluator
+	for p.token != ")" {
+		if len(args) > 0 {
+			if p.token != "," {
+				return nil, p.errorf("missing , or ) in the arguments of %s", name)
+			}
+			p.next()
+		}
+		arg, err := p.parseSum(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if len(args) < f.minArgs || f.maxArgs >= 0 && len(args) > f.maxArgs {
+		return nil, p.errorf("wrong number of the arguments of %s: %d", name, len(args))
+	}
+	return func(v []float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return f.call(values)
+	}, nil
+}
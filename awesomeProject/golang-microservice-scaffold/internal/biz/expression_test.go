@@ -0,0 +1,142 @@
+package biz
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCompileExpression(t *testing.T) {
+	variables := map[string]struct{}{"a": {}, "b": {}, "t": {}, "rh": {}}
+	values := map[string]float64{"a": 2, "b": 3, "t": 20, "rh": 50}
+	tests := []struct {
+		source string
+		want   float64
+	}{
+		{source: "1 + 2 * 3", want: 7},
+		{source: "(1 + 2) * 3", want: 9},
+		{source: "10 - 4 - 3", want: 3},
+		{source: "24 / 4 / 2", want: 3},
+		{source: "7 % 4 * 2", want: 6},
+		// The exponentiation is right-associative and binds tighter than the negation
+		{source: "2 ^ 3 ^ 2", want: 512},
+		{source: "-2 ^ 2", want: -4},
+		{source: "(-2) ^ 2", want: 4},
+		{source: "2 ^ -1", want: 0.5},
+		{source: "--a", want: 2},
+		{source: "-a * +b", want: -6},
+		{source: "a - -b", want: 5},
+		{source: "1.5e1 + 2E-1", want: 15.2},
+		{source: "a*b + a/b*3", want: 8},
+		{source: "ABS(-a) + max(a, b, 1) + min(4, b)", want: 8},
+		{source: "avg(a, b, 4) + clamp(10, 0, 5) + pow(b, 2)", want: 17},
+		{source: "round(dew_point(t, rh) * 100) / 100", want: 9.26},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			e, err := compileExpression(tt.source, variables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := make([]float64, len(e.variables))
+			for i, name := range e.variables {
+				args[i] = values[name]
+			}
+			if got := e.eval(args); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionVariables(t *testing.T) {
+	e, err := compileExpression("b * a + b", map[string]struct{}{"a": {}, "b": {}, "c": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The variables are collected in the order of their first occurrences, and the unused ones are left out
+	if len(e.variables) != 2 || e.variables[0] != "b" || e.variables[1] != "a" {
+		t.Fatalf("got variables %v, want [b a]", e.variables)
+	}
+	if got := e.eval([]float64{3, 2}); got != 9 {
+		t.Errorf("got %v, want 9", got)
+	}
+}
+
+func TestExpressionNonFinite(t *testing.T) {
+	tests := []struct {
+		source string
+		nan    bool
+	}{
+		{source: "a / 0"},
+		{source: "-a / 0"},
+		{source: "0 / 0", nan: true},
+		{source: "a % 0", nan: true},
+		{source: "sqrt(-a)", nan: true},
+		{source: "ln(0)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			e, err := compileExpression(tt.source, map[string]struct{}{"a": {}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := make([]float64, len(e.variables))
+			for i := range args {
+				args[i] = 1
+			}
+			got := e.eval(args)
+			// The computed readings which are not finite are left out rather than failing
+			if tt.nan && !math.IsNaN(got) || !tt.nan && !math.IsInf(got, 0) {
+				t.Errorf("got %v", got)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "", want: "unexpected end"},
+		{source: "a +", want: "unexpected end"},
+		{source: "a b", want: `unexpected "b"`},
+		{source: "(a + 1", want: "missing )"},
+		{source: "a + 1)", want: `unexpected ")"`},
+		{source: "* a", want: `unexpected "*"`},
+		{source: "x + 1", want: `unknown variable "x"`},
+		{source: "foo(a)", want: `unknown function "foo"`},
+		{source: "sqrt(a, a)", want: "wrong number of the arguments of sqrt: 2"},
+		{source: "pow(a)", want: "wrong number of the arguments of pow: 1"},
+		{source: "max()", want: "wrong number of the arguments of max: 0"},
+		{source: "min(a a)", want: "missing , or )"},
+		{source: "1e999", want: "malformed number"},
+		{source: "1..2", want: "malformed number"},
+		{source: "a $ 1", want: `unexpected "$"`},
+		{source: strings.Repeat("(", 40) + "a" + strings.Repeat(")", 40), want: "nested too deeply"},
+		{source: strings.Repeat("-", 40) + "a", want: "nested too deeply"},
+		{source: strings.Repeat("abs(", 40) + "a" + strings.Repeat(")", 40), want: "nested too deeply"},
+		{source: strings.Repeat("2^", 40) + "a", want: "nested too deeply"},
+		{source: "a" + strings.Repeat(" + a", maxExpressionLength/4), want: "longer than 1024 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			_, err := compileExpression(tt.source, map[string]struct{}{"a": {}})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionLimits(t *testing.T) {
+	// The expressions at the limits are accepted
+	nested := strings.Repeat("(", maxExpressionDepth) + "a" + strings.Repeat(")", maxExpressionDepth)
+	long := "a" + strings.Repeat("+a", (maxExpressionLength-1)/2)
+	for _, source := range []string{nested, long} {
+		if _, err := compileExpression(source, map[string]struct{}{"a": {}}); err != nil {
+			t.Errorf("got error %v for an expression of %d bytes", err, len(source))
+		}
+	}
+}
@@ -0,0 +1,641 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	v1 "example/api/terminal"
+	"example/internal/conf"
+	"example/internal/ent"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// Firmware is an artifact in the version catalog
+type Firmware = v1.Firmware
+
+// Campaign rolls out a firmware to the members of a group in stages.
+//
+// A campaign goes through the following states:
+//
+//	running <-> paused
+//	   |          |
+//	   v          v
+//	completed -> rolled back
+//
+// The campaign advances to the next stage once all the updates of the current stage have finished, and completes
+// after the last stage. It pauses automatically when the failure rate of the finished updates passes its threshold.
+type Campaign = v1.Campaign
+
+// TerminalUpdate is the firmware update of a single terminal targeted by a campaign.
+//
+// An update goes through the following states:
+//
+//	pending -> downloading -> installing -> succeeded / failed
+//
+// The terminal may skip any of the intermediate states. Once the campaign is rolled back, the pending updates are
+// cancelled, and the other ones wait for the terminals to reinstall their previous firmware.
+type TerminalUpdate = v1.TerminalUpdate
+
+// ErrFirmwareTooLarge is returned by [FirmwareStore.Save] if the artifact exceeds the size limit of the store
+var ErrFirmwareTooLarge = errors.New("the firmware artifact is too large")
+
+// FirmwareStore keeps the firmware artifacts, which are too large to be stored in the database
+type FirmwareStore interface {
+	// Save writes the artifact and returns its name in the store along with its size and hex encoded SHA-256 checksum
+	Save(ctx context.Context, r io.Reader) (name string, size int64, sum string, err error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	Remove(ctx context.Context, name string) error
+}
+
+// FirmwareRepository stores the metadata of the firmware catalog
+type FirmwareRepository interface {
+	// Add stores the metadata of the firmware whose artifact is saved under the name in the store
+	Add(ctx context.Context, firmware *Firmware, artifact string) (*Firmware, error)
+	FindById(ctx context.Context, id int) (*Firmware, error)
+	FindByVersion(ctx context.Context, version string) (*Firmware, error)
+	// FindArtifact finds the name of the artifact of the firmware in the store
+	FindArtifact(ctx context.Context, id int) (string, error)
+	// List lists a page of the firmware from the newest to the oldest and counts all of them
+	List(ctx context.Context, offset, limit int) ([]*Firmware, int, error)
+	// IsUsed reports whether any campaign rolls out the firmware
+	IsUsed(ctx context.Context, id int) (bool, error)
+	Remove(ctx context.Context, id int) error
+}
+
+// CampaignRepository stores the campaigns and the updates of their targets.
+//
+// Like [CommandRepository], the state transitions are guarded by the current states, so that multiple instances of
+// the service may drive the same campaign. A transition which does not match the current state results in an error
+// satisfying [ent.IsNotFound].
+type CampaignRepository interface {
+	// Add stores the running campaign along with the updates of its targets
+	Add(ctx context.Context, campaign *Campaign, updates []*TerminalUpdate) (*Campaign, error)
+	// FindById finds the campaign without counting its updates
+	FindById(ctx context.Context, id int) (*Campaign, error)
+	// List lists a page of the campaigns from the newest to the oldest and counts all of them
+	List(ctx context.Context, offset, limit int) ([]*Campaign, int, error)
+	FindRunning(ctx context.Context) ([]*Campaign, error)
+	// SetStatus moves the campaign from any of the given states to another one, along with the reason of the pause
+	SetStatus(ctx context.Context, id int, from []v1.Campaign_Status, to v1.Campaign_Status, reason string) error
+	// Advance moves the running campaign from the stage to the next one
+	Advance(ctx context.Context, id int, stage int) error
+	// Rollback moves the campaign from any of the given states to rolled back. The pending updates are cancelled,
+	// and the other ones wait for the rollback if the previous firmware versions of the terminals are known.
+	Rollback(ctx context.Context, id int, from []v1.Campaign_Status) error
+	// CountUpdates counts the updates in the stages up to maxStage by their states, or all the updates if maxStage
+	// is negative
+	CountUpdates(ctx context.Context, id int, maxStage int) (map[v1.TerminalUpdate_Status]int, error)
+	FindUpdate(ctx context.Context, id int64) (*TerminalUpdate, error)
+	// FindUpdates lists a page of the updates of the campaign ordered by their stages and counts all the matches.
+	// All the updates are found if the states are empty.
+	FindUpdates(ctx context.Context, id int, status []v1.TerminalUpdate_Status, offset, limit int) (
+		[]*TerminalUpdate, int, error)
+	// FindOffers finds the updates which may be offered to the terminal from the oldest to the newest, i.e. the
+	// unfinished updates in the stages rolled out by the running campaigns, and the pending rollbacks
+	FindOffers(ctx context.Context, terminalId int) ([]*TerminalUpdate, error)
+	// MarkOffered records the time when the update is offered for the first time
+	MarkOffered(ctx context.Context, id int64) error
+	// Progress moves the update from any of the given states to another one
+	Progress(ctx context.Context, id int64, from []v1.TerminalUpdate_Status, to v1.TerminalUpdate_Status,
+		progress int32, message string) error
+	// TimeoutUpdates fails the unfinished updates in the stages up to maxStage of the campaign which were offered
+	// before the time, as well as the ones never offered at all if includeUnoffered is set, and returns the number
+	// of them
+	TimeoutUpdates(ctx context.Context, id int, maxStage int, offeredBefore time.Time, includeUnoffered bool) (
+		int, error)
+}
+
+const (
+	defaultFailureThreshold = 10
+	defaultUpdateTimeout    = 2 * time.Hour
+	defaultFirmwarePageSize = 50
+)
+
+// defaultCampaignStages rolls out to the canaries first, then to a quarter of the targets and finally to all of them
+var defaultCampaignStages = []int32{5, 25, 100}
+
+// unfinishedUpdates are the states of the updates which have not finished yet
+var unfinishedUpdates = []v1.TerminalUpdate_Status{
+	v1.TerminalUpdate_PENDING, v1.TerminalUpdate_DOWNLOADING, v1.TerminalUpdate_INSTALLING,
+}
+
+// FirmwareManager maintains the firmware catalog and rolls out the firmware to the terminals by campaigns
+type FirmwareManager struct {
+	firmware  FirmwareRepository
+	store     FirmwareStore
+	campaigns CampaignRepository
+	terminals *TerminalManager
+	log       *log.Helper
+
+	failureThreshold float32
+	updateTimeout    time.Duration
+}
+
+func NewFirmwareManager(
+	c *conf.Terminal, firmware FirmwareRepository, store FirmwareStore, campaigns CampaignRepository,
+	terminals *TerminalManager, logger log.Logger) *FirmwareManager {
+	cc := c.GetCampaign()
+	threshold := cc.GetFailureThreshold()
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+	return &FirmwareManager{
+		firmware:         firmware,
+		store:            store,
+		campaigns:        campaigns,
+		terminals:        terminals,
+		log:              log.NewHelper(log.With(logger, "module", "biz/firmware")),
+		failureThreshold: threshold,
+		updateTimeout:    durationOr(cc.GetUpdateTimeout(), defaultUpdateTimeout),
+	}
+}
+
+// Upload saves the artifact and adds the firmware to the catalog. The version must not be in the catalog yet.
+func (m *FirmwareManager) Upload(ctx context.Context, version, releaseNotes string, r io.Reader) (*Firmware, error) {
+	if version == "" || len(version) > 64 {
+		return nil, v1.ErrorMalformedInput("The version must have 1 to 64 characters")
+	}
+	if _, err := m.firmware.FindByVersion(ctx, version); err == nil {
+		return nil, v1.ErrorFirmwareAlreadyExists("Firmware %v is already in the catalog", version)
+	} else if !ent.IsNotFound(err) {
+		return nil, err
+	}
+	name, size, sum, err := m.store.Save(ctx, r)
+	if errors.Is(err, ErrFirmwareTooLarge) {
+		return nil, v1.ErrorFirmwareTooLarge("Firmware %v: %v", version, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	firmware, err := m.firmware.Add(ctx, &Firmware{
+		Version:      version,
+		Size:         size,
+		Sha256:       sum,
+		ReleaseNotes: releaseNotes,
+	}, name)
+	if err != nil {
+		m.removeArtifact(ctx, name)
+		// Another upload of the same version has won the race
+		if ent.IsConstraintError(err) {
+			return nil, v1.ErrorFirmwareAlreadyExists("Firmware %v is already in the catalog", version)
+		}
+		return nil, err
+	}
+	return firmware, nil
+}
+
+// removeArtifact removes the artifact from the store. A failure leaves an orphaned file behind only, so it is
+// logged rather than returned.
+func (m *FirmwareManager) removeArtifact(ctx context.Context, name string) {
+	if err := m.store.Remove(ctx, name); err != nil {
+		m.log.Warnf("failed to remove the firmware artifact %v: %v", name, err)
+	}
+}
+
+func (m *FirmwareManager) GetFirmware(ctx context.Context, id int) (firmware *Firmware, err error) {
+	if firmware, err = m.firmware.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorFirmwareNotFound("There is no such firmware id %v", id)
+	}
+	return
+}
+
+// ListFirmware returns a page of the catalog from the newest to the oldest, along with the size of the catalog
+func (m *FirmwareManager) ListFirmware(ctx context.Context, offset, limit int) ([]*Firmware, int, error) {
+	if limit <= 0 {
+		limit = defaultFirmwarePageSize
+	}
+	return m.firmware.List(ctx, offset, limit)
+}
+
+// OpenArtifact opens the artifact of the firmware for download. The caller should close the artifact.
+func (m *FirmwareManager) OpenArtifact(ctx context.Context, id int) (*Firmware, io.ReadSeekCloser, error) {
+	firmware, err := m.GetFirmware(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := m.firmware.FindArtifact(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	artifact, err := m.store.Open(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return firmware, artifact, nil
+}
+
+// DeleteFirmware removes the firmware from the catalog. The firmware used by any campaign is kept, since the
+// campaign may still be offering it or be rolled back to it.
+func (m *FirmwareManager) DeleteFirmware(ctx context.Context, id int) error {
+	if _, err := m.GetFirmware(ctx, id); err != nil {
+		return err
+	}
+	used, err := m.firmware.IsUsed(ctx, id)
+	if err != nil {
+		return err
+	}
+	if used {
+		return v1.ErrorFirmwareInUse("Firmware %v is used by campaigns", id)
+	}
+	name, err := m.firmware.FindArtifact(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err = m.firmware.Remove(ctx, id); err != nil {
+		return err
+	}
+	m.removeArtifact(ctx, name)
+	return nil
+}
+
+// CreateCampaign starts rolling out the firmware to the members of the group in service. The members are split
+// into the stages by their ids, and the ones already running the firmware are regarded as updated.
+func (m *FirmwareManager) CreateCampaign(ctx context.Context, req *v1.CreateCampaignRequest) (*Campaign, error) {
+	firmware, err := m.GetFirmware(ctx, int(req.FirmwareId))
+	if err != nil {
+		return nil, err
+	}
+	stages := req.Stages
+	if len(stages) == 0 {
+		stages = defaultCampaignStages
+	}
+	for i := 1; i < len(stages); i++ {
+		if stages[i] <= stages[i-1] {
+			return nil, v1.ErrorMalformedInput("The percentages of the stages must be strictly increasing")
+		}
+	}
+	if stages[len(stages)-1] != 100 {
+		return nil, v1.ErrorMalformedInput("The last stage must cover 100%% of the terminals")
+	}
+	threshold := m.failureThreshold
+	if req.FailureThreshold != nil {
+		threshold = *req.FailureThreshold
+	}
+	groupIds, err := m.terminals.groupIds(ctx, int(req.GroupId), req.Recursive)
+	if err != nil {
+		return nil, err
+	}
+	targets, total, err := m.terminals.repo.FindTerminals(ctx, &TerminalQuery{GroupIds: groupIds, Limit: maxBulkTargets})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case total == 0:
+		return nil, v1.ErrorMalformedInput("Group %v has no terminals in service", req.GroupId)
+	case total > maxBulkTargets:
+		return nil, v1.ErrorMalformedInput("The group has %d terminals, more than the limit %d", total, maxBulkTargets)
+	}
+	updates := make([]*TerminalUpdate, 0, len(targets))
+	for i, t := range targets {
+		update := &TerminalUpdate{
+			TerminalId:  t.Id,
+			Stage:       int32(stageOf(stages, i, len(targets))),
+			Status:      v1.TerminalUpdate_PENDING,
+			FromVersion: t.FirmwareVersion,
+		}
+		if t.FirmwareVersion == firmware.Version {
+			update.Status = v1.TerminalUpdate_SUCCEEDED
+			update.Progress = 100
+		}
+		updates = append(updates, update)
+	}
+	campaign, err := m.campaigns.Add(ctx, &Campaign{
+		FirmwareId:       firmware.Id,
+		GroupId:          req.GroupId,
+		Stages:           stages,
+		FailureThreshold: threshold,
+	}, updates)
+	if err != nil {
+		return nil, err
+	}
+	// The first stages may have finished already if their members are running the firmware
+	if err = m.evaluate(ctx, int(campaign.Id), false); err != nil {
+		return nil, err
+	}
+	return m.GetCampaign(ctx, int(campaign.Id))
+}
+
+// stageOf finds the stage of the i-th of the n targets given the cumulative percentages of the stages. Every stage
+// covers at least one target as long as there are enough targets.
+func stageOf(stages []int32, i, n int) int {
+	for stage, percent := range stages {
+		if i < (int(percent)*n+99)/100 {
+			return stage
+		}
+	}
+	return len(stages) - 1
+}
+
+// GetCampaign returns the campaign along with the progress of its updates
+func (m *FirmwareManager) GetCampaign(ctx context.Context, id int) (*Campaign, error) {
+	campaign, err := m.campaigns.FindById(ctx, id)
+	if ent.IsNotFound(err) {
+		return nil, v1.ErrorCampaignNotFound("There is no such campaign id %v", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return campaign, m.countUpdates(ctx, campaign)
+}
+
+// ListCampaigns returns a page of the campaigns from the newest to the oldest, along with the number of them
+func (m *FirmwareManager) ListCampaigns(ctx context.Context, offset, limit int) ([]*Campaign, int, error) {
+	if limit <= 0 {
+		limit = defaultFirmwarePageSize
+	}
+	campaigns, total, err := m.campaigns.List(ctx, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, campaign := range campaigns {
+		if err = m.countUpdates(ctx, campaign); err != nil {
+			return nil, 0, err
+		}
+	}
+	return campaigns, total, nil
+}
+
+// countUpdates fills in the progress of the campaign
+func (m *FirmwareManager) countUpdates(ctx context.Context, campaign *Campaign) error {
+	counts, err := m.campaigns.CountUpdates(ctx, int(campaign.Id), -1)
+	if err != nil {
+		return err
+	}
+	campaign.Total = 0
+	for _, n := range counts {
+		campaign.Total += int32(n)
+	}
+	campaign.Succeeded = int32(counts[v1.TerminalUpdate_SUCCEEDED])
+	campaign.Failed = int32(counts[v1.TerminalUpdate_FAILED])
+	return nil
+}
+
+// ListUpdates returns a page of the updates of the campaign in the given states, or in any state if none is given
+func (m *FirmwareManager) ListUpdates(
+	ctx context.Context, id int, status []v1.TerminalUpdate_Status, offset, limit int) ([]*TerminalUpdate, int, error) {
+	if _, err := m.GetCampaign(ctx, id); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = defaultFirmwarePageSize
+	}
+	return m.campaigns.FindUpdates(ctx, id, status, offset, limit)
+}
+
+// Pause stops offering the updates of the running campaign
+func (m *FirmwareManager) Pause(ctx context.Context, id int) (*Campaign, error) {
+	return m.transit(ctx, id, func() error {
+		return m.campaigns.SetStatus(ctx, id,
+			[]v1.Campaign_Status{v1.Campaign_RUNNING}, v1.Campaign_PAUSED, "Paused manually")
+	})
+}
+
+// Resume resumes the paused campaign, which may advance to the next stage at once. The failure rate is checked
+// again on the next failure only, otherwise a campaign paused by its failures would pause again immediately.
+func (m *FirmwareManager) Resume(ctx context.Context, id int) (*Campaign, error) {
+	return m.transit(ctx, id, func() error {
+		err := m.campaigns.SetStatus(ctx, id, []v1.Campaign_Status{v1.Campaign_PAUSED}, v1.Campaign_RUNNING, "")
+		if err != nil {
+			return err
+		}
+		return m.evaluate(ctx, id, false)
+	})
+}
+
+// Rollback cancels the pending updates of the campaign, and offers the terminals which have started or finished
+// the update their previous firmware
+func (m *FirmwareManager) Rollback(ctx context.Context, id int) (*Campaign, error) {
+	return m.transit(ctx, id, func() error {
+		return m.campaigns.Rollback(ctx, id,
+			[]v1.Campaign_Status{v1.Campaign_RUNNING, v1.Campaign_PAUSED, v1.Campaign_COMPLETED})
+	})
+}
+
+// transit runs a state transition of the campaign and returns the campaign afterwards
+func (m *FirmwareManager) transit(ctx context.Context, id int, transition func() error) (*Campaign, error) {
+	campaign, err := m.GetCampaign(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = transition(); ent.IsNotFound(err) {
+		return nil, v1.ErrorInvalidCampaignState("Campaign %v is %v", id, campaign.Status)
+	} else if err != nil {
+		return nil, err
+	}
+	return m.GetCampaign(ctx, id)
+}
+
+// evaluate moves the running campaign forward. It pauses the campaign if the failure rate of the finished updates
+// in the stages so far passes the threshold, which is only checked after new failures, and starts the next stage
+// once the current one has finished.
+func (m *FirmwareManager) evaluate(ctx context.Context, id int, newFailures bool) (err error) {
+	for {
+		var campaign *Campaign
+		if campaign, err = m.campaigns.FindById(ctx, id); err != nil {
+			return err
+		}
+		if campaign.Status != v1.Campaign_RUNNING {
+			return nil
+		}
+		var counts map[v1.TerminalUpdate_Status]int
+		if counts, err = m.campaigns.CountUpdates(ctx, id, int(campaign.CurrentStage)); err != nil {
+			return err
+		}
+		var total int
+		for _, n := range counts {
+			total += n
+		}
+		succeeded, failed := counts[v1.TerminalUpdate_SUCCEEDED], counts[v1.TerminalUpdate_FAILED]
+		finished := succeeded + failed
+		if newFailures && failed > 0 && float32(failed)*100 > campaign.FailureThreshold*float32(finished) {
+			reason := fmt.Sprintf("%d of %d finished updates failed, beyond the threshold %v%%",
+				failed, finished, campaign.FailureThreshold)
+			err = m.campaigns.SetStatus(ctx, id, []v1.Campaign_Status{v1.Campaign_RUNNING}, v1.Campaign_PAUSED, reason)
+			if err == nil {
+				m.log.Warnf("campaign %d paused: %v", id, reason)
+			}
+			break
+		}
+		if finished < total {
+			return nil
+		}
+		if int(campaign.CurrentStage) >= len(campaign.Stages)-1 {
+			err = m.campaigns.SetStatus(ctx, id, []v1.Campaign_Status{v1.Campaign_RUNNING}, v1.Campaign_COMPLETED, "")
+			if err == nil {
+				m.log.Infof("campaign %d completed", id)
+			}
+			break
+		}
+		if err = m.campaigns.Advance(ctx, id, int(campaign.CurrentStage)); err != nil {
+			break
+		}
+		m.log.Infof("campaign %d advanced to stage %d", id, campaign.CurrentStage+1)
+		// The next stage may have finished already if its members are running the firmware
+		newFailures = false
+	}
+	// Another instance has moved the campaign in the meantime
+	if ent.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// CheckForUpdate records the firmware version reported by the terminal, and offers the terminal the oldest update
+// it should install if there is any. An update is regarded as finished at once if the terminal is already running
+// the offered firmware.
+func (m *FirmwareManager) CheckForUpdate(
+	ctx context.Context, terminalId int, currentVersion string) (*v1.CheckForUpdateReply, error) {
+	terminal, err := m.terminals.GetTerminalById(ctx, terminalId)
+	if err != nil {
+		return nil, err
+	}
+	if terminal.DecommissionTime != nil {
+		return nil, v1.ErrorTerminalDecommissioned("Terminal %v has been decommissioned", terminalId)
+	}
+	if currentVersion == "" {
+		currentVersion = terminal.FirmwareVersion
+	} else if currentVersion != terminal.FirmwareVersion {
+		if err = m.terminals.repo.SetFirmwareVersion(ctx, terminalId, currentVersion); err != nil {
+			return nil, err
+		}
+	}
+	offers, err := m.campaigns.FindOffers(ctx, terminalId)
+	if err != nil {
+		return nil, err
+	}
+	for _, update := range offers {
+		firmware, err := m.firmwareOf(ctx, update)
+		if ent.IsNotFound(err) {
+			// The previous firmware has been removed from the catalog, so the terminal cannot be rolled back
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if firmware.Version == currentVersion {
+			if err = m.finish(ctx, update); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if update.OfferTime == nil {
+			if err = m.campaigns.MarkOffered(ctx, update.Id); err != nil {
+				return nil, err
+			}
+		}
+		return &v1.CheckForUpdateReply{
+			Available:    true,
+			UpdateId:     update.Id,
+			Firmware:     firmware,
+			DownloadPath: fmt.Sprintf("/firmware/%d/download", firmware.Id),
+		}, nil
+	}
+	return &v1.CheckForUpdateReply{}, nil
+}
+
+// firmwareOf finds the firmware the update installs, which is the previous one of the terminal on rollback
+func (m *FirmwareManager) firmwareOf(ctx context.Context, update *TerminalUpdate) (*Firmware, error) {
+	if update.Status == v1.TerminalUpdate_ROLLBACK_PENDING {
+		return m.firmware.FindByVersion(ctx, update.FromVersion)
+	}
+	campaign, err := m.campaigns.FindById(ctx, int(update.CampaignId))
+	if err != nil {
+		return nil, err
+	}
+	return m.firmware.FindById(ctx, int(campaign.FirmwareId))
+}
+
+// finish completes the update of the terminal which is already running the firmware
+func (m *FirmwareManager) finish(ctx context.Context, update *TerminalUpdate) error {
+	var err error
+	if update.Status == v1.TerminalUpdate_ROLLBACK_PENDING {
+		err = m.campaigns.Progress(ctx, update.Id, []v1.TerminalUpdate_Status{v1.TerminalUpdate_ROLLBACK_PENDING},
+			v1.TerminalUpdate_ROLLED_BACK, 100, "")
+	} else if err = m.campaigns.Progress(ctx, update.Id, unfinishedUpdates,
+		v1.TerminalUpdate_SUCCEEDED, 100, ""); err == nil {
+		err = m.evaluate(ctx, int(update.CampaignId), false)
+	}
+	if ent.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ReportProgress records the progress of the update reported by the terminal. The terminal is regarded as running
+// the new firmware once the update succeeds. A failed rollback stays pending, so that the terminal retries it.
+func (m *FirmwareManager) ReportProgress(ctx context.Context, progress *v1.UpdateProgress) error {
+	update, err := m.campaigns.FindUpdate(ctx, progress.UpdateId)
+	if ent.IsNotFound(err) || err == nil && update.TerminalId != progress.TerminalId {
+		return v1.ErrorUpdateNotFound("There is no such update id %v of terminal %v",
+			progress.UpdateId, progress.TerminalId)
+	}
+	if err != nil {
+		return err
+	}
+	var version string
+	switch update.Status {
+	case v1.TerminalUpdate_ROLLBACK_PENDING:
+		to := v1.TerminalUpdate_ROLLBACK_PENDING
+		if progress.Status == v1.TerminalUpdate_SUCCEEDED {
+			to, version = v1.TerminalUpdate_ROLLED_BACK, update.FromVersion
+		}
+		err = m.campaigns.Progress(ctx, update.Id,
+			[]v1.TerminalUpdate_Status{v1.TerminalUpdate_ROLLBACK_PENDING}, to, progress.Progress, progress.Message)
+	case v1.TerminalUpdate_PENDING, v1.TerminalUpdate_DOWNLOADING, v1.TerminalUpdate_INSTALLING:
+		if progress.Status == v1.TerminalUpdate_SUCCEEDED {
+			var campaign *Campaign
+			if campaign, err = m.campaigns.FindById(ctx, int(update.CampaignId)); err != nil {
+				return err
+			}
+			version = campaign.FirmwareVersion
+		}
+		err = m.campaigns.Progress(ctx, update.Id, unfinishedUpdates,
+			progress.Status, progress.Progress, progress.Message)
+	default:
+		return v1.ErrorInvalidCampaignState("Update %v is %v", update.Id, update.Status)
+	}
+	if ent.IsNotFound(err) {
+		return v1.ErrorInvalidCampaignState("Update %v has changed its state in the meantime", update.Id)
+	}
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		if err = m.terminals.repo.SetFirmwareVersion(ctx, int(update.TerminalId), version); err != nil {
+			return err
+		}
+	}
+	if progress.Status == v1.TerminalUpdate_SUCCEEDED || progress.Status == v1.TerminalUpdate_FAILED {
+		return m.evaluate(ctx, int(update.CampaignId), progress.Status == v1.TerminalUpdate_FAILED)
+	}
+	return nil
+}
+
+// Maintain fails the updates of the running campaigns which have not finished in time and moves the campaigns
+// forward. The updates never offered are failed as well once their stage has lasted longer than the timeout, since
+// their terminals are not checking for updates at all. It should be run periodically.
+func (m *FirmwareManager) Maintain(ctx context.Context) error {
+	campaigns, err := m.campaigns.FindRunning(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-m.updateTimeout)
+	for _, campaign := range campaigns {
+		id := int(campaign.Id)
+		timedOut, err := m.campaigns.TimeoutUpdates(
+			ctx, id, int(campaign.CurrentStage), cutoff, campaign.StageStartTime.AsTime().Before(cutoff))
+		if err != nil {
+			return err
+		}
+		if timedOut > 0 {
+			m.log.Infof("%d updates of campaign %d timed out", timedOut, id)
+		}
+		if err = m.evaluate(ctx, id, timedOut > 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
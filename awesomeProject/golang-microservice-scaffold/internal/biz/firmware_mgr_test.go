@@ -0,0 +1,394 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/ent"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestStageOf(t *testing.T) {
+	tests := []struct {
+		stages []int32
+		n      int
+		// sizes are the numbers of the targets in the stages
+		sizes []int
+	}{
+		{stages: []int32{5, 25, 100}, n: 1, sizes: []int{1, 0, 0}},
+		{stages: []int32{5, 25, 100}, n: 3, sizes: []int{1, 0, 2}},
+		{stages: []int32{5, 25, 100}, n: 5, sizes: []int{1, 1, 3}},
+		{stages: []int32{5, 25, 100}, n: 100, sizes: []int{5, 20, 75}},
+		{stages: []int32{5, 25, 100}, n: 101, sizes: []int{6, 20, 75}},
+		{stages: []int32{50, 100}, n: 3, sizes: []int{2, 1}},
+		{stages: []int32{100}, n: 4, sizes: []int{4}},
+	}
+	for _, tt := range tests {
+		sizes := make([]int, len(tt.stages))
+		for i := 0; i < tt.n; i++ {
+			sizes[stageOf(tt.stages, i, tt.n)]++
+		}
+		if !slices.Equal(sizes, tt.sizes) {
+			t.Errorf("got stages of sizes %v for %d targets in %v, want %v", sizes, tt.n, tt.stages, tt.sizes)
+		}
+	}
+}
+
+// campaignRepo holds a single campaign, whose transitions are guarded by the current states like the repository
+type campaignRepo struct {
+	CampaignRepository
+	campaign *Campaign
+	updates  []*TerminalUpdate
+	// unoffered tells whether TimeoutUpdates was asked to fail the updates never offered
+	unoffered bool
+}
+
+// newCampaignRepo creates the running campaign 1 with an update in the given state for each of the stages
+func newCampaignRepo(stages []int32, threshold float32, updates map[int][]v1.TerminalUpdate_Status) *campaignRepo {
+	r := &campaignRepo{campaign: &Campaign{
+		Id: 1, Status: v1.Campaign_RUNNING, Stages: stages, FailureThreshold: threshold,
+		StageStartTime: timestamppb.Now(),
+	}}
+	for stage := range stages {
+		for _, status := range updates[stage] {
+			r.updates = append(r.updates, &TerminalUpdate{
+				Id: int64(len(r.updates) + 1), CampaignId: 1, TerminalId: int64(len(r.updates) + 1),
+				Stage: int32(stage), Status: status, FromVersion: "1.0",
+			})
+		}
+	}
+	return r
+}
+
+func (r *campaignRepo) FindById(_ context.Context, id int) (*Campaign, error) {
+	if id != int(r.campaign.Id) {
+		return nil, &ent.NotFoundError{}
+	}
+	return proto.Clone(r.campaign).(*Campaign), nil
+}
+
+func (r *campaignRepo) FindRunning(context.Context) ([]*Campaign, error) {
+	if r.campaign.Status != v1.Campaign_RUNNING {
+		return nil, nil
+	}
+	return []*Campaign{proto.Clone(r.campaign).(*Campaign)}, nil
+}
+
+func (r *campaignRepo) SetStatus(
+	_ context.Context, _ int, from []v1.Campaign_Status, to v1.Campaign_Status, reason string) error {
+	if !slices.Contains(from, r.campaign.Status) {
+		return &ent.NotFoundError{}
+	}
+	r.campaign.Status, r.campaign.PauseReason = to, reason
+	return nil
+}
+
+func (r *campaignRepo) Advance(_ context.Context, _ int, stage int) error {
+	if r.campaign.Status != v1.Campaign_RUNNING || int(r.campaign.CurrentStage) != stage {
+		return &ent.NotFoundError{}
+	}
+	r.campaign.CurrentStage++
+	r.campaign.StageStartTime = timestamppb.Now()
+	return nil
+}
+
+func (r *campaignRepo) Rollback(_ context.Context, _ int, from []v1.Campaign_Status) error {
+	if !slices.Contains(from, r.campaign.Status) {
+		return &ent.NotFoundError{}
+	}
+	r.campaign.Status = v1.Campaign_ROLLED_BACK
+	for _, u := range r.updates {
+		if u.Status == v1.TerminalUpdate_PENDING {
+			u.Status = v1.TerminalUpdate_CANCELLED
+		} else if u.FromVersion != "" {
+			u.Status = v1.TerminalUpdate_ROLLBACK_PENDING
+		}
+	}
+	return nil
+}
+
+func (r *campaignRepo) CountUpdates(_ context.Context, _ int, maxStage int) (map[v1.TerminalUpdate_Status]int, error) {
+	counts := make(map[v1.TerminalUpdate_Status]int)
+	for _, u := range r.updates {
+		if maxStage < 0 || int(u.Stage) <= maxStage {
+			counts[u.Status]++
+		}
+	}
+	return counts, nil
+}
+
+func (r *campaignRepo) FindUpdate(_ context.Context, id int64) (*TerminalUpdate, error) {
+	for _, u := range r.updates {
+		if u.Id == id {
+			return proto.Clone(u).(*TerminalUpdate), nil
+		}
+	}
+	return nil, &ent.NotFoundError{}
+}
+
+func (r *campaignRepo) Progress(_ context.Context, id int64, from []v1.TerminalUpdate_Status,
+	to v1.TerminalUpdate_Status, progress int32, message string) error {
+	for _, u := range r.updates {
+		if u.Id == id && slices.Contains(from, u.Status) {
+			u.Status, u.Progress, u.Message = to, progress, message
+			return nil
+		}
+	}
+	return &ent.NotFoundError{}
+}
+
+func (r *campaignRepo) TimeoutUpdates(
+	_ context.Context, _ int, maxStage int, offeredBefore time.Time, includeUnoffered bool) (int, error) {
+	r.unoffered = includeUnoffered
+	var n int
+	for _, u := range r.updates {
+		if int(u.Stage) > maxStage || !slices.Contains(unfinishedUpdates, u.Status) {
+			continue
+		}
+		if u.OfferTime != nil && u.OfferTime.AsTime().Before(offeredBefore) || u.OfferTime == nil && includeUnoffered {
+			u.Status = v1.TerminalUpdate_FAILED
+			n++
+		}
+	}
+	return n, nil
+}
+
+// statuses returns the states of the updates in the order of their ids
+func (r *campaignRepo) statuses() []v1.TerminalUpdate_Status {
+	statuses := make([]v1.TerminalUpdate_Status, 0, len(r.updates))
+	for _, u := range r.updates {
+		statuses = append(statuses, u.Status)
+	}
+	return statuses
+}
+
+func newTestFirmwareManager(campaigns CampaignRepository) *FirmwareManager {
+	return &FirmwareManager{
+		campaigns:     campaigns,
+		log:           log.NewHelper(log.DefaultLogger),
+		updateTimeout: time.Hour,
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	const (
+		pending   = v1.TerminalUpdate_PENDING
+		succeeded = v1.TerminalUpdate_SUCCEEDED
+		failed    = v1.TerminalUpdate_FAILED
+	)
+	stages := []int32{10, 50, 100}
+	tests := []struct {
+		name        string
+		threshold   float32
+		updates     map[int][]v1.TerminalUpdate_Status
+		newFailures bool
+		status      v1.Campaign_Status
+		stage       int32
+	}{
+		{
+			name:      "stage in progress",
+			threshold: 10,
+			updates:   map[int][]v1.TerminalUpdate_Status{0: {succeeded, pending}, 1: {pending}, 2: {pending}},
+			status:    v1.Campaign_RUNNING,
+		},
+		{
+			name:        "failures beyond the threshold",
+			threshold:   10,
+			updates:     map[int][]v1.TerminalUpdate_Status{0: {succeeded, failed, pending}, 2: {pending}},
+			newFailures: true,
+			status:      v1.Campaign_PAUSED,
+		},
+		{
+			// The failure rate must pass the threshold rather than reach it
+			name:        "failures at the threshold",
+			threshold:   50,
+			updates:     map[int][]v1.TerminalUpdate_Status{0: {succeeded, failed, pending}, 2: {pending}},
+			newFailures: true,
+			status:      v1.Campaign_RUNNING,
+		},
+		{
+			// A resumed campaign does not pause again for the failures it was paused for
+			name:      "failures known before",
+			threshold: 10,
+			updates:   map[int][]v1.TerminalUpdate_Status{0: {succeeded, failed, pending}, 2: {pending}},
+			status:    v1.Campaign_RUNNING,
+		},
+		{
+			name:      "stage finished",
+			threshold: 10,
+			updates:   map[int][]v1.TerminalUpdate_Status{0: {succeeded, succeeded}, 1: {pending}, 2: {pending}},
+			status:    v1.Campaign_RUNNING,
+			stage:     1,
+		},
+		{
+			// The stages without any target, or whose targets are running the firmware already, finish at once
+			name:      "stages finished already",
+			threshold: 10,
+			updates:   map[int][]v1.TerminalUpdate_Status{0: {succeeded}, 2: {succeeded, succeeded}},
+			status:    v1.Campaign_COMPLETED,
+			stage:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCampaignRepo(stages, tt.threshold, tt.updates)
+			if err := newTestFirmwareManager(r).evaluate(context.Background(), 1, tt.newFailures); err != nil {
+				t.Fatal(err)
+			}
+			if r.campaign.Status != tt.status || r.campaign.CurrentStage != tt.stage {
+				t.Errorf("got campaign %v at stage %d, want %v at stage %d",
+					r.campaign.Status, r.campaign.CurrentStage, tt.status, tt.stage)
+			}
+			if (r.campaign.PauseReason != "") != (tt.status == v1.Campaign_PAUSED) {
+				t.Errorf("got pause reason %q", r.campaign.PauseReason)
+			}
+		})
+	}
+}
+
+func TestReportProgressPauses(t *testing.T) {
+	r := newCampaignRepo([]int32{100}, 20, map[int][]v1.TerminalUpdate_Status{
+		0: {v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_SUCCEEDED,
+			v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_INSTALLING, v1.TerminalUpdate_DOWNLOADING},
+	})
+	m := newTestFirmwareManager(r)
+	ctx := context.Background()
+	// 1 of 5 finished updates failed, which is at the threshold
+	if err := m.ReportProgress(ctx, &v1.UpdateProgress{
+		TerminalId: 5, UpdateId: 5, Status: v1.TerminalUpdate_FAILED}); err != nil {
+		t.Fatal(err)
+	}
+	if r.campaign.Status != v1.Campaign_RUNNING {
+		t.Fatalf("got campaign %v, want running", r.campaign.Status)
+	}
+	// 2 of 6 are beyond it
+	if err := m.ReportProgress(ctx, &v1.UpdateProgress{
+		TerminalId: 6, UpdateId: 6, Status: v1.TerminalUpdate_FAILED}); err != nil {
+		t.Fatal(err)
+	}
+	if r.campaign.Status != v1.Campaign_PAUSED {
+		t.Errorf("got campaign %v, want paused", r.campaign.Status)
+	}
+	// A finished update cannot be reported again
+	err := m.ReportProgress(ctx, &v1.UpdateProgress{TerminalId: 6, UpdateId: 6, Status: v1.TerminalUpdate_SUCCEEDED})
+	if !v1.IsInvalidCampaignState(err) {
+		t.Errorf("got error %v, want invalid campaign state", err)
+	}
+}
+
+func TestCampaignTransitions(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		from v1.Campaign_Status
+		run  func(m *FirmwareManager) (*Campaign, error)
+		// to is the state after the transition, which is rejected if it is the unspecified state
+		to v1.Campaign_Status
+	}{
+		{name: "pause running", from: v1.Campaign_RUNNING, to: v1.Campaign_PAUSED,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Pause(ctx, 1) }},
+		{name: "pause paused", from: v1.Campaign_PAUSED,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Pause(ctx, 1) }},
+		{name: "pause completed", from: v1.Campaign_COMPLETED,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Pause(ctx, 1) }},
+		{name: "resume paused", from: v1.Campaign_PAUSED, to: v1.Campaign_RUNNING,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Resume(ctx, 1) }},
+		{name: "resume running", from: v1.Campaign_RUNNING,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Resume(ctx, 1) }},
+		{name: "resume rolled back", from: v1.Campaign_ROLLED_BACK,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Resume(ctx, 1) }},
+		{name: "roll back completed", from: v1.Campaign_COMPLETED, to: v1.Campaign_ROLLED_BACK,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Rollback(ctx, 1) }},
+		{name: "roll back rolled back", from: v1.Campaign_ROLLED_BACK,
+			run: func(m *FirmwareManager) (*Campaign, error) { return m.Rollback(ctx, 1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCampaignRepo([]int32{100}, 10, map[int][]v1.TerminalUpdate_Status{
+				0: {v1.TerminalUpdate_PENDING}})
+			r.campaign.Status = tt.from
+			c, err := tt.run(newTestFirmwareManager(r))
+			if tt.to == v1.Campaign_STATUS_UNSPECIFIED {
+				if !v1.IsInvalidCampaignState(err) || r.campaign.Status != tt.from {
+					t.Errorf("got campaign %v: %v, want the transition rejected", r.campaign.Status, err)
+				}
+				return
+			}
+			if err != nil || c.Status != tt.to {
+				t.Errorf("got campaign %v: %v, want %v", c, err, tt.to)
+			}
+		})
+	}
+}
+
+func TestCampaignRollback(t *testing.T) {
+	r := newCampaignRepo([]int32{50, 100}, 10, map[int][]v1.TerminalUpdate_Status{
+		0: {v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_INSTALLING},
+		1: {v1.TerminalUpdate_PENDING, v1.TerminalUpdate_PENDING},
+	})
+	m := newTestFirmwareManager(r)
+	c, err := m.Rollback(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Status != v1.Campaign_ROLLED_BACK {
+		t.Errorf("got campaign %v, want rolled back", c.Status)
+	}
+	want := []v1.TerminalUpdate_Status{
+		v1.TerminalUpdate_ROLLBACK_PENDING, v1.TerminalUpdate_ROLLBACK_PENDING,
+		v1.TerminalUpdate_CANCELLED, v1.TerminalUpdate_CANCELLED,
+	}
+	if got := r.statuses(); !slices.Equal(got, want) {
+		t.Errorf("got updates %v, want %v", got, want)
+	}
+	// The cancelled updates are not counted as finished, and the rolled back campaign is no longer evaluated
+	if err = m.evaluate(context.Background(), 1, true); err != nil || r.campaign.Status != v1.Campaign_ROLLED_BACK {
+		t.Errorf("got campaign %v: %v", r.campaign.Status, err)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	offered := timestamppb.New(time.Now().Add(-2 * time.Hour))
+	r := newCampaignRepo([]int32{50, 100}, 10, map[int][]v1.TerminalUpdate_Status{
+		0: {v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_DOWNLOADING, v1.TerminalUpdate_PENDING},
+		1: {v1.TerminalUpdate_DOWNLOADING},
+	})
+	r.updates[1].OfferTime = offered
+	r.updates[3].OfferTime = offered
+	m := newTestFirmwareManager(r)
+
+	// The update offered too long ago times out, while the one never offered waits as long as the stage is young.
+	// The updates of the later stages are not rolled out yet.
+	if err := m.Maintain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []v1.TerminalUpdate_Status{
+		v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_FAILED, v1.TerminalUpdate_PENDING,
+		v1.TerminalUpdate_DOWNLOADING,
+	}
+	if got := r.statuses(); r.unoffered || !slices.Equal(got, want) {
+		t.Fatalf("got updates %v and the unoffered ones failed %v, want %v", got, r.unoffered, want)
+	}
+	// The timeout is a new failure, which pauses the campaign beyond the threshold
+	if r.campaign.Status != v1.Campaign_PAUSED {
+		t.Fatalf("got campaign %v, want paused", r.campaign.Status)
+	}
+
+	// Once the stage has lasted longer than the timeout, the updates never offered fail as well
+	r.campaign.Status, r.campaign.FailureThreshold = v1.Campaign_RUNNING, 100
+	r.campaign.StageStartTime = offered
+	if err := m.Maintain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !r.unoffered || r.updates[2].Status != v1.TerminalUpdate_FAILED {
+		t.Errorf("got update %v, want the unoffered update failed", r.updates[2].Status)
+	}
+	if r.campaign.CurrentStage != 1 {
+		t.Errorf("got stage %d, want the campaign advanced", r.campaign.CurrentStage)
+	}
+}
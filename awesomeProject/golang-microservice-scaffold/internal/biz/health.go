@@ -0,0 +1,13 @@
+package biz
+
+import "context"
+
+// HealthCheck checks whether a dependency of the service is available. The service is ready only if all the checks
+// pass.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthChecks are the checks of the stores the repositories rely on
+type HealthChecks []HealthCheck
@@ -0,0 +1,599 @@
+package biz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	v1 "example/api/alert/v1"
+	userv1 "example/api/user/v1"
+	"example/internal/conf"
+	"example/internal/ent"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Channel is where the notifications of the alerts are sent to
+type Channel = v1.Channel
+
+// Route sends the matching alerts to a channel
+type Route = v1.Route
+
+// Delivery is a notification of an alert through a channel along with the attempts to send it
+type Delivery = v1.Delivery
+
+// DeliveryQuery finds the deliveries matching all the given conditions from the newest to the oldest
+type DeliveryQuery struct {
+	AlertId   int
+	ChannelId int
+	Statuses  []v1.Delivery_Status
+	Offset    int
+	Limit     int
+}
+
+// ErrUndeliverable marks the failures of the notifications which retrying would not fix, e.g. a rejected request
+var ErrUndeliverable = errors.New("undeliverable notification")
+
+// NotificationRepository stores the channels, the routes and the deliveries of the notifications
+type NotificationRepository interface {
+	AddChannel(ctx context.Context, channel *Channel) (*Channel, error)
+	// FindChannelById finds the channel along with its secret
+	FindChannelById(ctx context.Context, id int) (*Channel, error)
+	ListChannels(ctx context.Context, offset, limit int) ([]*Channel, int, error)
+	// UpdateChannel replaces the definition of the channel, but keeps its secret unless the secret is given
+	UpdateChannel(ctx context.Context, channel *Channel) (*Channel, error)
+	// DeleteChannel deletes the channel along with its routes and deliveries
+	DeleteChannel(ctx context.Context, id int) error
+	AddRoute(ctx context.Context, route *Route) (*Route, error)
+	FindRouteById(ctx context.Context, id int) (*Route, error)
+	// ListRoutes lists the routes to the channel, or all of them if the channel is zero
+	ListRoutes(ctx context.Context, channelId int, offset, limit int) ([]*Route, int, error)
+	UpdateRoute(ctx context.Context, route *Route) (*Route, error)
+	DeleteRoute(ctx context.Context, id int) error
+	// FindActiveRoutes finds all the routes to the channels which are not disabled
+	FindActiveRoutes(ctx context.Context) ([]*Route, error)
+	AddDeliveries(ctx context.Context, deliveries []*Delivery) error
+	// CountSince counts the deliveries through the channel created since the time, except for the suppressed ones
+	CountSince(ctx context.Context, channelId int, since time.Time) (int, error)
+	// FindDue finds at most limit pending deliveries whose next attempts are due by the time
+	FindDue(ctx context.Context, at time.Time, limit int) ([]*Delivery, error)
+	// Claim counts an attempt of the pending delivery and postpones its next attempt to the time, so that no one
+	// else attempts it in the meantime. It reports whether the delivery is claimed, i.e. it has not been attempted
+	// since it was found.
+	Claim(ctx context.Context, delivery *Delivery, until time.Time) (bool, error)
+	// SaveAttempt records the outcome of the latest attempt of the delivery
+	SaveAttempt(ctx context.Context, delivery *Delivery) error
+	FindDeliveryById(ctx context.Context, id int) (*Delivery, error)
+	ListDeliveries(ctx context.Context, query *DeliveryQuery) ([]*Delivery, int, error)
+	// FindGroupEmails finds the email addresses of the members of the user group
+	FindGroupEmails(ctx context.Context, groupId int64) ([]string, error)
+}
+
+// Notifier sends the notifications through the channels. The failures which retrying would not fix are wrapped
+// around [ErrUndeliverable].
+type Notifier interface {
+	Send(ctx context.Context, channel *Channel, delivery *Delivery) error
+}
+
+// Defaults of the delivery of the notifications
+const (
+	defaultMaxAttempts     = 5
+	defaultDeliveryBackoff = 10 * time.Second
+	defaultDeliveryTimeout = 10 * time.Second
+	defaultRateWindow      = time.Hour
+	defaultSubjectTemplate = "[{{.Severity}}] {{.Rule.Name}} is {{.Event}}"
+	defaultBodyTemplate    = "{{.Alert.Message}}"
+	// deliveryBatchSize is the number of the due deliveries attempted by a run of the delivery job at most
+	deliveryBatchSize = 100
+)
+
+// notificationPolicy is how the notifications are delivered
+type notificationPolicy struct {
+	maxAttempts     int32
+	backoff         time.Duration
+	timeout         time.Duration
+	subjectTemplate string
+	bodyTemplate    string
+	// allowPrivateHosts lets the channels post to the internal addresses
+	allowPrivateHosts bool
+}
+
+func newNotificationPolicy(c *conf.Alert_Notification) notificationPolicy {
+	p := notificationPolicy{
+		maxAttempts:       c.GetMaxAttempts(),
+		backoff:           c.GetBackoff().AsDuration(),
+		timeout:           c.GetTimeout().AsDuration(),
+		subjectTemplate:   c.GetSubjectTemplate(),
+		bodyTemplate:      c.GetBodyTemplate(),
+		allowPrivateHosts: c.GetAllowPrivateHosts(),
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultMaxAttempts
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultDeliveryBackoff
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultDeliveryTimeout
+	}
+	if p.subjectTemplate == "" {
+		p.subjectTemplate = defaultSubjectTemplate
+	}
+	if p.bodyTemplate == "" {
+		p.bodyTemplate = defaultBodyTemplate
+	}
+	return p
+}
+
+// notification is what the templates of the notifications are executed with
+type notification struct {
+	// Event is either "firing" or "resolved"
+	Event    string
+	Severity string
+	Alert    *Alert
+	Rule     *AlertRule
+	// Tags are of the terminal which the alert concerns
+	Tags []string
+}
+
+// NotificationManager routes the alerts to the channels and delivers the notifications. The deliveries are
+// attempted by [NotificationManager.Deliver] in the background.
+type NotificationManager struct {
+	repo      NotificationRepository
+	notifier  Notifier
+	users     UserRepository
+	sensors   SensorRepository
+	terminals TerminalRepository
+	policy    notificationPolicy
+	log       *log.Helper
+}
+
+func NewNotificationManager(
+	c *conf.Alert, repo NotificationRepository, notifier Notifier, alerts *AlertManager, users UserRepository,
+	sensors SensorRepository, terminals TerminalRepository, logger log.Logger) *NotificationManager {
+	m := &NotificationManager{
+		repo:      repo,
+		notifier:  notifier,
+		users:     users,
+		sensors:   sensors,
+		terminals: terminals,
+		policy:    newNotificationPolicy(c.GetNotification()),
+		log:       log.NewHelper(log.With(logger, "module", "biz/notification")),
+	}
+	alerts.ObserveAlerts(m.onAlert)
+	return m
+}
+
+// redact removes the secret of the channel, which is never revealed
+func redact(channel *Channel, err error) (*Channel, error) {
+	if channel != nil {
+		channel.Secret = nil
+	}
+	return channel, err
+}
+
+// IsInternalAddr reports whether the address is of the host itself or of a private network, which the channels
+// must not post to unless it is allowed. The notifier checks the addresses it dials against it as well, since the
+// names of the hosts may resolve to anything.
+func IsInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || sharedAddrSpace.Contains(addr)
+}
+
+// sharedAddrSpace is the carrier-grade NAT range, which is private to the network of the provider
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkChannel makes sure the channel has what its type requires and its templates are valid
+func (m *NotificationManager) checkChannel(channel *Channel) error {
+	if channel.Type != v1.Channel_EMAIL {
+		u, err := url.Parse(channel.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return v1.ErrorMalformedInput("An HTTP URL is required by the channel of type %v", channel.Type)
+		}
+		if !m.policy.allowPrivateHosts {
+			host := u.Hostname()
+			addr, err := netip.ParseAddr(host)
+			if host == "localhost" || strings.HasSuffix(host, ".localhost") || (err == nil && IsInternalAddr(addr)) {
+				return v1.ErrorMalformedInput("The channel cannot post to the internal host %v", host)
+			}
+		}
+	}
+	for _, text := range []string{channel.SubjectTemplate, channel.BodyTemplate} {
+		if _, err := template.New("").Parse(text); err != nil {
+			return v1.ErrorMalformedInput("Malformed template: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m *NotificationManager) CreateChannel(ctx context.Context, channel *Channel) (*Channel, error) {
+	if err := m.checkChannel(channel); err != nil {
+		return nil, err
+	}
+	return redact(m.repo.AddChannel(ctx, channel))
+}
+
+func (m *NotificationManager) GetChannel(ctx context.Context, id int) (*Channel, error) {
+	return redact(m.getChannel(ctx, id))
+}
+
+// getChannel returns the channel along with its secret
+func (m *NotificationManager) getChannel(ctx context.Context, id int) (channel *Channel, err error) {
+	if channel, err = m.repo.FindChannelById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorChannelNotFound("There is no such channel id %v", id)
+	}
+	return
+}
+
+func (m *NotificationManager) ListChannels(ctx context.Context, offset, limit int) ([]*Channel, int, error) {
+	if limit <= 0 {
+		limit = defaultAlertPageSize
+	}
+	channels, total, err := m.repo.ListChannels(ctx, offset, limit)
+	for _, c := range channels {
+		c.Secret = nil
+	}
+	return channels, total, err
+}
+
+// UpdateChannel replaces the definition of the channel. The secret is kept unless it is given.
+func (m *NotificationManager) UpdateChannel(ctx context.Context, channel *Channel) (*Channel, error) {
+	if err := m.checkChannel(channel); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.UpdateChannel(ctx, channel)
+	if ent.IsNotFound(err) {
+		return nil, v1.ErrorChannelNotFound("There is no such channel id %v", channel.Id)
+	}
+	return redact(updated, err)
+}
+
+// DeleteChannel deletes the channel along with its routes and deliveries
+func (m *NotificationManager) DeleteChannel(ctx context.Context, id int) error {
+	err := m.repo.DeleteChannel(ctx, id)
+	if ent.IsNotFound(err) {
+		return v1.ErrorChannelNotFound("There is no such channel id %v", id)
+	}
+	return err
+}
+
+// TestChannel sends a sample notification through the channel right away, which is neither recorded nor retried.
+// It returns the failure of the notification, if any, rather than an error.
+func (m *NotificationManager) TestChannel(ctx context.Context, id int) (*v1.TestChannelReply, error) {
+	channel, err := m.getChannel(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := timestamppb.Now()
+	value := 42.0
+	rule := &AlertRule{
+		Name:       "Test",
+		Kind:       v1.AlertRule_THRESHOLD,
+		Operator:   v1.AlertRule_GT,
+		Threshold:  40,
+		Severity:   v1.AlertRule_INFO,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	alert := &Alert{
+		Status:     v1.Alert_FIRING,
+		Severity:   rule.Severity,
+		Value:      &value,
+		Message:    "This is a test notification of channel " + channel.Name,
+		StartTime:  now,
+		FireTime:   now,
+		UpdateTime: now,
+	}
+	delivery, err := m.render(channel, &notification{
+		Event:    "firing",
+		Severity: rule.Severity.String(),
+		Alert:    alert,
+		Rule:     rule,
+	})
+	if err == nil {
+		delivery.Recipients = channel.Recipients
+		sendCtx, cancel := context.WithTimeout(ctx, m.policy.timeout)
+		err = m.notifier.Send(sendCtx, channel, delivery)
+		cancel()
+	}
+	if err != nil {
+		return &v1.TestChannelReply{Error: err.Error()}, nil
+	}
+	return &v1.TestChannelReply{Success: true}, nil
+}
+
+// checkRoute makes sure the channel and the user group of the route exist
+func (m *NotificationManager) checkRoute(ctx context.Context, route *Route) error {
+	if _, err := m.getChannel(ctx, int(route.ChannelId)); err != nil {
+		return err
+	}
+	if route.UserGroupId == 0 {
+		return nil
+	}
+	group, err := m.users.FindById(ctx, route.UserGroupId)
+	if ent.IsNotFound(err) || (err == nil && group.Type != userv1.User_USER_GROUP) {
+		return v1.ErrorMalformedInput("There is no such user group id %v", route.UserGroupId)
+	}
+	return err
+}
+
+func (m *NotificationManager) CreateRoute(ctx context.Context, route *Route) (*Route, error) {
+	if err := m.checkRoute(ctx, route); err != nil {
+		return nil, err
+	}
+	return m.repo.AddRoute(ctx, route)
+}
+
+func (m *NotificationManager) GetRoute(ctx context.Context, id int) (route *Route, err error) {
+	if route, err = m.repo.FindRouteById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorRouteNotFound("There is no such route id %v", id)
+	}
+	return
+}
+
+func (m *NotificationManager) ListRoutes(ctx context.Context, channelId int, offset, limit int) ([]*Route, int, error) {
+	if limit <= 0 {
+		limit = defaultAlertPageSize
+	}
+	return m.repo.ListRoutes(ctx, channelId, offset, limit)
+}
+
+func (m *NotificationManager) UpdateRoute(ctx context.Context, route *Route) (*Route, error) {
+	if err := m.checkRoute(ctx, route); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.UpdateRoute(ctx, route)
+	if ent.IsNotFound(err) {
+		return nil, v1.ErrorRouteNotFound("There is no such route id %v", route.Id)
+	}
+	return updated, err
+}
+
+func (m *NotificationManager) DeleteRoute(ctx context.Context, id int) error {
+	err := m.repo.DeleteRoute(ctx, id)
+	if ent.IsNotFound(err) {
+		return v1.ErrorRouteNotFound("There is no such route id %v", id)
+	}
+	return err
+}
+
+func (m *NotificationManager) GetDelivery(ctx context.Context, id int) (delivery *Delivery, err error) {
+	if delivery, err = m.repo.FindDeliveryById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorDeliveryNotFound("There is no such delivery id %v", id)
+	}
+	return
+}
+
+func (m *NotificationManager) ListDeliveries(ctx context.Context, query *DeliveryQuery) ([]*Delivery, int, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAlertPageSize
+	}
+	return m.repo.ListDeliveries(ctx, query)
+}
+
+// onAlert routes the alert to the channels of the matching routes. A channel is notified once even if several
+// routes to it match. The silenced alerts are not notified at all.
+func (m *NotificationManager) onAlert(ctx context.Context, alert *Alert, rule *AlertRule) {
+	if alert.Silenced {
+		return
+	}
+	routes, err := m.repo.FindActiveRoutes(ctx)
+	if err != nil {
+		m.log.Errorf("failed to route alert %v: %v", alert.Id, err)
+		return
+	}
+	if len(routes) == 0 {
+		return
+	}
+	n := &notification{
+		Event:    strings.ToLower(alert.Status.String()),
+		Severity: alert.Severity.String(),
+		Alert:    alert,
+		Rule:     rule,
+		Tags:     m.tagsOf(ctx, rule),
+	}
+	matched := make(map[int64][]*Route)
+	var channelIds []int64
+	for _, r := range routes {
+		if !matches(r, n) {
+			continue
+		}
+		if _, ok := matched[r.ChannelId]; !ok {
+			channelIds = append(channelIds, r.ChannelId)
+		}
+		matched[r.ChannelId] = append(matched[r.ChannelId], r)
+	}
+	deliveries := make([]*Delivery, 0, len(channelIds))
+	for _, id := range channelIds {
+		delivery, err := m.deliveryOf(ctx, int(id), matched[id], n)
+		if err != nil {
+			m.log.Errorf("failed to notify alert %v through channel %v: %v", alert.Id, id, err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err = m.repo.AddDeliveries(ctx, deliveries); err != nil {
+		m.log.Errorf("failed to record %d deliveries of alert %v: %v", len(deliveries), alert.Id, err)
+	}
+}
+
+// matches reports whether the notification matches all the conditions of the route
+func matches(r *Route, n *notification) bool {
+	if n.Alert.Status == v1.Alert_RESOLVED && !r.SendResolved {
+		return false
+	}
+	if len(r.Severities) > 0 && !slices.Contains(r.Severities, n.Alert.Severity) {
+		return false
+	}
+	return len(r.Tags) == 0 || slices.ContainsFunc(r.Tags, func(tag string) bool {
+		return slices.Contains(n.Tags, tag)
+	})
+}
+
+// tagsOf returns the tags of the terminal which the rule watches, either directly or through the sensor attached
+// to it. The rule is regarded to have no tags if they cannot be found.
+func (m *NotificationManager) tagsOf(ctx context.Context, rule *AlertRule) []string {
+	terminalId := int(rule.TerminalId)
+	if rule.SensorId > 0 {
+		sensor, err := m.sensors.FindById(ctx, int(rule.SensorId))
+		if err != nil || sensor.TerminalId == nil {
+			return nil
+		}
+		terminalId = int(*sensor.TerminalId)
+	}
+	terminal, err := m.terminals.GetTerminalByID(ctx, terminalId)
+	if err != nil {
+		return nil
+	}
+	return terminal.Tags
+}
+
+// deliveryOf prepares the delivery of the notification through the channel. The email channels notify the members
+// of the user groups of the routes as well. The delivery is suppressed if the channel exceeds its rate limit.
+func (m *NotificationManager) deliveryOf(
+	ctx context.Context, channelId int, routes []*Route, n *notification) (*Delivery, error) {
+	channel, err := m.repo.FindChannelById(ctx, channelId)
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := m.render(channel, n)
+	if err != nil {
+		return nil, err
+	}
+	if channel.Type == v1.Channel_EMAIL {
+		recipients := slices.Clone(channel.Recipients)
+		for _, r := range routes {
+			if r.UserGroupId == 0 {
+				continue
+			}
+			var emails []string
+			if emails, err = m.repo.FindGroupEmails(ctx, r.UserGroupId); err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, emails...)
+		}
+		slices.Sort(recipients)
+		delivery.Recipients = slices.Compact(recipients)
+	}
+	now := time.Now()
+	delivery.Status, delivery.NextAttemptTime = v1.Delivery_PENDING, timestamppb.New(now)
+	if channel.RateLimit > 0 {
+		window := channel.RateWindow.AsDuration()
+		if window <= 0 {
+			window = defaultRateWindow
+		}
+		var count int
+		if count, err = m.repo.CountSince(ctx, channelId, now.Add(-window)); err != nil {
+			return nil, err
+		}
+		if count >= int(channel.RateLimit) {
+			delivery.Status, delivery.NextAttemptTime = v1.Delivery_SUPPRESSED, nil
+			delivery.LastError = "The rate limit of the channel is exceeded"
+		}
+	}
+	return delivery, nil
+}
+
+// render executes the templates of the channel, or the configured ones if the channel has none
+func (m *NotificationManager) render(channel *Channel, n *notification) (*Delivery, error) {
+	subjectTemplate, bodyTemplate := channel.SubjectTemplate, channel.BodyTemplate
+	if subjectTemplate == "" {
+		subjectTemplate = m.policy.subjectTemplate
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = m.policy.bodyTemplate
+	}
+	subject, err := execute(subjectTemplate, n)
+	if err != nil {
+		return nil, err
+	}
+	body, err := execute(bodyTemplate, n)
+	if err != nil {
+		return nil, err
+	}
+	return &Delivery{
+		AlertId:   n.Alert.Id,
+		ChannelId: channel.Id,
+		Event:     n.Alert.Status,
+		Subject:   strings.TrimSpace(subject),
+		Body:      body,
+	}, nil
+}
+
+func execute(text string, n *notification) (string, error) {
+	t, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Deliver attempts the due deliveries. A delivery failing for a reason which retrying may fix is attempted again
+// after a backoff, which doubles on each attempt, until it runs out of attempts. It should be run periodically.
+func (m *NotificationManager) Deliver(ctx context.Context) error {
+	now := time.Now()
+	due, err := m.repo.FindDue(ctx, now, deliveryBatchSize)
+	if err != nil {
+		return err
+	}
+	channels := make(map[int64]*Channel)
+	for _, d := range due {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// The delivery is left to whoever claims it first, and it is not attempted again until the claim expires
+		var claimed bool
+		if claimed, err = m.repo.Claim(ctx, d, now.Add(2*m.policy.timeout)); err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		d.Attempts++
+		channel, ok := channels[d.ChannelId]
+		if !ok {
+			// The deliveries are deleted along with their channel in the meantime
+			if channel, err = m.repo.FindChannelById(ctx, int(d.ChannelId)); ent.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			channels[d.ChannelId] = channel
+		}
+		if err = m.attempt(ctx, channel, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attempt sends the notification of the delivery and records the outcome
+func (m *NotificationManager) attempt(ctx context.Context, channel *Channel, d *Delivery) error {
+	sendCtx, cancel := context.WithTimeout(ctx, m.policy.timeout)
+	err := m.notifier.Send(sendCtx, channel, d)
+	cancel()
+	now := time.Now()
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.NextAttemptTime, d.SentTime = v1.Delivery_SENT, "", nil, timestamppb.New(now)
+	case errors.Is(err, ErrUndeliverable) || d.Attempts >= m.policy.maxAttempts:
+		d.Status, d.LastError, d.NextAttemptTime = v1.Delivery_FAILED, err.Error(), nil
+		m.log.Warnf("gave up delivery %v after %d attempts: %v", d.Id, d.Attempts, err)
+	default:
+		backoff := m.policy.backoff << min(d.Attempts-1, 16)
+		d.LastError, d.NextAttemptTime = err.Error(), timestamppb.New(now.Add(backoff))
+	}
+	return m.repo.SaveAttempt(ctx, d)
+}
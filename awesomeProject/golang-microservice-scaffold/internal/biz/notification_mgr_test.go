@@ -0,0 +1,117 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	v1 "example/api/alert/v1"
+	"example/internal/conf"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// routingRepo routes all the alerts to a single channel, which has sent the given number of notifications
+type routingRepo struct {
+	NotificationRepository
+	channel    *Channel
+	sent       int
+	since      time.Time
+	deliveries []*Delivery
+}
+
+func (r *routingRepo) FindActiveRoutes(context.Context) ([]*Route, error) {
+	return []*Route{{Id: 1, ChannelId: r.channel.Id}}, nil
+}
+
+func (r *routingRepo) FindChannelById(context.Context, int) (*Channel, error) {
+	return r.channel, nil
+}
+
+func (r *routingRepo) CountSince(_ context.Context, _ int, since time.Time) (int, error) {
+	r.since = since
+	return r.sent, nil
+}
+
+func (r *routingRepo) AddDeliveries(_ context.Context, deliveries []*Delivery) error {
+	r.deliveries = append(r.deliveries, deliveries...)
+	return nil
+}
+
+type noTerminals struct{ TerminalRepository }
+
+func (noTerminals) GetTerminalByID(context.Context, int) (*Terminal, error) {
+	return nil, errors.New("no terminals")
+}
+
+func TestNotificationRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int32
+		window time.Duration
+		sent   int
+		status v1.Delivery_Status
+	}{
+		{name: "unlimited", sent: 1000, status: v1.Delivery_PENDING},
+		{name: "within the limit", limit: 3, sent: 2, status: v1.Delivery_PENDING},
+		{name: "at the limit", limit: 3, sent: 3, status: v1.Delivery_SUPPRESSED},
+		{name: "custom window", limit: 3, window: time.Minute, sent: 5, status: v1.Delivery_SUPPRESSED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			channel := &Channel{Id: 1, Type: v1.Channel_WEBHOOK, Url: "https://example.com", RateLimit: tt.limit}
+			if tt.window > 0 {
+				channel.RateWindow = durationpb.New(tt.window)
+			}
+			repo := &routingRepo{channel: channel, sent: tt.sent}
+			m := NewNotificationManager(&conf.Alert{}, repo, nil, &AlertManager{}, nil, nil, noTerminals{},
+				log.DefaultLogger)
+			before := time.Now()
+			m.onAlert(context.Background(), &Alert{Id: 1, Status: v1.Alert_FIRING}, &AlertRule{Id: 1, Name: "rule"})
+			after := time.Now()
+			if len(repo.deliveries) != 1 {
+				t.Fatalf("got %d deliveries, want 1", len(repo.deliveries))
+			}
+			if d := repo.deliveries[0]; d.Status != tt.status {
+				t.Errorf("got %v, want %v", d.Status, tt.status)
+			}
+			window := tt.window
+			if window == 0 {
+				window = defaultRateWindow
+			}
+			if tt.limit > 0 && (repo.since.Before(before.Add(-window)) || repo.since.After(after.Add(-window))) {
+				t.Errorf("got counted since %v, want %v ago", repo.since, window)
+			}
+		})
+	}
+}
+
+func TestCheckChannelHosts(t *testing.T) {
+	tests := []struct {
+		url      string
+		internal bool
+	}{
+		{url: "https://hooks.example.com/x"},
+		{url: "http://93.184.216.34:8080/"},
+		{url: "http://localhost:8080/", internal: true},
+		{url: "http://127.0.0.1/", internal: true},
+		{url: "http://10.1.2.3/", internal: true},
+		{url: "http://192.168.0.1/", internal: true},
+		{url: "http://169.254.169.254/latest/meta-data", internal: true},
+		{url: "http://100.64.0.1/", internal: true},
+		{url: "http://[::1]/", internal: true},
+		{url: "http://[fe80::1]/", internal: true},
+		{url: "http://[::ffff:127.0.0.1]/", internal: true},
+		{url: "http://0.0.0.0/", internal: true},
+	}
+	for _, tt := range tests {
+		for _, allow := range []bool{false, true} {
+			m := &NotificationManager{policy: notificationPolicy{allowPrivateHosts: allow}}
+			err := m.checkChannel(&Channel{Type: v1.Channel_WEBHOOK, Url: tt.url})
+			if want := tt.internal && !allow; (err != nil) != want {
+				t.Errorf("%s allowing private hosts %v: got error %v, want refused %v", tt.url, allow, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package biz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// This file implements the small subset of the Apache Parquet format the exports need, i.e. flat schemas of the
+// required or optional INT64, DOUBLE and BOOLEAN columns, PLAIN encoded and uncompressed, with a data page per column
+// chunk. The rows are buffered a row group at a time, so the memory is bounded no matter how many rows are written.
+
+// Physical types, converted types and other enumerations of the Parquet format
+const (
+	parquetBoolean         = 0
+	parquetInt64           = 2
+	parquetDouble          = 5
+	parquetRequired        = 0
+	parquetOptional        = 1
+	parquetTimestampMicros = 10
+	parquetPlain           = 0
+	parquetRLE             = 3
+	parquetUncompressed    = 0
+	parquetDataPage        = 0
+	// parquetRowGroupSize is the number of the rows of a row group
+	parquetRowGroupSize = 128 << 10
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn is a column of the schema along with the values of the current row group
+type parquetColumn struct {
+	name string
+	typ  int32
+	// converted is the converted type, negative if absent
+	converted int32
+	// optional columns may be null, which their definition levels tell
+	optional bool
+	values   bytes.Buffer
+	// count is the number of the values of the current row group, i.e. of the rows where the column is not null
+	count int
+	// levels are the definition levels of the current row group in RLE runs, except for the current run of level
+	levels bytes.Buffer
+	level  byte
+	run    uint64
+}
+
+// parquetChunk is the location of a column chunk written to the file
+type parquetChunk struct {
+	offset, size int64
+}
+
+// parquetWriter writes the rows to a Parquet file
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []*parquetColumn
+	rows    int
+	// groupSize is the number of the rows of a row group
+	groupSize int
+	total     int64
+	// groups are the column chunks of the row groups written, which make up the footer
+	groups [][]parquetChunk
+	sizes  []int64
+	counts []int64
+}
+
+// newParquetWriter creates a writer of the columns, whose values are appended row by row
+func newParquetWriter(w io.Writer, columns ...*parquetColumn) *parquetWriter {
+	return &parquetWriter{w: w, columns: columns, groupSize: parquetRowGroupSize}
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// appendInt64 appends a value of an INT64 column of the current row
+func (c *parquetColumn) appendInt64(v int64) {
+	c.define(1)
+	_ = binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+// appendDouble appends a value of a DOUBLE column of the current row
+func (c *parquetColumn) appendDouble(v float64) {
+	c.define(1)
+	_ = binary.Write(&c.values, binary.LittleEndian, math.Float64bits(v))
+}
+
+// appendBoolean appends a value of a BOOLEAN column of the current row. The values are bit-packed from the least
+// significant bit.
+func (c *parquetColumn) appendBoolean(v bool) {
+	if c.count%8 == 0 {
+		c.values.WriteByte(0)
+	}
+	if v {
+		c.values.Bytes()[c.count/8] |= 1 << (c.count % 8)
+	}
+	c.define(1)
+}
+
+// appendNull leaves an optional column of the current row null
+func (c *parquetColumn) appendNull() {
+	c.define(0)
+}
+
+// define counts a value of the current row, or none if the level is zero, and records the definition level if the
+// column is optional
+func (c *parquetColumn) define(level byte) {
+	c.count += int(level)
+	if !c.optional {
+		return
+	}
+	if c.run > 0 && level != c.level {
+		c.endRun()
+	}
+	c.level = level
+	c.run++
+}
+
+// endRun writes the current run of the definition levels, which are a bit wide
+func (c *parquetColumn) endRun() {
+	if c.run == 0 {
+		return
+	}
+	c.levels.Write(binary.AppendUvarint(nil, c.run<<1))
+	c.levels.WriteByte(c.level)
+	c.run = 0
+}
+
+// endRow completes the current row, whose values have been appended to all the columns
+func (p *parquetWriter) endRow() error {
+	p.rows++
+	if p.rows >= p.groupSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// flush writes the current row group
+func (p *parquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+	if p.offset == 0 {
+		if err := p.write(parquetMagic); err != nil {
+			return err
+		}
+	}
+	chunks := make([]parquetChunk, 0, len(p.columns))
+	var size int64
+	for _, c := range p.columns {
+		// The definition levels of an optional column precede its values along with their length
+		var levels []byte
+		if c.optional {
+			c.endRun()
+			levels = binary.LittleEndian.AppendUint32(nil, uint32(c.levels.Len()))
+			levels = append(levels, c.levels.Bytes()...)
+		}
+		n := len(levels) + c.values.Len()
+		var t thriftWriter
+		t.i32(1, parquetDataPage)
+		t.i32(2, int32(n))
+		t.i32(3, int32(n))
+		t.structBegin(5)
+		t.i32(1, int32(p.rows))
+		t.i32(2, parquetPlain)
+		t.i32(3, parquetRLE)
+		t.i32(4, parquetRLE)
+		t.structEnd()
+		t.stop()
+		chunk := parquetChunk{offset: p.offset, size: int64(t.buf.Len() + n)}
+		if err := p.write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(levels); err != nil {
+			return err
+		}
+		if err := p.write(c.values.Bytes()); err != nil {
+			return err
+		}
+		c.values.Reset()
+		c.levels.Reset()
+		c.count = 0
+		chunks = append(chunks, chunk)
+		size += chunk.size
+	}
+	p.groups = append(p.groups, chunks)
+	p.sizes = append(p.sizes, size)
+	p.counts = append(p.counts, int64(p.rows))
+	p.total += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+// close writes the last row group followed by the footer
+func (p *parquetWriter) close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	if p.offset == 0 {
+		if err := p.write(parquetMagic); err != nil {
+			return err
+		}
+	}
+	var t thriftWriter
+	t.i32(1, 1)
+	t.listBegin(2, thriftStruct, len(p.columns)+1)
+	t.elemBegin()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.structEnd()
+	for _, c := range p.columns {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		if c.optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.binary(4, c.name)
+		if c.converted >= 0 {
+			t.i32(6, c.converted)
+		}
+		t.structEnd()
+	}
+	t.i64(3, p.total)
+	t.listBegin(4, thriftStruct, len(p.groups))
+	for i, chunks := range p.groups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(chunks))
+		for j, chunk := range chunks {
+			c := p.columns[j]
+			t.elemBegin()
+			t.i64(2, chunk.offset)
+			t.structBegin(3)
+			t.i32(1, c.typ)
+			t.listBegin(2, thriftI32, 1)
+			t.elemI32(parquetPlain)
+			t.listBegin(3, thriftBinary, 1)
+			t.elemBinary(c.name)
+			t.i32(4, parquetUncompressed)
+			t.i64(5, p.counts[i])
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, p.sizes[i])
+		t.i64(3, p.counts[i])
+		t.structEnd()
+	}
+	t.binary(6, "example-service")
+	t.stop()
+	footer := t.buf.Bytes()
+	if err := p.write(footer); err != nil {
+		return err
+	}
+	if err := binary.Write(p.w, binary.LittleEndian, uint32(len(footer))); err != nil {
+		return err
+	}
+	_, err := p.w.Write(parquetMagic)
+	return err
+}
+
+// Types of the Thrift compact protocol
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the structures of the Parquet metadata in the Thrift compact protocol
+type thriftWriter struct {
+	buf bytes.Buffer
+	// last is the id of the previous field of the current structure, and stack is that of the enclosing ones
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(uint64((id << 1) ^ (id >> 15)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.elemI32(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemBinary(s)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+// elemBegin begins a structure which is an element of a list
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// stop ends the fields of a structure
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elem)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elem)
+	t.varint(uint64(size))
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	t.varint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (t *thriftWriter) elemBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
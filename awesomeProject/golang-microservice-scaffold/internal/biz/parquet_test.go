@@ -0,0 +1,111 @@
+package biz
+
+import (
+	"bytes"
+	"errors"
+	v1 "example/api/sensor/v1"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readParquet reads the file back with a reference reader, and returns the rows of each row group
+func readParquet(t *testing.T, b []byte) (*parquet.File, [][]parquet.Row) {
+	t.Helper()
+	f, err := parquet.OpenFile(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups [][]parquet.Row
+	for _, g := range f.RowGroups() {
+		rows := g.Rows()
+		buf := make([]parquet.Row, g.NumRows()+1)
+		n, err := rows.ReadRows(buf)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		_ = rows.Close()
+		groups = append(groups, buf[:n])
+	}
+	return f, groups
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	yes, no := true, false
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var rows []*exportRow
+	for i, flag := range []*bool{&yes, nil, nil, &no, &yes, nil, &no} {
+		rows = append(rows, &exportRow{
+			SensorId:   int64(i + 1),
+			Timestamp:  start.Add(time.Duration(i) * time.Millisecond),
+			Value:      float64(i) / 2,
+			OutOfRange: flag,
+		})
+	}
+
+	var b bytes.Buffer
+	e := newExportEncoder(v1.ExportSensorValuesRequest_PARQUET, &b, false).(*parquetEncoder)
+	// Small row groups so the rows span several of them, the last one partly filled
+	e.p.groupSize = 3
+	for _, row := range rows {
+		if err := e.encode(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, groups := readParquet(t, b.Bytes())
+	if f.NumRows() != int64(len(rows)) || len(groups) != 3 {
+		t.Fatalf("got %d rows in %d row groups, want %d in 3", f.NumRows(), len(groups), len(rows))
+	}
+	fields := f.Schema().Fields()
+	if len(fields) != 4 || fields[3].Name() != "out_of_range" || !fields[3].Optional() || fields[2].Optional() {
+		t.Fatalf("got schema %v", f.Schema())
+	}
+	i := 0
+	for _, group := range groups {
+		for _, got := range group {
+			want := rows[i]
+			i++
+			if len(got) != 4 {
+				t.Fatalf("row %d: got %d values, want 4", i, len(got))
+			}
+			if got[0].Int64() != want.SensorId || got[1].Int64() != want.Timestamp.UnixMicro() ||
+				got[2].Double() != want.Value {
+				t.Errorf("row %d: got %v, want %+v", i, got, want)
+			}
+			if want.OutOfRange == nil {
+				if !got[3].IsNull() {
+					t.Errorf("row %d: got out_of_range %v, want null", i, got[3])
+				}
+			} else if got[3].IsNull() || got[3].Boolean() != *want.OutOfRange {
+				t.Errorf("row %d: got out_of_range %v, want %v", i, got[3], *want.OutOfRange)
+			}
+		}
+	}
+	if i != len(rows) {
+		t.Errorf("read %d rows, want %d", i, len(rows))
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	for _, downsampled := range []bool{false, true} {
+		var b bytes.Buffer
+		e := newExportEncoder(v1.ExportSensorValuesRequest_PARQUET, &b, downsampled)
+		if err := e.close(); err != nil {
+			t.Fatal(err)
+		}
+		f, groups := readParquet(t, b.Bytes())
+		want := 4
+		if downsampled {
+			want = 3
+		}
+		if f.NumRows() != 0 || len(groups) != 0 || len(f.Schema().Fields()) != want {
+			t.Errorf("got %d rows in %d row groups of schema %v", f.NumRows(), len(groups), f.Schema())
+		}
+	}
+}
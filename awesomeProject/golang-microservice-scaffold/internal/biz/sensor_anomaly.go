@@ -0,0 +1,491 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Defaults and limits of the anomaly detection
+const (
+	defaultAnomalyThreshold = 4
+	defaultAnomalyWindow    = 60
+	maxAnomalyWindow        = 1000
+	defaultAnomalyAlpha     = 0.05
+	defaultSeason           = 24 * time.Hour
+	defaultSeasonSlots      = 96
+	// maxSeasonSlots allows a slot per minute of a week at most, which bounds the size of a model
+	maxSeasonSlots       = 10080
+	defaultSeasonAlpha   = 0.02
+	defaultAnomalyWarmup = 30
+	defaultRetrainWindow = 7 * 24 * time.Hour
+	// maxAnomalyScore caps the score of a reading deviating from a baseline which has never varied
+	maxAnomalyScore = 1e6
+	// defaultAnomalyQueue is the capacity of the queue of the readings to learn if it is not configured
+	defaultAnomalyQueue = 1000
+)
+
+var detectedAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sensor_anomalies_total",
+	Help: "Number of the readings detected as anomalies",
+}, []string{"detector"})
+
+var droppedAnomalyReadings = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "sensor_anomaly_dropped_readings_total",
+	Help: "Number of the readings which are not learned since the queue is full",
+})
+
+// SensorAnomaly is a reading which deviates from the baseline of a detector
+type SensorAnomaly = v1.SensorAnomaly
+
+// AnomalyModel is what the detectors have learned from the readings of a sensor
+type AnomalyModel = v1.AnomalyModel
+
+// AnomalyScore is the highest score of a reading by the detectors, whether it is an anomaly or not
+type AnomalyScore struct {
+	SensorId  int
+	Timestamp time.Time
+	Value     float64
+	Score     float64
+}
+
+// AnomalyQuery finds the anomalies matching all the given conditions from the newest to the oldest. The zero time
+// leaves the time range unbounded on its side.
+type AnomalyQuery struct {
+	SensorIds []int
+	From, To  time.Time
+	MinScore  float64
+	Offset    int
+	Limit     int
+}
+
+// AnomalyRepository stores the models of the sensors and the anomalies detected
+type AnomalyRepository interface {
+	// FindModels finds the models of the sensors. The sensors which have no model are absent from the result.
+	FindModels(ctx context.Context, ids []int) (map[int]*AnomalyModel, error)
+	// SaveModel stores the model of its sensor, replacing the existing one
+	SaveModel(ctx context.Context, model *AnomalyModel) error
+	// DeleteModel deletes the model of the sensor if there is one
+	DeleteModel(ctx context.Context, sensorId int) error
+	AddAnomalies(ctx context.Context, anomalies []*SensorAnomaly) error
+	ListAnomalies(ctx context.Context, query *AnomalyQuery) ([]*SensorAnomaly, int, error)
+}
+
+// ScoreObserver is notified of the scores of the readings once the models have learned them
+type ScoreObserver func(ctx context.Context, scores []*AnomalyScore)
+
+// anomalyParams are the parameters of the detectors
+type anomalyParams struct {
+	disabled      bool
+	threshold     float64
+	window        int
+	alpha         float64
+	season        time.Duration
+	slots         int
+	seasonAlpha   float64
+	warmup        int64
+	retrainWindow time.Duration
+}
+
+func newAnomalyParams(c *conf.Sensor_Anomaly) anomalyParams {
+	p := anomalyParams{
+		disabled:      c.GetDisabled(),
+		threshold:     c.GetThreshold(),
+		window:        int(c.GetWindow()),
+		alpha:         c.GetAlpha(),
+		season:        c.GetSeason().AsDuration(),
+		slots:         int(c.GetSeasonSlots()),
+		seasonAlpha:   c.GetSeasonAlpha(),
+		warmup:        int64(c.GetWarmup()),
+		retrainWindow: c.GetRetrainWindow().AsDuration(),
+	}
+	if p.threshold <= 0 {
+		p.threshold = defaultAnomalyThreshold
+	}
+	if p.window <= 1 {
+		p.window = defaultAnomalyWindow
+	}
+	p.window = min(p.window, maxAnomalyWindow)
+	if p.alpha <= 0 || p.alpha > 1 {
+		p.alpha = defaultAnomalyAlpha
+	}
+	if p.season <= 0 {
+		p.season = defaultSeason
+	}
+	if p.slots <= 0 {
+		p.slots = defaultSeasonSlots
+	}
+	// A slot is no shorter than a second
+	p.slots = min(p.slots, maxSeasonSlots, int(p.season/time.Second))
+	if p.seasonAlpha <= 0 || p.seasonAlpha > 1 {
+		p.seasonAlpha = defaultSeasonAlpha
+	}
+	if p.warmup <= 1 {
+		p.warmup = defaultAnomalyWarmup
+	}
+	if p.retrainWindow <= 0 {
+		p.retrainWindow = defaultRetrainWindow
+	}
+	return p
+}
+
+// fit adapts the model to the parameters, which may have changed since the model was saved. The seasonal baselines
+// start over if the season has changed.
+func (p *anomalyParams) fit(model *AnomalyModel) {
+	if model.Ewma == nil {
+		model.Ewma = &v1.AnomalyModel_Baseline{}
+	}
+	if len(model.Window) > p.window {
+		model.Window = model.Window[len(model.Window)-p.window:]
+	}
+	if s := model.Seasonal; s == nil || s.Period.AsDuration() != p.season || len(s.Slots) != p.slots {
+		slots := make([]*v1.AnomalyModel_Baseline, p.slots)
+		for i := range slots {
+			slots[i] = &v1.AnomalyModel_Baseline{}
+		}
+		model.Seasonal = &v1.AnomalyModel_Seasonal{Period: durationpb.New(p.season), Slots: slots}
+	}
+}
+
+// slotOf returns the slot of the season the time falls in, where the seasons are aligned to the Unix epoch
+func (p *anomalyParams) slotOf(t time.Time) int {
+	offset := t.UnixNano() % int64(p.season)
+	if offset < 0 {
+		offset += int64(p.season)
+	}
+	return min(int(offset/(int64(p.season)/int64(p.slots))), p.slots-1)
+}
+
+// learn scores the reading by the detectors which have learned enough, and then learns it. It returns the anomaly
+// candidate of the detector scoring the reading the highest, which is nil if none of them has learned enough.
+func (p *anomalyParams) learn(model *AnomalyModel, r *SensorReading) *SensorAnomaly {
+	var best *SensorAnomaly
+	score := func(detector v1.SensorAnomaly_Detector, mean, variance float64) {
+		if s := zscore(r.Value, mean, variance); best == nil || s > best.Score {
+			best = &SensorAnomaly{
+				SensorId:  model.SensorId,
+				Timestamp: timestamppb.New(r.Timestamp),
+				Value:     r.Value,
+				Expected:  mean,
+				Score:     s,
+				Detector:  detector,
+			}
+		}
+	}
+	if model.Count >= p.warmup {
+		mean, variance := meanVariance(model.Window)
+		score(v1.SensorAnomaly_ROLLING_ZSCORE, mean, variance)
+		score(v1.SensorAnomaly_EWMA, model.Ewma.Mean, model.Ewma.Variance)
+	}
+	slot := model.Seasonal.Slots[p.slotOf(r.Timestamp)]
+	if slot.Count >= p.warmup {
+		score(v1.SensorAnomaly_SEASONAL, slot.Mean, slot.Variance)
+	}
+	// The reading is learned after it is scored, so that it is compared with what precedes it
+	if len(model.Window) >= p.window {
+		model.Window = append(model.Window[:0], model.Window[len(model.Window)-p.window+1:]...)
+	}
+	model.Window = append(model.Window, r.Value)
+	updateBaseline(model.Ewma, r.Value, p.alpha)
+	updateBaseline(slot, r.Value, p.seasonAlpha)
+	model.Count++
+	model.LastTime = timestamppb.New(r.Timestamp)
+	return best
+}
+
+// updateBaseline moves the exponentially weighted moving average and variance of the baseline by the value
+func updateBaseline(b *v1.AnomalyModel_Baseline, value float64, alpha float64) {
+	if b.Count == 0 {
+		b.Mean, b.Variance = value, 0
+	} else {
+		diff := value - b.Mean
+		increment := alpha * diff
+		b.Mean += increment
+		b.Variance = (1 - alpha) * (b.Variance + diff*increment)
+	}
+	b.Count++
+}
+
+func meanVariance(values []float64) (mean float64, variance float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / float64(len(values))
+}
+
+// zscore is the deviation of the value from the mean in the standard deviations. A baseline which has never varied
+// still tells a deviation apart from the rounding errors, whose score is capped.
+func zscore(value, mean, variance float64) float64 {
+	deviation := math.Abs(value - mean)
+	if deviation == 0 {
+		return 0
+	}
+	std := max(math.Sqrt(variance), 1e-9*max(1, math.Abs(mean)))
+	return min(deviation/std, maxAnomalyScore)
+}
+
+// defaultAnomalyPageSize is the page size of the anomalies if it is not given
+const defaultAnomalyPageSize = 50
+
+// AnomalyManager detects the anomalies of the readings as they are written. The model of each sensor is loaded,
+// advanced and saved along with each batch of the readings, so that it survives the restarts.
+//
+// The written readings are queued without blocking the writer, and learned on the goroutine of
+// [AnomalyManager.Run].
+type AnomalyManager struct {
+	repo      AnomalyRepository
+	sensors   *SensorManager
+	params    anomalyParams
+	observers []ScoreObserver
+	// live provides the threshold, which is reloaded at runtime
+	live *conf.Live
+	log  *log.Helper
+	// queue holds the batches of the written readings to learn
+	queue chan []*SensorReading
+	// mu serializes the learning, the resets and the retraining, which read and write the models
+	mu sync.Mutex
+}
+
+func NewAnomalyManager(
+	c *conf.Sensor, live *conf.Live, repo AnomalyRepository, sensors *SensorManager,
+	logger log.Logger) *AnomalyManager {
+	queueSize := int(c.GetAnomaly().GetQueueSize())
+	if queueSize <= 0 {
+		queueSize = defaultAnomalyQueue
+	}
+	m := &AnomalyManager{
+		repo:    repo,
+		sensors: sensors,
+		params:  newAnomalyParams(c.GetAnomaly()),
+		live:    live,
+		log:     log.NewHelper(log.With(logger, "module", "biz/anomaly")),
+		queue:   make(chan []*SensorReading, queueSize),
+	}
+	if !m.params.disabled {
+		sensors.ObserveReadings(m.onReadings)
+	}
+	return m
+}
+
+// ObserveScores registers the observer of the scores. It must be called before the readings are written, i.e.
+// while the application is being initialized.
+func (m *AnomalyManager) ObserveScores(o ScoreObserver) {
+	m.observers = append(m.observers, o)
+}
+
+// DefaultThreshold is the score at or above which a reading is an anomaly. It follows sensor.anomaly.threshold as
+// it is reloaded.
+func (m *AnomalyManager) DefaultThreshold() float64 {
+	if threshold := m.live.Get().GetSensor().GetAnomaly().GetThreshold(); threshold > 0 {
+		return threshold
+	}
+	return m.params.threshold
+}
+
+// Run learns the queued readings until the context is done. The readings queued by then are learned before it
+// returns.
+func (m *AnomalyManager) Run(ctx context.Context) error {
+	// The learning in progress is never aborted, otherwise the models would miss the readings
+	learnCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case readings := <-m.queue:
+			m.learnAll(learnCtx, readings)
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(learnCtx, drainTimeout)
+			defer cancel()
+			for {
+				select {
+				case readings := <-m.queue:
+					m.learnAll(drainCtx, readings)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// onReadings queues the written readings to learn, which are dropped if the queue is full
+func (m *AnomalyManager) onReadings(_ context.Context, readings []*SensorReading) {
+	select {
+	case m.queue <- readings:
+	default:
+		droppedAnomalyReadings.Add(float64(len(readings)))
+	}
+}
+
+// learnAll advances the models of the sensors by their readings in the order of time. The readings older than the
+// latest one learned are ignored, e.g. those recorded again.
+func (m *AnomalyManager) learnAll(ctx context.Context, readings []*SensorReading) {
+	bySensor := make(map[int][]*SensorReading)
+	for _, r := range readings {
+		bySensor[r.SensorId] = append(bySensor[r.SensorId], r)
+	}
+	ids := make([]int, 0, len(bySensor))
+	for id, rs := range bySensor {
+		ids = append(ids, id)
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Timestamp.Before(rs[j].Timestamp) })
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	models, err := m.repo.FindModels(ctx, ids)
+	if err != nil {
+		m.log.Errorf("failed to find the anomaly models of %d sensors: %v", len(ids), err)
+		return
+	}
+	var scores []*AnomalyScore
+	var anomalies []*SensorAnomaly
+	threshold := m.DefaultThreshold()
+	for _, id := range ids {
+		model, ok := models[id]
+		if !ok {
+			model = &AnomalyModel{SensorId: int64(id)}
+		}
+		m.params.fit(model)
+		learned := false
+		for _, r := range bySensor[id] {
+			if model.LastTime != nil && !r.Timestamp.After(model.LastTime.AsTime()) {
+				continue
+			}
+			learned = true
+			candidate := m.params.learn(model, r)
+			if candidate == nil {
+				continue
+			}
+			scores = append(scores, &AnomalyScore{
+				SensorId:  id,
+				Timestamp: r.Timestamp,
+				Value:     r.Value,
+				Score:     candidate.Score,
+			})
+			if candidate.Score >= threshold {
+				anomalies = append(anomalies, candidate)
+			}
+		}
+		if !learned {
+			continue
+		}
+		if err = m.repo.SaveModel(ctx, model); err != nil {
+			m.log.Errorf("failed to save the anomaly model of sensor %v: %v", id, err)
+		}
+	}
+	if len(anomalies) > 0 {
+		if err = m.repo.AddAnomalies(ctx, anomalies); err != nil {
+			m.log.Errorf("failed to add %d anomalies: %v", len(anomalies), err)
+		}
+		for _, a := range anomalies {
+			detectedAnomalies.WithLabelValues(a.Detector.String()).Inc()
+		}
+	}
+	if len(scores) > 0 {
+		for _, o := range m.observers {
+			o(ctx, scores)
+		}
+	}
+}
+
+func (m *AnomalyManager) ListAnomalies(ctx context.Context, query *AnomalyQuery) ([]*SensorAnomaly, int, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultAnomalyPageSize
+	}
+	return m.repo.ListAnomalies(ctx, query)
+}
+
+// GetModel returns the model of the sensor, which is empty if the sensor has learned nothing
+func (m *AnomalyManager) GetModel(ctx context.Context, sensorId int) (*AnomalyModel, error) {
+	if _, err := m.sensors.GetById(ctx, sensorId); err != nil {
+		return nil, err
+	}
+	models, err := m.repo.FindModels(ctx, []int{sensorId})
+	if err != nil {
+		return nil, err
+	}
+	if model, ok := models[sensorId]; ok {
+		return model, nil
+	}
+	return &AnomalyModel{SensorId: int64(sensorId)}, nil
+}
+
+// ResetModel forgets what the model of the sensor has learned
+func (m *AnomalyManager) ResetModel(ctx context.Context, sensorId int) error {
+	if _, err := m.sensors.GetById(ctx, sensorId); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.repo.DeleteModel(ctx, sensorId)
+}
+
+// RetrainModel replaces the model of the sensor by one learning the stored readings within the time range
+// [from, to), which defaults to the retrain window until now. No anomaly is recorded for the readings replayed.
+//
+// The readings are replayed without holding up the learning of the new ones. The readings the current model has
+// learned meanwhile beyond the time range are then replayed as well while the learning waits, so that the model
+// replaced has learned nothing the new one misses.
+func (m *AnomalyManager) RetrainModel(ctx context.Context, sensorId int, from, to time.Time) (*AnomalyModel, error) {
+	if _, err := m.sensors.GetById(ctx, sensorId); err != nil {
+		return nil, err
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-m.params.retrainWindow)
+	}
+	if !from.Before(to) {
+		return nil, v1.ErrorMalformedInput("The start time %v is not before the end time %v", from, to)
+	}
+	model := &AnomalyModel{SensorId: int64(sensorId)}
+	m.params.fit(model)
+	if err := m.replay(ctx, model, from, to); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	models, err := m.repo.FindModels(ctx, []int{sensorId})
+	if err != nil {
+		return nil, err
+	}
+	if current, ok := models[sensorId]; ok && current.LastTime != nil && !current.LastTime.AsTime().Before(to) {
+		if err = m.replay(ctx, model, to, current.LastTime.AsTime().Add(time.Microsecond)); err != nil {
+			return nil, err
+		}
+	}
+	if err = m.repo.SaveModel(ctx, model); err != nil {
+		return nil, err
+	}
+	m.log.Infof("retrained the anomaly model of sensor %v with %d readings", sensorId, model.Count)
+	return model, nil
+}
+
+// replay learns the stored readings of the sensor of the model within the time range [from, to)
+func (m *AnomalyManager) replay(ctx context.Context, model *AnomalyModel, from, to time.Time) error {
+	for {
+		page, err := m.sensors.repo.FindValues(ctx, int(model.SensorId), from, to, scanPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			m.params.learn(model, r)
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		from = page[len(page)-1].Timestamp.Add(time.Microsecond)
+	}
+}
@@ -0,0 +1,170 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestZscore(t *testing.T) {
+	tests := []struct {
+		name                  string
+		value, mean, variance float64
+		want                  float64
+	}{
+		{name: "at the mean", value: 5, mean: 5, variance: 4, want: 0},
+		{name: "above", value: 9, mean: 5, variance: 4, want: 2},
+		{name: "below", value: 1, mean: 5, variance: 4, want: 2},
+		{name: "never varied", value: 5, mean: 5, variance: 0, want: 0},
+		// The deviation from a baseline which has never varied is measured against the rounding errors
+		{name: "deviation from a constant", value: 5.5, mean: 5, variance: 0, want: maxAnomalyScore},
+		{name: "rounding error", value: 1e9 + 1e-6, mean: 1e9, variance: 0, want: 1e-6 / (1e-9 * 1e9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := zscore(tt.value, tt.mean, tt.variance); math.Abs(got-tt.want) > 1e-6*max(1, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateBaseline(t *testing.T) {
+	b := &v1.AnomalyModel_Baseline{}
+	// The first value starts the baseline
+	updateBaseline(b, 10, 0.5)
+	if b.Mean != 10 || b.Variance != 0 || b.Count != 1 {
+		t.Fatalf("got %+v after the first value", b)
+	}
+	updateBaseline(b, 14, 0.5)
+	// The mean moves halfway, and the variance is (1 - alpha) * (0 + diff * alpha * diff)
+	if b.Mean != 12 || b.Variance != 4 || b.Count != 2 {
+		t.Fatalf("got %+v after the second value", b)
+	}
+	// A constant series converges to its value with no variance
+	for i := 0; i < 200; i++ {
+		updateBaseline(b, 20, 0.1)
+	}
+	if math.Abs(b.Mean-20) > 1e-6 || b.Variance > 1e-6 {
+		t.Errorf("got %+v after a constant series", b)
+	}
+}
+
+func TestSlotOf(t *testing.T) {
+	p := newAnomalyParams(&conf.Sensor_Anomaly{Season: durationpb.New(24 * time.Hour), SeasonSlots: 96})
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at   time.Time
+		want int
+	}{
+		{at: day, want: 0},
+		{at: day.Add(14*time.Minute + 59*time.Second), want: 0},
+		{at: day.Add(15 * time.Minute), want: 1},
+		{at: day.Add(23*time.Hour + 59*time.Minute), want: 95},
+		{at: day.Add(24 * time.Hour), want: 0},
+		// The seasons are aligned to the epoch rather than the time zone, and extend before it
+		{at: day.In(time.FixedZone("", 3600)).Add(time.Hour), want: 4},
+		{at: time.Unix(-1, 0), want: 95},
+	}
+	for _, tt := range tests {
+		if got := p.slotOf(tt.at); got != tt.want {
+			t.Errorf("got slot %d of %v, want %d", got, tt.at, tt.want)
+		}
+	}
+	// The slots which do not divide the season evenly leave the remainder in the last slot
+	p = newAnomalyParams(&conf.Sensor_Anomaly{Season: durationpb.New(10 * time.Second), SeasonSlots: 3})
+	if got := p.slotOf(time.Unix(9, 999)); got != 2 {
+		t.Errorf("got slot %d of the remainder, want 2", got)
+	}
+}
+
+// modelRepo keeps the models in memory
+type modelRepo struct {
+	AnomalyRepository
+	models map[int]*AnomalyModel
+}
+
+func (r *modelRepo) FindModels(_ context.Context, ids []int) (map[int]*AnomalyModel, error) {
+	found := make(map[int]*AnomalyModel)
+	for _, id := range ids {
+		if model, ok := r.models[id]; ok {
+			found[id] = proto.Clone(model).(*AnomalyModel)
+		}
+	}
+	return found, nil
+}
+
+func (r *modelRepo) SaveModel(_ context.Context, model *AnomalyModel) error {
+	r.models[int(model.SensorId)] = proto.Clone(model).(*AnomalyModel)
+	return nil
+}
+
+// anomalySensors is a single sensor whose readings are kept in memory
+type anomalySensors struct {
+	*retentionRepo
+}
+
+func (anomalySensors) FindById(_ context.Context, id int) (*Sensor, error) {
+	return &Sensor{Id: int64(id)}, nil
+}
+
+func TestRetrainModelKeepsLearning(t *testing.T) {
+	sensors := anomalySensors{newRetentionRepo()}
+	repo := &modelRepo{models: map[int]*AnomalyModel{}}
+	sm := NewSensorManager(&conf.Sensor{}, sensors, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	m := NewAnomalyManager(&conf.Sensor{}, conf.NewLive(&conf.Bootstrap{}), repo, sm, log.DefaultLogger)
+	ctx := context.Background()
+	to := time.Now().Truncate(time.Second)
+	var old, recent []*SensorReading
+	for i := 0; i < 10; i++ {
+		at := time.Duration(i) * time.Second
+		old = append(old, &SensorReading{SensorId: 1, Value: float64(i), Timestamp: to.Add(at - 10*time.Second)})
+		recent = append(recent, &SensorReading{SensorId: 1, Value: float64(i), Timestamp: to.Add(at)})
+	}
+	_, _ = sensors.AddValues(ctx, old)
+	// The readings written while the old ones are replayed are learned by the current model
+	_, _ = sensors.AddValues(ctx, recent)
+	m.learnAll(ctx, recent)
+
+	model, err := m.RetrainModel(ctx, 1, to.Add(-time.Minute), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Count != 20 || !model.LastTime.AsTime().Equal(recent[len(recent)-1].Timestamp) {
+		t.Errorf("got %d readings learned until %v, want 20 until %v", model.Count, model.LastTime.AsTime(),
+			recent[len(recent)-1].Timestamp)
+	}
+	if saved := repo.models[1]; saved.Count != 20 {
+		t.Errorf("got %d readings learned by the saved model, want 20", saved.Count)
+	}
+}
+
+func TestAnomalyQueue(t *testing.T) {
+	repo := &modelRepo{models: map[int]*AnomalyModel{}}
+	sm := NewSensorManager(&conf.Sensor{}, nil, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	c := &conf.Sensor{Anomaly: &conf.Sensor_Anomaly{QueueSize: 1}}
+	m := NewAnomalyManager(c, conf.NewLive(&conf.Bootstrap{}), repo, sm, log.DefaultLogger)
+	// The writer is not held up by the learning, and the batches beyond the queue are dropped
+	now := time.Now()
+	batch := func(i int) []*SensorReading {
+		return []*SensorReading{{SensorId: 1, Value: 1, Timestamp: now.Add(time.Duration(i) * time.Second)}}
+	}
+	m.onReadings(context.Background(), batch(0))
+	m.onReadings(context.Background(), batch(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The batches queued by the time it stops are learned
+	if err := m.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if model := repo.models[1]; model == nil || model.Count != 1 {
+		t.Errorf("got model %+v, want a reading learned", model)
+	}
+}
@@ -0,0 +1,362 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"example/internal/ent"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Calibration is a profile converting the raw values of a sensor into the calibrated ones from a point in time
+type Calibration = v1.Calibration
+
+// CalibrationRecompute is a background job calibrating the stored readings of a sensor again
+type CalibrationRecompute = v1.CalibrationRecompute
+
+// CalibrationRepository stores the calibration profiles and the recompute jobs. The jobs are claimed by the workers
+// in the same way as the exports of [SensorExportRepository].
+type CalibrationRepository interface {
+	// Add stores the profile. A profile in effect from the same time as another one of the sensor violates the
+	// unique constraint.
+	Add(ctx context.Context, c *Calibration) (*Calibration, error)
+	FindById(ctx context.Context, id int) (*Calibration, error)
+	// FindBySensors finds the profiles of the sensors in the order of their effective times. The sensors without any
+	// profile are absent from the result.
+	FindBySensors(ctx context.Context, ids []int) (map[int][]*Calibration, error)
+	// Update replaces the effective time, the coefficients and the description of the profile
+	Update(ctx context.Context, c *Calibration) (*Calibration, error)
+	Delete(ctx context.Context, id int) error
+	AddRecompute(ctx context.Context, r *CalibrationRecompute) (*CalibrationRecompute, error)
+	FindRecomputeById(ctx context.Context, id int) (*CalibrationRecompute, error)
+	// ClaimNextRecompute marks the earliest pending recompute, or a running one which has not reported any progress
+	// since the time, as running, and returns it along with the attempts of the claim. It returns nil if there is
+	// none.
+	ClaimNextRecompute(ctx context.Context, stalledBefore time.Time) (*CalibrationRecompute, int32, error)
+	// ProgressRecompute records the number of the readings calibrated so far, and reports whether the claim still
+	// holds
+	ProgressRecompute(ctx context.Context, id int, attempts int32, rows int64) (bool, error)
+	// FinishRecompute records the result of the recompute, i.e. its status, rows, error and finish time, and reports
+	// whether the claim still held
+	FinishRecompute(ctx context.Context, id int, attempts int32, result *CalibrationRecompute) (bool, error)
+}
+
+// Defaults of the recompute jobs
+const (
+	defaultRecomputeStallTimeout = 5 * time.Minute
+	// maxRecomputeError limits the length of the error recorded for a failed recompute
+	maxRecomputeError = 1024
+)
+
+// errRecomputeTakenOver aborts a job which has been claimed by another worker
+var errRecomputeTakenOver = errors.New("the recompute has been taken over by another worker")
+
+// calibrate converts the raw value by the profile
+func calibrate(c *Calibration, raw float64) float64 {
+	switch p := c.Profile.(type) {
+	case *v1.Calibration_Offset_:
+		return raw + p.Offset.Offset
+	case *v1.Calibration_Linear_:
+		return raw*p.Linear.Scale + p.Linear.Offset
+	case *v1.Calibration_Polynomial_:
+		// Horner's method from the highest term down
+		coefficients := p.Polynomial.Coefficients
+		value := 0.0
+		for i := len(coefficients) - 1; i >= 0; i-- {
+			value = value*raw + coefficients[i]
+		}
+		return value
+	case *v1.Calibration_LookupTable_:
+		points := p.LookupTable.Points
+		// The segment containing the raw value, or the first or the last one beyond the table
+		i := sort.Search(len(points), func(i int) bool { return points[i].Raw > raw })
+		i = min(max(i, 1), len(points)-1)
+		lo, hi := points[i-1], points[i]
+		return lo.Calibrated + (raw-lo.Raw)*(hi.Calibrated-lo.Calibrated)/(hi.Raw-lo.Raw)
+	}
+	return raw
+}
+
+// calibrationAt finds the profile in effect at the time among the ones in the order of their effective times, which
+// is nil if none of them is
+func calibrationAt(cs []*Calibration, t time.Time) *Calibration {
+	i := sort.Search(len(cs), func(i int) bool { return cs[i].EffectiveFrom.AsTime().After(t) })
+	if i == 0 {
+		return nil
+	}
+	return cs[i-1]
+}
+
+// calibrateReading calibrates the raw value of the reading by the profile in effect at its timestamp, and keeps the
+// raw value along with the calibrated one. A reading which has been calibrated before is calibrated from its raw
+// value again.
+func calibrateReading(cs []*Calibration, r *SensorReading) {
+	raw := r.Value
+	if r.Raw != nil {
+		raw = *r.Raw
+	}
+	if c := calibrationAt(cs, r.Timestamp); c != nil {
+		r.Value, r.Raw = calibrate(c, raw), &raw
+	} else {
+		r.Value, r.Raw = raw, nil
+	}
+}
+
+// checkCalibration checks what the validation rules of the profile cannot express
+func checkCalibration(c *Calibration) error {
+	finite := func(values ...float64) bool {
+		for _, v := range values {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return false
+			}
+		}
+		return true
+	}
+	switch p := c.Profile.(type) {
+	case *v1.Calibration_Offset_:
+		if !finite(p.Offset.Offset) {
+			return v1.ErrorMalformedInput("The offset must be finite")
+		}
+	case *v1.Calibration_Linear_:
+		if !finite(p.Linear.Scale, p.Linear.Offset) {
+			return v1.ErrorMalformedInput("The scale and the offset must be finite")
+		}
+	case *v1.Calibration_Polynomial_:
+		if !finite(p.Polynomial.Coefficients...) {
+			return v1.ErrorMalformedInput("The coefficients must be finite")
+		}
+	case *v1.Calibration_LookupTable_:
+		for i, point := range p.LookupTable.Points {
+			if !finite(point.Raw, point.Calibrated) {
+				return v1.ErrorMalformedInput("The points of the lookup table must be finite")
+			}
+			if i > 0 && point.Raw <= p.LookupTable.Points[i-1].Raw {
+				return v1.ErrorMalformedInput("The raw values of the lookup table must be strictly ascending")
+			}
+		}
+	}
+	// The timestamps are stored in microseconds, by which the readings are told apart as well
+	c.EffectiveFrom = timestamppb.New(c.EffectiveFrom.AsTime().Truncate(time.Microsecond))
+	return nil
+}
+
+// recalibrate calibrates the stored readings of the sensor within the time range again by the profiles in effect,
+// and then rebuilds the rollups of the range from them. The readings are rounded and flagged by the type of the
+// sensor as on ingestion, but never rejected. It reports the number of the readings calibrated after each batch, and
+// returns it along with the number of the rollups which are left as they are since some of their data has expired.
+func (m *SensorManager) recalibrate(
+	ctx context.Context, id int, from, to time.Time, progress func(rows int64) error,
+) (rows, stale int64, err error) {
+	types, err := m.typesOf(ctx, []int{id})
+	if err != nil {
+		return 0, 0, err
+	}
+	calibrations, err := m.calibrations.FindBySensors(ctx, []int{id})
+	if err != nil {
+		return 0, 0, err
+	}
+	for cursor := from; cursor.Before(to); {
+		page, err := m.repo.FindValues(ctx, id, cursor, to, m.retention.batchSize)
+		if err != nil {
+			return rows, 0, err
+		}
+		for _, r := range page {
+			calibrateReading(calibrations[id], r)
+			if t, ok := types[id]; ok {
+				flagReading(t, r)
+			}
+		}
+		if err = m.repo.UpdateValues(ctx, page); err != nil {
+			return rows, 0, err
+		}
+		rows += int64(len(page))
+		if err = progress(rows); err != nil {
+			return rows, 0, err
+		}
+		if len(page) < m.retention.batchSize {
+			break
+		}
+		cursor = page[len(page)-1].Timestamp.Add(time.Microsecond)
+	}
+	// The hourly rollups are rebuilt from the 1-minute ones, which are rebuilt first
+	for _, resolution := range []v1.Resolution{v1.Resolution_MINUTE, v1.Resolution_HOUR} {
+		n, err := m.rebuildRollups(ctx, id, resolution, from, to)
+		if stale += n; err != nil {
+			return rows, stale, err
+		}
+	}
+	// The cached latest reading is replaced in case it has been calibrated again
+	latest, err := m.repo.FindLatestValues(ctx, []int{id})
+	if err != nil {
+		return rows, stale, err
+	}
+	if r, ok := latest[id]; ok {
+		m.cacheLatest(ctx, []*SensorReading{r})
+	}
+	return rows, stale, nil
+}
+
+// CalibrationManager maintains the calibration profiles of the sensors, and runs the recompute jobs applying the
+// corrected profiles to the stored readings
+type CalibrationManager struct {
+	repo         CalibrationRepository
+	sensors      *SensorManager
+	stallTimeout time.Duration
+	log          *log.Helper
+}
+
+func NewCalibrationManager(
+	c *conf.Sensor, repo CalibrationRepository, sensors *SensorManager, logger log.Logger) *CalibrationManager {
+	m := &CalibrationManager{
+		repo:         repo,
+		sensors:      sensors,
+		stallTimeout: c.GetCalibration().GetStallTimeout().AsDuration(),
+		log:          log.NewHelper(log.With(logger, "module", "biz/sensor-calibration")),
+	}
+	if m.stallTimeout <= 0 {
+		m.stallTimeout = defaultRecomputeStallTimeout
+	}
+	return m
+}
+
+// CreateCalibration adds the profile to its sensor, which takes effect on the readings written from then on
+func (m *CalibrationManager) CreateCalibration(ctx context.Context, c *Calibration) (*Calibration, error) {
+	if err := checkCalibration(c); err != nil {
+		return nil, err
+	}
+	if _, err := m.sensors.GetById(ctx, int(c.SensorId)); err != nil {
+		return nil, err
+	}
+	created, err := m.repo.Add(ctx, c)
+	if ent.IsConstraintError(err) {
+		return nil, v1.ErrorCalibrationAlreadyExists(
+			"Sensor %v has another calibration profile in effect from %v", c.SensorId, c.EffectiveFrom.AsTime())
+	}
+	return created, err
+}
+
+// ListCalibrations lists the profiles of the sensor in the order of their effective times
+func (m *CalibrationManager) ListCalibrations(ctx context.Context, sensorId int) ([]*Calibration, error) {
+	if _, err := m.sensors.GetById(ctx, sensorId); err != nil {
+		return nil, err
+	}
+	calibrations, err := m.repo.FindBySensors(ctx, []int{sensorId})
+	if err != nil {
+		return nil, err
+	}
+	return calibrations[sensorId], nil
+}
+
+func (m *CalibrationManager) GetCalibration(ctx context.Context, id int) (c *Calibration, err error) {
+	if c, err = m.repo.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorCalibrationNotFound("There is no such calibration id %v", id)
+	}
+	return
+}
+
+// UpdateCalibration corrects the profile, which takes effect on the readings written from then on
+func (m *CalibrationManager) UpdateCalibration(ctx context.Context, c *Calibration) (*Calibration, error) {
+	if err := checkCalibration(c); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.Update(ctx, c)
+	switch {
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorCalibrationNotFound("There is no such calibration id %v", c.Id)
+	case ent.IsConstraintError(err):
+		return nil, v1.ErrorCalibrationAlreadyExists(
+			"The sensor has another calibration profile in effect from %v", c.EffectiveFrom.AsTime())
+	}
+	return updated, err
+}
+
+func (m *CalibrationManager) DeleteCalibration(ctx context.Context, id int) error {
+	err := m.repo.Delete(ctx, id)
+	if ent.IsNotFound(err) {
+		return v1.ErrorCalibrationNotFound("There is no such calibration id %v", id)
+	}
+	return err
+}
+
+// Recompute queues a recompute job, which calibrates the stored readings of the sensor within the time range again
+// in the background
+func (m *CalibrationManager) Recompute(
+	ctx context.Context, sensorId int, from, to time.Time) (*CalibrationRecompute, error) {
+	if !from.Before(to) {
+		return nil, v1.ErrorMalformedInput("The end time must be after the start time")
+	}
+	if _, err := m.sensors.GetById(ctx, sensorId); err != nil {
+		return nil, err
+	}
+	return m.repo.AddRecompute(ctx, &CalibrationRecompute{
+		SensorId:  int64(sensorId),
+		StartTime: timestamppb.New(from),
+		EndTime:   timestamppb.New(to),
+	})
+}
+
+func (m *CalibrationManager) GetRecompute(ctx context.Context, id int) (r *CalibrationRecompute, err error) {
+	if r, err = m.repo.FindRecomputeById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorRecomputeNotFound("There is no such recompute id %v", id)
+	}
+	return
+}
+
+// Run runs the pending recomputes one after another until none is left
+func (m *CalibrationManager) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		recompute, attempts, err := m.repo.ClaimNextRecompute(ctx, time.Now().Add(-m.stallTimeout))
+		if err != nil {
+			return err
+		}
+		if recompute == nil {
+			return nil
+		}
+		if err = m.run(ctx, recompute, attempts); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// run calibrates the readings of the recompute again and records the result
+func (m *CalibrationManager) run(ctx context.Context, recompute *CalibrationRecompute, attempts int32) error {
+	id := int(recompute.Id)
+	rows, stale, err := m.sensors.recalibrate(ctx, int(recompute.SensorId), recompute.StartTime.AsTime(),
+		recompute.EndTime.AsTime(), func(rows int64) error {
+			held, err := m.repo.ProgressRecompute(ctx, id, attempts, rows)
+			if err == nil && !held {
+				err = errRecomputeTakenOver
+			}
+			return err
+		})
+	if errors.Is(err, errRecomputeTakenOver) {
+		m.log.Warnf("recompute %v has been taken over by another worker", id)
+		return nil
+	}
+	if ctx.Err() != nil {
+		// The recompute is left running, and taken over once it stalls
+		return ctx.Err()
+	}
+	result := &CalibrationRecompute{
+		Status:       v1.CalibrationRecompute_SUCCEEDED,
+		Rows:         rows,
+		StaleBuckets: stale,
+		FinishTime:   timestamppb.Now(),
+	}
+	if err != nil {
+		m.log.Errorf("recompute %v failed: %v", id, err)
+		result.Status = v1.CalibrationRecompute_FAILED
+		if result.Error = err.Error(); len(result.Error) > maxRecomputeError {
+			result.Error = result.Error[:maxRecomputeError]
+		}
+	}
+	_, err = m.repo.FinishRecompute(ctx, id, attempts, result)
+	return err
+}
@@ -0,0 +1,111 @@
+package biz
+
+import (
+	v1 "example/api/sensor/v1"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCalibrate(t *testing.T) {
+	polynomial := func(coefficients ...float64) *Calibration {
+		return &Calibration{Profile: &v1.Calibration_Polynomial_{
+			Polynomial: &v1.Calibration_Polynomial{Coefficients: coefficients}}}
+	}
+	// The table is linear with the slope 2 below 10 and 1 above it
+	table := &Calibration{Profile: &v1.Calibration_LookupTable_{LookupTable: &v1.Calibration_LookupTable{
+		Points: []*v1.Calibration_LookupTable_Point{
+			{Raw: 0, Calibrated: 0},
+			{Raw: 10, Calibrated: 20},
+			{Raw: 20, Calibrated: 30},
+		},
+	}}}
+	tests := []struct {
+		name string
+		c    *Calibration
+		raw  float64
+		want float64
+	}{
+		{name: "offset", c: &Calibration{Profile: &v1.Calibration_Offset_{
+			Offset: &v1.Calibration_Offset{Offset: -1.5}}}, raw: 10, want: 8.5},
+		{name: "linear", c: &Calibration{Profile: &v1.Calibration_Linear_{
+			Linear: &v1.Calibration_Linear{Scale: 2, Offset: 1}}}, raw: 3, want: 7},
+		{name: "constant polynomial", c: polynomial(4), raw: 100, want: 4},
+		// 1 + 2x + 3x^2
+		{name: "quadratic", c: polynomial(1, 2, 3), raw: 2, want: 17},
+		{name: "quadratic of negative", c: polynomial(1, 2, 3), raw: -1, want: 2},
+		// 0.5x^3 - x
+		{name: "cubic", c: polynomial(0, -1, 0, 0.5), raw: 2, want: 2},
+		{name: "first point", c: table, raw: 0, want: 0},
+		{name: "within first segment", c: table, raw: 5, want: 10},
+		{name: "inner point", c: table, raw: 10, want: 20},
+		{name: "within last segment", c: table, raw: 15, want: 25},
+		{name: "last point", c: table, raw: 20, want: 30},
+		{name: "below table", c: table, raw: -5, want: -10},
+		{name: "above table", c: table, raw: 30, want: 40},
+		{name: "no profile", c: &Calibration{}, raw: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calibrate(tt.c, tt.raw); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrationAt(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs := []*Calibration{
+		{Id: 1, EffectiveFrom: timestamppb.New(from)},
+		{Id: 2, EffectiveFrom: timestamppb.New(from.Add(time.Hour))},
+		{Id: 3, EffectiveFrom: timestamppb.New(from.Add(2 * time.Hour))},
+	}
+	tests := []struct {
+		name string
+		cs   []*Calibration
+		t    time.Time
+		want int64
+	}{
+		{name: "no profile", t: from},
+		{name: "before first", cs: cs, t: from.Add(-time.Microsecond)},
+		{name: "on first", cs: cs, t: from, want: 1},
+		{name: "within first", cs: cs, t: from.Add(30 * time.Minute), want: 1},
+		{name: "just before second", cs: cs, t: from.Add(time.Hour - time.Microsecond), want: 1},
+		{name: "on second", cs: cs, t: from.Add(time.Hour), want: 2},
+		{name: "on last", cs: cs, t: from.Add(2 * time.Hour), want: 3},
+		{name: "after last", cs: cs, t: from.Add(48 * time.Hour), want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := calibrationAt(tt.cs, tt.t)
+			if got := c.GetId(); got != tt.want || (c == nil) != (tt.want == 0) {
+				t.Errorf("got profile %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalibrateReading(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs := []*Calibration{{EffectiveFrom: timestamppb.New(from), Profile: &v1.Calibration_Offset_{
+		Offset: &v1.Calibration_Offset{Offset: 1}}}}
+	r := &SensorReading{Value: 10, Timestamp: from}
+	calibrateReading(cs, r)
+	if r.Value != 11 || r.Raw == nil || *r.Raw != 10 {
+		t.Fatalf("got value %v and raw %v, want 11 and 10", r.Value, r.Raw)
+	}
+	// A calibrated reading is calibrated from its raw value again
+	calibrateReading(cs, r)
+	if r.Value != 11 || *r.Raw != 10 {
+		t.Fatalf("got value %v and raw %v after calibrating again, want 11 and 10", r.Value, *r.Raw)
+	}
+	// A reading before any profile gets its raw value back
+	r.Timestamp = from.Add(-time.Second)
+	calibrateReading(cs, r)
+	if r.Value != 10 || r.Raw != nil {
+		t.Errorf("got value %v and raw %v before the profile, want 10 without raw", r.Value, r.Raw)
+	}
+}
@@ -0,0 +1,253 @@
+package biz
+
+import (
+	"context"
+	"example/internal/conf"
+	"example/internal/ent"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults and limits of the collection of the samples from the agents
+const (
+	defaultCollectBodySize = 16 << 20
+	// collectBatch bounds the readings of a single submission, the same as a request of the API
+	collectBatch = 10000
+	// maxSensorIdentity bounds the length of the type and identifier of a sensor, i.e. the size of the columns
+	maxSensorIdentity = 255
+	// maxIdentityCache bounds the identities of the series kept in memory, beyond which the cache starts over
+	maxIdentityCache = 100000
+)
+
+var collectDroppedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sensor_collect_dropped_samples_total",
+	Help: "Number of the samples pushed by the agents which are dropped",
+}, []string{"reason"})
+
+// SensorSample is a sample of a series pushed by an agent, e.g. a field of a line of the InfluxDB line protocol or
+// a sample of a Prometheus time series
+type SensorSample struct {
+	// Name is the name of the series, i.e. the measurement followed by the field, or the name of the metric
+	Name string
+	Tags map[string]string
+	// Value is NaN or infinite if the agent says so, in which case the sample is dropped
+	Value float64
+	// Timestamp is zero if the agent did not give one
+	Timestamp time.Time
+}
+
+// sensorIdentity identifies a sensor by its type and identifier
+type sensorIdentity struct {
+	sensorType string
+	identifier string
+}
+
+// sensorCollect maps the series pushed by the agents to the sensors, and remembers the mapping
+type sensorCollect struct {
+	autoCreate     bool
+	identifierTags []string
+	maxBodySize    int64
+	mu             sync.Mutex
+	ids            map[sensorIdentity]int
+}
+
+func newSensorCollect(c *conf.Sensor_Collect) *sensorCollect {
+	sc := &sensorCollect{
+		autoCreate:     c.GetAutoCreate(),
+		identifierTags: c.GetIdentifierTags(),
+		maxBodySize:    c.GetMaxBodySize(),
+		ids:            make(map[sensorIdentity]int),
+	}
+	if sc.maxBodySize <= 0 {
+		sc.maxBodySize = defaultCollectBodySize
+	}
+	return sc
+}
+
+// identityOf identifies the sensor of the series of the sample by the first present identifier tag, or the whole
+// tag set in the order of the keys, or the name of the series itself if there are no tags
+func (c *sensorCollect) identityOf(s *SensorSample) sensorIdentity {
+	identity := sensorIdentity{sensorType: s.Name}
+	for _, tag := range c.identifierTags {
+		if v := s.Tags[tag]; v != "" {
+			identity.identifier = v
+			return identity
+		}
+	}
+	if len(s.Tags) == 0 {
+		identity.identifier = s.Name
+		return identity
+	}
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(s.Tags[k])
+	}
+	identity.identifier = b.String()
+	return identity
+}
+
+func (c *sensorCollect) lookup(identity sensorIdentity) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.ids[identity]
+	return id, ok
+}
+
+func (c *sensorCollect) remember(identity sensorIdentity, id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.ids) >= maxIdentityCache {
+		c.ids = make(map[sensorIdentity]int)
+	}
+	c.ids[identity] = id
+}
+
+// forget forgets the series mapped to the sensor
+func (c *sensorCollect) forget(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for identity, v := range c.ids {
+		if v == id {
+			delete(c.ids, identity)
+		}
+	}
+}
+
+// MaxCollectBodySize is the limit of the size of a request body of the agents after decompression
+func (m *SensorManager) MaxCollectBodySize() int64 {
+	return m.collect.maxBodySize
+}
+
+// Collect records the samples pushed by the agents, and waits until they are written. The series of each sample is
+// mapped to a sensor, which is created for an unknown series if configured so. The samples whose values are not
+// finite, whose series are mapped to no sensor or to a virtual one, or which the sensor type rejects, are dropped
+// one by one rather than failing the others. It returns the number of the samples recorded.
+func (m *SensorManager) Collect(ctx context.Context, samples []*SensorSample) (int, error) {
+	identities := make([]sensorIdentity, len(samples))
+	for i, s := range samples {
+		identities[i] = m.collect.identityOf(s)
+	}
+	ids, err := m.resolve(ctx, identities)
+	if err != nil {
+		return 0, err
+	}
+	readings := make([]*SensorReading, 0, len(samples))
+	for i, s := range samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			// Prometheus marks the series which have gone away with a NaN as well
+			collectDroppedSamples.WithLabelValues("not_finite").Inc()
+			continue
+		}
+		id, ok := ids[identities[i]]
+		if !ok {
+			collectDroppedSamples.WithLabelValues("unknown_series").Inc()
+			continue
+		}
+		readings = append(readings, &SensorReading{SensorId: id, Value: s.Value, Timestamp: s.Timestamp})
+	}
+	readings, err = m.prepare(ctx, readings, func(r *SensorReading, reason string) {
+		if reason == "unknown_series" {
+			// The sensor has been deleted since its series was mapped to it
+			m.collect.forget(r.SensorId)
+		}
+		collectDroppedSamples.WithLabelValues(reason).Inc()
+	})
+	if err != nil {
+		return 0, err
+	}
+	pendings := make([]*PendingReadings, 0, len(readings)/collectBatch+1)
+	for start := 0; start < len(readings); start += collectBatch {
+		pending, err := m.enqueue(ctx, readings[start:min(start+collectBatch, len(readings))])
+		if err != nil {
+			return 0, err
+		}
+		pendings = append(pendings, pending)
+	}
+	for _, pending := range pendings {
+		if err = pending.Wait(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return len(readings), nil
+}
+
+// resolve finds the sensors of the identities, creating the missing ones if configured so. The identities which
+// are mapped to no sensor are absent from the result.
+func (m *SensorManager) resolve(ctx context.Context, identities []sensorIdentity) (map[sensorIdentity]int, error) {
+	ids := make(map[sensorIdentity]int)
+	missing := make(map[string][]string)
+	for _, identity := range identities {
+		if _, ok := ids[identity]; ok {
+			continue
+		}
+		if id, ok := m.collect.lookup(identity); ok {
+			ids[identity] = id
+			continue
+		}
+		if identity.sensorType == "" || len(identity.sensorType) > maxSensorIdentity ||
+			len(identity.identifier) > maxSensorIdentity {
+			continue
+		}
+		// The identity is looked up once however many samples it has, and removed again if there is no sensor
+		ids[identity] = 0
+		missing[identity.sensorType] = append(missing[identity.sensorType], identity.identifier)
+	}
+	for sensorType, identifiers := range missing {
+		found, err := m.repo.FindByIdentifiers(ctx, sensorType, identifiers)
+		if err != nil {
+			return nil, err
+		}
+		for _, identifier := range identifiers {
+			identity := sensorIdentity{sensorType: sensorType, identifier: identifier}
+			id, ok := found[identifier]
+			if !ok && m.collect.autoCreate {
+				if id, err = m.createSensor(ctx, identity); err != nil {
+					return nil, err
+				}
+				ok = true
+			}
+			if !ok {
+				delete(ids, identity)
+				continue
+			}
+			ids[identity] = id
+			m.collect.remember(identity, id)
+		}
+	}
+	return ids, nil
+}
+
+// createSensor creates the sensor of the identity, unless another request has created it in the meantime
+func (m *SensorManager) createSensor(ctx context.Context, identity sensorIdentity) (int, error) {
+	id, err := m.repo.Add(ctx, identity.sensorType, identity.identifier)
+	if ent.IsConstraintError(err) {
+		found, ferr := m.repo.FindByIdentifiers(ctx, identity.sensorType, []string{identity.identifier})
+		if ferr != nil {
+			return 0, ferr
+		}
+		if id, ok := found[identity.identifier]; ok {
+			return id, nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	m.log.Infof("created sensor %d of type %s identified by %s", id, identity.sensorType, identity.identifier)
+	return id, nil
+}
@@ -0,0 +1,116 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectRepo maps the series to the sensors by their identifiers, of which "virtual" is a virtual sensor and
+// "deleted" a sensor deleted since
+type collectRepo struct {
+	ingestRepo
+	ids map[string]int
+}
+
+func (r *collectRepo) FindByIdentifiers(_ context.Context, _ string, identifiers []string) (map[string]int, error) {
+	found := make(map[string]int)
+	for _, identifier := range identifiers {
+		if id, ok := r.ids[identifier]; ok {
+			found[identifier] = id
+		}
+	}
+	return found, nil
+}
+
+func (r *collectRepo) FindSensorTypes(_ context.Context, ids []int) (map[int]string, error) {
+	names := make(map[int]string)
+	for _, id := range ids {
+		if id != r.ids["deleted"] {
+			names[id] = "temperature"
+		}
+	}
+	return names, nil
+}
+
+type collectCatalog struct {
+	SensorTypeRepository
+}
+
+func (collectCatalog) FindByNames(context.Context, []string) (map[string]*SensorType, error) {
+	return map[string]*SensorType{"temperature": {
+		Name: "temperature", Max: proto.Float64(100), OutOfRange: v1.SensorType_REJECT,
+	}}, nil
+}
+
+type collectVirtuals struct {
+	VirtualSensorRepository
+	id int
+}
+
+func (v collectVirtuals) FindBySensors(_ context.Context, ids []int) (map[int]*VirtualSensor, error) {
+	for _, id := range ids {
+		if id == v.id {
+			return map[int]*VirtualSensor{id: {SensorId: int64(id)}}, nil
+		}
+	}
+	return nil, nil
+}
+
+type noCalibrations struct {
+	CalibrationRepository
+}
+
+func (noCalibrations) FindBySensors(context.Context, []int) (map[int][]*Calibration, error) {
+	return nil, nil
+}
+
+func TestCollectDropsRejectedSamples(t *testing.T) {
+	repo := &collectRepo{ids: map[string]int{"a": 1, "b": 2, "virtual": 3, "deleted": 4}}
+	m := NewSensorManager(&conf.Sensor{}, repo, collectCatalog{}, noCalibrations{}, collectVirtuals{id: 3},
+		nopLatest{}, nil, log.DefaultLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = m.Write(ctx) }()
+
+	dropped := func(reason string) float64 {
+		return testutil.ToFloat64(collectDroppedSamples.WithLabelValues(reason))
+	}
+	before := map[string]float64{}
+	for _, reason := range []string{"out_of_range", "virtual_sensor", "unknown_series", "not_finite"} {
+		before[reason] = dropped(reason)
+	}
+	sample := func(identifier string, value float64) *SensorSample {
+		return &SensorSample{Name: "temperature", Tags: map[string]string{"id": identifier}, Value: value,
+			Timestamp: time.Now()}
+	}
+	m.collect.identifierTags = []string{"id"}
+	n, err := m.Collect(ctx, []*SensorSample{
+		sample("a", 20), sample("a", 120), sample("b", 30), sample("virtual", 1), sample("deleted", 1),
+		sample("b", math.NaN()), sample("unknown", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(repo.stored) != 2 {
+		t.Fatalf("got %d samples recorded and %d stored, want 2", n, len(repo.stored))
+	}
+	for reason, want := range map[string]float64{
+		"out_of_range": 1, "virtual_sensor": 1, "unknown_series": 2, "not_finite": 1,
+	} {
+		if got := dropped(reason) - before[reason]; got != want {
+			t.Errorf("got %v samples dropped as %s, want %v", got, reason, want)
+		}
+	}
+	// The series of the deleted sensor is looked up again rather than remembered
+	if _, ok := m.collect.lookup(sensorIdentity{sensorType: "temperature", identifier: "deleted"}); ok {
+		t.Error("got the series of the deleted sensor remembered")
+	}
+}
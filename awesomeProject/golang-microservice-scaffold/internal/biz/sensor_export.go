@@ -0,0 +1,509 @@
+package biz
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"example/internal/ent"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SensorExport is a background job exporting the readings of the sensors to a file in the store
+type SensorExport = v1.SensorExport
+
+// ExportRequest specifies the readings exported and the format of the file
+type ExportRequest = v1.ExportSensorValuesRequest
+
+// ExportStore keeps the files of the exports, which are too large to be stored in the database
+type ExportStore interface {
+	// Save writes the file and returns its name in the store along with its size
+	Save(ctx context.Context, r io.Reader) (name string, size int64, err error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+	Remove(ctx context.Context, name string) error
+}
+
+// SensorExportRepository stores the export jobs.
+//
+// A job is claimed by a worker at a time, and each claim increments its attempts. The progress and the result of
+// a job are recorded only if the attempts still match, so that a worker which has stalled and been taken over
+// cannot overwrite the result of its successor.
+type SensorExportRepository interface {
+	Add(ctx context.Context, req *ExportRequest) (*SensorExport, error)
+	FindById(ctx context.Context, id int) (*SensorExport, error)
+	// FindArtifact finds the name of the file of the export in the store, which is empty until the export succeeds
+	FindArtifact(ctx context.Context, id int) (string, error)
+	// List lists a page of the exports from the newest to the oldest and counts all of them
+	List(ctx context.Context, offset, limit int) ([]*SensorExport, int, error)
+	Delete(ctx context.Context, id int) error
+	// ClaimNext marks the earliest pending export, or a running one which has not reported any progress since the
+	// time, as running, and returns it along with the attempts of the claim. It returns nil if there is none.
+	ClaimNext(ctx context.Context, stalledBefore time.Time) (*SensorExport, int32, error)
+	// Progress records the number of the rows written so far, and reports whether the claim still holds
+	Progress(ctx context.Context, id int, attempts int32, rows int64) (bool, error)
+	// Finish records the result of the export, i.e. its status, rows, size, error, finish and expire times, along
+	// with the name of its file if it succeeded, and reports whether the claim still held
+	Finish(ctx context.Context, id int, attempts int32, result *SensorExport, artifact string) (bool, error)
+	// FindExpired finds at most limit exports which have expired by the time, and returns the names of their files
+	// by their ids
+	FindExpired(ctx context.Context, t time.Time, limit int) (map[int]string, error)
+}
+
+// Defaults of the export jobs
+const (
+	defaultExportTTL          = 24 * time.Hour
+	defaultExportStallTimeout = 5 * time.Minute
+	defaultExportPageSize     = 50
+	// exportWindowPoints is the number of the buckets of a sensor downsampled at a time
+	exportWindowPoints = 10000
+	// exportProgressInterval is how often a running job reports its progress
+	exportProgressInterval = 10 * time.Second
+	// exportExpiryBatch is the number of the expired exports removed at a time
+	exportExpiryBatch = 100
+	// maxExportError limits the length of the error recorded for a failed export
+	maxExportError = 1024
+)
+
+// errExportTakenOver aborts a job which has been claimed by another worker
+var errExportTakenOver = errors.New("the export has been taken over by another worker")
+
+// SensorExportManager exports the readings of the sensors as CSV, NDJSON or Parquet files. The readings are read
+// page by page and written as they are read, so an export takes constant memory no matter how many rows it has.
+type SensorExportManager struct {
+	sensors      *SensorManager
+	repo         SensorExportRepository
+	store        ExportStore
+	ttl          time.Duration
+	stallTimeout time.Duration
+	log          *log.Helper
+}
+
+func NewSensorExportManager(
+	c *conf.Sensor, sensors *SensorManager, repo SensorExportRepository, store ExportStore,
+	logger log.Logger) *SensorExportManager {
+	m := &SensorExportManager{
+		sensors:      sensors,
+		repo:         repo,
+		store:        store,
+		ttl:          c.GetExport().GetTtl().AsDuration(),
+		stallTimeout: c.GetExport().GetStallTimeout().AsDuration(),
+		log:          log.NewHelper(log.With(logger, "module", "biz/sensor-export")),
+	}
+	if m.ttl <= 0 {
+		m.ttl = defaultExportTTL
+	}
+	if m.stallTimeout <= 0 {
+		m.stallTimeout = defaultExportStallTimeout
+	}
+	return m
+}
+
+// exportRow is a reading, or a bucket if downsampled, written to the file
+type exportRow struct {
+	SensorId   int64     `json:"sensor_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Value      float64   `json:"value"`
+	OutOfRange *bool     `json:"out_of_range,omitempty"`
+}
+
+// exportEncoder writes the rows in a format. The file is complete once it is closed.
+type exportEncoder interface {
+	encode(row *exportRow) error
+	close() error
+}
+
+// newExportEncoder creates the encoder of the format. The flag out_of_range is written unless downsampled.
+func newExportEncoder(format v1.ExportSensorValuesRequest_Format, w io.Writer, downsampled bool) exportEncoder {
+	switch format {
+	case v1.ExportSensorValuesRequest_NDJSON:
+		b := bufio.NewWriter(w)
+		return &ndjsonEncoder{w: b, enc: json.NewEncoder(b)}
+	case v1.ExportSensorValuesRequest_PARQUET:
+		columns := []*parquetColumn{
+			{name: "sensor_id", typ: parquetInt64, converted: -1},
+			{name: "timestamp", typ: parquetInt64, converted: parquetTimestampMicros},
+			{name: "value", typ: parquetDouble, converted: -1},
+		}
+		if !downsampled {
+			columns = append(columns,
+				&parquetColumn{name: "out_of_range", typ: parquetBoolean, converted: -1, optional: true})
+		}
+		return &parquetEncoder{p: newParquetWriter(w, columns...)}
+	default:
+		header := []string{"sensor_id", "timestamp", "value"}
+		if !downsampled {
+			header = append(header, "out_of_range")
+		}
+		return &csvEncoder{w: csv.NewWriter(w), header: header}
+	}
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	header []string
+	record []string
+}
+
+func (e *csvEncoder) encode(row *exportRow) error {
+	if e.record == nil {
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+		e.record = make([]string, len(e.header))
+	}
+	e.record[0] = strconv.FormatInt(row.SensorId, 10)
+	e.record[1] = row.Timestamp.UTC().Format(time.RFC3339Nano)
+	e.record[2] = strconv.FormatFloat(row.Value, 'g', -1, 64)
+	if row.OutOfRange != nil {
+		e.record[3] = strconv.FormatBool(*row.OutOfRange)
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) close() error {
+	if e.record == nil {
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(row *exportRow) error {
+	row.Timestamp = row.Timestamp.UTC()
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonEncoder) close() error {
+	return e.w.Flush()
+}
+
+type parquetEncoder struct {
+	p *parquetWriter
+}
+
+func (e *parquetEncoder) encode(row *exportRow) error {
+	e.p.columns[0].appendInt64(row.SensorId)
+	e.p.columns[1].appendInt64(row.Timestamp.UnixMicro())
+	e.p.columns[2].appendDouble(row.Value)
+	if len(e.p.columns) > 3 {
+		if row.OutOfRange != nil {
+			e.p.columns[3].appendBoolean(*row.OutOfRange)
+		} else {
+			e.p.columns[3].appendNull()
+		}
+	}
+	return e.p.endRow()
+}
+
+func (e *parquetEncoder) close() error {
+	return e.p.close()
+}
+
+// checkExport makes sure the sensors exist and their readings can be converted into the unit, and returns the
+// types of the sensors
+func (m *SensorExportManager) checkExport(ctx context.Context, req *ExportRequest) (map[int]*SensorType, error) {
+	start, end := req.StartTime.AsTime(), req.EndTime.AsTime()
+	if !start.Before(end) {
+		return nil, v1.ErrorMalformedInput("The start time %v is not before the end time %v", start, end)
+	}
+	ids := make([]int, 0, len(req.SensorIds))
+	for _, id := range req.SensorIds {
+		ids = append(ids, int(id))
+	}
+	types, err := m.sensors.typesOf(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, _, err = converterFor(id, types[id], req.Unit); err != nil {
+			return nil, err
+		}
+	}
+	return types, nil
+}
+
+// Export writes the file of the readings to the writer, and returns the number of the rows. Nothing is written if
+// the request is rejected.
+func (m *SensorExportManager) Export(ctx context.Context, req *ExportRequest, w io.Writer) (int64, error) {
+	types, err := m.checkExport(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return m.export(ctx, req, types, w, func(int64) error { return nil })
+}
+
+// export writes the file of the readings, and reports the number of the rows written so far every now and then
+func (m *SensorExportManager) export(
+	ctx context.Context, req *ExportRequest, types map[int]*SensorType, w io.Writer,
+	progress func(rows int64) error) (int64, error) {
+	downsampled := req.Interval != nil
+	enc := newExportEncoder(req.Format, w, downsampled)
+	var rows int64
+	reported := time.Now()
+	write := func(row *exportRow) error {
+		if err := enc.encode(row); err != nil {
+			return err
+		}
+		if rows++; time.Since(reported) >= exportProgressInterval {
+			reported = time.Now()
+			return progress(rows)
+		}
+		return nil
+	}
+	for _, id := range req.SensorIds {
+		var err error
+		if downsampled {
+			err = m.exportBuckets(ctx, req, int(id), write)
+		} else {
+			err = m.exportValues(ctx, req, int(id), types[int(id)], write)
+		}
+		if err != nil {
+			return rows, err
+		}
+	}
+	return rows, enc.close()
+}
+
+// exportValues writes the raw readings of the sensor page by page
+func (m *SensorExportManager) exportValues(
+	ctx context.Context, req *ExportRequest, id int, t *SensorType, write func(row *exportRow) error) error {
+	_, convert, err := converterFor(id, t, req.Unit)
+	if err != nil {
+		return err
+	}
+	end := req.EndTime.AsTime()
+	for from := req.StartTime.AsTime(); ; {
+		page, err := m.sensors.repo.FindValues(ctx, id, from, end, scanPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range page {
+			outOfRange := r.OutOfRange
+			if err = write(&exportRow{
+				SensorId:   int64(id),
+				Timestamp:  r.Timestamp,
+				Value:      convert(r.Value),
+				OutOfRange: &outOfRange,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		from = page[len(page)-1].Timestamp.Add(time.Microsecond)
+	}
+}
+
+// exportBuckets downsamples the readings of the sensor window by window. The windows are aligned to the buckets, so
+// the buckets are the same as those of a single query over the whole range.
+func (m *SensorExportManager) exportBuckets(
+	ctx context.Context, req *ExportRequest, id int, write func(row *exportRow) error) error {
+	start, end := req.StartTime.AsTime(), req.EndTime.AsTime()
+	interval := req.Interval.AsDuration()
+	step := interval.Microseconds()
+	window := interval * time.Duration(min(exportWindowPoints, m.sensors.limits.maxPoints))
+	origin := time.UnixMicro(floorDiv(start.UnixMicro(), step) * step)
+	for from, to := start, origin.Add(window); from.Before(end); from, to = to, to.Add(window) {
+		series, err := m.sensors.Query(ctx, &v1.QuerySensorValuesRequest{
+			SensorIds:   []int64{int64(id)},
+			StartTime:   timestamppb.New(from),
+			EndTime:     timestamppb.New(earlier(to, end)),
+			Interval:    req.Interval,
+			Aggregation: req.Aggregation,
+			Percentile:  req.Percentile,
+			Unit:        req.Unit,
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range series[0].Points {
+			if p.Value == nil {
+				continue
+			}
+			if err = write(&exportRow{SensorId: int64(id), Timestamp: p.Time.AsTime(), Value: *p.Value}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateExport queues an export job, which writes the file to the store in the background
+func (m *SensorExportManager) CreateExport(ctx context.Context, req *ExportRequest) (*SensorExport, error) {
+	if _, err := m.checkExport(ctx, req); err != nil {
+		return nil, err
+	}
+	return m.repo.Add(ctx, req)
+}
+
+func (m *SensorExportManager) GetExport(ctx context.Context, id int) (export *SensorExport, err error) {
+	if export, err = m.repo.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorExportNotFound("There is no such export id %v", id)
+	}
+	return
+}
+
+func (m *SensorExportManager) ListExports(ctx context.Context, offset, limit int) ([]*SensorExport, int, error) {
+	if limit <= 0 {
+		limit = defaultExportPageSize
+	}
+	return m.repo.List(ctx, offset, limit)
+}
+
+// DeleteExport removes the export along with its file. A running export finds itself deleted once it finishes,
+// and then removes its file.
+func (m *SensorExportManager) DeleteExport(ctx context.Context, id int) error {
+	artifact, err := m.repo.FindArtifact(ctx, id)
+	if ent.IsNotFound(err) {
+		return v1.ErrorExportNotFound("There is no such export id %v", id)
+	}
+	if err != nil {
+		return err
+	}
+	if err = m.repo.Delete(ctx, id); ent.IsNotFound(err) {
+		return v1.ErrorExportNotFound("There is no such export id %v", id)
+	} else if err != nil {
+		return err
+	}
+	m.removeArtifact(ctx, artifact)
+	return nil
+}
+
+// OpenExport opens the file of the export for download. The caller should close the file.
+func (m *SensorExportManager) OpenExport(ctx context.Context, id int) (*SensorExport, io.ReadSeekCloser, error) {
+	export, err := m.GetExport(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if export.Status != v1.SensorExport_SUCCEEDED {
+		return nil, nil, v1.ErrorExportNotReady("Export %v is %v", id, export.Status)
+	}
+	artifact, err := m.repo.FindArtifact(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := m.store.Open(ctx, artifact)
+	if err != nil {
+		return nil, nil, err
+	}
+	return export, f, nil
+}
+
+func (m *SensorExportManager) removeArtifact(ctx context.Context, artifact string) {
+	if artifact == "" {
+		return
+	}
+	if err := m.store.Remove(ctx, artifact); err != nil {
+		m.log.Warnf("failed to remove export file %v: %v", artifact, err)
+	}
+}
+
+// Run removes the expired exports, and then runs the pending ones one after another until none is left
+func (m *SensorExportManager) Run(ctx context.Context) error {
+	for {
+		expired, err := m.repo.FindExpired(ctx, time.Now(), exportExpiryBatch)
+		if err != nil {
+			return err
+		}
+		for id, artifact := range expired {
+			if err = m.repo.Delete(ctx, id); err != nil && !ent.IsNotFound(err) {
+				return err
+			}
+			m.removeArtifact(ctx, artifact)
+		}
+		if len(expired) < exportExpiryBatch {
+			break
+		}
+	}
+	for ctx.Err() == nil {
+		export, attempts, err := m.repo.ClaimNext(ctx, time.Now().Add(-m.stallTimeout))
+		if err != nil {
+			return err
+		}
+		if export == nil {
+			return nil
+		}
+		if err = m.run(ctx, export, attempts); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// run writes the file of the export to the store and records the result
+func (m *SensorExportManager) run(ctx context.Context, export *SensorExport, attempts int32) error {
+	id := int(export.Id)
+	req := export.Request
+	var rows int64
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		types, err := m.checkExport(ctx, req)
+		if err == nil {
+			rows, err = m.export(ctx, req, types, w, func(rows int64) error {
+				held, err := m.repo.Progress(ctx, id, attempts, rows)
+				if err == nil && !held {
+					err = errExportTakenOver
+				}
+				return err
+			})
+		}
+		_ = w.CloseWithError(err)
+		done <- err
+	}()
+	artifact, size, err := m.store.Save(ctx, r)
+	_ = r.CloseWithError(err)
+	if exportErr := <-done; exportErr != nil {
+		// The store fails with the error of the export as well, which is the cause
+		err = exportErr
+	}
+	if errors.Is(err, errExportTakenOver) {
+		m.log.Warnf("export %v has been taken over by another worker", id)
+		return nil
+	}
+	if ctx.Err() != nil {
+		// The export is left running, and taken over once it stalls
+		return ctx.Err()
+	}
+	now := time.Now()
+	result := &SensorExport{
+		Status:     v1.SensorExport_SUCCEEDED,
+		Rows:       rows,
+		Size:       size,
+		FinishTime: timestamppb.New(now),
+		ExpireTime: timestamppb.New(now.Add(m.ttl)),
+	}
+	if err != nil {
+		m.log.Errorf("export %v failed: %v", id, err)
+		result.Status, result.Size = v1.SensorExport_FAILED, 0
+		if result.Error = err.Error(); len(result.Error) > maxExportError {
+			result.Error = result.Error[:maxExportError]
+		}
+	}
+	held, finishErr := m.repo.Finish(ctx, id, attempts, result, artifact)
+	if finishErr != nil || !held {
+		// The export has been deleted or taken over in the meantime, so the file is left to nobody
+		m.removeArtifact(ctx, artifact)
+		if ent.IsNotFound(finishErr) {
+			return nil
+		}
+		return finishErr
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"example/internal/ent"
+	"time"
+)
+
+// Defaults of the buffering of the sensor readings
+const (
+	defaultFlushSize     = 1000
+	defaultFlushInterval = 200 * time.Millisecond
+	defaultIngestQueue   = 10000
+	// drainTimeout bounds the last flush when the writer stops
+	drainTimeout = 10 * time.Second
+)
+
+// sensorIngest buffers the submitted readings until [SensorManager.Write] flushes them
+type sensorIngest struct {
+	flushSize     int
+	flushInterval time.Duration
+	queue         chan *PendingReadings
+}
+
+func newSensorIngest(c *conf.Sensor_Ingest) *sensorIngest {
+	in := &sensorIngest{
+		flushSize:     int(c.GetFlushSize()),
+		flushInterval: c.GetFlushInterval().AsDuration(),
+	}
+	if in.flushSize <= 0 {
+		in.flushSize = defaultFlushSize
+	}
+	if in.flushInterval <= 0 {
+		in.flushInterval = defaultFlushInterval
+	}
+	queueSize := int(c.GetQueueSize())
+	if queueSize <= 0 {
+		queueSize = defaultIngestQueue
+	}
+	in.queue = make(chan *PendingReadings, queueSize)
+	return in
+}
+
+// PendingReadings are the submitted readings waiting for being written
+type PendingReadings struct {
+	readings []*SensorReading
+	done     chan struct{}
+	err      error
+}
+
+// Done is closed once the readings are written or have failed to be written
+func (p *PendingReadings) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the error writing the readings, which is meaningful only after Done is closed
+func (p *PendingReadings) Err() error {
+	return p.err
+}
+
+// Wait waits until the readings are written
+func (p *PendingReadings) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record stores the readings and waits until they are written. Readings without a timestamp are regarded as
+// measured right now.
+func (m *SensorManager) Record(ctx context.Context, readings ...*SensorReading) error {
+	pending, err := m.Submit(ctx, readings...)
+	if err != nil {
+		return err
+	}
+	return pending.Wait(ctx)
+}
+
+// Submit queues the readings for being written in bulk, and blocks only if the queue is full. Readings without a
+// timestamp are regarded as measured right now. The readings are calibrated by the profiles of their sensors, and
+// then rounded and checked by the types of their sensors. None of them is queued if any of them is rejected, e.g.
+// the readings of the virtual sensors, which are computed rather than recorded.
+func (m *SensorManager) Submit(ctx context.Context, readings ...*SensorReading) (*PendingReadings, error) {
+	readings, err := m.prepare(ctx, readings, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m.enqueue(ctx, readings)
+}
+
+// prepare timestamps, calibrates, rounds and checks the readings. A reading which is rejected fails them all, unless
+// there is a drop function, which is then given the reading and the reason and the reading is left out instead. The
+// readings of the sensors which do not exist are dropped for the reason "unknown_series", those of the virtual
+// sensors for "virtual_sensor", and those outside the valid range for "out_of_range".
+func (m *SensorManager) prepare(
+	ctx context.Context, readings []*SensorReading, drop func(r *SensorReading, reason string),
+) ([]*SensorReading, error) {
+	if len(readings) == 0 {
+		return readings, nil
+	}
+	now := time.Now()
+	seen := make(map[int]struct{})
+	ids := make([]int, 0, 1)
+	for _, r := range readings {
+		if r.Timestamp.IsZero() {
+			r.Timestamp = now
+		}
+		// The databases keep the microseconds at most, so the readings are told apart at the same precision
+		r.Timestamp = r.Timestamp.Truncate(time.Microsecond)
+		if _, ok := seen[r.SensorId]; !ok {
+			seen[r.SensorId] = struct{}{}
+			ids = append(ids, r.SensorId)
+		}
+	}
+	types, missing, err := m.knownTypesOf(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	rejected := make(map[int]string, len(missing))
+	for _, id := range missing {
+		if drop == nil {
+			return nil, v1.ErrorSensorNotFound("There is no such sensor id %v", id)
+		}
+		rejected[id] = "unknown_series"
+	}
+	virtuals, err := m.virtuals.FindBySensors(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for id := range virtuals {
+		if drop == nil {
+			return nil, v1.ErrorVirtualSensorReadOnly("The readings of virtual sensor %v cannot be recorded", id)
+		}
+		rejected[id] = "virtual_sensor"
+	}
+	calibrations, err := m.calibrations.FindBySensors(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]*SensorReading, 0, len(readings))
+	for _, r := range readings {
+		if reason, ok := rejected[r.SensorId]; ok {
+			drop(r, reason)
+			continue
+		}
+		calibrateReading(calibrations[r.SensorId], r)
+		if t, ok := types[r.SensorId]; ok {
+			if err = checkReading(t, r); err != nil {
+				if drop == nil {
+					return nil, err
+				}
+				drop(r, "out_of_range")
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	return kept, nil
+}
+
+// enqueue queues the prepared readings for being written in bulk, and blocks only if the queue is full
+func (m *SensorManager) enqueue(ctx context.Context, readings []*SensorReading) (*PendingReadings, error) {
+	pending := &PendingReadings{readings: readings, done: make(chan struct{})}
+	if len(readings) == 0 {
+		close(pending.done)
+		return pending, nil
+	}
+	select {
+	case m.ingest.queue <- pending:
+		return pending, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Write writes the submitted readings until the context is done. The readings are flushed in bulk once enough of
+// them are buffered, or once the flush interval elapses. The readings queued by the time the context is done are
+// flushed before it returns.
+func (m *SensorManager) Write(ctx context.Context) error {
+	ticker := time.NewTicker(m.ingest.flushInterval)
+	defer ticker.Stop()
+	// A flush in progress is never aborted, otherwise the readings accepted by then would be lost
+	flushCtx := context.WithoutCancel(ctx)
+	var batch []*PendingReadings
+	size := 0
+	add := func(p *PendingReadings) {
+		batch = append(batch, p)
+		if size += len(p.readings); size >= m.ingest.flushSize {
+			m.flush(flushCtx, batch, size)
+			batch, size = nil, 0
+		}
+	}
+	for {
+		select {
+		case p := <-m.ingest.queue:
+			add(p)
+		case <-ticker.C:
+			m.flush(flushCtx, batch, size)
+			batch, size = nil, 0
+		case <-ctx.Done():
+			var cancel context.CancelFunc
+			flushCtx, cancel = context.WithTimeout(flushCtx, drainTimeout)
+			defer cancel()
+			for {
+				select {
+				case p := <-m.ingest.queue:
+					add(p)
+				default:
+					m.flush(flushCtx, batch, size)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// flush writes the readings of the submissions in bulk and tells the submitters the result
+func (m *SensorManager) flush(ctx context.Context, batch []*PendingReadings, size int) {
+	if len(batch) == 0 {
+		return
+	}
+	readings := make([]*SensorReading, 0, size)
+	for _, p := range batch {
+		readings = append(readings, p.readings...)
+	}
+	// Only the readings which have not been stored before are cached and observed
+	written, err := m.addValues(ctx, readings)
+	if ent.IsConstraintError(err) && len(batch) > 1 {
+		// Some of the readings still violate a constraint, e.g. of a sensor deleted in the meantime. The submissions
+		// are written one by one then, so that only the offending ones fail.
+		written = make([]*SensorReading, 0, size)
+		for _, p := range batch {
+			var added []*SensorReading
+			if added, p.err = m.addValues(ctx, p.readings); p.err != nil {
+				m.log.Errorf("failed to write %d readings: %v", len(p.readings), p.err)
+				continue
+			}
+			written = append(written, added...)
+		}
+	} else {
+		if err != nil {
+			m.log.Errorf("failed to write %d readings: %v", len(readings), err)
+		}
+		for _, p := range batch {
+			p.err = err
+		}
+	}
+	for _, p := range batch {
+		close(p.done)
+	}
+	if len(written) > 0 {
+		m.cacheLatest(ctx, written)
+		for _, o := range m.observers {
+			o(ctx, written)
+		}
+	}
+}
+
+// addValues stores the readings, and returns the ones which have not been stored before. Another replica may store
+// some of them in the meantime, which violates the unique constraint, and those are skipped on the second attempt.
+func (m *SensorManager) addValues(ctx context.Context, readings []*SensorReading) ([]*SensorReading, error) {
+	added, err := m.repo.AddValues(ctx, readings)
+	if ent.IsConstraintError(err) {
+		added, err = m.repo.AddValues(ctx, readings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.markLate(ctx, added)
+	return added, nil
+}
+
+// markLate marks the minutes of the readings which the compaction job may have rolled up already, so that they are
+// rolled up again. A failure is only logged, since the readings are stored anyway.
+func (m *SensorManager) markLate(ctx context.Context, readings []*SensorReading) {
+	// The compaction job rolls up the minutes ending a delay ago, and another minute allows for the clocks of the
+	// replicas to differ a little
+	horizon := time.Now().Add(time.Minute - m.retention.delay)
+	seen := make(map[DirtyBucket]struct{})
+	var dirty []*DirtyBucket
+	for _, r := range readings {
+		if !r.Timestamp.Before(horizon) {
+			continue
+		}
+		d := DirtyBucket{SensorId: r.SensorId, Bucket: r.Timestamp.Truncate(time.Minute)}
+		if _, ok := seen[d]; !ok {
+			seen[d] = struct{}{}
+			dirty = append(dirty, &d)
+		}
+	}
+	if len(dirty) == 0 {
+		return
+	}
+	if err := m.repo.MarkDirty(ctx, dirty); err != nil {
+		m.log.Errorf("failed to mark %d late buckets to be rolled up again: %v", len(dirty), err)
+	}
+}
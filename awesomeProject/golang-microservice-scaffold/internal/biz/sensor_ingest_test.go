@@ -0,0 +1,90 @@
+package biz
+
+import (
+	"context"
+	"example/internal/conf"
+	"example/internal/ent"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// ingestRepo stores the readings in memory, and rejects those of the missing sensor like a foreign key would
+type ingestRepo struct {
+	SensorRepository
+	missing int
+	stored  []*SensorReading
+}
+
+func (r *ingestRepo) AddValues(_ context.Context, readings []*SensorReading) ([]*SensorReading, error) {
+	for _, reading := range readings {
+		if reading.SensorId == r.missing {
+			return nil, &ent.ConstraintError{}
+		}
+	}
+	r.stored = append(r.stored, readings...)
+	return readings, nil
+}
+
+type nopLatest struct{}
+
+func (nopLatest) Put(context.Context, []*SensorReading) error { return nil }
+
+func (nopLatest) Get(context.Context, []int) (map[int]*SensorReading, error) { return nil, nil }
+
+func TestFlushIsolatesFailedSubmissions(t *testing.T) {
+	repo := &ingestRepo{missing: 99}
+	m := NewSensorManager(&conf.Sensor{}, repo, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	var observed []*SensorReading
+	m.ObserveReadings(func(_ context.Context, readings []*SensorReading) {
+		observed = append(observed, readings...)
+	})
+	now := time.Now()
+	pending := func(ids ...int) *PendingReadings {
+		p := &PendingReadings{done: make(chan struct{})}
+		for _, id := range ids {
+			p.readings = append(p.readings, &SensorReading{SensorId: id, Value: 1, Timestamp: now})
+		}
+		return p
+	}
+	good, bad, other := pending(1, 2), pending(3, 99), pending(4)
+	m.flush(context.Background(), []*PendingReadings{good, bad, other}, 5)
+
+	for name, p := range map[string]*PendingReadings{"good": good, "other": other} {
+		if err := p.Wait(context.Background()); err != nil {
+			t.Errorf("%s submission failed: %v", name, err)
+		}
+	}
+	if err := bad.Wait(context.Background()); !ent.IsConstraintError(err) {
+		t.Errorf("got %v for the bad submission, want a constraint error", err)
+	}
+	if len(repo.stored) != 3 || len(observed) != 3 {
+		t.Errorf("got %d stored and %d observed readings, want 3", len(repo.stored), len(observed))
+	}
+}
+
+// slowLatest hangs until the caching is given up
+type slowLatest struct {
+	nopLatest
+}
+
+func (slowLatest) Put(ctx context.Context, _ []*SensorReading) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlushBoundsCaching(t *testing.T) {
+	repo := &ingestRepo{}
+	m := NewSensorManager(&conf.Sensor{}, repo, nil, nil, nil, slowLatest{}, nil, log.DefaultLogger)
+	p := &PendingReadings{done: make(chan struct{})}
+	p.readings = []*SensorReading{{SensorId: 1, Value: 1, Timestamp: time.Now()}}
+	start := time.Now()
+	m.flush(context.Background(), []*PendingReadings{p}, 1)
+	if err := p.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*latestCacheTimeout {
+		t.Errorf("got the flush held up for %v by a hanging cache", elapsed)
+	}
+}
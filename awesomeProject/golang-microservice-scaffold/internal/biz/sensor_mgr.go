@@ -0,0 +1,259 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	terminalv1 "example/api/terminal"
+	"example/internal/conf"
+	"example/internal/ent"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+// SensorReading is a value measured by a sensor at a point in time
+type SensorReading struct {
+	SensorId  int
+	Value     float64
+	Timestamp time.Time
+	// OutOfRange flags a value outside the valid range of the sensor type
+	OutOfRange bool
+	// Raw is the value before calibration, which is nil if the value is not calibrated
+	Raw *float64
+}
+
+// Sensor is a measuring device, which usually hangs off a terminal
+type Sensor = v1.Sensor
+
+// SensorRepository stores the sensors and their readings
+type SensorRepository interface {
+	IsSensorExist(ctx context.Context, id int) (bool, error)
+	FindById(ctx context.Context, id int) (*Sensor, error)
+	// FindByTerminal finds the sensors attached to the terminal along with their latest readings
+	FindByTerminal(ctx context.Context, terminalId int) ([]*Sensor, error)
+	// FindByIds finds the sensors in the order of their ids. The sensors which do not exist are absent from the
+	// result.
+	FindByIds(ctx context.Context, ids []int) ([]*Sensor, error)
+	// FindByTerminals finds at most limit sensors attached to any of the terminals in the order of their ids
+	FindByTerminals(ctx context.Context, terminalIds []int, limit int) ([]*Sensor, error)
+	// FindSensorTypes finds the type names of the given sensors. The sensors which do not exist are absent from the
+	// result.
+	FindSensorTypes(ctx context.Context, ids []int) (map[int]string, error)
+	// CountByType counts the sensors of the type
+	CountByType(ctx context.Context, sensorType string) (int, error)
+	// FindByIdentifiers finds the ids of the sensors of the type by their identifiers. The sensors which do not exist
+	// are absent from the result.
+	FindByIdentifiers(ctx context.Context, sensorType string, identifiers []string) (map[string]int, error)
+	// Add creates a detached sensor of the type and identifier. A sensor of the same type and identifier as an
+	// existing one violates the unique constraint.
+	Add(ctx context.Context, sensorType string, identifier string) (int, error)
+	// AddValues stores the readings in bulk, advances the last update time of their sensors and clears their stale
+	// marks. The readings which have been stored before, i.e. of the same sensors and timestamps, are skipped, and the
+	// others are returned.
+	AddValues(ctx context.Context, readings []*SensorReading) ([]*SensorReading, error)
+	// UpdateValues replaces the values, raw values and out-of-range flags of the stored readings, which are
+	// identified by their sensors and timestamps
+	UpdateValues(ctx context.Context, readings []*SensorReading) error
+	// FindValues finds at most limit readings of the sensor within the time range [from, to) in the order of time
+	FindValues(ctx context.Context, id int, from, to time.Time, limit int) ([]*SensorReading, error)
+	// FindValueBefore finds the latest reading of the sensor before the time, which is nil if there is none
+	FindValueBefore(ctx context.Context, id int, t time.Time) (*SensorReading, error)
+	// FindValueAfter finds the earliest reading of the sensor at or after the time, which is nil if there is none
+	FindValueAfter(ctx context.Context, id int, t time.Time) (*SensorReading, error)
+	// FindLatestValues finds the latest reading of each of the sensors. The sensors which have no readings are absent
+	// from the result.
+	FindLatestValues(ctx context.Context, ids []int) (map[int]*SensorReading, error)
+	// DeleteValuesBefore deletes at most limit of the earliest readings of the sensor before the time, and returns
+	// the number of the deleted readings
+	DeleteValuesBefore(ctx context.Context, id int, before time.Time, limit int) (int, error)
+	// FindAfter finds at most limit sensors whose ids are greater than the given one in the order of their ids
+	FindAfter(ctx context.Context, afterId int, limit int) ([]*Sensor, error)
+	// AddRollups stores the rollups in bulk. A rollup of the same sensor, resolution and bucket as a stored one
+	// violates the unique constraint.
+	AddRollups(ctx context.Context, rollups []*SensorRollup) error
+	// FindRollups finds at most limit rollups of the sensor at the resolution, whose buckets start within the time
+	// range [from, to), in the order of time
+	FindRollups(ctx context.Context, id int, resolution v1.Resolution, from, to time.Time,
+		limit int) ([]*SensorRollup, error)
+	// UpdateRollups replaces the aggregates of the stored rollups, which are identified by their sensors,
+	// resolutions and buckets
+	UpdateRollups(ctx context.Context, rollups []*SensorRollup) error
+	// FindLatestRollup finds the latest rollup of the sensor at the resolution, which is nil if there is none
+	FindLatestRollup(ctx context.Context, id int, resolution v1.Resolution) (*SensorRollup, error)
+	// DeleteRollupsBefore deletes at most limit of the earliest rollups of the sensor at the resolution, whose
+	// buckets start before the time, and returns the number of the deleted rollups
+	DeleteRollupsBefore(ctx context.Context, id int, resolution v1.Resolution, before time.Time, limit int) (int, error)
+	// MarkDirty marks the minute buckets of the sensors to be rolled up again
+	MarkDirty(ctx context.Context, buckets []*DirtyBucket) error
+	// FindDirty finds at most limit of the earliest marks of the minute buckets of the sensor in the order of the
+	// buckets
+	FindDirty(ctx context.Context, id int, limit int) ([]*DirtyBucket, error)
+	// ClearDirty deletes the marks
+	ClearDirty(ctx context.Context, ids []int) error
+	// Attach attaches the sensor to the terminal unless it is attached to another one, and reports whether the
+	// sensor is attached to the terminal at last
+	Attach(ctx context.Context, id int, terminalId int) (bool, error)
+	// Detach detaches the sensor from the terminal, and reports whether it was attached to the terminal
+	Detach(ctx context.Context, id int, terminalId int) (bool, error)
+	// MarkStale marks all the sensors attached to the terminal as stale
+	MarkStale(ctx context.Context, terminalId int) (int, error)
+}
+
+// ReadingObserver is notified of the readings once they are written
+type ReadingObserver func(ctx context.Context, readings []*SensorReading)
+
+// SensorManager is the entry of the sensor readings, no matter which transport they come from. The readings are
+// calibrated by the profiles of their sensors and checked against the sensor type catalog on ingestion. It also
+// maintains the topology of the sensors, i.e. which terminal each of them hangs off.
+type SensorManager struct {
+	repo         SensorRepository
+	types        SensorTypeRepository
+	calibrations CalibrationRepository
+	virtuals     VirtualSensorRepository
+	latest       LatestValueCache
+	terminals    TerminalRepository
+	ingest       *sensorIngest
+	limits       sensorQueryLimits
+	retention    *sensorRetention
+	collect      *sensorCollect
+	observers    []ReadingObserver
+	// staleIntervals is the number of the sampling intervals after which a sensor which has not reported is stale
+	staleIntervals float64
+	log            *log.Helper
+}
+
+func NewSensorManager(
+	c *conf.Sensor, repo SensorRepository, types SensorTypeRepository, calibrations CalibrationRepository,
+	virtuals VirtualSensorRepository, latest LatestValueCache, terminals TerminalRepository,
+	logger log.Logger) *SensorManager {
+	m := &SensorManager{
+		repo:           repo,
+		types:          types,
+		calibrations:   calibrations,
+		virtuals:       virtuals,
+		latest:         latest,
+		terminals:      terminals,
+		ingest:         newSensorIngest(c.GetIngest()),
+		limits:         newSensorQueryLimits(c.GetQuery()),
+		retention:      newSensorRetention(c.GetRetention()),
+		collect:        newSensorCollect(c.GetCollect()),
+		staleIntervals: c.GetSnapshot().GetStaleIntervals(),
+		log:            log.NewHelper(log.With(logger, "module", "biz/sensor")),
+	}
+	if m.staleIntervals <= 0 {
+		m.staleIntervals = defaultStaleIntervals
+	}
+	return m
+}
+
+// ObserveReadings registers the observer of the written readings. It must be called before the readings are
+// written, i.e. while the application is being initialized.
+func (m *SensorManager) ObserveReadings(o ReadingObserver) {
+	m.observers = append(m.observers, o)
+}
+
+func (m *SensorManager) GetById(ctx context.Context, id int) (sensor *Sensor, err error) {
+	if sensor, err = m.repo.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorSensorNotFound("There is no such sensor id %v", id)
+	}
+	return
+}
+
+// ListByTerminal returns the sensors attached to the terminal along with their latest readings
+func (m *SensorManager) ListByTerminal(ctx context.Context, terminalId int) ([]*Sensor, error) {
+	return m.repo.FindByTerminal(ctx, terminalId)
+}
+
+// Attach hangs the sensor off the terminal. A sensor is attached to a single terminal at a time.
+func (m *SensorManager) Attach(ctx context.Context, id int, terminalId int) error {
+	if err := m.checkTopology(ctx, id, terminalId); err != nil {
+		return err
+	}
+	attached, err := m.repo.Attach(ctx, id, terminalId)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return v1.ErrorSensorAlreadyAttached("Sensor %v is attached to another terminal", id)
+	}
+	return nil
+}
+
+// Detach removes the sensor from the terminal
+func (m *SensorManager) Detach(ctx context.Context, id int, terminalId int) error {
+	if err := m.checkTopology(ctx, id, terminalId); err != nil {
+		return err
+	}
+	detached, err := m.repo.Detach(ctx, id, terminalId)
+	if err != nil {
+		return err
+	}
+	if !detached {
+		return v1.ErrorSensorNotFound("Sensor %v is not attached to terminal %v", id, terminalId)
+	}
+	return nil
+}
+
+// checkTopology makes sure both the sensor and the terminal exist
+func (m *SensorManager) checkTopology(ctx context.Context, id int, terminalId int) error {
+	ext, err := m.terminals.IsTerminalExist(ctx, terminalId)
+	if err != nil {
+		return err
+	}
+	if !ext {
+		return terminalv1.ErrorTerminalNotFound("There is no such Terminal id %v", terminalId)
+	}
+	if ext, err = m.repo.IsSensorExist(ctx, id); err != nil {
+		return err
+	}
+	if !ext {
+		return v1.ErrorSensorNotFound("There is no such sensor id %v", id)
+	}
+	return nil
+}
+
+// typesOf finds the sensor types of the sensors, failing if any of the sensors does not exist. The sensors whose
+// types are not in the catalog are absent from the result.
+func (m *SensorManager) typesOf(ctx context.Context, ids []int) (map[int]*SensorType, error) {
+	types, missing, err := m.knownTypesOf(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, v1.ErrorSensorNotFound("There is no such sensor id %v", missing[0])
+	}
+	return types, nil
+}
+
+// knownTypesOf is like typesOf, but returns the sensors which do not exist rather than failing
+func (m *SensorManager) knownTypesOf(ctx context.Context, ids []int) (map[int]*SensorType, []int, error) {
+	names, err := m.repo.FindSensorTypes(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	distinct := make([]string, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	var missing []int
+	for _, id := range ids {
+		name, ok := names[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if _, ok = seen[name]; !ok {
+			seen[name] = struct{}{}
+			distinct = append(distinct, name)
+		}
+	}
+	catalog, err := m.types.FindByNames(ctx, distinct)
+	if err != nil {
+		return nil, nil, err
+	}
+	types := make(map[int]*SensorType, len(ids))
+	for _, id := range ids {
+		if t, ok := catalog[names[id]]; ok {
+			types[id] = t
+		}
+	}
+	return types, missing, nil
+}
@@ -0,0 +1,403 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Defaults of the limits of the time-series queries
+const (
+	defaultMaxPoints   = 20000
+	defaultMaxScanRows = 1000000
+	// scanPageSize is the number of the readings fetched at a time while scanning a time range
+	scanPageSize = 5000
+)
+
+// sensorQueryLimits are the limits of the time-series queries
+type sensorQueryLimits struct {
+	maxPoints   int
+	maxScanRows int
+}
+
+func newSensorQueryLimits(c *conf.Sensor_Query) sensorQueryLimits {
+	limits := sensorQueryLimits{maxPoints: int(c.GetMaxPoints()), maxScanRows: int(c.GetMaxScanRows())}
+	if limits.maxPoints <= 0 {
+		limits.maxPoints = defaultMaxPoints
+	}
+	if limits.maxScanRows <= 0 {
+		limits.maxScanRows = defaultMaxScanRows
+	}
+	return limits
+}
+
+// bucket accumulates the readings within a bucket of a series
+type bucket struct {
+	count               int
+	sum, min, max, last float64
+	// values are kept for the percentile only
+	values []float64
+}
+
+func (b *bucket) add(value float64, keep bool) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	b.count++
+	b.sum += value
+	// The readings are scanned in the order of time
+	b.last = value
+	if keep {
+		b.values = append(b.values, value)
+	}
+}
+
+// merge adds the rollup converted into the unit of the series. The conversions between the units are linear, so the
+// sum is converted by way of the mean.
+func (b *bucket) merge(r *SensorRollup, convert func(float64) float64) {
+	lo, hi := convert(r.Min), convert(r.Max)
+	if b.count == 0 || lo < b.min {
+		b.min = lo
+	}
+	if b.count == 0 || hi > b.max {
+		b.max = hi
+	}
+	b.count += int(r.Count)
+	b.sum += convert(r.Sum/float64(r.Count)) * float64(r.Count)
+	b.last = convert(r.Last)
+}
+
+func (b *bucket) result(aggregation v1.QuerySensorValuesRequest_Aggregation, percentile float64) float64 {
+	switch aggregation {
+	case v1.QuerySensorValuesRequest_MIN:
+		return b.min
+	case v1.QuerySensorValuesRequest_MAX:
+		return b.max
+	case v1.QuerySensorValuesRequest_SUM:
+		return b.sum
+	case v1.QuerySensorValuesRequest_COUNT:
+		return float64(b.count)
+	case v1.QuerySensorValuesRequest_LAST:
+		return b.last
+	case v1.QuerySensorValuesRequest_PERCENTILE:
+		return percentileOf(b.values, percentile)
+	default:
+		return b.sum / float64(b.count)
+	}
+}
+
+// percentileOf computes the percentile of the values by the linear interpolation between the closest ranks
+func percentileOf(values []float64, percentile float64) float64 {
+	sort.Float64s(values)
+	rank := percentile / 100 * float64(len(values)-1)
+	lo, hi := int(math.Floor(rank)), int(math.Ceil(rank))
+	return values[lo] + (values[hi]-values[lo])*(rank-float64(lo))
+}
+
+// Query downsamples the readings of the sensors. The buckets are aligned to the Unix epoch, so that the points do
+// not shift as the time range of a chart moves. The number of the points and of the scanned readings are capped.
+// The rollups of the resolution picked for each sensor are read in place of its raw readings where they exist. The
+// readings of the virtual sensors evaluated on query are computed from the raw readings of their inputs.
+func (m *SensorManager) Query(ctx context.Context, q *v1.QuerySensorValuesRequest) ([]*v1.SensorSeries, error) {
+	start, end := q.StartTime.AsTime(), q.EndTime.AsTime()
+	if !start.Before(end) {
+		return nil, v1.ErrorMalformedInput("The start time %v is not before the end time %v", start, end)
+	}
+	interval := q.Interval.AsDuration()
+	step := interval.Microseconds()
+	origin := time.UnixMicro(floorDiv(start.UnixMicro(), step) * step)
+	n := int((end.UnixMicro() - origin.UnixMicro() + step - 1) / step)
+	if total := n * len(q.SensorIds); total > m.limits.maxPoints {
+		return nil, v1.ErrorQueryTooLarge(
+			"The query would return %d points, more than the limit %d", total, m.limits.maxPoints)
+	}
+	ids := make([]int, 0, len(q.SensorIds))
+	for _, id := range q.SensorIds {
+		ids = append(ids, int(id))
+	}
+	types, err := m.typesOf(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := m.querySources(ctx, ids, types)
+	if err != nil {
+		return nil, err
+	}
+	series := make([]*v1.SensorSeries, 0, len(ids))
+	now := time.Now()
+	scanned := 0
+	for _, id := range ids {
+		unit, convert, err := converterFor(id, types[id], q.Unit)
+		if err != nil {
+			return nil, err
+		}
+		s := &seriesScan{
+			origin:   origin,
+			interval: interval,
+			buckets:  make([]*bucket, n),
+			keep:     q.Aggregation == v1.QuerySensorValuesRequest_PERCENTILE,
+			convert:  convert,
+			scanned:  &scanned,
+			limit:    m.limits.maxScanRows,
+			source:   sources[id],
+		}
+		resolution := v1.Resolution_RAW
+		if s.source == nil {
+			resolution = m.resolutionFor(q, types[id], now)
+		}
+		from := start
+		if resolution != v1.Resolution_RAW {
+			if from, err = m.scanRollups(ctx, s, id, resolution, start, end); err != nil {
+				return nil, err
+			}
+		}
+		// The readings not rolled up yet are read raw
+		if from.Before(end) {
+			if err = m.scanValues(ctx, s, id, from, end); err != nil {
+				return nil, err
+			}
+		}
+		points := make([]*v1.SensorSeries_Point, n)
+		for i, b := range s.buckets {
+			points[i] = &v1.SensorSeries_Point{Time: timestamppb.New(origin.Add(time.Duration(i) * interval))}
+			switch {
+			case b != nil:
+				value := b.result(q.Aggregation, q.Percentile)
+				points[i].Value = &value
+			case q.Aggregation == v1.QuerySensorValuesRequest_COUNT:
+				points[i].Value = new(float64)
+			}
+		}
+		if err = m.fill(ctx, id, s.source, q, convert, points); err != nil {
+			return nil, err
+		}
+		series = append(series, &v1.SensorSeries{
+			SensorId:   int64(id),
+			Points:     points,
+			Unit:       unit,
+			Resolution: resolution,
+		})
+	}
+	return series, nil
+}
+
+// seriesScan accumulates the data of a sensor into the buckets of a series
+type seriesScan struct {
+	origin   time.Time
+	interval time.Duration
+	buckets  []*bucket
+	keep     bool
+	convert  func(float64) float64
+	// scanned counts the rows scanned by the whole query
+	scanned *int
+	limit   int
+	// source computes the readings in place of the stored ones if the sensor is evaluated on query
+	source *virtualSource
+}
+
+// at returns the bucket of the time, which is created on demand
+func (s *seriesScan) at(t time.Time) *bucket {
+	i := int(t.Sub(s.origin) / s.interval)
+	if s.buckets[i] == nil {
+		s.buckets[i] = &bucket{}
+	}
+	return s.buckets[i]
+}
+
+// count counts the scanned rows against the limit of the query
+func (s *seriesScan) count(n int) error {
+	if *s.scanned += n; *s.scanned > s.limit {
+		return v1.ErrorQueryTooLarge("The query would scan more than %d readings, please narrow it down", s.limit)
+	}
+	return nil
+}
+
+// scanValues scans the raw readings of the sensor within the time range [from, to)
+func (m *SensorManager) scanValues(ctx context.Context, s *seriesScan, id int, from, to time.Time) error {
+	for {
+		var page []*SensorReading
+		var err error
+		if s.source != nil {
+			page, err = m.computeValues(ctx, s.source, from, to, scanPageSize)
+		} else {
+			page, err = m.repo.FindValues(ctx, id, from, to, scanPageSize)
+		}
+		if err != nil {
+			return err
+		}
+		if err = s.count(len(page)); err != nil {
+			return err
+		}
+		for _, r := range page {
+			s.at(r.Timestamp).add(s.convert(r.Value), s.keep)
+		}
+		if len(page) < scanPageSize {
+			return nil
+		}
+		// A reading is identified by its sensor and timestamp, so no reading is skipped
+		from = page[len(page)-1].Timestamp.Add(time.Microsecond)
+	}
+}
+
+// scanRollups scans the rollups of the sensor at the resolution whose buckets lie within the time range. The
+// readings of the buckets partially within the range are read raw, and so are those not rolled up yet, from the time
+// it returns.
+func (m *SensorManager) scanRollups(
+	ctx context.Context, s *seriesScan, id int, resolution v1.Resolution, start, end time.Time) (time.Time, error) {
+	latest, err := m.repo.FindLatestRollup(ctx, id, resolution)
+	if err != nil || latest == nil {
+		return start, err
+	}
+	width := resolutionWidths[resolution]
+	from := start.Truncate(width)
+	if from.Before(start) {
+		from = from.Add(width)
+	}
+	to := earlier(latest.Bucket.Add(width), end.Truncate(width))
+	if !from.Before(to) {
+		return start, nil
+	}
+	if start.Before(from) {
+		if err = m.scanValues(ctx, s, id, start, from); err != nil {
+			return start, err
+		}
+	}
+	for f := from; ; {
+		page, err := m.repo.FindRollups(ctx, id, resolution, f, to, scanPageSize)
+		if err != nil {
+			return start, err
+		}
+		if err = s.count(len(page)); err != nil {
+			return start, err
+		}
+		for _, r := range page {
+			s.at(r.Bucket).merge(r, s.convert)
+		}
+		if len(page) < scanPageSize {
+			return to, nil
+		}
+		f = page[len(page)-1].Bucket.Add(time.Microsecond)
+	}
+}
+
+// converterFor returns the unit of the series of the sensor along with the function converting the readings into
+// it. The readings are converted only if the unit is requested, which requires the unit of the sensor type to be
+// known.
+func converterFor(id int, t *SensorType, unit string) (string, func(float64) float64, error) {
+	if unit == "" || t.GetUnit() == unit {
+		return t.GetUnit(), func(v float64) float64 { return v }, nil
+	}
+	if t == nil {
+		return "", nil, v1.ErrorIncompatibleUnit(
+			"The unit of sensor %v is unknown, since its type is not in the catalog", id)
+	}
+	convert, ok := converterOf(t.Unit, unit)
+	if !ok {
+		return "", nil, v1.ErrorIncompatibleUnit(
+			"The readings of sensor %v cannot be converted from %v to %v", id, t.Unit, unit)
+	}
+	return unit, convert, nil
+}
+
+// floorDiv divides the integers rounding towards negative infinity
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// fill fills the points without values as requested. The readings just outside the time range serve as the
+// anchors, except for SUM, whose points are not comparable with single readings.
+func (m *SensorManager) fill(
+	ctx context.Context, id int, source *virtualSource, q *v1.QuerySensorValuesRequest,
+	convert func(float64) float64, points []*v1.SensorSeries_Point) error {
+	if q.Fill != v1.QuerySensorValuesRequest_PREVIOUS && q.Fill != v1.QuerySensorValuesRequest_LINEAR {
+		return nil
+	}
+	var before, after *SensorReading
+	var err error
+	switch {
+	case q.Aggregation == v1.QuerySensorValuesRequest_SUM:
+	case source != nil:
+		if before, err = m.computeValueAt(ctx, source, q.StartTime.AsTime(), false); err != nil {
+			return err
+		}
+		if q.Fill == v1.QuerySensorValuesRequest_LINEAR {
+			if after, err = m.computeValueAt(ctx, source, q.EndTime.AsTime(), true); err != nil {
+				return err
+			}
+		}
+	default:
+		if before, err = m.repo.FindValueBefore(ctx, id, q.StartTime.AsTime()); err != nil {
+			return err
+		}
+		if q.Fill == v1.QuerySensorValuesRequest_LINEAR {
+			if after, err = m.repo.FindValueAfter(ctx, id, q.EndTime.AsTime()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range []*SensorReading{before, after} {
+		if r != nil {
+			r.Value = convert(r.Value)
+		}
+	}
+	if q.Fill == v1.QuerySensorValuesRequest_PREVIOUS {
+		var previous *float64
+		if before != nil {
+			previous = &before.Value
+		}
+		for _, p := range points {
+			if p.Value == nil && previous != nil {
+				value := *previous
+				p.Value = &value
+			}
+			previous = p.Value
+		}
+		return nil
+	}
+	// The gaps are interpolated between the known points on both sides of them
+	var leftTime time.Time
+	var leftValue *float64
+	if before != nil {
+		leftTime, leftValue = before.Timestamp, &before.Value
+	}
+	for i := 0; i < len(points); {
+		if points[i].Value != nil {
+			leftTime, leftValue = points[i].Time.AsTime(), points[i].Value
+			i++
+			continue
+		}
+		j := i
+		for j < len(points) && points[j].Value == nil {
+			j++
+		}
+		var rightTime time.Time
+		var rightValue *float64
+		if j < len(points) {
+			rightTime, rightValue = points[j].Time.AsTime(), points[j].Value
+		} else if after != nil {
+			rightTime, rightValue = after.Timestamp, &after.Value
+		}
+		if leftValue != nil && rightValue != nil {
+			span := rightTime.Sub(leftTime).Seconds()
+			for k := i; k < j; k++ {
+				ratio := points[k].Time.AsTime().Sub(leftTime).Seconds() / span
+				value := *leftValue + (*rightValue-*leftValue)*ratio
+				points[k].Value = &value
+			}
+		}
+		i = j
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPercentileOf(t *testing.T) {
+	tests := []struct {
+		values     []float64
+		percentile float64
+		want       float64
+	}{
+		{values: []float64{7}, percentile: 0, want: 7},
+		{values: []float64{7}, percentile: 50, want: 7},
+		{values: []float64{7}, percentile: 100, want: 7},
+		{values: []float64{4, 1, 3, 2}, percentile: 0, want: 1},
+		{values: []float64{4, 1, 3, 2}, percentile: 100, want: 4},
+		{values: []float64{4, 1, 3, 2}, percentile: 50, want: 2.5},
+		{values: []float64{4, 1, 3, 2}, percentile: 25, want: 1.75},
+		{values: []float64{5, 4, 3, 2, 1}, percentile: 1, want: 1.04},
+		{values: []float64{5, 4, 3, 2, 1}, percentile: 50, want: 3},
+		{values: []float64{2, 2, 2}, percentile: 90, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("p%v of %v", tt.percentile, tt.values), func(t *testing.T) {
+			if got := percentileOf(tt.values, tt.percentile); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketResult(t *testing.T) {
+	b := &bucket{}
+	for _, value := range []float64{3, -1, 4, 2} {
+		b.add(value, true)
+	}
+	tests := []struct {
+		aggregation v1.QuerySensorValuesRequest_Aggregation
+		want        float64
+	}{
+		{aggregation: v1.QuerySensorValuesRequest_AGGREGATION_UNSPECIFIED, want: 2},
+		{aggregation: v1.QuerySensorValuesRequest_AVG, want: 2},
+		{aggregation: v1.QuerySensorValuesRequest_MIN, want: -1},
+		{aggregation: v1.QuerySensorValuesRequest_MAX, want: 4},
+		{aggregation: v1.QuerySensorValuesRequest_SUM, want: 8},
+		{aggregation: v1.QuerySensorValuesRequest_COUNT, want: 4},
+		{aggregation: v1.QuerySensorValuesRequest_LAST, want: 2},
+		{aggregation: v1.QuerySensorValuesRequest_PERCENTILE, want: 2.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.aggregation.String(), func(t *testing.T) {
+			if got := b.result(tt.aggregation, 50); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketMerge(t *testing.T) {
+	b := &bucket{}
+	b.add(10, false)
+	// A rollup in Celsius merged into a series in Fahrenheit
+	b.merge(&SensorRollup{Count: 2, Sum: 20, Min: 0, Max: 20, Last: 5}, func(c float64) float64 { return c*1.8 + 32 })
+	if b.count != 3 || b.min != 10 || b.max != 68 || b.last != 41 {
+		t.Fatalf("got %+v", b)
+	}
+	if got, want := b.result(v1.QuerySensorValuesRequest_AVG, 0), (10+50+50)/3.0; math.Abs(got-want) > 1e-9 {
+		t.Errorf("got mean %v, want %v", got, want)
+	}
+}
+
+// fillRepo finds the readings just outside the range of a query
+type fillRepo struct {
+	SensorRepository
+	before, after *float64
+	origin, end   time.Time
+}
+
+func (r fillRepo) FindValueBefore(context.Context, int, time.Time) (*SensorReading, error) {
+	if r.before == nil {
+		return nil, nil
+	}
+	return &SensorReading{SensorId: 1, Value: *r.before, Timestamp: r.origin.Add(-2 * time.Minute)}, nil
+}
+
+func (r fillRepo) FindValueAfter(context.Context, int, time.Time) (*SensorReading, error) {
+	if r.after == nil {
+		return nil, nil
+	}
+	return &SensorReading{SensorId: 1, Value: *r.after, Timestamp: r.end.Add(time.Minute)}, nil
+}
+
+func TestFill(t *testing.T) {
+	origin := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := func(value float64) *float64 { return &value }
+	tests := []struct {
+		name          string
+		fill          v1.QuerySensorValuesRequest_GapFill
+		aggregation   v1.QuerySensorValuesRequest_Aggregation
+		before, after *float64
+		values, want  []*float64
+	}{
+		{name: "null", fill: v1.QuerySensorValuesRequest_NULL_VALUE, before: v(0),
+			values: []*float64{nil, v(1), nil}, want: []*float64{nil, v(1), nil}},
+		{name: "unspecified", before: v(0),
+			values: []*float64{nil, v(1), nil}, want: []*float64{nil, v(1), nil}},
+		{name: "previous", fill: v1.QuerySensorValuesRequest_PREVIOUS, before: v(0),
+			values: []*float64{nil, v(1), nil, nil, v(2)}, want: []*float64{v(0), v(1), v(1), v(1), v(2)}},
+		{name: "previous without reading before", fill: v1.QuerySensorValuesRequest_PREVIOUS,
+			values: []*float64{nil, v(1), nil}, want: []*float64{nil, v(1), v(1)}},
+		{name: "previous all empty", fill: v1.QuerySensorValuesRequest_PREVIOUS, before: v(3),
+			values: []*float64{nil, nil}, want: []*float64{v(3), v(3)}},
+		{name: "linear", fill: v1.QuerySensorValuesRequest_LINEAR,
+			values: []*float64{v(1), nil, nil, v(4)}, want: []*float64{v(1), v(2), v(3), v(4)}},
+		// The reading before is two minutes before the first bucket and the one after a minute after the range
+		{name: "linear from the readings outside", fill: v1.QuerySensorValuesRequest_LINEAR, before: v(-2), after: v(5),
+			values: []*float64{nil, v(1), nil, nil}, want: []*float64{v(0), v(1), v(2), v(3)}},
+		{name: "linear without reading after", fill: v1.QuerySensorValuesRequest_LINEAR, before: v(-2),
+			values: []*float64{v(0), nil}, want: []*float64{v(0), nil}},
+		{name: "linear all empty", fill: v1.QuerySensorValuesRequest_LINEAR, before: v(-2), after: v(4),
+			values: []*float64{nil, nil, nil}, want: []*float64{v(0), v(1), v(2)}},
+		// The sums of the buckets are not comparable with the readings outside the range
+		{name: "sum", fill: v1.QuerySensorValuesRequest_PREVIOUS, aggregation: v1.QuerySensorValuesRequest_SUM,
+			before: v(5), values: []*float64{nil, v(1), nil}, want: []*float64{nil, v(1), v(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end := origin.Add(time.Duration(len(tt.values)) * time.Minute)
+			repo := fillRepo{before: tt.before, after: tt.after, origin: origin, end: end}
+			m := NewSensorManager(&conf.Sensor{}, repo, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+			points := make([]*v1.SensorSeries_Point, len(tt.values))
+			for i, value := range tt.values {
+				points[i] = &v1.SensorSeries_Point{
+					Time:  timestamppb.New(origin.Add(time.Duration(i) * time.Minute)),
+					Value: value,
+				}
+			}
+			q := &v1.QuerySensorValuesRequest{
+				StartTime:   timestamppb.New(origin),
+				EndTime:     timestamppb.New(end),
+				Aggregation: tt.aggregation,
+				Fill:        tt.fill,
+			}
+			if err := m.fill(context.Background(), 1, nil, q, func(v float64) float64 { return v }, points); err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range points {
+				got, want := p.Value, tt.want[i]
+				if (got == nil) != (want == nil) || got != nil && math.Abs(*got-*want) > 1e-9 {
+					t.Errorf("got %v at bucket %d, want %v", fmtValue(got), i, fmtValue(want))
+				}
+			}
+		})
+	}
+}
+
+// fmtValue formats the value of a point, which is absent if it is not filled
+func fmtValue(value *float64) string {
+	if value == nil {
+		return "none"
+	}
+	return fmt.Sprint(*value)
+}
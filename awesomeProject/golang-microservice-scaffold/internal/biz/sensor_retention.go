@@ -0,0 +1,518 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"example/internal/ent"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of the retention of the readings, where zero keeps the data forever
+const (
+	defaultRawRetention    = 30 * 24 * time.Hour
+	defaultMinuteRetention = 365 * 24 * time.Hour
+	defaultHourRetention   = 0
+	defaultRollupDelay     = 2 * time.Minute
+	defaultCompactionBatch = 1000
+	// compactionPageSize is the number of the sensors compacted at a time
+	compactionPageSize = 500
+	// dirtyPasses is the number of the batches of the dirty buckets of a sensor rolled up again by a run of the
+	// compaction job at most, so that a sensor backfilled for long does not hold up the others
+	dirtyPasses = 10
+)
+
+// resolutionWidths are the widths of the buckets of the rollups
+var resolutionWidths = map[v1.Resolution]time.Duration{
+	v1.Resolution_MINUTE: time.Minute,
+	v1.Resolution_HOUR:   time.Hour,
+}
+
+// Progress of the compaction job, which is exposed along with the other metrics
+var (
+	rollupBuckets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sensor_rollup_buckets_total",
+		Help: "Number of the buckets rolled up by the compaction job",
+	}, []string{"resolution"})
+	compactionDeletedRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sensor_compaction_deleted_rows_total",
+		Help: "Number of the expired rows deleted by the compaction job",
+	}, []string{"resolution"})
+	compactionSensors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sensor_compaction_sensors_total",
+		Help: "Number of the sensors compacted",
+	})
+	compactionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sensor_compaction_duration_seconds",
+		Help:    "Duration of the complete runs of the compaction job",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	compactionLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sensor_compaction_last_success_timestamp_seconds",
+		Help: "Time of the last complete run of the compaction job",
+	})
+)
+
+func labelOf(resolution v1.Resolution) string {
+	return strings.ToLower(resolution.String())
+}
+
+// retention is how long the data is kept at each resolution, where zero keeps it forever
+type retention struct {
+	raw, minute, hour time.Duration
+}
+
+func (r retention) of(resolution v1.Resolution) time.Duration {
+	switch resolution {
+	case v1.Resolution_MINUTE:
+		return r.minute
+	case v1.Resolution_HOUR:
+		return r.hour
+	default:
+		return r.raw
+	}
+}
+
+// sensorRetention is the default retention along with the policy of the compaction job
+type sensorRetention struct {
+	defaults  retention
+	delay     time.Duration
+	batchSize int
+}
+
+func newSensorRetention(c *conf.Sensor_Retention) *sensorRetention {
+	p := &sensorRetention{
+		defaults:  retention{raw: defaultRawRetention, minute: defaultMinuteRetention, hour: defaultHourRetention},
+		delay:     c.GetRollupDelay().AsDuration(),
+		batchSize: int(c.GetBatchSize()),
+	}
+	// An absent retention takes the default, while zero keeps the data forever
+	if c.GetRaw() != nil {
+		p.defaults.raw = c.GetRaw().AsDuration()
+	}
+	if c.GetMinute() != nil {
+		p.defaults.minute = c.GetMinute().AsDuration()
+	}
+	if c.GetHour() != nil {
+		p.defaults.hour = c.GetHour().AsDuration()
+	}
+	if p.delay <= 0 {
+		p.delay = defaultRollupDelay
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = defaultCompactionBatch
+	}
+	return p
+}
+
+// of returns the retention of the sensor type, whose absent durations take the defaults. The sensors whose types
+// are not in the catalog are kept as long as the defaults.
+func (p *sensorRetention) of(t *SensorType) retention {
+	r := p.defaults
+	if t.GetRetention().GetRaw() != nil {
+		r.raw = t.Retention.Raw.AsDuration()
+	}
+	if t.GetRetention().GetMinute() != nil {
+		r.minute = t.Retention.Minute.AsDuration()
+	}
+	if t.GetRetention().GetHour() != nil {
+		r.hour = t.Retention.Hour.AsDuration()
+	}
+	return r
+}
+
+// SensorRollup aggregates the readings of a sensor within a bucket of a coarser resolution
+type SensorRollup struct {
+	SensorId   int
+	Resolution v1.Resolution
+	// Bucket is the start of the bucket
+	Bucket              time.Time
+	Count               int64
+	Sum, Min, Max, Last float64
+}
+
+// merge adds the finer aggregate, which comes later than the ones merged before
+func (r *SensorRollup) merge(o *SensorRollup) {
+	if r.Count == 0 || o.Min < r.Min {
+		r.Min = o.Min
+	}
+	if r.Count == 0 || o.Max > r.Max {
+		r.Max = o.Max
+	}
+	r.Count += o.Count
+	r.Sum += o.Sum
+	r.Last = o.Last
+}
+
+// DirtyBucket marks a minute bucket of a sensor which has received readings after it may have been rolled up
+type DirtyBucket struct {
+	Id       int
+	SensorId int
+	Bucket   time.Time
+}
+
+// earlier returns the earlier one of the times
+func earlier(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Compact rolls up the readings of all the sensors into the 1-minute and hourly aggregates, and then deletes the
+// data which has expired by the retention of the sensor types. The buckets which have received late readings since
+// they were rolled up are rolled up again. The data of a resolution is deleted only once it has been rolled up into
+// the next one. Every statement reads or deletes a limited batch of rows, so that the ingestion
+// is never blocked for long.
+func (m *SensorManager) Compact(ctx context.Context) error {
+	started := time.Now()
+	for after := 0; ; {
+		sensors, err := m.repo.FindAfter(ctx, after, compactionPageSize)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(sensors))
+		for _, s := range sensors {
+			names = append(names, s.SensorType)
+		}
+		catalog, err := m.types.FindByNames(ctx, names)
+		if err != nil {
+			return err
+		}
+		for _, s := range sensors {
+			if err = m.compact(ctx, int(s.Id), m.retention.of(catalog[s.SensorType]), started); err != nil {
+				return err
+			}
+			compactionSensors.Inc()
+		}
+		if len(sensors) < compactionPageSize {
+			break
+		}
+		after = int(sensors[len(sensors)-1].Id)
+	}
+	compactionDuration.Observe(time.Since(started).Seconds())
+	compactionLastSuccess.SetToCurrentTime()
+	return nil
+}
+
+// compact rolls up and expires the data of the sensor
+func (m *SensorManager) compact(ctx context.Context, id int, r retention, now time.Time) error {
+	// The readings are rolled up after a delay, so that the late ones still make it into their buckets
+	minute, err := m.rollup(ctx, id, v1.Resolution_MINUTE, now.Add(-m.retention.delay))
+	if err != nil {
+		return m.skipRolledUp(id, err)
+	}
+	hour, err := m.rollup(ctx, id, v1.Resolution_HOUR, minute)
+	if err != nil {
+		return m.skipRolledUp(id, err)
+	}
+	dirty, err := m.rollupDirty(ctx, id, minute, hour)
+	if err != nil {
+		return m.skipRolledUp(id, err)
+	}
+	if r.raw > 0 {
+		// The readings of the dirty buckets left are kept until the buckets are rolled up again
+		before := earlier(now.Add(-r.raw), minute)
+		if !dirty.IsZero() {
+			before = earlier(before, dirty)
+		}
+		if err = m.expire(ctx, id, v1.Resolution_RAW, before); err != nil {
+			return err
+		}
+	}
+	if r.minute > 0 {
+		if err = m.expire(ctx, id, v1.Resolution_MINUTE, earlier(now.Add(-r.minute), hour)); err != nil {
+			return err
+		}
+	}
+	if r.hour > 0 {
+		return m.expire(ctx, id, v1.Resolution_HOUR, now.Add(-r.hour))
+	}
+	return nil
+}
+
+// skipRolledUp leaves the sensor to another replica which has rolled up the same buckets in the meantime
+func (m *SensorManager) skipRolledUp(id int, err error) error {
+	if ent.IsConstraintError(err) {
+		m.log.Infof("sensor %v is being compacted by another replica", id)
+		return nil
+	}
+	return err
+}
+
+// rollup aggregates the data of the next finer resolution into the buckets of the resolution, which start after
+// the latest bucket rolled up and end before the time. It returns the time before which the data is rolled up.
+func (m *SensorManager) rollup(
+	ctx context.Context, id int, resolution v1.Resolution, until time.Time) (time.Time, error) {
+	width := resolutionWidths[resolution]
+	until = until.Truncate(width)
+	from := time.Unix(0, 0)
+	latest, err := m.repo.FindLatestRollup(ctx, id, resolution)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if latest != nil {
+		from = latest.Bucket.Add(width)
+	}
+	var current *SensorRollup
+	for from.Before(until) {
+		page, err := m.rollupSource(ctx, id, resolution, from, until)
+		if err != nil {
+			return time.Time{}, err
+		}
+		var done []*SensorRollup
+		for _, r := range page {
+			bucket := r.Bucket.Truncate(width)
+			if current == nil || !current.Bucket.Equal(bucket) {
+				if current != nil {
+					done = append(done, current)
+				}
+				current = &SensorRollup{SensorId: id, Resolution: resolution, Bucket: bucket}
+			}
+			current.merge(r)
+		}
+		// The last bucket may continue on the next page, so it is written once complete
+		if err = m.addRollups(ctx, done); err != nil {
+			return time.Time{}, err
+		}
+		if len(page) < m.retention.batchSize {
+			break
+		}
+		from = page[len(page)-1].Bucket.Add(time.Microsecond)
+	}
+	if current != nil {
+		if err = m.addRollups(ctx, []*SensorRollup{current}); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return until, nil
+}
+
+// rollupDirty rolls up the dirty minute buckets of the sensor before the time again, along with their hours before
+// the other time, and clears their marks. The dirty buckets after the times are left to [SensorManager.rollup]. It
+// returns the earliest dirty bucket left, which is zero if there is none.
+func (m *SensorManager) rollupDirty(ctx context.Context, id int, minute, hour time.Time) (time.Time, error) {
+	for pass := 0; ; pass++ {
+		dirty, err := m.repo.FindDirty(ctx, id, m.retention.batchSize)
+		if err != nil || len(dirty) == 0 {
+			return time.Time{}, err
+		}
+		if pass == dirtyPasses {
+			return dirty[0].Bucket, nil
+		}
+		ids := make([]int, 0, len(dirty))
+		var minutes, hours []time.Time
+		for _, d := range dirty {
+			ids = append(ids, d.Id)
+			// The marks are in the order of the buckets
+			if d.Bucket.Before(minute) && (len(minutes) == 0 || !minutes[len(minutes)-1].Equal(d.Bucket)) {
+				minutes = append(minutes, d.Bucket)
+			}
+			h := d.Bucket.Truncate(time.Hour)
+			if h.Before(hour) && (len(hours) == 0 || !hours[len(hours)-1].Equal(h)) {
+				hours = append(hours, h)
+			}
+		}
+		if err = m.rollupAgain(ctx, id, v1.Resolution_MINUTE, minutes); err != nil {
+			return time.Time{}, err
+		}
+		if err = m.rollupAgain(ctx, id, v1.Resolution_HOUR, hours); err != nil {
+			return time.Time{}, err
+		}
+		if err = m.repo.ClearDirty(ctx, ids); err != nil {
+			return time.Time{}, err
+		}
+	}
+}
+
+// rollupAgain aggregates the buckets of the sensor at the resolution again from the data of the next finer
+// resolution. The buckets which have not been rolled up for lack of data are added, and a bucket is left as it is if
+// less data is left than it has aggregated, i.e. some of the finer data has expired.
+func (m *SensorManager) rollupAgain(
+	ctx context.Context, id int, resolution v1.Resolution, buckets []time.Time) error {
+	width := resolutionWidths[resolution]
+	var changed []*SensorRollup
+	for _, bucket := range buckets {
+		rebuilt, err := m.aggregate(ctx, id, resolution, bucket, bucket.Add(width))
+		if err != nil {
+			return err
+		}
+		b, ok := rebuilt[bucket.UnixMicro()]
+		if !ok {
+			continue
+		}
+		stored, err := m.repo.FindRollups(ctx, id, resolution, bucket, bucket.Add(width), 1)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(stored) == 0:
+			if err = m.addRollups(ctx, []*SensorRollup{b}); err != nil {
+				return err
+			}
+		case b.Count >= stored[0].Count:
+			changed = append(changed, b)
+		default:
+			m.log.Warnf("left the %v bucket %v of sensor %v as it is, since some of its data has expired",
+				labelOf(resolution), bucket.Format(time.RFC3339), id)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return m.repo.UpdateRollups(ctx, changed)
+}
+
+// rollupSource reads a batch of the data of the next finer resolution, each of which is regarded as an aggregate
+func (m *SensorManager) rollupSource(
+	ctx context.Context, id int, resolution v1.Resolution, from, until time.Time) ([]*SensorRollup, error) {
+	if resolution == v1.Resolution_HOUR {
+		return m.repo.FindRollups(ctx, id, v1.Resolution_MINUTE, from, until, m.retention.batchSize)
+	}
+	readings, err := m.repo.FindValues(ctx, id, from, until, m.retention.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	rollups := make([]*SensorRollup, 0, len(readings))
+	for _, r := range readings {
+		rollups = append(rollups, &SensorRollup{
+			SensorId: id,
+			Bucket:   r.Timestamp,
+			Count:    1,
+			Sum:      r.Value,
+			Min:      r.Value,
+			Max:      r.Value,
+			Last:     r.Value,
+		})
+	}
+	return rollups, nil
+}
+
+func (m *SensorManager) addRollups(ctx context.Context, rollups []*SensorRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	if err := m.repo.AddRollups(ctx, rollups); err != nil {
+		return err
+	}
+	rollupBuckets.WithLabelValues(labelOf(rollups[0].Resolution)).Add(float64(len(rollups)))
+	return nil
+}
+
+// rebuildRollups aggregates the rollups of the sensor at the resolution, whose buckets overlap the time range, again
+// from the data of the next finer resolution, e.g. once the readings have been calibrated again. Only the buckets
+// rolled up before are rebuilt, and a bucket is left as it is if less data is left than it has aggregated, i.e. some
+// of the finer data has expired. It returns the number of the buckets left as they are.
+func (m *SensorManager) rebuildRollups(
+	ctx context.Context, id int, resolution v1.Resolution, from, to time.Time) (int64, error) {
+	width := resolutionWidths[resolution]
+	var stale int64
+	for from = from.Truncate(width); from.Before(to); {
+		stored, err := m.repo.FindRollups(ctx, id, resolution, from, to, m.retention.batchSize)
+		if err != nil || len(stored) == 0 {
+			return stale, err
+		}
+		end := stored[len(stored)-1].Bucket.Add(width)
+		rebuilt, err := m.aggregate(ctx, id, resolution, stored[0].Bucket, end)
+		if err != nil {
+			return stale, err
+		}
+		changed := make([]*SensorRollup, 0, len(stored))
+		for _, r := range stored {
+			if b, ok := rebuilt[r.Bucket.UnixMicro()]; ok && b.Count >= r.Count {
+				changed = append(changed, b)
+			} else {
+				stale++
+			}
+		}
+		if err = m.repo.UpdateRollups(ctx, changed); err != nil {
+			return stale, err
+		}
+		if len(stored) < m.retention.batchSize {
+			break
+		}
+		from = end
+	}
+	if stale > 0 {
+		m.log.Warnf("left %d %v buckets of sensor %v as they are, since some of their data has expired", stale,
+			labelOf(resolution), id)
+	}
+	return stale, nil
+}
+
+// aggregate aggregates the data of the next finer resolution within the time range into the buckets of the
+// resolution, which are keyed by their starts in microseconds
+func (m *SensorManager) aggregate(
+	ctx context.Context, id int, resolution v1.Resolution, from, to time.Time) (map[int64]*SensorRollup, error) {
+	width := resolutionWidths[resolution]
+	buckets := make(map[int64]*SensorRollup)
+	for from.Before(to) {
+		page, err := m.rollupSource(ctx, id, resolution, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			bucket := r.Bucket.Truncate(width)
+			b, ok := buckets[bucket.UnixMicro()]
+			if !ok {
+				b = &SensorRollup{SensorId: id, Resolution: resolution, Bucket: bucket}
+				buckets[bucket.UnixMicro()] = b
+			}
+			b.merge(r)
+		}
+		if len(page) < m.retention.batchSize {
+			break
+		}
+		from = page[len(page)-1].Bucket.Add(time.Microsecond)
+	}
+	return buckets, nil
+}
+
+// expire deletes the data of the sensor at the resolution before the time batch by batch
+func (m *SensorManager) expire(ctx context.Context, id int, resolution v1.Resolution, before time.Time) error {
+	if before.IsZero() {
+		return nil
+	}
+	for {
+		var n int
+		var err error
+		if resolution == v1.Resolution_RAW {
+			n, err = m.repo.DeleteValuesBefore(ctx, id, before, m.retention.batchSize)
+		} else {
+			n, err = m.repo.DeleteRollupsBefore(ctx, id, resolution, before, m.retention.batchSize)
+		}
+		if err != nil {
+			return err
+		}
+		compactionDeletedRows.WithLabelValues(labelOf(resolution)).Add(float64(n))
+		if n < m.retention.batchSize {
+			return nil
+		}
+	}
+}
+
+// resolutionFor picks the resolution a query reads for the sensor, i.e. the coarsest one which the interval is a
+// multiple of, or a coarser one still if the data of the former has expired at the start of the range. PERCENTILE
+// is computed from the raw readings only.
+func (m *SensorManager) resolutionFor(
+	q *v1.QuerySensorValuesRequest, t *SensorType, now time.Time) v1.Resolution {
+	if q.Aggregation == v1.QuerySensorValuesRequest_PERCENTILE {
+		return v1.Resolution_RAW
+	}
+	resolution := v1.Resolution_RAW
+	for _, coarser := range []v1.Resolution{v1.Resolution_MINUTE, v1.Resolution_HOUR} {
+		if q.Interval.AsDuration()%resolutionWidths[coarser] == 0 {
+			resolution = coarser
+		}
+	}
+	r := m.retention.of(t)
+	for resolution < v1.Resolution_HOUR && r.of(resolution) > 0 &&
+		q.StartTime.AsTime().Before(now.Add(-r.of(resolution))) {
+		resolution++
+	}
+	return resolution
+}
@@ -0,0 +1,262 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/conf"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// retentionRepo keeps the readings, the rollups and the dirty marks of a single sensor in memory
+type retentionRepo struct {
+	SensorRepository
+	readings []*SensorReading
+	rollups  map[v1.Resolution]map[int64]*SensorRollup
+	dirty    []*DirtyBucket
+	nextId   int
+}
+
+func newRetentionRepo() *retentionRepo {
+	return &retentionRepo{rollups: map[v1.Resolution]map[int64]*SensorRollup{
+		v1.Resolution_MINUTE: {},
+		v1.Resolution_HOUR:   {},
+	}}
+}
+
+func (r *retentionRepo) AddValues(_ context.Context, readings []*SensorReading) ([]*SensorReading, error) {
+	r.readings = append(r.readings, readings...)
+	sort.Slice(r.readings, func(i, j int) bool { return r.readings[i].Timestamp.Before(r.readings[j].Timestamp) })
+	return readings, nil
+}
+
+func (r *retentionRepo) FindValues(_ context.Context, _ int, from, to time.Time, limit int) ([]*SensorReading, error) {
+	var found []*SensorReading
+	for _, v := range r.readings {
+		if !v.Timestamp.Before(from) && v.Timestamp.Before(to) && len(found) < limit {
+			found = append(found, v)
+		}
+	}
+	return found, nil
+}
+
+func (r *retentionRepo) DeleteValuesBefore(_ context.Context, _ int, before time.Time, _ int) (int, error) {
+	kept := r.readings[:0]
+	for _, v := range r.readings {
+		if !v.Timestamp.Before(before) {
+			kept = append(kept, v)
+		}
+	}
+	n := len(r.readings) - len(kept)
+	r.readings = kept
+	return n, nil
+}
+
+func (r *retentionRepo) sorted(resolution v1.Resolution) []*SensorRollup {
+	var rollups []*SensorRollup
+	for _, v := range r.rollups[resolution] {
+		rollups = append(rollups, v)
+	}
+	sort.Slice(rollups, func(i, j int) bool { return rollups[i].Bucket.Before(rollups[j].Bucket) })
+	return rollups
+}
+
+func (r *retentionRepo) AddRollups(_ context.Context, rollups []*SensorRollup) error {
+	for _, v := range rollups {
+		r.rollups[v.Resolution][v.Bucket.UnixMicro()] = v
+	}
+	return nil
+}
+
+func (r *retentionRepo) UpdateRollups(ctx context.Context, rollups []*SensorRollup) error {
+	return r.AddRollups(ctx, rollups)
+}
+
+func (r *retentionRepo) FindRollups(
+	_ context.Context, _ int, resolution v1.Resolution, from, to time.Time, limit int) ([]*SensorRollup, error) {
+	var found []*SensorRollup
+	for _, v := range r.sorted(resolution) {
+		if !v.Bucket.Before(from) && v.Bucket.Before(to) && len(found) < limit {
+			found = append(found, v)
+		}
+	}
+	return found, nil
+}
+
+func (r *retentionRepo) DeleteRollupsBefore(
+	_ context.Context, _ int, resolution v1.Resolution, before time.Time, _ int) (int, error) {
+	n := 0
+	for bucket, v := range r.rollups[resolution] {
+		if v.Bucket.Before(before) {
+			delete(r.rollups[resolution], bucket)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *retentionRepo) FindLatestRollup(_ context.Context, _ int, resolution v1.Resolution) (*SensorRollup, error) {
+	rollups := r.sorted(resolution)
+	if len(rollups) == 0 {
+		return nil, nil
+	}
+	return rollups[len(rollups)-1], nil
+}
+
+func (r *retentionRepo) MarkDirty(_ context.Context, buckets []*DirtyBucket) error {
+	for _, d := range buckets {
+		r.nextId++
+		r.dirty = append(r.dirty, &DirtyBucket{Id: r.nextId, SensorId: d.SensorId, Bucket: d.Bucket})
+	}
+	sort.SliceStable(r.dirty, func(i, j int) bool { return r.dirty[i].Bucket.Before(r.dirty[j].Bucket) })
+	return nil
+}
+
+func (r *retentionRepo) FindDirty(_ context.Context, _ int, limit int) ([]*DirtyBucket, error) {
+	return r.dirty[:min(limit, len(r.dirty))], nil
+}
+
+func (r *retentionRepo) ClearDirty(_ context.Context, ids []int) error {
+	cleared := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		cleared[id] = true
+	}
+	kept := r.dirty[:0]
+	for _, d := range r.dirty {
+		if !cleared[d.Id] {
+			kept = append(kept, d)
+		}
+	}
+	r.dirty = kept
+	return nil
+}
+
+func TestCompactLateReadings(t *testing.T) {
+	repo := newRetentionRepo()
+	c := &conf.Sensor{Retention: &conf.Sensor_Retention{
+		Raw:         durationpb.New(3 * time.Hour),
+		RollupDelay: durationpb.New(time.Minute),
+		BatchSize:   2,
+	}}
+	m := NewSensorManager(c, repo, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Hour)
+	early, late := now.Add(-4*time.Hour), now.Add(-2*time.Hour)
+	at := func(start time.Time, minutes ...int) []*SensorReading {
+		var readings []*SensorReading
+		for _, i := range minutes {
+			readings = append(readings, &SensorReading{SensorId: 1, Value: float64(i), Timestamp: start.Add(
+				time.Duration(i) * time.Minute)})
+		}
+		return readings
+	}
+	if _, err := m.addValues(ctx, append(at(early, 0, 1), at(late, 0, 1, 3)...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.compact(ctx, 1, m.retention.defaults, now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(repo.rollups[v1.Resolution_MINUTE]); n != 5 {
+		t.Fatalf("got %d minute rollups, want 5", n)
+	}
+
+	// A late reading of a rolled up minute, another of a minute without readings, and a backfilled reading of a
+	// minute whose raw readings have expired
+	second := &SensorReading{SensorId: 1, Value: 1, Timestamp: late.Add(90 * time.Second)}
+	if _, err := m.addValues(ctx, append(append(at(late, 2), second), at(early, 5)...)); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.dirty) != 3 {
+		t.Fatalf("got %d dirty buckets, want 3", len(repo.dirty))
+	}
+	if err := m.compact(ctx, 1, m.retention.defaults, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.dirty) != 0 {
+		t.Errorf("got %d dirty buckets left", len(repo.dirty))
+	}
+	minutes := repo.rollups[v1.Resolution_MINUTE]
+	for i, want := range []int64{1, 2, 1, 1} {
+		if b := minutes[late.Add(time.Duration(i)*time.Minute).UnixMicro()]; b == nil || b.Count != want {
+			t.Errorf("got minute %d rolled up as %+v, want %d readings", i, b, want)
+		}
+	}
+	if b := minutes[early.Add(5*time.Minute).UnixMicro()]; b == nil || b.Count != 1 {
+		t.Errorf("got the backfilled minute rolled up as %+v", b)
+	}
+	if b := repo.rollups[v1.Resolution_HOUR][late.UnixMicro()]; b == nil || b.Count != 5 || b.Sum != 0+1+1+2+3 {
+		t.Errorf("got the hour rolled up as %+v, want 5 readings", b)
+	}
+	if b := repo.rollups[v1.Resolution_HOUR][early.UnixMicro()]; b == nil || b.Count != 3 {
+		t.Errorf("got the early hour rolled up as %+v, want 3 readings", b)
+	}
+}
+
+func TestCompactKeepsDirtyReadings(t *testing.T) {
+	repo := newRetentionRepo()
+	c := &conf.Sensor{Retention: &conf.Sensor_Retention{Raw: durationpb.New(time.Hour)}}
+	m := NewSensorManager(c, repo, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Minute)
+	old := now.Add(-3 * time.Hour)
+	_, _ = repo.AddValues(ctx, []*SensorReading{
+		{SensorId: 1, Timestamp: old},
+		{SensorId: 1, Timestamp: now.Add(-2 * time.Hour)},
+	})
+	// More dirty buckets than a run rolls up again
+	for i := 0; i <= dirtyPasses; i++ {
+		_ = repo.MarkDirty(ctx, []*DirtyBucket{{SensorId: 1, Bucket: old.Add(-time.Duration(i) * time.Minute)}})
+	}
+	m.retention.batchSize = 1
+	if err := m.compact(ctx, 1, m.retention.defaults, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.dirty) != 1 {
+		t.Fatalf("got %d dirty buckets left, want 1", len(repo.dirty))
+	}
+	// The readings of the dirty bucket left and after it are kept
+	if len(repo.readings) != 2 {
+		t.Errorf("got %d readings left, want 2", len(repo.readings))
+	}
+	if err := m.compact(ctx, 1, m.retention.defaults, now); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.dirty) != 0 || len(repo.readings) != 0 {
+		t.Errorf("got %d dirty buckets and %d readings left, want none", len(repo.dirty), len(repo.readings))
+	}
+}
+
+func TestRebuildRollupsReportsStale(t *testing.T) {
+	repo := newRetentionRepo()
+	m := NewSensorManager(&conf.Sensor{}, repo, nil, nil, nil, nopLatest{}, nil, log.DefaultLogger)
+	ctx := context.Background()
+	hour := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	_, _ = repo.AddValues(ctx, []*SensorReading{
+		{SensorId: 1, Value: 2, Timestamp: hour},
+		{SensorId: 1, Value: 3, Timestamp: hour.Add(time.Minute)},
+	})
+	// The second minute has lost a reading and the third all of them, so both are left as they are
+	_ = repo.AddRollups(ctx, []*SensorRollup{
+		{SensorId: 1, Resolution: v1.Resolution_MINUTE, Bucket: hour, Count: 1, Sum: 1},
+		{SensorId: 1, Resolution: v1.Resolution_MINUTE, Bucket: hour.Add(time.Minute), Count: 2, Sum: 5},
+		{SensorId: 1, Resolution: v1.Resolution_MINUTE, Bucket: hour.Add(2 * time.Minute), Count: 1, Sum: 4},
+	})
+	stale, err := m.rebuildRollups(ctx, 1, v1.Resolution_MINUTE, hour, hour.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 2 {
+		t.Errorf("got %d stale buckets, want 2", stale)
+	}
+	minutes := repo.rollups[v1.Resolution_MINUTE]
+	if b := minutes[hour.UnixMicro()]; b.Sum != 2 {
+		t.Errorf("got the first minute rebuilt as %+v", b)
+	}
+	if b := minutes[hour.Add(time.Minute).UnixMicro()]; b.Count != 2 || b.Sum != 5 {
+		t.Errorf("got the stale minute changed to %+v", b)
+	}
+}
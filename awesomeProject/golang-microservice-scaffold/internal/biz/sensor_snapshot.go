@@ -0,0 +1,226 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Defaults of the snapshots
+const (
+	defaultStaleIntervals = 3
+	// maxSnapshotSensors limits the number of the sensors in a snapshot
+	maxSnapshotSensors = 10000
+	// latestCacheTimeout bounds the caching of the latest readings, which the writer waits for
+	latestCacheTimeout = 500 * time.Millisecond
+)
+
+// SensorSnapshot is the current value of each sensor
+type SensorSnapshot = v1.SensorSnapshot
+
+// LatestValueCache keeps the latest reading of each sensor, so that the current values are read without querying the
+// readings
+type LatestValueCache interface {
+	// Put caches the readings, each of which replaces the cached one of its sensor unless that one is later
+	Put(ctx context.Context, readings []*SensorReading) error
+	// Get finds the cached readings of the sensors. The sensors which are not cached are absent from the result.
+	Get(ctx context.Context, ids []int) (map[int]*SensorReading, error)
+}
+
+// latestOf picks the latest reading of each sensor among the readings
+func latestOf(readings []*SensorReading) []*SensorReading {
+	latest := make(map[int]*SensorReading)
+	for _, r := range readings {
+		if l, ok := latest[r.SensorId]; !ok || r.Timestamp.After(l.Timestamp) {
+			latest[r.SensorId] = r
+		}
+	}
+	picked := make([]*SensorReading, 0, len(latest))
+	for _, r := range latest {
+		picked = append(picked, r)
+	}
+	return picked
+}
+
+// valueOf converts the reading into the message of the API
+func valueOf(r *SensorReading) *v1.SensorValue {
+	return &v1.SensorValue{
+		SensorId:   int64(r.SensorId),
+		Value:      r.Value,
+		Timestamp:  timestamppb.New(r.Timestamp),
+		OutOfRange: r.OutOfRange,
+		RawValue:   r.Raw,
+	}
+}
+
+// cacheLatest caches the latest ones of the readings. A failure is logged rather than returned, since the readings
+// are stored anyway, and the sensors which are not cached are read from the database on demand. A slow cache gives
+// up after a short while, so that it never holds up the writer for long.
+func (m *SensorManager) cacheLatest(ctx context.Context, readings []*SensorReading) {
+	if len(readings) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, latestCacheTimeout)
+	defer cancel()
+	if err := m.latest.Put(ctx, latestOf(readings)); err != nil {
+		m.log.Warnf("failed to cache the latest readings of %d sensors: %v", len(readings), err)
+	}
+}
+
+// latestValues finds the latest readings of the sensors in the cache, or in the database for the ones which are not
+// cached, which are cached then. The sensors which have never reported are absent from the result.
+func (m *SensorManager) latestValues(ctx context.Context, ids []int) (map[int]*SensorReading, error) {
+	latest, err := m.latest.Get(ctx, ids)
+	if err != nil {
+		m.log.Warnf("failed to read the latest readings from the cache: %v", err)
+		latest = make(map[int]*SensorReading, len(ids))
+	}
+	var missing []int
+	for _, id := range ids {
+		if _, ok := latest[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return latest, nil
+	}
+	found, err := m.repo.FindLatestValues(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]*SensorReading, 0, len(found))
+	for id, r := range found {
+		latest[id] = r
+		readings = append(readings, r)
+	}
+	m.cacheLatest(ctx, readings)
+	return latest, nil
+}
+
+// Snapshot reads the current values of the sensors given by their ids, or else of the ones attached to any of the
+// terminals, along with whether they are stale
+func (m *SensorManager) Snapshot(ctx context.Context, ids []int, terminalIds []int) (*SensorSnapshot, error) {
+	now := time.Now()
+	snapshot := &SensorSnapshot{SnapshotTime: timestamppb.New(now)}
+	var sensors []*Sensor
+	var err error
+	switch {
+	case len(ids) > 0:
+		if sensors, err = m.repo.FindByIds(ctx, ids); err != nil {
+			return nil, err
+		}
+		if len(sensors) < len(ids) {
+			found := make(map[int64]struct{}, len(sensors))
+			for _, s := range sensors {
+				found[s.Id] = struct{}{}
+			}
+			for _, id := range ids {
+				if _, ok := found[int64(id)]; !ok {
+					return nil, v1.ErrorSensorNotFound("There is no such sensor id %v", id)
+				}
+			}
+		}
+	case len(terminalIds) > 0:
+		if sensors, err = m.repo.FindByTerminals(ctx, terminalIds, maxSnapshotSensors+1); err != nil {
+			return nil, err
+		}
+	default:
+		return snapshot, nil
+	}
+	if len(sensors) > maxSnapshotSensors {
+		return nil, v1.ErrorQueryTooLarge("The snapshot has more than %d sensors", maxSnapshotSensors)
+	}
+	sensorIds := make([]int, 0, len(sensors))
+	names := make([]string, 0, len(sensors))
+	for _, s := range sensors {
+		sensorIds = append(sensorIds, int(s.Id))
+		names = append(names, s.SensorType)
+	}
+	catalog, err := m.types.FindByNames(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := m.latestValues(ctx, sensorIds)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Sensors = make([]*v1.SensorSnapshot_Entry, 0, len(sensors))
+	for _, s := range sensors {
+		entry := &v1.SensorSnapshot_Entry{
+			SensorId:   s.Id,
+			SensorType: s.SensorType,
+			Identifier: s.Identifier,
+			TerminalId: s.TerminalId,
+		}
+		r := latest[int(s.Id)]
+		if r != nil {
+			entry.Latest = valueOf(r)
+		}
+		entry.StaleReason = m.staleReason(catalog[s.SensorType], s, r, now)
+		entry.Stale = entry.StaleReason != v1.SensorSnapshot_STALE_REASON_UNSPECIFIED
+		snapshot.Sensors = append(snapshot.Sensors, entry)
+	}
+	return snapshot, nil
+}
+
+// staleReason tells why the latest reading of the sensor is out of date at the time. The readings of the sensors
+// whose types have no sampling interval are never overdue.
+func (m *SensorManager) staleReason(
+	t *SensorType, s *Sensor, latest *SensorReading, now time.Time) v1.SensorSnapshot_StaleReason {
+	interval := t.GetSamplingInterval().AsDuration()
+	switch {
+	case latest == nil:
+		return v1.SensorSnapshot_NEVER_REPORTED
+	case s.Stale:
+		return v1.SensorSnapshot_TERMINAL_OFFLINE
+	case interval > 0 && now.Sub(latest.Timestamp) > time.Duration(m.staleIntervals*float64(interval)):
+		return v1.SensorSnapshot_OVERDUE
+	}
+	return v1.SensorSnapshot_STALE_REASON_UNSPECIFIED
+}
+
+// RebuildLatest fills the cache of the latest readings from the database page by page of the sensors, e.g. after
+// Redis has lost its data. The readings cached in the meantime are never replaced by the earlier ones. A failure is
+// logged rather than returned, since the sensors which are not cached are read from the database on demand anyway.
+func (m *SensorManager) RebuildLatest(ctx context.Context) error {
+	cached, err := m.rebuildLatest(ctx)
+	if err != nil {
+		m.log.Errorf("failed to rebuild the cache of the latest readings: %v", err)
+		return nil
+	}
+	m.log.Infof("rebuilt the cache of the latest readings of %d sensors", cached)
+	return nil
+}
+
+// rebuildLatest fills the cache of the latest readings and returns the number of the sensors cached
+func (m *SensorManager) rebuildLatest(ctx context.Context) (int, error) {
+	cached := 0
+	for after := 0; ; {
+		sensors, err := m.repo.FindAfter(ctx, after, compactionPageSize)
+		if err != nil {
+			return cached, err
+		}
+		ids := make([]int, 0, len(sensors))
+		for _, s := range sensors {
+			ids = append(ids, int(s.Id))
+		}
+		latest, err := m.repo.FindLatestValues(ctx, ids)
+		if err != nil {
+			return cached, err
+		}
+		readings := make([]*SensorReading, 0, len(latest))
+		for _, r := range latest {
+			readings = append(readings, r)
+		}
+		if err = m.latest.Put(ctx, readings); err != nil {
+			return cached, err
+		}
+		cached += len(readings)
+		if len(sensors) < compactionPageSize {
+			return cached, nil
+		}
+		after = int(sensors[len(sensors)-1].Id)
+	}
+}
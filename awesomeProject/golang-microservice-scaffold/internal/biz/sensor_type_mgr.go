@@ -0,0 +1,155 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/ent"
+	"math"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// SensorType describes the readings of the sensors of a type
+type SensorType = v1.SensorType
+
+// SensorTypeRepository stores the sensor type catalog
+type SensorTypeRepository interface {
+	Add(ctx context.Context, t *SensorType) (*SensorType, error)
+	FindById(ctx context.Context, id int) (*SensorType, error)
+	// FindByNames finds the sensor types by their names. The names which are not in the catalog are absent from
+	// the result.
+	FindByNames(ctx context.Context, names []string) (map[string]*SensorType, error)
+	List(ctx context.Context, offset, limit int) ([]*SensorType, int, error)
+	// Update replaces the definition of the sensor type except for its name
+	Update(ctx context.Context, t *SensorType) (*SensorType, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// defaultSensorTypePageSize is the page size of the sensor types if it is not given
+const defaultSensorTypePageSize = 50
+
+// SensorTypeManager maintains the sensor type catalog
+type SensorTypeManager struct {
+	types   SensorTypeRepository
+	sensors SensorRepository
+}
+
+func NewSensorTypeManager(types SensorTypeRepository, sensors SensorRepository) *SensorTypeManager {
+	return &SensorTypeManager{types: types, sensors: sensors}
+}
+
+// checkRange makes sure the valid range of the sensor type is not empty
+func checkRange(t *SensorType) error {
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return v1.ErrorMalformedInput("The minimum %v is greater than the maximum %v", *t.Min, *t.Max)
+	}
+	return nil
+}
+
+// checkRetention makes sure a finer resolution is not kept longer than a coarser one, where zero means forever. The
+// durations left to the defaults are not checked.
+func checkRetention(t *SensorType) error {
+	r := t.GetRetention()
+	durations := []*durationpb.Duration{r.GetRaw(), r.GetMinute(), r.GetHour()}
+	names := []string{"raw readings", "1-minute rollups", "hourly rollups"}
+	for i := range durations {
+		for j := i + 1; j < len(durations); j++ {
+			if durations[i] == nil || durations[j] == nil || durations[j].AsDuration() == 0 {
+				continue
+			}
+			if d := durations[i].AsDuration(); d == 0 || d > durations[j].AsDuration() {
+				return v1.ErrorMalformedInput("The %v cannot be kept longer than the %v", names[i], names[j])
+			}
+		}
+	}
+	return nil
+}
+
+func (m *SensorTypeManager) Create(ctx context.Context, t *SensorType) (*SensorType, error) {
+	if err := checkRange(t); err != nil {
+		return nil, err
+	}
+	if err := checkRetention(t); err != nil {
+		return nil, err
+	}
+	created, err := m.types.Add(ctx, t)
+	if ent.IsConstraintError(err) {
+		return nil, v1.ErrorSensorTypeAlreadyExists("Sensor type %v is already in the catalog", t.Name)
+	}
+	return created, err
+}
+
+func (m *SensorTypeManager) Get(ctx context.Context, id int) (t *SensorType, err error) {
+	if t, err = m.types.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorSensorTypeNotFound("There is no such sensor type id %v", id)
+	}
+	return
+}
+
+func (m *SensorTypeManager) List(ctx context.Context, offset, limit int) ([]*SensorType, int, error) {
+	if limit <= 0 {
+		limit = defaultSensorTypePageSize
+	}
+	return m.types.List(ctx, offset, limit)
+}
+
+// Update replaces the definition of the sensor type. The name is immutable, since the sensors refer to their types
+// by the name.
+func (m *SensorTypeManager) Update(ctx context.Context, t *SensorType) (*SensorType, error) {
+	current, err := m.Get(ctx, int(t.Id))
+	if err != nil {
+		return nil, err
+	}
+	if t.Name != current.Name {
+		return nil, v1.ErrorMalformedInput("The name of sensor type %v cannot be changed", t.Id)
+	}
+	if err = checkRange(t); err != nil {
+		return nil, err
+	}
+	if err = checkRetention(t); err != nil {
+		return nil, err
+	}
+	updated, err := m.types.Update(ctx, t)
+	if ent.IsNotFound(err) {
+		return nil, v1.ErrorSensorTypeNotFound("There is no such sensor type id %v", t.Id)
+	}
+	return updated, err
+}
+
+// Delete removes the sensor type from the catalog unless any sensor is of the type
+func (m *SensorTypeManager) Delete(ctx context.Context, id int) error {
+	t, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	n, err := m.sensors.CountByType(ctx, t.Name)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return v1.ErrorSensorTypeInUse("There are %d sensors of sensor type %v", n, t.Name)
+	}
+	if err = m.types.Delete(ctx, id); ent.IsNotFound(err) {
+		return v1.ErrorSensorTypeNotFound("There is no such sensor type id %v", id)
+	}
+	return err
+}
+
+// checkReading rounds the reading to the precision of the sensor type, and then checks it against the valid range.
+// A reading outside the range is either rejected or flagged as the sensor type specifies.
+func checkReading(t *SensorType, r *SensorReading) error {
+	if flagReading(t, r); !r.OutOfRange || t.OutOfRange == v1.SensorType_FLAG {
+		return nil
+	}
+	return v1.ErrorReadingOutOfRange(
+		"The reading %v of sensor %v is outside the valid range of sensor type %v", r.Value, r.SensorId, t.Name)
+}
+
+// flagReading rounds the reading to the precision of the sensor type, and flags it if it is outside the valid range
+func flagReading(t *SensorType, r *SensorReading) {
+	if t.Precision != nil {
+		scale := math.Pow10(int(*t.Precision))
+		r.Value = math.Round(r.Value*scale) / scale
+	}
+	r.OutOfRange = (t.Min != nil && r.Value < *t.Min) || (t.Max != nil && r.Value > *t.Max)
+}
@@ -0,0 +1,116 @@
+package biz
+
+import (
+	"context"
+	serverv1 "example/api/server"
+	userv1 "example/api/user/v1"
+	"example/internal/ent"
+	"strings"
+)
+
+// ServerInfo is a host in the server inventory
+type ServerInfo = serverv1.ServerInfo
+
+// ServerFilter selects the hosts of the inventory, whose zero fields match any host
+type ServerFilter struct {
+	Role         string
+	Environment  serverv1.ServerInfo_Environment
+	Status       serverv1.ServerInfo_Status
+	OwnerGroupId int64
+	// Labels must all be attached to the hosts with the same values
+	Labels map[string]string
+}
+
+// ServerRepository stores the server inventory
+type ServerRepository interface {
+	// Add stores the host. A host of the same hostname as an existing one violates the unique constraint.
+	Add(ctx context.Context, s *ServerInfo) (*ServerInfo, error)
+	FindById(ctx context.Context, id int) (*ServerInfo, error)
+	// List finds the hosts selected by the filter in the order of their hostnames, along with the number of all
+	// the selected hosts
+	List(ctx context.Context, filter *ServerFilter, offset, limit int) ([]*ServerInfo, int, error)
+	// Update replaces all the fields of the host except for its creation time
+	Update(ctx context.Context, s *ServerInfo) (*ServerInfo, error)
+	Delete(ctx context.Context, id int) error
+}
+
+// defaultServerPageSize is the page size of the hosts if it is not given
+const defaultServerPageSize = 50
+
+// ServerManager maintains the server inventory
+type ServerManager struct {
+	repo  ServerRepository
+	users UserRepository
+}
+
+func NewServerManager(repo ServerRepository, users UserRepository) *ServerManager {
+	return &ServerManager{repo: repo, users: users}
+}
+
+// check normalizes the host, and makes sure its owner is a user group
+func (m *ServerManager) check(ctx context.Context, s *ServerInfo) error {
+	// Hostnames are case-insensitive, so they are compared in lower case
+	s.Hostname = strings.ToLower(strings.TrimSuffix(s.Hostname, "."))
+	if s.Status == serverv1.ServerInfo_STATUS_UNSPECIFIED {
+		s.Status = serverv1.ServerInfo_PROVISIONING
+	}
+	owner, err := m.users.FindById(ctx, s.OwnerGroupId)
+	if ent.IsNotFound(err) {
+		return serverv1.ErrorInvalidOwnerGroup("There is no such user group id %v", s.OwnerGroupId)
+	}
+	if err != nil {
+		return err
+	}
+	if owner.Type != userv1.User_USER_GROUP {
+		return serverv1.ErrorInvalidOwnerGroup("User %v is not a user group", s.OwnerGroupId)
+	}
+	return nil
+}
+
+func (m *ServerManager) Create(ctx context.Context, s *ServerInfo) (*ServerInfo, error) {
+	if err := m.check(ctx, s); err != nil {
+		return nil, err
+	}
+	created, err := m.repo.Add(ctx, s)
+	if ent.IsConstraintError(err) {
+		return nil, serverv1.ErrorServerAlreadyExists("Host %v is already in the inventory", s.Hostname)
+	}
+	return created, err
+}
+
+func (m *ServerManager) Get(ctx context.Context, id int) (s *ServerInfo, err error) {
+	if s, err = m.repo.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, serverv1.ErrorServerNotFound("There is no such server id %v", id)
+	}
+	return
+}
+
+func (m *ServerManager) List(ctx context.Context, filter *ServerFilter, offset, limit int) ([]*ServerInfo, int, error) {
+	if limit <= 0 {
+		limit = defaultServerPageSize
+	}
+	return m.repo.List(ctx, filter, offset, limit)
+}
+
+// Update replaces the host, including its labels
+func (m *ServerManager) Update(ctx context.Context, s *ServerInfo) (*ServerInfo, error) {
+	if err := m.check(ctx, s); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.Update(ctx, s)
+	switch {
+	case ent.IsNotFound(err):
+		return nil, serverv1.ErrorServerNotFound("There is no such server id %v", s.Id)
+	case ent.IsConstraintError(err):
+		return nil, serverv1.ErrorServerAlreadyExists("Host %v is already in the inventory", s.Hostname)
+	}
+	return updated, err
+}
+
+func (m *ServerManager) Delete(ctx context.Context, id int) error {
+	err := m.repo.Delete(ctx, id)
+	if ent.IsNotFound(err) {
+		return serverv1.ErrorServerNotFound("There is no such server id %v", id)
+	}
+	return err
+}
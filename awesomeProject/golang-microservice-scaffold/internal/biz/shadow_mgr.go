@@ -0,0 +1,273 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	v1 "example/api/terminal"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Shadow is the shadow document of a terminal, which consists of the desired state set by the operators and the
+// state reported by the terminal
+type Shadow = v1.Shadow
+
+// ErrShadowConflict is returned by [ShadowRepository.Save] if the version of the shadow has changed
+var ErrShadowConflict = errors.New("the version of the shadow has changed")
+
+// ShadowRepository stores the shadow documents
+type ShadowRepository interface {
+	// FindByTerminal finds the shadow of the terminal, which has empty documents of version zero if it has never
+	// been written
+	FindByTerminal(ctx context.Context, terminalId int) (*Shadow, error)
+	// Save writes the documents of the shadow and bumps its version, provided that the version is still the given
+	// one. It fails with [ErrShadowConflict] otherwise. The delta is not stored.
+	Save(ctx context.Context, shadow *Shadow, version int64) (*Shadow, error)
+}
+
+const (
+	// ShadowDeltaCommand is the name of the command pushing the delta to the terminal. Its payload is a JSON object
+	// carrying the version of the shadow and the delta as "state".
+	ShadowDeltaCommand = "shadow_delta"
+	// maxShadowSize limits the size of each JSON document, so that the delta always fits in a command
+	maxShadowSize = 32 << 10
+	// maxShadowAttempts is how many times an unversioned update is retried on conflicts with the concurrent ones
+	maxShadowAttempts = 3
+)
+
+// ShadowManager maintains the shadow documents of the terminals and pushes the deltas to them
+type ShadowManager struct {
+	repo      ShadowRepository
+	terminals TerminalRepository
+	commands  *CommandManager
+	log       *log.Helper
+}
+
+func NewShadowManager(
+	repo ShadowRepository, terminals TerminalRepository, commands *CommandManager, logger log.Logger) *ShadowManager {
+	return &ShadowManager{
+		repo:      repo,
+		terminals: terminals,
+		commands:  commands,
+		log:       log.NewHelper(log.With(logger, "module", "biz/shadow")),
+	}
+}
+
+// Get returns the shadow of the terminal along with its delta
+func (m *ShadowManager) Get(ctx context.Context, terminalId int) (*Shadow, error) {
+	if _, err := m.terminal(ctx, terminalId); err != nil {
+		return nil, err
+	}
+	shadow, err := m.repo.FindByTerminal(ctx, terminalId)
+	if err != nil {
+		return nil, err
+	}
+	shadow.Delta = deltaOf(shadow.Desired, shadow.Reported)
+	return shadow, nil
+}
+
+// UpdateDesired applies the merge patch to the desired state and pushes the delta to the terminal if there is any.
+// A failure to push the delta does not fail the update, since the terminal gets the delta on its next report anyway.
+// A member removed by the patch stays in the desired state as a null as long as the terminal still reports it, so
+// that the delta tells the terminal to drop it.
+func (m *ShadowManager) UpdateDesired(
+	ctx context.Context, terminalId int, patch *structpb.Struct, version *int64) (*Shadow, error) {
+	shadow, err := m.update(ctx, terminalId, version, func(shadow *Shadow) *structpb.Struct {
+		shadow.Desired = withdraw(mergePatch(shadow.Desired, patch), patch, shadow.Reported)
+		return shadow.Desired
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(shadow.Delta.GetFields()) > 0 {
+		if err = m.push(ctx, shadow); err != nil {
+			m.log.Warnf("failed to push the delta of version %d to terminal %d: %v", shadow.Version, terminalId, err)
+		}
+	}
+	return shadow, nil
+}
+
+// ReportState applies the merge patch to the reported state. The returned delta is what the terminal still has to
+// apply. The nulls of the desired state are dropped once the terminal no longer reports their members.
+func (m *ShadowManager) ReportState(
+	ctx context.Context, terminalId int, patch *structpb.Struct, version *int64) (*Shadow, error) {
+	return m.update(ctx, terminalId, version, func(shadow *Shadow) *structpb.Struct {
+		shadow.Reported = mergePatch(shadow.Reported, patch)
+		shadow.Desired = prune(shadow.Desired, shadow.Reported)
+		return shadow.Reported
+	})
+}
+
+// update modifies a document of the shadow under the optimistic concurrency control. An update without a version is
+// retried on conflicts, since it does not depend on what the client has read.
+func (m *ShadowManager) update(
+	ctx context.Context, terminalId int, version *int64, modify func(shadow *Shadow) *structpb.Struct,
+) (*Shadow, error) {
+	terminal, err := m.terminal(ctx, terminalId)
+	if err != nil {
+		return nil, err
+	}
+	if terminal.DecommissionTime != nil {
+		return nil, v1.ErrorTerminalDecommissioned("Terminal %v has been decommissioned", terminalId)
+	}
+	for attempt := 1; ; attempt++ {
+		var shadow *Shadow
+		if shadow, err = m.repo.FindByTerminal(ctx, terminalId); err != nil {
+			return nil, err
+		}
+		current := shadow.Version
+		if version != nil && *version != current {
+			return nil, v1.ErrorShadowVersionConflict(
+				"The shadow of terminal %v is of version %d rather than %d", terminalId, current, *version)
+		}
+		var raw []byte
+		if raw, err = protojson.Marshal(modify(shadow)); err != nil {
+			return nil, v1.ErrorMalformedInput("Malformed state: %v", err)
+		}
+		if len(raw) > maxShadowSize {
+			return nil, v1.ErrorShadowTooLarge(
+				"The document would have %d bytes, more than the limit %d", len(raw), maxShadowSize)
+		}
+		shadow, err = m.repo.Save(ctx, shadow, current)
+		if errors.Is(err, ErrShadowConflict) && version == nil && attempt < maxShadowAttempts {
+			continue
+		}
+		if errors.Is(err, ErrShadowConflict) {
+			return nil, v1.ErrorShadowVersionConflict("The shadow of terminal %v has changed concurrently", terminalId)
+		}
+		if err != nil {
+			return nil, err
+		}
+		shadow.Delta = deltaOf(shadow.Desired, shadow.Reported)
+		return shadow, nil
+	}
+}
+
+// terminal finds the terminal owning the shadow
+func (m *ShadowManager) terminal(ctx context.Context, id int) (*Terminal, error) {
+	ext, err := m.terminals.IsTerminalExist(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ext {
+		return nil, v1.ErrorTerminalNotFound("There is no such Terminal id %v", id)
+	}
+	return m.terminals.GetTerminalByID(ctx, id)
+}
+
+// push queues the delta of the shadow for the terminal
+func (m *ShadowManager) push(ctx context.Context, shadow *Shadow) error {
+	payload, err := structpb.NewStruct(map[string]any{"version": shadow.Version})
+	if err != nil {
+		return err
+	}
+	payload.Fields["state"] = structpb.NewStructValue(shadow.Delta)
+	raw, err := protojson.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = m.commands.Send(ctx, &v1.SendCommandRequest{
+		TerminalId: shadow.TerminalId,
+		Name:       ShadowDeltaCommand,
+		Payload:    string(raw),
+	})
+	return err
+}
+
+// mergePatch applies the JSON merge patch to the document as defined by RFC 7396 and returns the result. Neither
+// of the arguments is modified.
+func mergePatch(doc, patch *structpb.Struct) *structpb.Struct {
+	merged := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(doc.GetFields()))}
+	for name, value := range doc.GetFields() {
+		merged.Fields[name] = value
+	}
+	for name, value := range patch.GetFields() {
+		switch value.GetKind().(type) {
+		case *structpb.Value_NullValue:
+			delete(merged.Fields, name)
+		case *structpb.Value_StructValue:
+			merged.Fields[name] = structpb.NewStructValue(
+				mergePatch(merged.Fields[name].GetStructValue(), value.GetStructValue()))
+		default:
+			merged.Fields[name] = proto.Clone(value).(*structpb.Value)
+		}
+	}
+	return merged
+}
+
+// withdraw keeps a null in the merged desired state for each member which the patch removes while the reported
+// state still holds it. Neither of the arguments is modified.
+func withdraw(merged, patch, reported *structpb.Struct) *structpb.Struct {
+	withdrawn := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(merged.GetFields()))}
+	for name, value := range merged.GetFields() {
+		withdrawn.Fields[name] = value
+	}
+	for name, value := range patch.GetFields() {
+		got, ok := reported.GetFields()[name]
+		if !ok {
+			continue
+		}
+		switch value.GetKind().(type) {
+		case *structpb.Value_NullValue:
+			withdrawn.Fields[name] = structpb.NewNullValue()
+		case *structpb.Value_StructValue:
+			if got.GetStructValue() != nil {
+				withdrawn.Fields[name] = structpb.NewStructValue(withdraw(
+					withdrawn.Fields[name].GetStructValue(), value.GetStructValue(), got.GetStructValue()))
+			}
+		}
+	}
+	return withdrawn
+}
+
+// prune drops the nulls of the desired state whose members are no longer in the reported state, along with the
+// nested objects left empty by it. Neither of the arguments is modified.
+func prune(desired, reported *structpb.Struct) *structpb.Struct {
+	pruned := &structpb.Struct{Fields: make(map[string]*structpb.Value, len(desired.GetFields()))}
+	for name, value := range desired.GetFields() {
+		got, ok := reported.GetFields()[name]
+		switch value.GetKind().(type) {
+		case *structpb.Value_NullValue:
+			if !ok {
+				continue
+			}
+		case *structpb.Value_StructValue:
+			nested := prune(value.GetStructValue(), got.GetStructValue())
+			if len(nested.Fields) == 0 && len(value.GetStructValue().GetFields()) > 0 {
+				continue
+			}
+			value = structpb.NewStructValue(nested)
+		}
+		pruned.Fields[name] = value
+	}
+	return pruned
+}
+
+// deltaOf finds the members of the desired state which differ from the reported state. The nested objects are
+// compared member by member, while the other values including the arrays are compared as a whole. A null in the
+// desired state asks the terminal to drop the member, so it is in the delta as long as the member is reported.
+func deltaOf(desired, reported *structpb.Struct) *structpb.Struct {
+	delta := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for name, want := range desired.GetFields() {
+		got, ok := reported.GetFields()[name]
+		if _, null := want.GetKind().(*structpb.Value_NullValue); null {
+			if ok {
+				delta.Fields[name] = want
+			}
+			continue
+		}
+		if want.GetStructValue() != nil && got.GetStructValue() != nil {
+			if nested := deltaOf(want.GetStructValue(), got.GetStructValue()); len(nested.Fields) > 0 {
+				delta.Fields[name] = structpb.NewStructValue(nested)
+			}
+			continue
+		}
+		if !ok || !proto.Equal(want, got) {
+			delta.Fields[name] = want
+		}
+	}
+	return delta
+}
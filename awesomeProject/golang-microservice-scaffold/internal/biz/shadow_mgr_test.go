@@ -0,0 +1,121 @@
+package biz
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// document parses the JSON object into a document of the shadow
+func document(t *testing.T, raw string) *structpb.Struct {
+	t.Helper()
+	doc := &structpb.Struct{}
+	if err := protojson.Unmarshal([]byte(raw), doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{name: "add", doc: `{"a":1}`, patch: `{"b":2}`, want: `{"a":1,"b":2}`},
+		{name: "replace", doc: `{"a":1}`, patch: `{"a":"x"}`, want: `{"a":"x"}`},
+		{name: "null removes", doc: `{"a":1,"b":2}`, patch: `{"a":null}`, want: `{"b":2}`},
+		{name: "null of missing", doc: `{"a":1}`, patch: `{"b":null}`, want: `{"a":1}`},
+		{name: "nested merge", doc: `{"a":{"x":1,"y":2}}`, patch: `{"a":{"y":3,"z":4}}`, want: `{"a":{"x":1,"y":3,"z":4}}`},
+		{name: "nested null", doc: `{"a":{"x":1,"y":2}}`, patch: `{"a":{"x":null}}`, want: `{"a":{"y":2}}`},
+		{name: "object over scalar", doc: `{"a":1}`, patch: `{"a":{"x":null,"y":1}}`, want: `{"a":{"y":1}}`},
+		// The arrays are replaced as a whole rather than merged
+		{name: "array", doc: `{"a":[1,2,3]}`, patch: `{"a":[4]}`, want: `{"a":[4]}`},
+		{name: "array over object", doc: `{"a":{"x":1}}`, patch: `{"a":[{"x":null}]}`, want: `{"a":[{"x":null}]}`},
+		{name: "empty patch", doc: `{"a":1}`, patch: `{}`, want: `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, patch := document(t, tt.doc), document(t, tt.patch)
+			before := proto.Clone(doc)
+			if got, want := mergePatch(doc, patch), document(t, tt.want); !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if !proto.Equal(doc, before) {
+				t.Errorf("the document has been modified to %v", doc)
+			}
+		})
+	}
+}
+
+func TestDeltaOf(t *testing.T) {
+	tests := []struct {
+		name, desired, reported, want string
+	}{
+		{name: "in sync", desired: `{"a":1}`, reported: `{"a":1,"b":2}`, want: `{}`},
+		{name: "missing", desired: `{"a":1}`, reported: `{}`, want: `{"a":1}`},
+		{name: "different", desired: `{"a":1,"b":2}`, reported: `{"a":1,"b":3}`, want: `{"b":2}`},
+		{name: "nested", desired: `{"a":{"x":1,"y":2}}`, reported: `{"a":{"x":1,"y":3}}`, want: `{"a":{"y":2}}`},
+		{name: "nested in sync", desired: `{"a":{"x":1}}`, reported: `{"a":{"x":1,"y":3}}`, want: `{}`},
+		{name: "object over scalar", desired: `{"a":{"x":1}}`, reported: `{"a":1}`, want: `{"a":{"x":1}}`},
+		{name: "array", desired: `{"a":[1,2]}`, reported: `{"a":[1,2,3]}`, want: `{"a":[1,2]}`},
+		{name: "array in sync", desired: `{"a":[1,{"x":2}]}`, reported: `{"a":[1,{"x":2}]}`, want: `{}`},
+		// A null asks the terminal to drop the member as long as it reports it
+		{name: "null reported", desired: `{"a":null}`, reported: `{"a":1}`, want: `{"a":null}`},
+		{name: "null dropped", desired: `{"a":null}`, reported: `{"b":1}`, want: `{}`},
+		{name: "nested null", desired: `{"a":{"x":null,"y":1}}`, reported: `{"a":{"x":1,"y":1}}`, want: `{"a":{"x":null}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := deltaOf(document(t, tt.desired), document(t, tt.reported))
+			if want := document(t, tt.want); !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	tests := []struct {
+		name, desired, patch, reported, want string
+	}{
+		{name: "reported", desired: `{"a":1,"b":2}`, patch: `{"a":null}`, reported: `{"a":1}`, want: `{"a":null,"b":2}`},
+		{name: "not reported", desired: `{"a":1,"b":2}`, patch: `{"a":null}`, reported: `{}`, want: `{"b":2}`},
+		{name: "never desired", desired: `{}`, patch: `{"a":null}`, reported: `{"a":1}`, want: `{"a":null}`},
+		{name: "nested", desired: `{"a":{"x":1,"y":2}}`, patch: `{"a":{"x":null}}`, reported: `{"a":{"x":1}}`,
+			want: `{"a":{"x":null,"y":2}}`},
+		{name: "nested not reported", desired: `{"a":{"x":1}}`, patch: `{"a":{"x":null}}`, reported: `{"a":2}`,
+			want: `{"a":{}}`},
+		{name: "replaced", desired: `{"a":null}`, patch: `{"a":[1]}`, reported: `{"a":[2]}`, want: `{"a":[1]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desired, patch := document(t, tt.desired), document(t, tt.patch)
+			got := withdraw(mergePatch(desired, patch), patch, document(t, tt.reported))
+			if want := document(t, tt.want); !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name, desired, reported, want string
+	}{
+		{name: "still reported", desired: `{"a":null,"b":1}`, reported: `{"a":1}`, want: `{"a":null,"b":1}`},
+		{name: "dropped", desired: `{"a":null,"b":1}`, reported: `{}`, want: `{"b":1}`},
+		{name: "nested dropped", desired: `{"a":{"x":null}}`, reported: `{"a":{"y":1}}`, want: `{}`},
+		{name: "nested kept", desired: `{"a":{"x":null,"y":1}}`, reported: `{}`, want: `{"a":{"y":1}}`},
+		{name: "empty object", desired: `{"a":{}}`, reported: `{}`, want: `{"a":{}}`},
+		{name: "array", desired: `{"a":[null]}`, reported: `{}`, want: `{"a":[null]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := prune(document(t, tt.desired), document(t, tt.reported))
+			if want := document(t, tt.want); !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/constant"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Location is a WGS 84 position of a terminal
+type Location = v1.Location
+
+// EarthRadius is the mean radius of the earth in meters
+const EarthRadius = 6371008.8
+
+// statusColors are the marker colors of the terminals on the map by their status
+var statusColors = map[string]string{
+	constant.TerminalStatusOnline:         "#2e7d32",
+	constant.TerminalStatusOffline:        "#c62828",
+	constant.TerminalStatusDecommissioned: "#757575",
+}
+
+// unknownStatusColor is the marker color of any other status
+const unknownStatusColor = "#f9a825"
+
+// SetLocation sets the location of the terminal, or clears it if the location is nil
+func (m *TerminalManager) SetLocation(ctx context.Context, id int, location *Location) error {
+	if _, err := m.GetTerminalById(ctx, id); err != nil {
+		return err
+	}
+	return m.repo.SetLocation(ctx, id, location)
+}
+
+// List returns a page of the terminals along with the number of all the matches. The terminals within a radius are
+// ordered by their distances to the center, and the others by their ids.
+func (m *TerminalManager) List(
+	ctx context.Context, area *v1.GeoArea, includeDecommissioned bool, offset, limit int) ([]*Terminal, int, error) {
+	if limit <= 0 {
+		limit = defaultTerminalPageSize
+	}
+	query, err := areaQuery(area)
+	if err != nil {
+		return nil, 0, err
+	}
+	query.IncludeDecommissioned, query.Offset, query.Limit = includeDecommissioned, offset, limit
+	terminals, total, err := m.repo.FindTerminals(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, t := range terminals {
+		t.Status = m.statusOf(t)
+	}
+	return terminals, total, nil
+}
+
+// areaQuery finds the terminals inside the box or within the circle of the area, or all of them if the area is nil
+func areaQuery(area *v1.GeoArea) (*TerminalQuery, error) {
+	query := &TerminalQuery{}
+	if box := area.GetBox(); box != nil {
+		if box.South > box.North {
+			return nil, v1.ErrorMalformedInput(
+				"The south edge %v is to the north of the north edge %v", box.South, box.North)
+		}
+		query.Box = box
+	}
+	if circle := area.GetCircle(); circle != nil {
+		query.Box, query.Circle = boundingBoxOf(circle), circle
+	}
+	return query, nil
+}
+
+// Distance computes the great-circle distance in meters between two points by the haversine formula
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// boundingBoxOf computes the smallest bounding box of the circle. The box covers all the longitudes if the circle
+// covers a pole, and crosses the antimeridian if the circle does.
+func boundingBoxOf(circle *v1.GeoCircle) *v1.GeoBox {
+	angle := circle.Radius / EarthRadius
+	lat := circle.Latitude * math.Pi / 180
+	box := &v1.GeoBox{
+		South: math.Max(circle.Latitude-angle*180/math.Pi, -90),
+		North: math.Min(circle.Latitude+angle*180/math.Pi, 90),
+		West:  -180,
+		East:  180,
+	}
+	if box.South == -90 || box.North == 90 {
+		return box
+	}
+	ratio := math.Sin(angle) / math.Cos(lat)
+	if ratio >= 1 {
+		return box
+	}
+	delta := math.Asin(ratio) * 180 / math.Pi
+	box.West, box.East = circle.Longitude-delta, circle.Longitude+delta
+	if box.West < -180 {
+		box.West += 360
+	}
+	if box.East > 180 {
+		box.East -= 360
+	}
+	return box
+}
+
+// Features returns the located terminals within the area, or all of them if the area is nil, as a GeoJSON
+// FeatureCollection for the map view
+func (m *TerminalManager) Features(
+	ctx context.Context, area *v1.GeoArea, includeDecommissioned bool) (*v1.FeatureCollection, error) {
+	query, err := areaQuery(area)
+	if err != nil {
+		return nil, err
+	}
+	query.Located, query.IncludeDecommissioned, query.Limit = true, includeDecommissioned, maxBulkTargets
+	terminals, total, err := m.repo.FindTerminals(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if total > maxBulkTargets {
+		return nil, v1.ErrorMalformedInput(
+			"There are %d terminals in the area, more than the limit %d", total, maxBulkTargets)
+	}
+	collection := &v1.FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*v1.Feature, 0, len(terminals)),
+	}
+	for _, t := range terminals {
+		feature, err := m.featureOf(t)
+		if err != nil {
+			return nil, err
+		}
+		collection.Features = append(collection.Features, feature)
+	}
+	return collection, nil
+}
+
+// featureOf converts the located terminal into a Point feature, whose marker is colored by the status of the
+// terminal following the simplestyle convention
+func (m *TerminalManager) featureOf(t *Terminal) (*v1.Feature, error) {
+	status := m.statusOf(t)
+	color, ok := statusColors[status]
+	if !ok {
+		color = unknownStatusColor
+	}
+	coordinates := []float64{t.Location.Longitude, t.Location.Latitude}
+	if t.Location.Altitude != nil {
+		coordinates = append(coordinates, *t.Location.Altitude)
+	}
+	properties, err := structpb.NewStruct(map[string]any{
+		"id":               t.Id,
+		"status":           status,
+		"marker-color":     color,
+		"firmware_version": t.FirmwareVersion,
+		"last_updated":     t.LastUpdated.AsTime().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Feature{
+		Type:       "Feature",
+		Geometry:   &v1.Geometry{Type: "Point", Coordinates: coordinates},
+		Properties: properties,
+	}, nil
+}
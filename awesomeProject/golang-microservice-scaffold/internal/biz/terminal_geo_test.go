@@ -0,0 +1,81 @@
+package biz
+
+import (
+	v1 "example/api/terminal"
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{name: "same point", lat1: 48.85, lon1: 2.35, lat2: 48.85, lon2: 2.35},
+		{name: "degree on the equator", lon2: 1, want: 111195},
+		{name: "across the antimeridian", lon1: 179.5, lon2: -179.5, want: 111195},
+		{name: "antipodes", lat1: 0, lon1: 0, lat2: 0, lon2: 180, want: math.Pi * EarthRadius},
+		{name: "paris to london", lat1: 48.8566, lon1: 2.3522, lat2: 51.5074, lon2: -0.1278, want: 343557},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(got-tt.want) > 1 {
+				t.Errorf("got %v m, want %v m", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoundingBoxOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		circle *v1.GeoCircle
+		want   *v1.GeoBox
+	}{
+		{
+			name:   "equator",
+			circle: &v1.GeoCircle{Latitude: 0, Longitude: 10, Radius: 111195},
+			want:   &v1.GeoBox{South: -1, North: 1, West: 9, East: 11},
+		},
+		{
+			// The box crosses the antimeridian, i.e. its west edge is to the east of its east edge
+			name:   "antimeridian",
+			circle: &v1.GeoCircle{Latitude: 0, Longitude: 179.5, Radius: 111195},
+			want:   &v1.GeoBox{South: -1, North: 1, West: 178.5, East: -179.5},
+		},
+		{
+			name:   "pole",
+			circle: &v1.GeoCircle{Latitude: 89.5, Longitude: 30, Radius: 111195},
+			want:   &v1.GeoBox{South: 88.5, North: 90, West: -180, East: 180},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := boundingBoxOf(tt.circle)
+			for _, edge := range [][2]float64{
+				{got.South, tt.want.South}, {got.North, tt.want.North},
+				{got.West, tt.want.West}, {got.East, tt.want.East},
+			} {
+				if math.Abs(edge[0]-edge[1]) > 1e-4 {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAreaQuery(t *testing.T) {
+	circle := &v1.GeoCircle{Latitude: 0, Longitude: 179.5, Radius: 111195}
+	query, err := areaQuery(&v1.GeoArea{Area: &v1.GeoArea_Circle{Circle: circle}})
+	if err != nil || query.Circle != circle || query.Box == nil || query.Box.West <= query.Box.East {
+		t.Errorf("got query %v: %v, want the circle and its bounding box across the antimeridian", query, err)
+	}
+	box := &v1.GeoBox{South: 1, North: -1, West: 0, East: 1}
+	if _, err = areaQuery(&v1.GeoArea{Area: &v1.GeoArea_Box{Box: box}}); !v1.IsMalformedInput(err) {
+		t.Errorf("got error %v for the box upside down", err)
+	}
+	if query, err = areaQuery(nil); err != nil || query.Box != nil || query.Circle != nil {
+		t.Errorf("got query %v: %v, want no area", query, err)
+	}
+}
@@ -0,0 +1,146 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/ent"
+)
+
+// TerminalGroup is a named collection of terminals, e.g. a site or a model. Groups form a hierarchy, and a terminal
+// may belong to several groups at once.
+type TerminalGroup = v1.TerminalGroup
+
+// TerminalGroupRepository stores the groups and their members
+type TerminalGroupRepository interface {
+	Add(ctx context.Context, group *TerminalGroup) (*TerminalGroup, error)
+	FindById(ctx context.Context, id int) (*TerminalGroup, error)
+	// FindByParent lists the children of the group, or the top level groups if the parent is nil
+	FindByParent(ctx context.Context, parentId *int) ([]*TerminalGroup, error)
+	Update(ctx context.Context, group *TerminalGroup) (*TerminalGroup, error)
+	// Remove deletes the group along with its memberships
+	Remove(ctx context.Context, id int) error
+	IsGroupExist(ctx context.Context, id int) (bool, error)
+	// FindChildIds finds the ids of the direct children of any of the groups
+	FindChildIds(ctx context.Context, ids []int) ([]int, error)
+	// AddMembers adds the terminals to the group, skipping the ones which are already members
+	AddMembers(ctx context.Context, id int, terminalIds []int) error
+	RemoveMembers(ctx context.Context, id int, terminalIds []int) error
+}
+
+// TerminalGroupManager maintains the hierarchy of the groups. The memberships are managed by [TerminalManager].
+type TerminalGroupManager struct {
+	repo TerminalGroupRepository
+}
+
+func NewTerminalGroupManager(repo TerminalGroupRepository) *TerminalGroupManager {
+	return &TerminalGroupManager{repo: repo}
+}
+
+func (m *TerminalGroupManager) Create(ctx context.Context, group *TerminalGroup) (*TerminalGroup, error) {
+	if group.ParentId != nil {
+		if err := m.checkParent(ctx, 0, int(*group.ParentId)); err != nil {
+			return nil, err
+		}
+	} else if err := m.checkTopLevelName(ctx, 0, group.Name); err != nil {
+		return nil, err
+	}
+	created, err := m.repo.Add(ctx, group)
+	if ent.IsConstraintError(err) {
+		return nil, v1.ErrorGroupAlreadyExists("There is already a group named %v under the parent", group.Name)
+	}
+	return created, err
+}
+
+func (m *TerminalGroupManager) GetById(ctx context.Context, id int) (group *TerminalGroup, err error) {
+	if group, err = m.repo.FindById(ctx, id); ent.IsNotFound(err) {
+		return nil, v1.ErrorGroupNotFound("There is no such group id %v", id)
+	}
+	return
+}
+
+// List returns the children of the group, or the top level groups if the parent is nil
+func (m *TerminalGroupManager) List(ctx context.Context, parentId *int) ([]*TerminalGroup, error) {
+	if parentId != nil {
+		if _, err := m.GetById(ctx, *parentId); err != nil {
+			return nil, err
+		}
+	}
+	return m.repo.FindByParent(ctx, parentId)
+}
+
+// Update replaces the name, the description and the parent of the group
+func (m *TerminalGroupManager) Update(ctx context.Context, group *TerminalGroup) (*TerminalGroup, error) {
+	if _, err := m.GetById(ctx, int(group.Id)); err != nil {
+		return nil, err
+	}
+	if group.ParentId != nil {
+		if err := m.checkParent(ctx, int(group.Id), int(*group.ParentId)); err != nil {
+			return nil, err
+		}
+	} else if err := m.checkTopLevelName(ctx, int(group.Id), group.Name); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.Update(ctx, group)
+	if ent.IsConstraintError(err) {
+		return nil, v1.ErrorGroupAlreadyExists("There is already a group named %v under the parent", group.Name)
+	}
+	return updated, err
+}
+
+// Delete removes the group. A group having children cannot be deleted, otherwise the children would be orphaned
+// silently.
+func (m *TerminalGroupManager) Delete(ctx context.Context, id int) error {
+	if _, err := m.GetById(ctx, id); err != nil {
+		return err
+	}
+	children, err := m.repo.FindChildIds(ctx, []int{id})
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return v1.ErrorGroupNotEmpty("Group %v has %d child groups", id, len(children))
+	}
+	return m.repo.Remove(ctx, id)
+}
+
+// checkParent makes sure the parent exists and is neither the group itself nor one of its descendants, which keeps
+// the hierarchy acyclic. The group id is zero for a new group.
+func (m *TerminalGroupManager) checkParent(ctx context.Context, id int, parentId int) error {
+	ext, err := m.repo.IsGroupExist(ctx, parentId)
+	if err != nil {
+		return err
+	}
+	if !ext {
+		return v1.ErrorInvalidGroupParent("There is no such parent group id %v", parentId)
+	}
+	if id == 0 {
+		return nil
+	}
+	for level := []int{id}; len(level) > 0; {
+		for _, descendant := range level {
+			if descendant == parentId {
+				return v1.ErrorInvalidGroupParent("Group %v cannot be moved under itself or its descendants", id)
+			}
+		}
+		if level, err = m.repo.FindChildIds(ctx, level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTopLevelName makes sure no other top level group has the name. The unique index on the parent and the name
+// does not cover the top level groups, since their null parents are distinct from each other in the databases. The
+// group id is zero for a new group.
+func (m *TerminalGroupManager) checkTopLevelName(ctx context.Context, id int, name string) error {
+	groups, err := m.repo.FindByParent(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Name == name && int(g.Id) != id {
+			return v1.ErrorGroupAlreadyExists("There is already a top level group named %v", name)
+		}
+	}
+	return nil
+}
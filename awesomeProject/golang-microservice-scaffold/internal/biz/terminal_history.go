@@ -0,0 +1,244 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/constant"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// TerminalStatusChange is a status transition of a terminal. The transitions are recorded whenever a terminal
+// reports a different status, turns offline because it has not reported in time, or is decommissioned.
+type TerminalStatusChange = v1.TerminalStatusChange
+
+// TerminalHistoryRepository reads the status history of the terminals
+type TerminalHistoryRepository interface {
+	// FindChanges lists a page of the transitions within [start, end) from the oldest to the newest and counts all
+	// of them
+	FindChanges(ctx context.Context, terminalId int, start, end time.Time, offset, limit int) (
+		[]*TerminalStatusChange, int, error)
+	// FindAllChanges finds all the transitions within [start, end) from the oldest to the newest
+	FindAllChanges(ctx context.Context, terminalId int, start, end time.Time) ([]*TerminalStatusChange, error)
+	// FindLastChangeBefore finds the latest transition before the time, or nil if there is none
+	FindLastChangeBefore(ctx context.Context, terminalId int, t time.Time) (*TerminalStatusChange, error)
+	// FindLastChangeFromBefore finds the latest transition from the status before the time, or nil if there is none
+	FindLastChangeFromBefore(ctx context.Context, terminalId int, status string, t time.Time) (
+		*TerminalStatusChange, error)
+}
+
+// defaultHistoryRange is the time range of the history and the reports if the start time is not specified
+const defaultHistoryRange = 7 * 24 * time.Hour
+
+// timeRange resolves the optional time range of a request
+func timeRange(start, end *timestamppb.Timestamp) (from, to time.Time, err error) {
+	to = time.Now()
+	if end != nil {
+		to = end.AsTime()
+	}
+	from = to.Add(-defaultHistoryRange)
+	if start != nil {
+		from = start.AsTime()
+	}
+	if !from.Before(to) {
+		return from, to, v1.ErrorMalformedInput("The start time %v is not before the end time %v", from, to)
+	}
+	return
+}
+
+// History returns a page of the status transitions of the terminal within the time range, along with the total
+// number of them
+func (m *TerminalManager) History(
+	ctx context.Context, terminalId int, start, end *timestamppb.Timestamp, offset, limit int,
+) ([]*TerminalStatusChange, int, error) {
+	from, to, err := timeRange(start, end)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err = m.GetTerminalById(ctx, terminalId); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = defaultTerminalPageSize
+	}
+	return m.history.FindChanges(ctx, terminalId, from, to, offset, limit)
+}
+
+// UptimeReport computes the availability of the terminal, or of the members of the group if the terminal id is
+// zero, over the time range
+func (m *TerminalManager) UptimeReport(
+	ctx context.Context, terminalId, groupId int, recursive bool, start, end *timestamppb.Timestamp,
+) (*v1.UptimeReport, error) {
+	from, to, err := timeRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	switch {
+	case terminalId > 0:
+		ids = []int{terminalId}
+	case groupId > 0:
+		var groupIds []int
+		if groupIds, err = m.groupIds(ctx, groupId, recursive); err != nil {
+			return nil, err
+		}
+		query := &TerminalQuery{GroupIds: groupIds, IncludeDecommissioned: true}
+		if ids, err = m.repo.FindIds(ctx, query); err != nil {
+			return nil, err
+		}
+		if len(ids) > maxBulkTargets {
+			return nil, v1.ErrorMalformedInput(
+				"The group has %d terminals, more than the limit %d", len(ids), maxBulkTargets)
+		}
+	default:
+		return nil, v1.ErrorMalformedInput("Either the terminal or the group must be specified")
+	}
+	report := &v1.UptimeReport{
+		StartTime: timestamppb.New(from),
+		EndTime:   timestamppb.New(to),
+		Terminals: make([]*v1.TerminalUptime, 0, len(ids)),
+	}
+	for _, id := range ids {
+		uptime, err := m.uptime(ctx, id, from, to)
+		if err != nil {
+			return nil, err
+		}
+		report.Terminals = append(report.Terminals, uptime)
+		report.UptimePercent += uptime.UptimePercent
+	}
+	if len(report.Terminals) > 0 {
+		report.UptimePercent /= float64(len(report.Terminals))
+	}
+	return report, nil
+}
+
+// uptime computes the availability of a terminal from its status history
+func (m *TerminalManager) uptime(ctx context.Context, id int, from, to time.Time) (*v1.TerminalUptime, error) {
+	terminal, err := m.GetTerminalById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := m.history.FindAllChanges(ctx, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	// The status at the start time is the result of the latest transition before it. Without such a transition,
+	// the terminal has kept the status it left with the first transition, or its current status if it has never
+	// changed at all.
+	var initial string
+	last, err := m.history.FindLastChangeBefore(ctx, id, from)
+	switch {
+	case err != nil:
+		return nil, err
+	case last != nil:
+		initial = last.ToStatus
+	case len(changes) > 0:
+		initial = changes[0].FromStatus
+	default:
+		initial = terminal.Status
+	}
+	// An outage in progress at the start time is counted from the moment the terminal went down, so that the time to
+	// recover from it is not cut short by the time range. The terminal which has never been online is regarded as
+	// down since the start time.
+	outageStart := from
+	if initial != constant.TerminalStatusOnline && initial != constant.TerminalStatusDecommissioned && last != nil {
+		down := last
+		if down.FromStatus != constant.TerminalStatusOnline {
+			down, err = m.history.FindLastChangeFromBefore(ctx, id, constant.TerminalStatusOnline, from)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if down != nil {
+			outageStart = down.ChangeTime.AsTime()
+		}
+	}
+	return uptimeOf(id, initial, outageStart, changes, from, to), nil
+}
+
+// uptimeOf computes the availability of a terminal over [from, to) given its status at the start time, the start
+// of the outage in progress at the start time if it is down, and the transitions in between. A terminal is up while
+// it is online, and down otherwise. The time after the terminal is decommissioned is not taken into account at all.
+func uptimeOf(
+	id int, initial string, outageStart time.Time, changes []*TerminalStatusChange, from, to time.Time,
+) *v1.TerminalUptime {
+	var up, down, recovery time.Duration
+	var outages, recovered int
+	status, since := initial, from
+	if status != constant.TerminalStatusOnline && status != constant.TerminalStatusDecommissioned {
+		outages++ // Already down at the start time
+	}
+	for _, c := range changes {
+		at := c.ChangeTime.AsTime()
+		if status == constant.TerminalStatusOnline {
+			up += at.Sub(since)
+		} else {
+			down += at.Sub(since)
+		}
+		if c.ToStatus == constant.TerminalStatusDecommissioned {
+			status = c.ToStatus
+			since = at
+			break
+		}
+		wasUp, isUp := status == constant.TerminalStatusOnline, c.ToStatus == constant.TerminalStatusOnline
+		switch {
+		case wasUp && !isUp:
+			outages++
+			outageStart = at
+		case !wasUp && isUp:
+			recovered++
+			recovery += at.Sub(outageStart)
+		}
+		status, since = c.ToStatus, at
+	}
+	if status != constant.TerminalStatusDecommissioned {
+		if status == constant.TerminalStatusOnline {
+			up += to.Sub(since)
+		} else {
+			down += to.Sub(since)
+		}
+	}
+	uptime := &v1.TerminalUptime{
+		TerminalId:  int64(id),
+		OutageCount: int32(outages),
+		Downtime:    durationpb.New(down),
+	}
+	if total := up + down; total > 0 {
+		uptime.UptimePercent = float64(up) / float64(total) * 100
+	}
+	if recovered > 0 {
+		uptime.MeanTimeToRecovery = durationpb.New(recovery / time.Duration(recovered))
+	}
+	return uptime
+}
+
+// SweepOffline marks the terminals which have not reported within their timeouts as offline, so that the outages
+// are recorded in the status history at the moment the terminals timed out. It should be run periodically.
+func (m *TerminalManager) SweepOffline(ctx context.Context) error {
+	terminals, err := m.repo.FindReporting(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, t := range terminals {
+		lastUpdated := t.LastUpdated.AsTime()
+		deadline := lastUpdated.Add(m.timeoutOf(t))
+		if now.Before(deadline) {
+			continue
+		}
+		// The terminal may report right now, in which case it is not marked at all
+		var marked bool
+		if marked, err = m.repo.MarkOffline(ctx, int(t.Id), t.Status, lastUpdated, deadline); err != nil {
+			return err
+		}
+		if marked {
+			m.notify(ctx, int(t.Id), constant.TerminalStatusOffline, deadline)
+			if err = m.markSensorsStale(ctx, int(t.Id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
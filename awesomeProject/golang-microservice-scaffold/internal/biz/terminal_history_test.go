@@ -0,0 +1,169 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/constant"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestUptimeOf(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	change := func(hours int, fromStatus, toStatus string) *TerminalStatusChange {
+		return &TerminalStatusChange{
+			FromStatus: fromStatus,
+			ToStatus:   toStatus,
+			ChangeTime: timestamppb.New(from.Add(time.Duration(hours) * time.Hour)),
+		}
+	}
+	online, offline := constant.TerminalStatusOnline, constant.TerminalStatusOffline
+	tests := []struct {
+		name        string
+		initial     string
+		outageStart time.Time
+		changes     []*TerminalStatusChange
+		percent     float64
+		outages     int32
+		mttr        time.Duration
+	}{
+		{name: "always up", initial: online, outageStart: from, percent: 100},
+		{
+			name:        "outage within the range",
+			initial:     online,
+			outageStart: from,
+			changes:     []*TerminalStatusChange{change(2, online, offline), change(4, offline, online)},
+			percent:     80,
+			outages:     1,
+			mttr:        2 * time.Hour,
+		},
+		{
+			// The outage began 3 hours before the range, so it took 5 hours to recover
+			name:        "outage in progress at the start",
+			initial:     offline,
+			outageStart: from.Add(-3 * time.Hour),
+			changes:     []*TerminalStatusChange{change(2, offline, online)},
+			percent:     80,
+			outages:     1,
+			mttr:        5 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := uptimeOf(1, tt.initial, tt.outageStart, tt.changes, from, to)
+			if u.UptimePercent != tt.percent {
+				t.Errorf("got uptime %v%%, want %v%%", u.UptimePercent, tt.percent)
+			}
+			if u.OutageCount != tt.outages {
+				t.Errorf("got %d outages, want %d", u.OutageCount, tt.outages)
+			}
+			if got := u.GetMeanTimeToRecovery().AsDuration(); got != tt.mttr {
+				t.Errorf("got MTTR %v, want %v", got, tt.mttr)
+			}
+		})
+	}
+}
+
+// historyRepo holds a single terminal and records its transitions as the repository does
+type historyRepo struct {
+	TerminalRepository
+	TerminalHistoryRepository
+	terminal *Terminal
+	changes  []*TerminalStatusChange
+}
+
+func (r *historyRepo) IsTerminalExist(context.Context, int) (bool, error) {
+	return true, nil
+}
+
+func (r *historyRepo) GetTerminalByID(context.Context, int) (*Terminal, error) {
+	return proto.Clone(r.terminal).(*Terminal), nil
+}
+
+func (r *historyRepo) change(to string, at time.Time) {
+	r.changes = append(r.changes, &TerminalStatusChange{
+		FromStatus: r.terminal.Status, ToStatus: to, ChangeTime: timestamppb.New(at),
+	})
+	r.terminal.Status = to
+}
+
+func (r *historyRepo) UpdateTerminal(_ context.Context, t *Terminal) error {
+	now := time.Now()
+	if r.terminal.Status != t.Status {
+		r.change(t.Status, now)
+	}
+	r.terminal.LastUpdated = timestamppb.New(now)
+	return nil
+}
+
+func (r *historyRepo) MarkOffline(_ context.Context, _ int, from string, lastUpdated, at time.Time) (bool, error) {
+	if r.terminal.Status != from || r.terminal.LastUpdated.AsTime().After(lastUpdated) {
+		return false, nil
+	}
+	r.change(constant.TerminalStatusOffline, at)
+	return true, nil
+}
+
+func TestUpdateRecordsMissedOutage(t *testing.T) {
+	online, offline := constant.TerminalStatusOnline, constant.TerminalStatusOffline
+	lastUpdated := time.Now().Add(-10 * time.Minute)
+	repo := &historyRepo{terminal: &Terminal{
+		Id: 1, Status: online, Timeout: 60, LastUpdated: timestamppb.New(lastUpdated),
+	}}
+	m := &TerminalManager{repo: repo, history: repo}
+	var observed []string
+	m.ObserveStatus(func(_ context.Context, _ int, status string, _ time.Time) {
+		observed = append(observed, status)
+	})
+
+	// The terminal timed out 9 minutes ago and reports again before the sweep has marked it
+	if err := m.Update(context.Background(), &Terminal{Id: 1, Status: online}); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.changes) != 2 {
+		t.Fatalf("got %d transitions, want 2", len(repo.changes))
+	}
+	down, up := repo.changes[0], repo.changes[1]
+	deadline := lastUpdated.Add(time.Minute)
+	if down.FromStatus != online || down.ToStatus != offline || !down.ChangeTime.AsTime().Equal(deadline) {
+		t.Errorf("got transition %v, want online to offline at the deadline", down)
+	}
+	if up.FromStatus != offline || up.ToStatus != online {
+		t.Errorf("got transition %v, want offline to online", up)
+	}
+	if len(observed) != 1 || observed[0] != online {
+		t.Errorf("got observed %v, want [online]", observed)
+	}
+
+	u := uptimeOf(1, online, lastUpdated, repo.changes, lastUpdated, up.ChangeTime.AsTime())
+	if u.OutageCount != 1 || u.Downtime.AsDuration() != up.ChangeTime.AsTime().Sub(down.ChangeTime.AsTime()) {
+		t.Errorf("got %d outages and downtime %v, want the outage since the deadline", u.OutageCount,
+			u.Downtime.AsDuration())
+	}
+
+	// A terminal reporting within its timeout records no outage
+	if err := m.Update(context.Background(), &Terminal{Id: 1, Status: online}); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.changes) != 2 || len(observed) != 1 {
+		t.Errorf("got %d transitions and observed %v", len(repo.changes), observed)
+	}
+}
+
+func TestUpdateRejectsUnknownStatus(t *testing.T) {
+	repo := &historyRepo{terminal: &Terminal{Id: 1, Status: constant.TerminalStatusOnline, Timeout: 60,
+		LastUpdated: timestamppb.Now()}}
+	m := &TerminalManager{repo: repo, history: repo}
+	for _, status := range []string{"", "busy", constant.TerminalStatusDecommissioned} {
+		if err := m.Update(context.Background(), &Terminal{Id: 1, Status: status}); !v1.IsMalformedInput(err) {
+			t.Errorf("got error %v for status %q", err, status)
+		}
+	}
+	if len(repo.changes) != 0 {
+		t.Errorf("got transitions %v", repo.changes)
+	}
+}
@@ -3,9 +3,12 @@ package biz
 import (
 	"context"
 	v1 "example/api/terminal"
+	"example/internal/conf"
 
 	"example/internal/constant"
 	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
 )
 
 // What we should do here includes:
@@ -22,27 +25,145 @@ import (
 // or infrastructure layer in a typical DDD repository.
 type Terminal = v1.Terminal
 
+// TerminalQuery finds the terminals matching all the given conditions. An empty condition matches all the terminals.
+type TerminalQuery struct {
+	// GroupIds finds the direct members of any of the groups
+	GroupIds []int
+	// Tags finds the terminals having all the tags, or any of them if MatchAnyTag is set
+	Tags        []string
+	MatchAnyTag bool
+	// Box finds the located terminals inside the bounding box
+	Box *v1.GeoBox
+	// Circle finds the located terminals within the circle, ordered by their distances to the center rather than
+	// their ids. The box should be set to the bounding box of the circle as well, which is served by the index.
+	Circle *v1.GeoCircle
+	// Located finds the terminals whose locations are known only
+	Located bool
+	// IncludeDecommissioned finds the decommissioned terminals as well
+	IncludeDecommissioned bool
+	Offset                int
+	Limit                 int
+}
+
 type TerminalRepository interface {
 	GetTerminalByID(ctx context.Context, id int) (*Terminal, error)
 	GetTerminalStatusByID(ctx context.Context, id int) (string, error)
-	UpdateTerminal(ctx context.Context, terminal Terminal) error
+	UpdateTerminal(ctx context.Context, terminal *Terminal) error
 	SetTerminalTimeout(ctx context.Context, id int, timeout int) error
+	SetFirmwareVersion(ctx context.Context, id int, version string) error
+	// SetLocation sets the location of the terminal, or clears it if the location is nil
+	SetLocation(ctx context.Context, id int, location *Location) error
 	IsTerminalExist(ctx context.Context, id int) (bool, error)
+	// FindTerminals lists a page of the matching terminals ordered by their ids and counts all the matches
+	FindTerminals(ctx context.Context, query *TerminalQuery) ([]*Terminal, int, error)
+	// FindIds finds the ids of all the matching terminals, regardless of the page
+	FindIds(ctx context.Context, query *TerminalQuery) ([]int, error)
+	// AddTags attaches the tags to the terminal, skipping the ones already attached
+	AddTags(ctx context.Context, id int, tags []string) error
+	RemoveTags(ctx context.Context, id int, tags []string) error
+	// Decommission marks the terminal as decommissioned and fails its outstanding commands
+	Decommission(ctx context.Context, id int) error
+	// FindReporting finds the terminals in service which are not known to be offline, bypassing any cache
+	FindReporting(ctx context.Context) ([]*Terminal, error)
+	// MarkOffline turns the terminal offline and records the transition at the given time, unless the terminal has
+	// changed its status or reported after the last update time. It reports whether the terminal is marked.
+	MarkOffline(ctx context.Context, id int, from string, lastUpdated time.Time, at time.Time) (bool, error)
 }
 
+// defaultTerminalTimeout is the timeout of the terminals which have not set their own, unless it is configured
+const defaultTerminalTimeout = 60 * time.Second
+
+// StatusObserver is notified of the changes of the effective status of the terminals, along with the time of the
+// changes
+type StatusObserver func(ctx context.Context, id int, status string, at time.Time)
+
 // UserManager is where the business logic resides. It encapsulates the repository inside and provides intuitive
 // operations to help the upper layers only concentrate on the business logic instead of manipulating the repository.
 type TerminalManager struct {
-	repo    TerminalRepository
-	timeout time.Duration
+	repo      TerminalRepository
+	groups    TerminalGroupRepository
+	history   TerminalHistoryRepository
+	sensors   SensorRepository
+	observers []StatusObserver
+	// live provides the default timeout, which is reloaded at runtime
+	live *conf.Live
 }
 
-func NewTerminalManager(repo TerminalRepository) *TerminalManager {
-	return &TerminalManager{repo: repo}
+func NewTerminalManager(
+	repo TerminalRepository, groups TerminalGroupRepository, history TerminalHistoryRepository,
+	sensors SensorRepository, live *conf.Live) *TerminalManager {
+	return &TerminalManager{repo: repo, groups: groups, history: history, sensors: sensors, live: live}
 }
 
+// Update records the status reported by the terminal, which is either online or offline. Decommissioned terminals
+// are not allowed to report, and only the administrators decommission the terminals.
 func (m *TerminalManager) Update(ctx context.Context, terminal *Terminal) error {
-	return m.repo.UpdateTerminal(ctx, terminal)
+	if terminal.Status != constant.TerminalStatusOnline && terminal.Status != constant.TerminalStatusOffline {
+		return v1.ErrorMalformedInput("Unknown status %q, which is either online or offline", terminal.Status)
+	}
+	t, err := m.GetTerminalById(ctx, int(terminal.Id))
+	if err != nil {
+		return err
+	}
+	if t.DecommissionTime != nil {
+		return v1.ErrorTerminalDecommissioned("Terminal %v has been decommissioned", terminal.Id)
+	}
+	previous := m.statusOf(t)
+	if previous == constant.TerminalStatusOffline && t.Status != constant.TerminalStatusOffline {
+		// The terminal has timed out before the sweep has marked it, so the outage is recorded now as the sweep
+		// would have, unless the terminal has been marked or has reported in the meantime
+		lastUpdated := t.LastUpdated.AsTime()
+		if _, err = m.repo.MarkOffline(
+			ctx, int(t.Id), t.Status, lastUpdated, lastUpdated.Add(m.timeoutOf(t))); err != nil {
+			return err
+		}
+	}
+	if err = m.repo.UpdateTerminal(ctx, terminal); err != nil {
+		return err
+	}
+	if terminal.Status != previous {
+		m.notify(ctx, int(terminal.Id), terminal.Status, time.Now())
+	}
+	if terminal.Status == constant.TerminalStatusOffline && t.Status != constant.TerminalStatusOffline {
+		return m.markSensorsStale(ctx, int(terminal.Id))
+	}
+	return nil
+}
+
+// ObserveStatus registers the observer of the status changes. It must be called before any terminal reports, i.e.
+// while the application is being initialized.
+func (m *TerminalManager) ObserveStatus(o StatusObserver) {
+	m.observers = append(m.observers, o)
+}
+
+// notify tells the observers the change of the status of the terminal
+func (m *TerminalManager) notify(ctx context.Context, id int, status string, at time.Time) {
+	for _, o := range m.observers {
+		o(ctx, id, status, at)
+	}
+}
+
+// markSensorsStale marks the sensors of the terminal which has gone offline, since their latest readings are no
+// longer up to date. The marks are cleared as soon as the sensors report again.
+func (m *TerminalManager) markSensorsStale(ctx context.Context, id int) error {
+	_, err := m.sensors.MarkStale(ctx, id)
+	return err
+}
+
+// GetTerminal returns the terminal, whose status turns offline if it has not reported in time. The sensors attached
+// to the terminal are included if requested.
+func (m *TerminalManager) GetTerminal(ctx context.Context, id int, includeSensors bool) (*Terminal, error) {
+	terminal, err := m.GetTerminalById(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	terminal.Status = m.statusOf(terminal)
+	if includeSensors {
+		if terminal.Sensors, err = m.sensors.FindByTerminal(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return terminal, nil
 }
 
 func (m *TerminalManager) GetTerminalById(ctx context.Context, id int) (terminal *Terminal, err error) {
@@ -56,16 +177,253 @@ func (m *TerminalManager) GetTerminalById(ctx context.Context, id int) (terminal
 	return m.repo.GetTerminalByID(ctx, id)
 }
 func (m *TerminalManager) GetTerminalStatus(ctx context.Context, id int) (string, error) {
-	terminal, err := m.repo.GetTerminalByID(ctx, id)
+	terminal, err := m.GetTerminalById(ctx, id)
 	if err != nil {
 		return "", err
 	}
+	return m.statusOf(terminal), nil
+}
+
+// timeoutOf returns the duration after which the silent terminal is regarded as offline, which is the configured
+// default unless the terminal has set its own
+func (m *TerminalManager) timeoutOf(terminal *Terminal) time.Duration {
+	if terminal.Timeout > 0 {
+		return time.Duration(terminal.Timeout) * time.Second
+	}
+	if timeout := m.live.Get().GetTerminal().GetDefaultTimeout().AsDuration(); timeout > 0 {
+		return timeout
+	}
+	return defaultTerminalTimeout
+}
+
+// statusOf returns the effective status of the terminal
+func (m *TerminalManager) statusOf(terminal *Terminal) string {
+	if terminal.DecommissionTime != nil {
+		return constant.TerminalStatusDecommissioned
+	}
 	// if timeout status become offline
-	if time.Since(terminal.LastUpdated) > m.timeout {
-		return constant.TerminalStatusOffline, nil
+	if time.Since(terminal.LastUpdated.AsTime()) > m.timeoutOf(terminal) {
+		return constant.TerminalStatusOffline
 	}
-	return terminal.Status, nil
+	return terminal.Status
 }
 func (m *TerminalManager) SetTimeOut(ctx context.Context, id int, timeout int) error {
+	if _, err := m.GetTerminalById(ctx, id); err != nil {
+		return err
+	}
 	return m.repo.SetTerminalTimeout(ctx, id, timeout)
 }
+
+// IsTerminalExist reports whether the terminal with the given id has been registered
+func (m *TerminalManager) IsTerminalExist(ctx context.Context, id int) (bool, error) {
+	return m.repo.IsTerminalExist(ctx, id)
+}
+
+// TerminalSelector selects the targets of a bulk operation
+type TerminalSelector = v1.TerminalSelector
+
+// BulkResult is the outcome of a bulk operation for a single terminal
+type BulkResult = v1.BulkResult
+
+// maxBulkTargets limits the number of terminals a single bulk operation may target
+const maxBulkTargets = 10000
+
+// Select resolves the ids of the terminals matched by the selector. The ids listed explicitly are returned as they
+// are, so that the bulk operations report the unknown and decommissioned ones instead of skipping them silently.
+func (m *TerminalManager) Select(ctx context.Context, sel *TerminalSelector) (ids []int, err error) {
+	query := &TerminalQuery{IncludeDecommissioned: sel.IncludeDecommissioned}
+	switch target := sel.Target.(type) {
+	case *v1.TerminalSelector_Ids_:
+		seen := make(map[int]struct{}, len(target.Ids.Ids))
+		for _, id := range target.Ids.Ids {
+			if _, ok := seen[int(id)]; !ok {
+				seen[int(id)] = struct{}{}
+				ids = append(ids, int(id))
+			}
+		}
+		return
+	case *v1.TerminalSelector_GroupId:
+		if query.GroupIds, err = m.groupIds(ctx, int(target.GroupId), sel.Recursive); err != nil {
+			return
+		}
+	case *v1.TerminalSelector_Tags_:
+		query.Tags, query.MatchAnyTag = target.Tags.Tags, target.Tags.MatchAny
+	default:
+		return nil, v1.ErrorMalformedInput("The selector has no target")
+	}
+	if ids, err = m.repo.FindIds(ctx, query); err != nil {
+		return
+	}
+	if len(ids) > maxBulkTargets {
+		return nil, v1.ErrorMalformedInput(
+			"The selector matches %d terminals, more than the limit %d", len(ids), maxBulkTargets)
+	}
+	return
+}
+
+// groupIds returns the id of the group, followed by the ids of its descendants if recursive is set
+func (m *TerminalManager) groupIds(ctx context.Context, id int, recursive bool) ([]int, error) {
+	ext, err := m.groups.IsGroupExist(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ext {
+		return nil, v1.ErrorGroupNotFound("There is no such group id %v", id)
+	}
+	ids := []int{id}
+	if !recursive {
+		return ids, nil
+	}
+	// Walk down the hierarchy level by level. The hierarchy is guaranteed to be acyclic by the group manager.
+	for level := ids; len(level) > 0; {
+		if level, err = m.groups.FindChildIds(ctx, level); err != nil {
+			return nil, err
+		}
+		ids = append(ids, level...)
+	}
+	return ids, nil
+}
+
+// Bulk runs the operation on each of the terminals matched by the selector and collects the outcomes. A failure
+// for one terminal does not stop the others. The operation may fill in the extra fields of the result.
+func (m *TerminalManager) Bulk(
+	ctx context.Context, sel *TerminalSelector,
+	op func(ctx context.Context, terminal *Terminal, res *BulkResult) error) (*v1.BulkReply, error) {
+	ids, err := m.Select(ctx, sel)
+	if err != nil {
+		return nil, err
+	}
+	return m.bulk(ctx, ids, func(ctx context.Context, id int, res *BulkResult) error {
+		terminal, err := m.GetTerminalById(ctx, id)
+		if err != nil {
+			return err
+		}
+		if terminal.DecommissionTime != nil && !sel.IncludeDecommissioned {
+			return v1.ErrorTerminalDecommissioned("Terminal %v has been decommissioned", id)
+		}
+		return op(ctx, terminal, res)
+	})
+}
+
+// bulk runs the operation on each of the terminals and collects the outcomes
+func (m *TerminalManager) bulk(
+	ctx context.Context, ids []int, op func(ctx context.Context, id int, res *BulkResult) error) (*v1.BulkReply, error) {
+	reply := &v1.BulkReply{Results: make([]*BulkResult, 0, len(ids))}
+	for _, id := range ids {
+		// Give up the remaining terminals if the caller has gone
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		res := &BulkResult{TerminalId: int64(id)}
+		if err := op(ctx, id, res); err != nil {
+			e := errors.FromError(err)
+			res.Reason, res.Message = e.Reason, e.Message
+			reply.Failed++
+		} else {
+			res.Success = true
+			reply.Succeeded++
+		}
+		reply.Results = append(reply.Results, res)
+	}
+	return reply, nil
+}
+
+// BulkSetTimeOut sets the timeout of the selected terminals
+func (m *TerminalManager) BulkSetTimeOut(
+	ctx context.Context, sel *TerminalSelector, timeout int) (*v1.BulkReply, error) {
+	return m.Bulk(ctx, sel, func(ctx context.Context, terminal *Terminal, _ *BulkResult) error {
+		return m.repo.SetTerminalTimeout(ctx, int(terminal.Id), timeout)
+	})
+}
+
+// Decommission retires the selected terminals. Decommissioning a terminal twice has no effect.
+func (m *TerminalManager) Decommission(ctx context.Context, sel *TerminalSelector) (*v1.BulkReply, error) {
+	return m.Bulk(ctx, sel, func(ctx context.Context, terminal *Terminal, _ *BulkResult) error {
+		if terminal.DecommissionTime != nil {
+			return nil
+		}
+		if err := m.repo.Decommission(ctx, int(terminal.Id)); err != nil {
+			return err
+		}
+		m.notify(ctx, int(terminal.Id), constant.TerminalStatusDecommissioned, time.Now())
+		return nil
+	})
+}
+
+// Tag attaches the tags to each of the terminals
+func (m *TerminalManager) Tag(ctx context.Context, ids []int, tags []string) (*v1.BulkReply, error) {
+	return m.bulk(ctx, ids, func(ctx context.Context, id int, _ *BulkResult) error {
+		if _, err := m.GetTerminalById(ctx, id); err != nil {
+			return err
+		}
+		return m.repo.AddTags(ctx, id, tags)
+	})
+}
+
+// Untag detaches the tags from each of the terminals
+func (m *TerminalManager) Untag(ctx context.Context, ids []int, tags []string) (*v1.BulkReply, error) {
+	return m.bulk(ctx, ids, func(ctx context.Context, id int, _ *BulkResult) error {
+		if _, err := m.GetTerminalById(ctx, id); err != nil {
+			return err
+		}
+		return m.repo.RemoveTags(ctx, id, tags)
+	})
+}
+
+// ListGroupMembers returns a page of the members of the group, including the members of its descendants if
+// recursive is set, along with the total number of them.
+func (m *TerminalManager) ListGroupMembers(
+	ctx context.Context, groupId int, recursive bool, offset, limit int) ([]*Terminal, int, error) {
+	ids, err := m.groupIds(ctx, groupId, recursive)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = defaultTerminalPageSize
+	}
+	return m.repo.FindTerminals(ctx, &TerminalQuery{
+		GroupIds:              ids,
+		IncludeDecommissioned: true,
+		Offset:                offset,
+		Limit:                 limit,
+	})
+}
+
+// GroupMemberIds finds the ids of the members of the group which are in service, including the members of its
+// descendants if recursive is set
+func (m *TerminalManager) GroupMemberIds(ctx context.Context, groupId int, recursive bool) ([]int, error) {
+	ids, err := m.groupIds(ctx, groupId, recursive)
+	if err != nil {
+		return nil, err
+	}
+	return m.repo.FindIds(ctx, &TerminalQuery{GroupIds: ids})
+}
+
+// Assign adds each of the terminals to the group
+func (m *TerminalManager) Assign(ctx context.Context, groupId int, ids []int) (*v1.BulkReply, error) {
+	if _, err := m.groupIds(ctx, groupId, false); err != nil {
+		return nil, err
+	}
+	return m.bulk(ctx, ids, func(ctx context.Context, id int, _ *BulkResult) error {
+		if _, err := m.GetTerminalById(ctx, id); err != nil {
+			return err
+		}
+		return m.groups.AddMembers(ctx, groupId, []int{id})
+	})
+}
+
+// Unassign removes each of the terminals from the group
+func (m *TerminalManager) Unassign(ctx context.Context, groupId int, ids []int) (*v1.BulkReply, error) {
+	if _, err := m.groupIds(ctx, groupId, false); err != nil {
+		return nil, err
+	}
+	return m.bulk(ctx, ids, func(ctx context.Context, id int, _ *BulkResult) error {
+		if _, err := m.GetTerminalById(ctx, id); err != nil {
+			return err
+		}
+		return m.groups.RemoveMembers(ctx, groupId, []int{id})
+	})
+}
+
+// defaultTerminalPageSize is the number of terminals per page if the page size is not specified
+const defaultTerminalPageSize = 50
@@ -0,0 +1,87 @@
+package biz
+
+// unit converts the values of a UCUM unit linearly into the base unit of its dimension, i.e. the value in the base
+// unit is value*scale + offset
+type unit struct {
+	dimension     string
+	scale, offset float64
+}
+
+// units are the UCUM units which the readings can be converted between. The other units are allowed in the sensor
+// type catalog, whose readings are just not convertible.
+var units = map[string]unit{
+	// Temperature in kelvins
+	"K":      {"temperature", 1, 0},
+	"Cel":    {"temperature", 1, 273.15},
+	"[degF]": {"temperature", 5.0 / 9, 459.67 * 5 / 9},
+	// Length in meters
+	"m":      {"length", 1, 0},
+	"km":     {"length", 1e3, 0},
+	"cm":     {"length", 1e-2, 0},
+	"mm":     {"length", 1e-3, 0},
+	"[in_i]": {"length", 0.0254, 0},
+	"[ft_i]": {"length", 0.3048, 0},
+	"[mi_i]": {"length", 1609.344, 0},
+	// Mass in kilograms
+	"kg":      {"mass", 1, 0},
+	"g":       {"mass", 1e-3, 0},
+	"[lb_av]": {"mass", 0.45359237, 0},
+	// Pressure in pascals
+	"Pa":     {"pressure", 1, 0},
+	"hPa":    {"pressure", 1e2, 0},
+	"kPa":    {"pressure", 1e3, 0},
+	"bar":    {"pressure", 1e5, 0},
+	"mbar":   {"pressure", 1e2, 0},
+	"atm":    {"pressure", 101325, 0},
+	"[psi]":  {"pressure", 6894.757293168, 0},
+	"mm[Hg]": {"pressure", 133.322387415, 0},
+	// Speed in meters per second
+	"m/s":      {"speed", 1, 0},
+	"km/h":     {"speed", 1 / 3.6, 0},
+	"[mi_i]/h": {"speed", 0.44704, 0},
+	"[kn_i]":   {"speed", 1852.0 / 3600, 0},
+	// Dimensionless ratios
+	"1":     {"ratio", 1, 0},
+	"%":     {"ratio", 1e-2, 0},
+	"[ppm]": {"ratio", 1e-6, 0},
+	"[ppb]": {"ratio", 1e-9, 0},
+	// Energy in joules
+	"J":    {"energy", 1, 0},
+	"kJ":   {"energy", 1e3, 0},
+	"W.h":  {"energy", 3600, 0},
+	"kW.h": {"energy", 3.6e6, 0},
+	// Power in watts
+	"W":  {"power", 1, 0},
+	"mW": {"power", 1e-3, 0},
+	"kW": {"power", 1e3, 0},
+	// Electric potential in volts and current in amperes
+	"V":  {"voltage", 1, 0},
+	"mV": {"voltage", 1e-3, 0},
+	"A":  {"current", 1, 0},
+	"mA": {"current", 1e-3, 0},
+	// Frequency in hertz
+	"Hz":  {"frequency", 1, 0},
+	"kHz": {"frequency", 1e3, 0},
+	// Duration in seconds
+	"s":   {"time", 1, 0},
+	"ms":  {"time", 1e-3, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+}
+
+// converterOf returns the function converting the values from a unit to another, and reports whether the units
+// are convertible
+func converterOf(from, to string) (func(float64) float64, bool) {
+	if from == to {
+		return func(v float64) float64 { return v }, true
+	}
+	f, ok := units[from]
+	if !ok {
+		return nil, false
+	}
+	t, ok := units[to]
+	if !ok || f.dimension != t.dimension {
+		return nil, false
+	}
+	return func(v float64) float64 { return (v*f.scale + f.offset - t.offset) / t.scale }, true
+}
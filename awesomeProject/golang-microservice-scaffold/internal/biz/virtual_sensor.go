@@ -0,0 +1,564 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/ent"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// VirtualSensor is the definition of a sensor whose readings are computed from the readings of other sensors
+type VirtualSensor = v1.VirtualSensor
+
+// VirtualSensorRepository stores the definitions of the virtual sensors along with their sensors
+type VirtualSensorRepository interface {
+	// Add creates the sensor of the definition along with the definition, whose sensor id is filled in. A sensor of
+	// the same type and identifier as an existing one violates the unique constraint.
+	Add(ctx context.Context, v *VirtualSensor) (*VirtualSensor, error)
+	FindById(ctx context.Context, sensorId int) (*VirtualSensor, error)
+	// FindBySensors finds the definitions of the sensors. The sensors which are not virtual are absent from the
+	// result.
+	FindBySensors(ctx context.Context, ids []int) (map[int]*VirtualSensor, error)
+	// FindByInputs finds the definitions which any of the sensors is an input of in the order of their sensor ids
+	FindByInputs(ctx context.Context, ids []int) ([]*VirtualSensor, error)
+	// FindAll finds all the definitions in the order of their sensor ids
+	FindAll(ctx context.Context) ([]*VirtualSensor, error)
+	// Update replaces the expression, the inputs, the evaluation, the window and the description of the definition
+	Update(ctx context.Context, v *VirtualSensor) (*VirtualSensor, error)
+	Delete(ctx context.Context, sensorId int) error
+}
+
+const (
+	// defaultVirtualWindow is how much earlier than a computed reading the readings of the inputs may be by default
+	defaultVirtualWindow = 5 * time.Minute
+	// maxVirtualDepth bounds the chains of the virtual sensors which are inputs of one another
+	maxVirtualDepth = 8
+	// virtualQueueSize is the capacity of the queue of the written readings to compute the virtual sensors from
+	virtualQueueSize = 1000
+)
+
+var droppedVirtualReadings = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "virtual_sensor_dropped_readings_total",
+	Help: "Number of the written readings which the virtual sensors are not computed from since the queue is full",
+})
+
+// virtualSource computes the readings of a virtual sensor from the stored readings of its inputs
+type virtualSource struct {
+	sensorId int
+	compiled *expression
+	// inputs are the sensors in the order of the variables of the compiled expression
+	inputs []int
+	window time.Duration
+	// sensorType rounds and flags the computed readings if it is in the catalog
+	sensorType *SensorType
+}
+
+// newVirtualSource compiles the definition, which has been validated on its creation
+func newVirtualSource(v *VirtualSensor) (*virtualSource, error) {
+	variables := make(map[string]struct{}, len(v.Inputs))
+	for name := range v.Inputs {
+		variables[name] = struct{}{}
+	}
+	compiled, err := compileExpression(v.Expression, variables)
+	if err != nil {
+		return nil, err
+	}
+	s := &virtualSource{sensorId: int(v.SensorId), compiled: compiled, window: v.Window.AsDuration()}
+	for _, name := range compiled.variables {
+		s.inputs = append(s.inputs, int(v.Inputs[name]))
+	}
+	return s, nil
+}
+
+// compute computes the reading at the time from the latest readings of the inputs, which is nil if any of them is
+// missing or out of the window, or if the value is not finite
+func (s *virtualSource) compute(t time.Time, latest []*SensorReading) *SensorReading {
+	values := make([]float64, len(latest))
+	for i, r := range latest {
+		if r == nil || r.Timestamp.Before(t.Add(-s.window)) {
+			return nil
+		}
+		values[i] = r.Value
+	}
+	value := s.compiled.eval(values)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	r := &SensorReading{SensorId: s.sensorId, Value: value, Timestamp: t}
+	if s.sensorType != nil {
+		flagReading(s.sensorType, r)
+	}
+	return r
+}
+
+// computeValues computes at most limit readings of the virtual sensor within the time range [from, to) in the order
+// of time, one at the timestamp of each reading of any of its inputs
+func (m *SensorManager) computeValues(
+	ctx context.Context, s *virtualSource, from, to time.Time, limit int) ([]*SensorReading, error) {
+	latest := make([]*SensorReading, len(s.inputs))
+	for i, id := range s.inputs {
+		r, err := m.repo.FindValueBefore(ctx, id, from)
+		if err != nil {
+			return nil, err
+		}
+		latest[i] = r
+	}
+	type inputReading struct {
+		input   int
+		reading *SensorReading
+	}
+	var computed []*SensorReading
+	for cursor := from; cursor.Before(to) && len(computed) < limit; {
+		// The readings of the inputs are merged up to the earliest end of the pages which may be followed by more
+		horizon := to
+		var merged []inputReading
+		for i, id := range s.inputs {
+			page, err := m.repo.FindValues(ctx, id, cursor, to, scanPageSize)
+			if err != nil {
+				return nil, err
+			}
+			if len(page) == scanPageSize {
+				horizon = earlier(horizon, page[len(page)-1].Timestamp.Add(time.Microsecond))
+			}
+			for _, r := range page {
+				merged = append(merged, inputReading{input: i, reading: r})
+			}
+		}
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].reading.Timestamp.Before(merged[j].reading.Timestamp)
+		})
+		for i := 0; i < len(merged) && merged[i].reading.Timestamp.Before(horizon); {
+			t := merged[i].reading.Timestamp
+			for ; i < len(merged) && merged[i].reading.Timestamp.Equal(t); i++ {
+				latest[merged[i].input] = merged[i].reading
+			}
+			if r := s.compute(t, latest); r != nil {
+				computed = append(computed, r)
+			}
+		}
+		cursor = horizon
+	}
+	if len(computed) > limit {
+		computed = computed[:limit]
+	}
+	return computed, nil
+}
+
+// computeValueAt computes the reading of the virtual sensor at the timestamp of the latest reading of any of its
+// inputs before the time, or at or after it if after is set, which is nil if there is none
+func (m *SensorManager) computeValueAt(
+	ctx context.Context, s *virtualSource, t time.Time, after bool) (*SensorReading, error) {
+	var at time.Time
+	for _, id := range s.inputs {
+		var r *SensorReading
+		var err error
+		if after {
+			r, err = m.repo.FindValueAfter(ctx, id, t)
+		} else {
+			r, err = m.repo.FindValueBefore(ctx, id, t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && (at.IsZero() || after && r.Timestamp.Before(at) || !after && r.Timestamp.After(at)) {
+			at = r.Timestamp
+		}
+	}
+	if at.IsZero() {
+		return nil, nil
+	}
+	latest := make([]*SensorReading, len(s.inputs))
+	for i, id := range s.inputs {
+		r, err := m.repo.FindValueBefore(ctx, id, at.Add(time.Microsecond))
+		if err != nil {
+			return nil, err
+		}
+		latest[i] = r
+	}
+	return s.compute(at, latest), nil
+}
+
+// querySources compiles the definitions of the sensors evaluated on query, whose types have been found. The other
+// sensors are absent from the result.
+func (m *SensorManager) querySources(
+	ctx context.Context, ids []int, types map[int]*SensorType) (map[int]*virtualSource, error) {
+	virtuals, err := m.virtuals.FindBySensors(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[int]*virtualSource)
+	for id, v := range virtuals {
+		if v.Evaluation != v1.VirtualSensor_QUERY {
+			continue
+		}
+		s, err := newVirtualSource(v)
+		if err != nil {
+			return nil, err
+		}
+		s.sensorType = types[id]
+		sources[id] = s
+	}
+	return sources, nil
+}
+
+// writeComputed rounds and flags the computed readings by the types of their sensors, writes them and notifies the
+// observers, which computes the virtual sensors they are inputs of in turn. The readings which have been computed
+// before are skipped, and the observers are not notified of them again.
+func (m *SensorManager) writeComputed(ctx context.Context, readings []*SensorReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	seen := make(map[int]struct{})
+	ids := make([]int, 0, 1)
+	for _, r := range readings {
+		if _, ok := seen[r.SensorId]; !ok {
+			seen[r.SensorId] = struct{}{}
+			ids = append(ids, r.SensorId)
+		}
+	}
+	types, err := m.typesOf(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, r := range readings {
+		if t, ok := types[r.SensorId]; ok {
+			flagReading(t, r)
+		}
+	}
+	added, err := m.addValues(ctx, readings)
+	if err != nil || len(added) == 0 {
+		return err
+	}
+	m.cacheLatest(ctx, added)
+	for _, o := range m.observers {
+		o(ctx, added)
+	}
+	return nil
+}
+
+// VirtualSensorManager maintains the definitions of the virtual sensors, and computes the readings of the ones
+// evaluated on ingestion as the readings of their inputs are written.
+//
+// The written readings are queued without blocking the writer, and the virtual sensors are computed from them on the
+// goroutine of [VirtualSensorManager.Run].
+type VirtualSensorManager struct {
+	repo    VirtualSensorRepository
+	sensors *SensorManager
+	log     *log.Helper
+	// queue holds the batches of the written readings to compute the virtual sensors from
+	queue chan *virtualBatch
+	// mu serializes the changes of the definitions, so that two of them cannot make a cycle together
+	mu sync.Mutex
+}
+
+// virtualBatch is a batch of the written readings to compute the virtual sensors from
+type virtualBatch struct {
+	readings []*SensorReading
+	// depth is the number of the virtual sensors which the readings have been computed through
+	depth int
+}
+
+// virtualDepthKey is the context key of the depth of the readings being computed
+type virtualDepthKey struct{}
+
+func NewVirtualSensorManager(
+	repo VirtualSensorRepository, sensors *SensorManager, logger log.Logger) *VirtualSensorManager {
+	m := &VirtualSensorManager{
+		repo:    repo,
+		sensors: sensors,
+		log:     log.NewHelper(log.With(logger, "module", "biz/virtual-sensor")),
+		queue:   make(chan *virtualBatch, virtualQueueSize),
+	}
+	sensors.ObserveReadings(m.onReadings)
+	return m
+}
+
+// check validates the definition, i.e. its expression and its inputs, and fills in the default window. The sensor
+// of the definition is zero if it is being created.
+func (m *VirtualSensorManager) check(ctx context.Context, v *VirtualSensor) error {
+	if v.Window == nil {
+		v.Window = durationpb.New(defaultVirtualWindow)
+	}
+	if v.Evaluation == v1.VirtualSensor_EVALUATION_UNSPECIFIED {
+		v.Evaluation = v1.VirtualSensor_INGESTION
+	}
+	variables := make(map[string]struct{}, len(v.Inputs))
+	ids := make([]int, 0, len(v.Inputs))
+	for name, id := range v.Inputs {
+		variables[name] = struct{}{}
+		ids = append(ids, int(id))
+	}
+	compiled, err := compileExpression(v.Expression, variables)
+	if err != nil {
+		return v1.ErrorInvalidExpression("Invalid expression %q: %v", v.Expression, err)
+	}
+	referred := make(map[string]struct{}, len(compiled.variables))
+	for _, name := range compiled.variables {
+		referred[name] = struct{}{}
+	}
+	for name := range v.Inputs {
+		if _, ok := referred[name]; !ok {
+			return v1.ErrorInvalidExpression("Input %v is not referred to by the expression", name)
+		}
+	}
+	if _, err = m.sensors.typesOf(ctx, ids); err != nil {
+		return err
+	}
+	inputs, err := m.repo.FindBySensors(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for id, input := range inputs {
+		if input.Evaluation == v1.VirtualSensor_QUERY {
+			return v1.ErrorInvalidExpression(
+				"Sensor %v is evaluated on query, which cannot be an input of another virtual sensor", id)
+		}
+	}
+	if v.SensorId != 0 && v.Evaluation == v1.VirtualSensor_QUERY {
+		dependents, err := m.repo.FindByInputs(ctx, []int{int(v.SensorId)})
+		if err != nil {
+			return err
+		}
+		if len(dependents) > 0 {
+			return v1.ErrorInvalidExpression(
+				"Sensor %v is an input of virtual sensor %v, so it cannot be evaluated on query",
+				v.SensorId, dependents[0].SensorId)
+		}
+	}
+	return m.checkCycle(ctx, int(v.SensorId), ids, inputs)
+}
+
+// checkCycle walks through the inputs of the inputs of the virtual sensor, and fails if it reaches the sensor
+// itself, or if the sensor would be in a chain of more than maxVirtualDepth virtual sensors along with its inputs
+// and its dependents. The sensor is zero if it is being created. The definitions of the direct inputs have been
+// found.
+func (m *VirtualSensorManager) checkCycle(
+	ctx context.Context, sensorId int, ids []int, found map[int]*VirtualSensor) error {
+	below := 0
+	if sensorId != 0 {
+		var err error
+		if below, err = m.dependentDepth(ctx, sensorId); err != nil {
+			return err
+		}
+	}
+	visited := make(map[int]struct{})
+	for depth := 1; len(ids) > 0; depth++ {
+		var next []int
+		for _, id := range ids {
+			if id == sensorId {
+				return v1.ErrorDependencyCycle("The inputs of virtual sensor %v depend on the sensor itself", sensorId)
+			}
+			visited[id] = struct{}{}
+		}
+		if len(found) > 0 && depth+below >= maxVirtualDepth {
+			return v1.ErrorInvalidExpression("The inputs make a chain of more than %d virtual sensors", maxVirtualDepth)
+		}
+		for _, v := range found {
+			for _, input := range v.Inputs {
+				if _, ok := visited[int(input)]; !ok {
+					visited[int(input)] = struct{}{}
+					next = append(next, int(input))
+				}
+			}
+		}
+		if ids = next; len(ids) == 0 {
+			break
+		}
+		var err error
+		if found, err = m.repo.FindBySensors(ctx, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependentDepth finds how many levels of the virtual sensors depend on the sensor, up to maxVirtualDepth
+func (m *VirtualSensorManager) dependentDepth(ctx context.Context, sensorId int) (int, error) {
+	visited := map[int]struct{}{sensorId: {}}
+	ids := []int{sensorId}
+	depth := 0
+	for ; depth < maxVirtualDepth; depth++ {
+		dependents, err := m.repo.FindByInputs(ctx, ids)
+		if err != nil {
+			return 0, err
+		}
+		var next []int
+		for _, v := range dependents {
+			if _, ok := visited[int(v.SensorId)]; !ok {
+				visited[int(v.SensorId)] = struct{}{}
+				next = append(next, int(v.SensorId))
+			}
+		}
+		if ids = next; len(ids) == 0 {
+			break
+		}
+	}
+	return depth, nil
+}
+
+// CreateVirtualSensor creates the virtual sensor along with its definition
+func (m *VirtualSensorManager) CreateVirtualSensor(ctx context.Context, v *VirtualSensor) (*VirtualSensor, error) {
+	v.SensorId = 0
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(ctx, v); err != nil {
+		return nil, err
+	}
+	created, err := m.repo.Add(ctx, v)
+	if ent.IsConstraintError(err) {
+		return nil, v1.ErrorSensorAlreadyExists(
+			"There is another sensor of type %v and identifier %v", v.SensorType, v.Identifier)
+	}
+	return created, err
+}
+
+// ListVirtualSensors lists the virtual sensors, or the ones which the sensor is an input of if it is given
+func (m *VirtualSensorManager) ListVirtualSensors(ctx context.Context, inputId int) ([]*VirtualSensor, error) {
+	if inputId == 0 {
+		return m.repo.FindAll(ctx)
+	}
+	if _, err := m.sensors.GetById(ctx, inputId); err != nil {
+		return nil, err
+	}
+	return m.repo.FindByInputs(ctx, []int{inputId})
+}
+
+func (m *VirtualSensorManager) GetVirtualSensor(ctx context.Context, sensorId int) (v *VirtualSensor, err error) {
+	if v, err = m.repo.FindById(ctx, sensorId); ent.IsNotFound(err) {
+		return nil, v1.ErrorVirtualSensorNotFound("There is no such virtual sensor id %v", sensorId)
+	}
+	return
+}
+
+// UpdateVirtualSensor changes the definition, which takes effect on the readings computed from then on
+func (m *VirtualSensorManager) UpdateVirtualSensor(ctx context.Context, v *VirtualSensor) (*VirtualSensor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.GetVirtualSensor(ctx, int(v.SensorId)); err != nil {
+		return nil, err
+	}
+	if err := m.check(ctx, v); err != nil {
+		return nil, err
+	}
+	updated, err := m.repo.Update(ctx, v)
+	if ent.IsNotFound(err) {
+		return nil, v1.ErrorVirtualSensorNotFound("There is no such virtual sensor id %v", v.SensorId)
+	}
+	return updated, err
+}
+
+// DeleteVirtualSensor deletes the definition, while the sensor is kept as an ordinary one
+func (m *VirtualSensorManager) DeleteVirtualSensor(ctx context.Context, sensorId int) error {
+	err := m.repo.Delete(ctx, sensorId)
+	if ent.IsNotFound(err) {
+		return v1.ErrorVirtualSensorNotFound("There is no such virtual sensor id %v", sensorId)
+	}
+	return err
+}
+
+// Run computes the virtual sensors from the queued readings until the context is done. The readings queued by then
+// are computed from before it returns.
+func (m *VirtualSensorManager) Run(ctx context.Context) error {
+	// The computation in progress is never aborted, otherwise the computed readings would be missing
+	computeCtx := context.WithoutCancel(ctx)
+	for {
+		select {
+		case b := <-m.queue:
+			m.compute(computeCtx, b)
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(computeCtx, drainTimeout)
+			defer cancel()
+			for {
+				select {
+				case b := <-m.queue:
+					m.compute(drainCtx, b)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// onReadings queues the written readings to compute the virtual sensors from, which are dropped if the queue is full.
+// The readings computed through too many virtual sensors are dropped as well, which happens only if the definitions
+// make a cycle, e.g. when they are changed on several replicas at the same time.
+func (m *VirtualSensorManager) onReadings(ctx context.Context, readings []*SensorReading) {
+	depth, _ := ctx.Value(virtualDepthKey{}).(int)
+	if depth >= maxVirtualDepth {
+		m.log.Errorf("dropped %d readings computed through %d virtual sensors, whose definitions may make a cycle",
+			len(readings), depth)
+		return
+	}
+	select {
+	case m.queue <- &virtualBatch{readings: readings, depth: depth}:
+	default:
+		droppedVirtualReadings.Add(float64(len(readings)))
+	}
+}
+
+// compute computes the readings of the virtual sensors evaluated on ingestion which any of the sensors of the written
+// readings is an input of, at the timestamps of the written readings of their inputs
+func (m *VirtualSensorManager) compute(ctx context.Context, b *virtualBatch) {
+	// The readings computed here are observed through one more virtual sensor
+	ctx = context.WithValue(ctx, virtualDepthKey{}, b.depth+1)
+	spans := make(map[int][2]time.Time)
+	ids := make([]int, 0, 1)
+	for _, r := range b.readings {
+		span, ok := spans[r.SensorId]
+		if !ok {
+			ids = append(ids, r.SensorId)
+			span = [2]time.Time{r.Timestamp, r.Timestamp}
+		}
+		if r.Timestamp.Before(span[0]) {
+			span[0] = r.Timestamp
+		}
+		if r.Timestamp.After(span[1]) {
+			span[1] = r.Timestamp
+		}
+		spans[r.SensorId] = span
+	}
+	dependents, err := m.repo.FindByInputs(ctx, ids)
+	if err != nil {
+		m.log.Errorf("failed to find the virtual sensors of %d sensors: %v", len(ids), err)
+		return
+	}
+	for _, v := range dependents {
+		if v.Evaluation != v1.VirtualSensor_INGESTION {
+			continue
+		}
+		s, err := newVirtualSource(v)
+		if err != nil {
+			m.log.Errorf("failed to compile virtual sensor %v: %v", v.SensorId, err)
+			continue
+		}
+		var from, to time.Time
+		for _, id := range s.inputs {
+			if span, ok := spans[id]; ok {
+				if from.IsZero() || span[0].Before(from) {
+					from = span[0]
+				}
+				if span[1].After(to) {
+					to = span[1]
+				}
+			}
+		}
+		// The readings computed at the timestamps of the earlier readings of the other inputs within the span
+		// have been stored, and are skipped
+		computed, err := m.sensors.computeValues(ctx, s, from, to.Add(time.Microsecond), m.sensors.limits.maxScanRows)
+		if err == nil {
+			err = m.sensors.writeComputed(ctx, computed)
+		}
+		if err != nil {
+			m.log.Errorf("failed to compute virtual sensor %v: %v", v.SensorId, err)
+		}
+	}
+}
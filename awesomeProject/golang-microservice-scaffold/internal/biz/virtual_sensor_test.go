@@ -0,0 +1,111 @@
+package biz
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// chainRepo holds the definitions of the virtual sensors by their sensor ids
+type chainRepo struct {
+	VirtualSensorRepository
+	defs map[int]*VirtualSensor
+}
+
+// newChainRepo defines the sensors 2 to n+1 as virtual sensors, each of which has the previous sensor as its input
+func newChainRepo(n int) *chainRepo {
+	r := &chainRepo{defs: make(map[int]*VirtualSensor)}
+	for id := 2; id <= n+1; id++ {
+		r.defs[id] = &VirtualSensor{SensorId: int64(id), Inputs: map[string]int64{"x": int64(id - 1)}}
+	}
+	return r
+}
+
+func (r *chainRepo) FindBySensors(_ context.Context, ids []int) (map[int]*VirtualSensor, error) {
+	found := make(map[int]*VirtualSensor)
+	for _, id := range ids {
+		if v, ok := r.defs[id]; ok {
+			found[id] = v
+		}
+	}
+	return found, nil
+}
+
+func (r *chainRepo) FindByInputs(_ context.Context, ids []int) ([]*VirtualSensor, error) {
+	var found []*VirtualSensor
+	for _, v := range r.defs {
+		for _, input := range v.Inputs {
+			for _, id := range ids {
+				if int(input) == id {
+					found = append(found, v)
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+func TestCheckCycle(t *testing.T) {
+	tests := []struct {
+		name string
+		// chain is the number of the virtual sensors chained in the repository
+		chain    int
+		sensorId int
+		inputs   []int
+		// is tells the expected error, which is nil if the definition is valid
+		is func(error) bool
+	}{
+		{name: "physical input", chain: 3, inputs: []int{1}},
+		{name: "longest chain", chain: maxVirtualDepth - 1, inputs: []int{maxVirtualDepth}},
+		{name: "chain too long", chain: maxVirtualDepth, inputs: []int{maxVirtualDepth + 1},
+			is: v1.IsInvalidExpression},
+		{name: "cycle", chain: 3, sensorId: 2, inputs: []int{4}, is: v1.IsDependencyCycle},
+		{name: "self", chain: 3, sensorId: 2, inputs: []int{2}, is: v1.IsDependencyCycle},
+		// The dependents of the sensor count towards the chain as well
+		{name: "dependents within the chain", chain: maxVirtualDepth - 1, sensorId: 2, inputs: []int{100}},
+		{name: "dependents beyond the chain", chain: maxVirtualDepth, sensorId: 2, inputs: []int{100},
+			is: v1.IsInvalidExpression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newChainRepo(tt.chain)
+			repo.defs[100] = &VirtualSensor{SensorId: 100, Inputs: map[string]int64{"x": 1}}
+			m := &VirtualSensorManager{repo: repo}
+			found, _ := repo.FindBySensors(context.Background(), tt.inputs)
+			err := m.checkCycle(context.Background(), tt.sensorId, tt.inputs, found)
+			if tt.is == nil && err != nil || tt.is != nil && !tt.is(err) {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestVirtualQueue(t *testing.T) {
+	m := &VirtualSensorManager{queue: make(chan *virtualBatch, 1), log: log.NewHelper(log.DefaultLogger)}
+	readings := []*SensorReading{{SensorId: 1, Value: 1}}
+
+	// The readings computed through a chain of virtual sensors as long as allowed are not computed from
+	deep := context.WithValue(context.Background(), virtualDepthKey{}, maxVirtualDepth)
+	m.onReadings(deep, readings)
+	if len(m.queue) != 0 {
+		t.Fatal("got the readings computed through too many virtual sensors queued")
+	}
+	m.onReadings(context.WithValue(context.Background(), virtualDepthKey{}, 2), readings)
+	if b := <-m.queue; b.depth != 2 {
+		t.Errorf("got depth %d, want 2", b.depth)
+	}
+
+	// The writer is never blocked by a full queue
+	before := testutil.ToFloat64(droppedVirtualReadings)
+	m.onReadings(context.Background(), readings)
+	m.onReadings(context.Background(), readings)
+	if got := testutil.ToFloat64(droppedVirtualReadings) - before; got != 1 {
+		t.Errorf("got %v readings dropped, want 1", got)
+	}
+	if b := <-m.queue; b.depth != 0 {
+		t.Errorf("got depth %d, want 0", b.depth)
+	}
+}
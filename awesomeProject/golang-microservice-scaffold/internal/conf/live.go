@@ -0,0 +1,184 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Reloadable are the paths of the settings which take effect at runtime. A path covers all the fields beneath it.
+var Reloadable = []string{
+	"telemetry.log.level",
+	"telemetry.traces.sample_rate",
+	"server.rate_limit",
+	"terminal.default_timeout",
+	"sensor.anomaly.threshold",
+}
+
+// Live is the configuration as it changes at runtime, while the sections injected into the components are the ones
+// loaded on start. The components depending on the reloadable settings read them from it on each use, or observe
+// their changes.
+type Live struct {
+	current atomic.Pointer[Bootstrap]
+	// mu serializes the reloads along with the notifications of the observers
+	mu        sync.Mutex
+	observers []func(prev, next *Bootstrap)
+}
+
+func NewLive(bc *Bootstrap) *Live {
+	l := &Live{}
+	l.current.Store(bc)
+	return l
+}
+
+// Get returns the current configuration, which must not be modified
+func (l *Live) Get() *Bootstrap {
+	return l.current.Load()
+}
+
+// Observe registers the observer of the reloads. It must be called while the application is being initialized.
+func (l *Live) Observe(o func(prev, next *Bootstrap)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.observers = append(l.observers, o)
+}
+
+// Reload takes the reloadable settings of the configuration, and tells the observers if any of them has changed. It
+// returns the paths of the changed settings, which are split into the applied ones and the ones requiring a restart.
+// Nothing is applied if any of the reloadable settings is invalid.
+func (l *Live) Reload(next *Bootstrap) (applied, restart []string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.current.Load()
+	for _, path := range diff("", prev.ProtoReflect(), next.ProtoReflect(), nil) {
+		if isReloadable(path) {
+			applied = append(applied, path)
+		} else {
+			restart = append(restart, path)
+		}
+	}
+	if len(applied) == 0 {
+		return nil, restart, nil
+	}
+	if err = validateReloadable(next); err != nil {
+		return nil, restart, err
+	}
+	// The settings requiring a restart keep the values loaded on start
+	merged := proto.Clone(prev).(*Bootstrap)
+	for _, path := range applied {
+		copyField(merged.ProtoReflect(), next.ProtoReflect(), strings.Split(path, "."))
+	}
+	l.current.Store(merged)
+	for _, o := range l.observers {
+		o(prev, merged)
+	}
+	return applied, restart, nil
+}
+
+// Lookup returns the text of the leaf setting at the path
+func Lookup(bc *Bootstrap, path string) string {
+	m := bc.ProtoReflect()
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		f := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if f == nil {
+			return ""
+		}
+		m = m.Get(f).Message()
+	}
+	f := m.Descriptor().Fields().ByName(protoreflect.Name(names[len(names)-1]))
+	switch {
+	case f == nil:
+		return ""
+	case f.Kind() == protoreflect.EnumKind && !f.IsList():
+		if v := f.Enum().Values().ByNumber(m.Get(f).Enum()); v != nil {
+			return string(v.Name())
+		}
+	case f.Message() != nil && f.Message().FullName() == "google.protobuf.Duration":
+		return m.Get(f).Message().Interface().(*durationpb.Duration).AsDuration().String()
+	}
+	return m.Get(f).String()
+}
+
+func isReloadable(path string) bool {
+	for _, r := range Reloadable {
+		if path == r || strings.HasPrefix(path, r+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReloadable checks the reloadable settings beyond what their types can express
+func validateReloadable(bc *Bootstrap) error {
+	level := bc.GetTelemetry().GetLog().GetLevel()
+	if Log_Level_name[int32(level)] == "" {
+		return fmt.Errorf("telemetry.log.level: unknown level %v", int32(level))
+	}
+	if traces := bc.GetTelemetry().GetTraces(); traces != nil && traces.SampleRate != nil &&
+		(traces.GetSampleRate() < 0 || traces.GetSampleRate() > 1) {
+		return fmt.Errorf("telemetry.traces.sample_rate: %v is not within [0, 1]", traces.GetSampleRate())
+	}
+	r := bc.GetServer().GetRateLimit()
+	switch {
+	case r.GetWindow().AsDuration() < 0:
+		return fmt.Errorf("server.rate_limit.window: %v is negative", r.GetWindow().AsDuration())
+	case r.GetBucket() < 0:
+		return fmt.Errorf("server.rate_limit.bucket: %v is negative", r.GetBucket())
+	case r.GetCpuThreshold() < 0 || r.GetCpuThreshold() > 1000:
+		return fmt.Errorf("server.rate_limit.cpu_threshold: %v is not within [0, 1000]", r.GetCpuThreshold())
+	case r.GetCpuQuota() < 0:
+		return fmt.Errorf("server.rate_limit.cpu_quota: %v is negative", r.GetCpuQuota())
+	}
+	if timeout := bc.GetTerminal().GetDefaultTimeout().AsDuration(); timeout < 0 {
+		return fmt.Errorf("terminal.default_timeout: %v is negative", timeout)
+	}
+	if threshold := bc.GetSensor().GetAnomaly().GetThreshold(); threshold < 0 {
+		return fmt.Errorf("sensor.anomaly.threshold: %v is negative", threshold)
+	}
+	return nil
+}
+
+// isLeaf tells whether the field is compared as a whole rather than by the fields beneath it
+func isLeaf(f protoreflect.FieldDescriptor) bool {
+	return f.Kind() != protoreflect.MessageKind || f.IsList() || f.IsMap() ||
+		f.Message().FullName() == "google.protobuf.Duration"
+}
+
+// diff appends the paths of the leaf fields which differ between the messages
+func diff(prefix string, a, b protoreflect.Message, paths []string) []string {
+	fields := a.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		f := fields.Get(i)
+		path := prefix + string(f.Name())
+		switch {
+		case !isLeaf(f):
+			paths = diff(path+".", a.Get(f).Message(), b.Get(f).Message(), paths)
+		case a.Has(f) != b.Has(f) || !a.Get(f).Equal(b.Get(f)):
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// copyField copies the field at the path from the source into the destination, creating the messages on the way
+func copyField(dst, src protoreflect.Message, path []string) {
+	f := dst.Descriptor().Fields().ByName(protoreflect.Name(path[0]))
+	if len(path) > 1 {
+		if !src.Has(f) && !dst.Has(f) {
+			return
+		}
+		copyField(dst.Mutable(f).Message(), src.Get(f).Message(), path[1:])
+		return
+	}
+	if src.Has(f) {
+		dst.Set(f, src.Get(f))
+	} else {
+		dst.Clear(f)
+	}
+}
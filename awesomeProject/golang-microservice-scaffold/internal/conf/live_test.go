@@ -0,0 +1,174 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestDiff(t *testing.T) {
+	half := 0.5
+	tests := []struct {
+		name string
+		a, b *Bootstrap
+		want []string
+	}{
+		{name: "equal", a: &Bootstrap{}, b: &Bootstrap{}},
+		{
+			name: "scalar and enum",
+			a:    &Bootstrap{Telemetry: &Telemetry{Log: &Log{Level: Log_Info, Driver: "console"}}},
+			b:    &Bootstrap{Telemetry: &Telemetry{Log: &Log{Level: Log_Debug, Driver: "file"}}},
+			want: []string{"telemetry.log.driver", "telemetry.log.level"},
+		},
+		{
+			name: "duration as a whole",
+			a:    &Bootstrap{Server: &Server{RateLimit: &Server_RateLimit{Window: durationpb.New(time.Second)}}},
+			b:    &Bootstrap{Server: &Server{RateLimit: &Server_RateLimit{Window: durationpb.New(time.Minute)}}},
+			want: []string{"server.rate_limit.window"},
+		},
+		{
+			name: "absent message",
+			a:    &Bootstrap{},
+			b:    &Bootstrap{Server: &Server{RateLimit: &Server_RateLimit{Bucket: 10}}},
+			want: []string{"server.rate_limit.bucket"},
+		},
+		// An absent message equals a present but empty one, since the components read it by its getters alike
+		{name: "empty message", a: &Bootstrap{}, b: &Bootstrap{Terminal: &Terminal{}}},
+		{
+			name: "optional field",
+			a:    &Bootstrap{Telemetry: &Telemetry{Traces: &Traces{}}},
+			b:    &Bootstrap{Telemetry: &Telemetry{Traces: &Traces{SampleRate: proto.Float64(0)}}},
+			want: []string{"telemetry.traces.sample_rate"},
+		},
+		{
+			name: "optional value",
+			a:    &Bootstrap{Telemetry: &Telemetry{Traces: &Traces{SampleRate: &half}}},
+			b:    &Bootstrap{Telemetry: &Telemetry{Traces: &Traces{SampleRate: proto.Float64(1)}}},
+			want: []string{"telemetry.traces.sample_rate"},
+		},
+		{
+			name: "list as a whole",
+			a:    &Bootstrap{Sensor: &Sensor{Collect: &Sensor_Collect{IdentifierTags: []string{"a", "b"}}}},
+			b:    &Bootstrap{Sensor: &Sensor{Collect: &Sensor_Collect{IdentifierTags: []string{"a"}}}},
+			want: []string{"sensor.collect.identifier_tags"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diff("", tt.a.ProtoReflect(), tt.b.ProtoReflect(), nil)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyField(t *testing.T) {
+	src := &Bootstrap{Server: &Server{RateLimit: &Server_RateLimit{Bucket: 10}}}
+	dst := &Bootstrap{Server: &Server{Http: &Server_HTTP{Addr: ":8000"}}}
+	copyField(dst.ProtoReflect(), src.ProtoReflect(), strings.Split("server.rate_limit.bucket", "."))
+	if dst.GetServer().GetRateLimit().GetBucket() != 10 || dst.GetServer().GetHttp().GetAddr() != ":8000" {
+		t.Errorf("got %v", dst)
+	}
+
+	// A field absent from the source is cleared
+	dst.Telemetry = &Telemetry{Traces: &Traces{SampleRate: proto.Float64(0.5)}}
+	copyField(dst.ProtoReflect(), (&Bootstrap{}).ProtoReflect(), strings.Split("telemetry.traces.sample_rate", "."))
+	if dst.GetTelemetry().GetTraces().SampleRate != nil {
+		t.Errorf("got sample rate %v, want absent", *dst.Telemetry.Traces.SampleRate)
+	}
+
+	// The messages absent from both are not created on the way
+	copyField(dst.ProtoReflect(), src.ProtoReflect(), strings.Split("terminal.default_timeout", "."))
+	if dst.Terminal != nil {
+		t.Errorf("got terminal %v, want absent", dst.Terminal)
+	}
+}
+
+func TestReload(t *testing.T) {
+	prev := &Bootstrap{
+		Server:    &Server{Http: &Server_HTTP{Addr: ":8000"}},
+		Telemetry: &Telemetry{Log: &Log{Level: Log_Info}},
+	}
+	l := NewLive(prev)
+	var observed []*Bootstrap
+	l.Observe(func(p, n *Bootstrap) {
+		if p != prev && len(observed) == 0 {
+			t.Error("got the observer told of another previous configuration")
+		}
+		observed = append(observed, n)
+	})
+
+	next := &Bootstrap{
+		Server:    &Server{Http: &Server_HTTP{Addr: ":9000"}},
+		Telemetry: &Telemetry{Log: &Log{Level: Log_Debug}},
+		Terminal:  &Terminal{DefaultTimeout: durationpb.New(30 * time.Second)},
+	}
+	applied, restart, err := l.Reload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"telemetry.log.level", "terminal.default_timeout"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("got %v applied, want %v", applied, want)
+	}
+	if want := []string{"server.http.addr"}; !reflect.DeepEqual(restart, want) {
+		t.Errorf("got %v requiring a restart, want %v", restart, want)
+	}
+	// The settings requiring a restart keep the values loaded on start
+	current := l.Get()
+	if len(observed) != 1 || observed[0] != current {
+		t.Fatalf("got %d observations", len(observed))
+	}
+	if Lookup(current, "server.http.addr") != ":8000" || Lookup(current, "telemetry.log.level") != "Debug" ||
+		Lookup(current, "terminal.default_timeout") != "30s" {
+		t.Errorf("got %v", current)
+	}
+	if prev.GetTelemetry().GetLog().GetLevel() != Log_Info {
+		t.Error("got the configuration loaded on start modified")
+	}
+
+	// Nothing is applied if a reloadable setting is invalid
+	invalid := proto.Clone(next).(*Bootstrap)
+	invalid.Telemetry.Log.Level = Log_Info
+	invalid.Server.RateLimit = &Server_RateLimit{CpuThreshold: 2000}
+	if _, _, err = l.Reload(invalid); err == nil || !strings.Contains(err.Error(), "server.rate_limit.cpu_threshold") {
+		t.Errorf("got error %v", err)
+	}
+	if l.Get() != current || len(observed) != 1 {
+		t.Error("got the invalid configuration applied")
+	}
+
+	// The observers are not told of the changes requiring a restart only
+	applied, restart, err = l.Reload(&Bootstrap{
+		Server:    &Server{Http: &Server_HTTP{Addr: ":9001"}},
+		Telemetry: &Telemetry{Log: &Log{Level: Log_Debug}},
+		Terminal:  &Terminal{DefaultTimeout: durationpb.New(30 * time.Second)},
+	})
+	if err != nil || len(applied) != 0 || len(restart) != 1 || len(observed) != 1 {
+		t.Errorf("got %v applied, %v requiring a restart and %d observations: %v", applied, restart,
+			len(observed), err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	bc := &Bootstrap{
+		Telemetry: &Telemetry{Log: &Log{Level: Log_Warn}, Traces: &Traces{SampleRate: proto.Float64(0.25)}},
+		Server:    &Server{RateLimit: &Server_RateLimit{Window: durationpb.New(90 * time.Second), Bucket: 5}},
+	}
+	for path, want := range map[string]string{
+		"telemetry.log.level":          "Warn",
+		"telemetry.traces.sample_rate": "0.25",
+		"server.rate_limit.window":     "1m30s",
+		"server.rate_limit.bucket":     "5",
+		"server.rate_limit.unknown":    "",
+		"unknown.path":                 "",
+	} {
+		if got := Lookup(bc, path); got != want {
+			t.Errorf("got %q at %s, want %q", got, path, want)
+		}
+	}
+}
@@ -6,4 +6,7 @@ const (
 
 	// TerminalStatusOffline
 	TerminalStatusOffline = "offline"
+
+	// TerminalStatusDecommissioned
+	TerminalStatusDecommissioned = "decommissioned"
 )
@@ -0,0 +1,463 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/alert/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/alert"
+	"example/internal/ent/alertrule"
+	"example/internal/ent/alertsilence"
+	"example/internal/ent/predicate"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// alertRepo implements the interface [biz.AlertRepository]
+type alertRepo struct {
+	db *Data
+}
+
+// NewAlertRepository creates a new alert repository implementation instance
+func NewAlertRepository(database *Data) biz.AlertRepository {
+	return &alertRepo{db: database}
+}
+
+func ruleKindOf(k alertrule.Kind) v1.AlertRule_Kind {
+	return v1.AlertRule_Kind(v1.AlertRule_Kind_value[strings.ToUpper(k.String())])
+}
+
+func ruleKindsFrom(ks []v1.AlertRule_Kind) []alertrule.Kind {
+	kinds := make([]alertrule.Kind, 0, len(ks))
+	for _, k := range ks {
+		kinds = append(kinds, alertrule.Kind(strings.ToLower(k.String())))
+	}
+	return kinds
+}
+
+// operatorFrom converts the operator of the rule, which is nil if the rule does not compare
+func operatorFrom(op v1.AlertRule_Operator) *alertrule.Operator {
+	if op == v1.AlertRule_OPERATOR_UNSPECIFIED {
+		return nil
+	}
+	o := alertrule.Operator(strings.ToLower(op.String()))
+	return &o
+}
+
+func severityOf(s string) v1.AlertRule_Severity {
+	return v1.AlertRule_Severity(v1.AlertRule_Severity_value[strings.ToUpper(s)])
+}
+
+func alertStatusesFrom(ss []v1.Alert_Status) []alert.Status {
+	status := make([]alert.Status, 0, len(ss))
+	for _, s := range ss {
+		status = append(status, alert.Status(strings.ToLower(s.String())))
+	}
+	return status
+}
+
+// dedupKeyOf is the key which the firing alert of the rule is unique by
+func dedupKeyOf(ruleId int) string {
+	return fmt.Sprintf("rule:%d", ruleId)
+}
+
+func convertToBizAlertRule(r *ent.AlertRule) *biz.AlertRule {
+	rule := &biz.AlertRule{
+		Id:          int64(r.ID),
+		Name:        r.Name,
+		Kind:        ruleKindOf(r.Kind),
+		Threshold:   r.Threshold,
+		Duration:    durationpb.New(time.Duration(r.Duration) * time.Millisecond),
+		Severity:    severityOf(r.Severity.String()),
+		Disabled:    r.Disabled,
+		Description: r.Description,
+		CreateTime:  timestamppb.New(r.CreateTime),
+		UpdateTime:  timestamppb.New(r.UpdateTime),
+	}
+	if r.SensorID != nil {
+		rule.SensorId = int64(*r.SensorID)
+	}
+	if r.TerminalID != nil {
+		rule.TerminalId = int64(*r.TerminalID)
+	}
+	if r.Operator != nil {
+		rule.Operator = v1.AlertRule_Operator(v1.AlertRule_Operator_value[strings.ToUpper(r.Operator.String())])
+	}
+	return rule
+}
+
+func convertToBizAlert(a *ent.Alert) *biz.Alert {
+	return &biz.Alert{
+		Id:           int64(a.ID),
+		RuleId:       int64(a.RuleID),
+		Status:       v1.Alert_Status(v1.Alert_Status_value[strings.ToUpper(a.Status.String())]),
+		Severity:     severityOf(a.Severity.String()),
+		Value:        a.Value,
+		Message:      a.Message,
+		StartTime:    timestamppb.New(a.StartTime),
+		FireTime:     timestamppb.New(a.FireTime),
+		ResolveTime:  timestampOf(a.ResolveTime),
+		Silenced:     a.Silenced,
+		Acknowledged: a.Acknowledged,
+		AckTime:      timestampOf(a.AckTime),
+		AckBy:        a.AckBy,
+		AckComment:   a.AckComment,
+		UpdateTime:   timestamppb.New(a.UpdateTime),
+	}
+}
+
+func convertToBizSilence(s *ent.AlertSilence) *biz.Silence {
+	var ruleId *int64
+	if s.RuleID != nil {
+		id := int64(*s.RuleID)
+		ruleId = &id
+	}
+	return &biz.Silence{
+		Id:         int64(s.ID),
+		RuleId:     ruleId,
+		StartTime:  timestamppb.New(s.StartTime),
+		EndTime:    timestamppb.New(s.EndTime),
+		Comment:    s.Comment,
+		CreatedBy:  s.CreatedBy,
+		CreateTime: timestamppb.New(s.CreateTime),
+	}
+}
+
+// idOf converts a positive id of a proto message to the optional id of an entity
+func idOf(id int64) *int {
+	if id <= 0 {
+		return nil
+	}
+	v := int(id)
+	return &v
+}
+
+func (r *alertRepo) AddRule(ctx context.Context, rule *biz.AlertRule) (*biz.AlertRule, error) {
+	created, err := r.db.Client.AlertRule.Create().
+		SetName(rule.Name).
+		SetKind(alertrule.Kind(strings.ToLower(rule.Kind.String()))).
+		SetNillableSensorID(idOf(rule.SensorId)).
+		SetNillableTerminalID(idOf(rule.TerminalId)).
+		SetNillableOperator(operatorFrom(rule.Operator)).
+		SetThreshold(rule.Threshold).
+		SetDuration(rule.Duration.AsDuration().Milliseconds()).
+		SetSeverity(alertrule.Severity(strings.ToLower(rule.Severity.String()))).
+		SetDisabled(rule.Disabled).
+		SetDescription(rule.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlertRule(created), nil
+}
+
+func (r *alertRepo) FindRuleById(ctx context.Context, id int) (*biz.AlertRule, error) {
+	rule, err := r.db.Client.AlertRule.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlertRule(rule), nil
+}
+
+func (r *alertRepo) ListRules(ctx context.Context, offset, limit int) (rules []*biz.AlertRule, total int, err error) {
+	query := r.db.Client.AlertRule.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var rs []*ent.AlertRule
+	if rs, err = query.
+		Order(ent.Asc(alertrule.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	rules = make([]*biz.AlertRule, 0, len(rs))
+	for _, rule := range rs {
+		rules = append(rules, convertToBizAlertRule(rule))
+	}
+	return rules, total, nil
+}
+
+func (r *alertRepo) UpdateRule(ctx context.Context, rule *biz.AlertRule) (*biz.AlertRule, error) {
+	update := r.db.Client.AlertRule.UpdateOneID(int(rule.Id)).
+		SetName(rule.Name).
+		SetKind(alertrule.Kind(strings.ToLower(rule.Kind.String()))).
+		SetThreshold(rule.Threshold).
+		SetDuration(rule.Duration.AsDuration().Milliseconds()).
+		SetSeverity(alertrule.Severity(strings.ToLower(rule.Severity.String()))).
+		SetDisabled(rule.Disabled).
+		SetDescription(rule.Description).
+		SetUpdateTime(time.Now()).
+		ClearPendingSince().
+		ClearLastValue().
+		ClearLastTime()
+	// The definition is replaced as a whole, so the fields which the kind ignores are cleared
+	if id := idOf(rule.SensorId); id != nil {
+		update.SetSensorID(*id)
+	} else {
+		update.ClearSensorID()
+	}
+	if id := idOf(rule.TerminalId); id != nil {
+		update.SetTerminalID(*id)
+	} else {
+		update.ClearTerminalID()
+	}
+	if op := operatorFrom(rule.Operator); op != nil {
+		update.SetOperator(*op)
+	} else {
+		update.ClearOperator()
+	}
+	updated, err := update.Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlertRule(updated), nil
+}
+
+func (r *alertRepo) DeleteRule(ctx context.Context, id int) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.Alert.Delete().Where(alert.RuleIDEQ(id)).Exec(ctx); err != nil {
+		return
+	}
+	if _, err = tx.AlertSilence.Delete().Where(alertsilence.RuleIDEQ(id)).Exec(ctx); err != nil {
+		return
+	}
+	if err = tx.AlertRule.DeleteOneID(id).Exec(ctx); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (r *alertRepo) FindStates(ctx context.Context, query *biz.RuleStateQuery) ([]*biz.RuleState, error) {
+	conditions := []predicate.AlertRule{alertrule.DisabledEQ(false)}
+	if len(query.Kinds) > 0 {
+		conditions = append(conditions, alertrule.KindIn(ruleKindsFrom(query.Kinds)...))
+	}
+	if len(query.SensorIds) > 0 {
+		conditions = append(conditions, alertrule.SensorIDIn(query.SensorIds...))
+	}
+	if len(query.TerminalIds) > 0 {
+		conditions = append(conditions, alertrule.TerminalIDIn(query.TerminalIds...))
+	}
+	rs, err := r.db.Client.AlertRule.Query().Where(conditions...).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*biz.RuleState, 0, len(rs))
+	for _, rule := range rs {
+		states = append(states, &biz.RuleState{
+			Rule:         convertToBizAlertRule(rule),
+			PendingSince: rule.PendingSince,
+			LastValue:    rule.LastValue,
+			LastTime:     rule.LastTime,
+		})
+	}
+	return states, nil
+}
+
+func (r *alertRepo) SaveState(ctx context.Context, state *biz.RuleState) error {
+	update := r.db.Client.AlertRule.UpdateOneID(int(state.Rule.Id)).
+		SetNillablePendingSince(state.PendingSince).
+		SetNillableLastValue(state.LastValue).
+		SetNillableLastTime(state.LastTime)
+	if state.PendingSince == nil {
+		update.ClearPendingSince()
+	}
+	return update.Exec(ctx)
+}
+
+func (r *alertRepo) Fire(ctx context.Context, a *biz.Alert) (*biz.Alert, bool, error) {
+	key := dedupKeyOf(int(a.RuleId))
+	refreshed, err := r.refresh(ctx, key, a)
+	if refreshed != nil || err != nil {
+		return refreshed, false, err
+	}
+	created, err := r.db.Client.Alert.Create().
+		SetRuleID(int(a.RuleId)).
+		SetSeverity(alert.Severity(strings.ToLower(a.Severity.String()))).
+		SetNillableValue(a.Value).
+		SetMessage(a.Message).
+		SetStartTime(a.StartTime.AsTime()).
+		SetDedupKey(key).
+		SetSilenced(a.Silenced).
+		Save(ctx)
+	if ent.IsConstraintError(err) {
+		// Another replica has fired the alert in the meantime
+		refreshed, err = r.refresh(ctx, key, a)
+		return refreshed, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return convertToBizAlert(created), true, nil
+}
+
+// refresh refreshes the firing alert with the dedup key, and returns nil if there is none
+func (r *alertRepo) refresh(ctx context.Context, key string, a *biz.Alert) (*biz.Alert, error) {
+	n, err := r.db.Client.Alert.Update().
+		Where(alert.DedupKeyEQ(key)).
+		SetNillableValue(a.Value).
+		SetMessage(a.Message).
+		Save(ctx)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	refreshed, err := r.db.Client.Alert.Query().Where(alert.DedupKeyEQ(key)).Only(ctx)
+	if ent.IsNotFound(err) {
+		// The alert has been resolved right after being refreshed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlert(refreshed), nil
+}
+
+func (r *alertRepo) Resolve(ctx context.Context, ruleId int, at time.Time) (*biz.Alert, error) {
+	key := dedupKeyOf(ruleId)
+	firing, err := r.db.Client.Alert.Query().Where(alert.DedupKeyEQ(key)).Only(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := r.db.Client.Alert.UpdateOneID(firing.ID).
+		Where(alert.DedupKeyEQ(key)).
+		SetStatus(alert.StatusResolved).
+		SetResolveTime(at).
+		ClearDedupKey().
+		Save(ctx)
+	if ent.IsNotFound(err) {
+		// Another replica has resolved the alert in the meantime
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlert(resolved), nil
+}
+
+func (r *alertRepo) FindAlertById(ctx context.Context, id int) (*biz.Alert, error) {
+	a, err := r.db.Client.Alert.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlert(a), nil
+}
+
+func (r *alertRepo) ListAlerts(ctx context.Context, q *biz.AlertQuery) (alerts []*biz.Alert, total int, err error) {
+	query := r.db.Client.Alert.Query()
+	if len(q.Statuses) > 0 {
+		query.Where(alert.StatusIn(alertStatusesFrom(q.Statuses)...))
+	}
+	if q.RuleId > 0 {
+		query.Where(alert.RuleIDEQ(q.RuleId))
+	}
+	if !q.IncludeSilenced {
+		query.Where(alert.SilencedEQ(false))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var as []*ent.Alert
+	if as, err = query.
+		Order(ent.Desc(alert.FieldID)).
+		Offset(q.Offset).
+		Limit(q.Limit).
+		All(ctx); err != nil {
+		return
+	}
+	alerts = make([]*biz.Alert, 0, len(as))
+	for _, a := range as {
+		alerts = append(alerts, convertToBizAlert(a))
+	}
+	return alerts, total, nil
+}
+
+func (r *alertRepo) Acknowledge(ctx context.Context, id int, by, comment string) (*biz.Alert, error) {
+	acknowledged, err := r.db.Client.Alert.UpdateOneID(id).
+		SetAcknowledged(true).
+		SetAckTime(time.Now()).
+		SetAckBy(by).
+		SetAckComment(comment).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizAlert(acknowledged), nil
+}
+
+func (r *alertRepo) DeleteAlert(ctx context.Context, id int) (bool, error) {
+	n, err := r.db.Client.Alert.Delete().
+		Where(alert.ID(id), alert.StatusEQ(alert.StatusResolved)).
+		Exec(ctx)
+	return n > 0, err
+}
+
+func (r *alertRepo) AddSilence(ctx context.Context, s *biz.Silence) (*biz.Silence, error) {
+	create := r.db.Client.AlertSilence.Create().
+		SetStartTime(s.StartTime.AsTime()).
+		SetEndTime(s.EndTime.AsTime()).
+		SetComment(s.Comment).
+		SetCreatedBy(s.CreatedBy)
+	if s.RuleId != nil {
+		create.SetRuleID(int(*s.RuleId))
+	}
+	created, err := create.Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSilence(created), nil
+}
+
+func (r *alertRepo) ListSilences(
+	ctx context.Context, includeExpired bool, offset, limit int) (silences []*biz.Silence, total int, err error) {
+	query := r.db.Client.AlertSilence.Query()
+	if !includeExpired {
+		query.Where(alertsilence.EndTimeGT(time.Now()))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var ss []*ent.AlertSilence
+	if ss, err = query.
+		Order(ent.Desc(alertsilence.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	silences = make([]*biz.Silence, 0, len(ss))
+	for _, s := range ss {
+		silences = append(silences, convertToBizSilence(s))
+	}
+	return silences, total, nil
+}
+
+func (r *alertRepo) DeleteSilence(ctx context.Context, id int) error {
+	return r.db.Client.AlertSilence.DeleteOneID(id).Exec(ctx)
+}
+
+func (r *alertRepo) IsSilenced(ctx context.Context, ruleId int, at time.Time) (bool, error) {
+	return r.db.Client.AlertSilence.Query().
+		Where(
+			alertsilence.StartTimeLTE(at),
+			alertsilence.EndTimeGT(at),
+			alertsilence.Or(alertsilence.RuleIDIsNil(), alertsilence.RuleIDEQ(ruleId)),
+		).
+		Exist(ctx)
+}
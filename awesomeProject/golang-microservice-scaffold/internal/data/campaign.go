@@ -0,0 +1,374 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/campaign"
+	"example/internal/ent/campaigntarget"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// campaignRepo implements the interface [biz.CampaignRepository]
+type campaignRepo struct {
+	db *Data
+}
+
+// NewCampaignRepository creates a new campaign repository implementation instance
+func NewCampaignRepository(database *Data) biz.CampaignRepository {
+	return &campaignRepo{db: database}
+}
+
+// updateBatchSize keeps the statements creating the updates of a large campaign within the placeholder limits of
+// the databases
+const updateBatchSize = 1000
+
+func campaignStatusOf(s campaign.Status) v1.Campaign_Status {
+	return v1.Campaign_Status(v1.Campaign_Status_value[strings.ToUpper(s.String())])
+}
+
+func campaignStatusFrom(s v1.Campaign_Status) campaign.Status {
+	return campaign.Status(strings.ToLower(s.String()))
+}
+
+func campaignStatusesFrom(ss []v1.Campaign_Status) []campaign.Status {
+	status := make([]campaign.Status, 0, len(ss))
+	for _, s := range ss {
+		status = append(status, campaignStatusFrom(s))
+	}
+	return status
+}
+
+func updateStatusOf(s campaigntarget.Status) v1.TerminalUpdate_Status {
+	return v1.TerminalUpdate_Status(v1.TerminalUpdate_Status_value[strings.ToUpper(s.String())])
+}
+
+func updateStatusFrom(s v1.TerminalUpdate_Status) campaigntarget.Status {
+	return campaigntarget.Status(strings.ToLower(s.String()))
+}
+
+func updateStatusesFrom(ss []v1.TerminalUpdate_Status) []campaigntarget.Status {
+	status := make([]campaigntarget.Status, 0, len(ss))
+	for _, s := range ss {
+		status = append(status, updateStatusFrom(s))
+	}
+	return status
+}
+
+// unfinishedUpdates are the states of the updates which have not finished yet
+var unfinishedUpdates = []campaigntarget.Status{
+	campaigntarget.StatusPending, campaigntarget.StatusDownloading, campaigntarget.StatusInstalling,
+}
+
+// convertToBizCampaign converts the campaign, whose firmware should have been loaded eagerly
+func convertToBizCampaign(c *ent.Campaign) *biz.Campaign {
+	bc := &biz.Campaign{
+		Id:               int64(c.ID),
+		FirmwareId:       int64(c.FirmwareID),
+		GroupId:          int64(c.GroupID),
+		Status:           campaignStatusOf(c.Status),
+		Stages:           c.Stages,
+		CurrentStage:     int32(c.CurrentStage),
+		FailureThreshold: c.FailureThreshold,
+		PauseReason:      c.PauseReason,
+		CreateTime:       timestamppb.New(c.CreateTime),
+		UpdateTime:       timestamppb.New(c.UpdateTime),
+		StageStartTime:   timestamppb.New(c.StageStartTime),
+	}
+	if c.Edges.Firmware != nil {
+		bc.FirmwareVersion = c.Edges.Firmware.Version
+	}
+	return bc
+}
+
+func convertToBizCampaigns(cs []*ent.Campaign) []*biz.Campaign {
+	campaigns := make([]*biz.Campaign, 0, len(cs))
+	for _, c := range cs {
+		campaigns = append(campaigns, convertToBizCampaign(c))
+	}
+	return campaigns
+}
+
+func convertToBizUpdate(u *ent.CampaignTarget) *biz.TerminalUpdate {
+	return &biz.TerminalUpdate{
+		Id:          u.ID,
+		CampaignId:  int64(u.CampaignID),
+		TerminalId:  int64(u.TerminalID),
+		Stage:       int32(u.Stage),
+		Status:      updateStatusOf(u.Status),
+		Progress:    u.Progress,
+		FromVersion: u.FromVersion,
+		Message:     u.Message,
+		OfferTime:   timestampOf(u.OfferTime),
+		UpdateTime:  timestamppb.New(u.UpdateTime),
+	}
+}
+
+func convertToBizUpdates(us []*ent.CampaignTarget) []*biz.TerminalUpdate {
+	updates := make([]*biz.TerminalUpdate, 0, len(us))
+	for _, u := range us {
+		updates = append(updates, convertToBizUpdate(u))
+	}
+	return updates
+}
+
+func (r *campaignRepo) Add(
+	ctx context.Context, bc *biz.Campaign, updates []*biz.TerminalUpdate) (created *biz.Campaign, err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var c *ent.Campaign
+	if c, err = tx.Campaign.Create().
+		SetFirmwareID(int(bc.FirmwareId)).
+		SetGroupID(int(bc.GroupId)).
+		SetStages(bc.Stages).
+		SetFailureThreshold(bc.FailureThreshold).
+		Save(ctx); err != nil {
+		return
+	}
+	for start := 0; start < len(updates); start += updateBatchSize {
+		batch := updates[start:min(start+updateBatchSize, len(updates))]
+		if err = tx.CampaignTarget.MapCreateBulk(batch, func(create *ent.CampaignTargetCreate, i int) {
+			create.
+				SetCampaignID(c.ID).
+				SetTerminalID(int(batch[i].TerminalId)).
+				SetStage(int(batch[i].Stage)).
+				SetStatus(updateStatusFrom(batch[i].Status)).
+				SetProgress(batch[i].Progress).
+				SetFromVersion(batch[i].FromVersion)
+		}).Exec(ctx); err != nil {
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return r.FindById(ctx, c.ID)
+}
+
+func (r *campaignRepo) FindById(ctx context.Context, id int) (*biz.Campaign, error) {
+	c, err := r.db.Client.Campaign.Query().Where(campaign.IDEQ(id)).WithFirmware().Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCampaign(c), nil
+}
+
+func (r *campaignRepo) List(ctx context.Context, offset, limit int) (campaigns []*biz.Campaign, total int, err error) {
+	query := r.db.Client.Campaign.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var cs []*ent.Campaign
+	if cs, err = query.
+		WithFirmware().
+		Order(ent.Desc(campaign.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	return convertToBizCampaigns(cs), total, nil
+}
+
+func (r *campaignRepo) FindRunning(ctx context.Context) ([]*biz.Campaign, error) {
+	cs, err := r.db.Client.Campaign.Query().
+		Where(campaign.StatusEQ(campaign.StatusRunning)).
+		WithFirmware().
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCampaigns(cs), nil
+}
+
+func (r *campaignRepo) SetStatus(
+	ctx context.Context, id int, from []v1.Campaign_Status, to v1.Campaign_Status, reason string) error {
+	return r.db.Client.Campaign.UpdateOneID(id).
+		Where(campaign.StatusIn(campaignStatusesFrom(from)...)).
+		SetStatus(campaignStatusFrom(to)).
+		SetPauseReason(reason).
+		Exec(ctx)
+}
+
+func (r *campaignRepo) Advance(ctx context.Context, id int, stage int) error {
+	return r.db.Client.Campaign.UpdateOneID(id).
+		Where(campaign.StatusEQ(campaign.StatusRunning), campaign.CurrentStageEQ(stage)).
+		SetCurrentStage(stage + 1).
+		SetStageStartTime(time.Now()).
+		Exec(ctx)
+}
+
+func (r *campaignRepo) Rollback(ctx context.Context, id int, from []v1.Campaign_Status) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = tx.Campaign.UpdateOneID(id).
+		Where(campaign.StatusIn(campaignStatusesFrom(from)...)).
+		SetStatus(campaign.StatusRolledBack).
+		SetPauseReason("").
+		Exec(ctx); err != nil {
+		return
+	}
+	if _, err = tx.CampaignTarget.Update().
+		Where(
+			campaigntarget.CampaignIDEQ(id),
+			campaigntarget.StatusEQ(campaigntarget.StatusPending),
+		).
+		SetStatus(campaigntarget.StatusCancelled).
+		Save(ctx); err != nil {
+		return
+	}
+	// The terminals whose previous firmware is unknown have nothing to roll back to
+	if _, err = tx.CampaignTarget.Update().
+		Where(
+			campaigntarget.CampaignIDEQ(id),
+			campaigntarget.StatusIn(
+				campaigntarget.StatusDownloading, campaigntarget.StatusInstalling,
+				campaigntarget.StatusSucceeded, campaigntarget.StatusFailed,
+			),
+			campaigntarget.FromVersionNEQ(""),
+		).
+		SetStatus(campaigntarget.StatusRollbackPending).
+		SetProgress(0).
+		SetMessage("").
+		Save(ctx); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (r *campaignRepo) CountUpdates(
+	ctx context.Context, id int, maxStage int) (map[v1.TerminalUpdate_Status]int, error) {
+	query := r.db.Client.CampaignTarget.Query().Where(campaigntarget.CampaignIDEQ(id))
+	if maxStage >= 0 {
+		query.Where(campaigntarget.StageLTE(maxStage))
+	}
+	var rows []struct {
+		Status campaigntarget.Status `json:"status"`
+		Count  int                   `json:"count"`
+	}
+	if err := query.GroupBy(campaigntarget.FieldStatus).Aggregate(ent.Count()).Scan(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[v1.TerminalUpdate_Status]int, len(rows))
+	for _, row := range rows {
+		counts[updateStatusOf(row.Status)] = row.Count
+	}
+	return counts, nil
+}
+
+func (r *campaignRepo) FindUpdate(ctx context.Context, id int64) (*biz.TerminalUpdate, error) {
+	u, err := r.db.Client.CampaignTarget.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizUpdate(u), nil
+}
+
+func (r *campaignRepo) FindUpdates(
+	ctx context.Context, id int, status []v1.TerminalUpdate_Status, offset, limit int,
+) (updates []*biz.TerminalUpdate, total int, err error) {
+	query := r.db.Client.CampaignTarget.Query().Where(campaigntarget.CampaignIDEQ(id))
+	if len(status) > 0 {
+		query.Where(campaigntarget.StatusIn(updateStatusesFrom(status)...))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var us []*ent.CampaignTarget
+	if us, err = query.
+		Order(ent.Asc(campaigntarget.FieldStage), ent.Asc(campaigntarget.FieldTerminalID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	return convertToBizUpdates(us), total, nil
+}
+
+func (r *campaignRepo) FindOffers(ctx context.Context, terminalId int) ([]*biz.TerminalUpdate, error) {
+	us, err := r.db.Client.CampaignTarget.Query().
+		Where(
+			campaigntarget.TerminalIDEQ(terminalId),
+			campaigntarget.Or(
+				campaigntarget.And(
+					campaigntarget.StatusIn(unfinishedUpdates...),
+					campaigntarget.HasCampaignWith(campaign.StatusEQ(campaign.StatusRunning)),
+				),
+				campaigntarget.StatusEQ(campaigntarget.StatusRollbackPending),
+			),
+		).
+		WithCampaign().
+		Order(ent.Asc(campaigntarget.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offers := make([]*biz.TerminalUpdate, 0, len(us))
+	for _, u := range us {
+		// The later stages have not been rolled out yet
+		if u.Status != campaigntarget.StatusRollbackPending && u.Stage > u.Edges.Campaign.CurrentStage {
+			continue
+		}
+		offers = append(offers, convertToBizUpdate(u))
+	}
+	return offers, nil
+}
+
+func (r *campaignRepo) MarkOffered(ctx context.Context, id int64) error {
+	err := r.db.Client.CampaignTarget.UpdateOneID(id).
+		Where(campaigntarget.OfferTimeIsNil()).
+		SetOfferTime(time.Now()).
+		Exec(ctx)
+	// The update has been offered by another instance in the meantime
+	if ent.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *campaignRepo) Progress(
+	ctx context.Context, id int64, from []v1.TerminalUpdate_Status, to v1.TerminalUpdate_Status,
+	progress int32, message string) error {
+	return r.db.Client.CampaignTarget.UpdateOneID(id).
+		Where(campaigntarget.StatusIn(updateStatusesFrom(from)...)).
+		SetStatus(updateStatusFrom(to)).
+		SetProgress(progress).
+		SetMessage(message).
+		Exec(ctx)
+}
+
+func (r *campaignRepo) TimeoutUpdates(
+	ctx context.Context, id int, maxStage int, offeredBefore time.Time, includeUnoffered bool) (int, error) {
+	offered := campaigntarget.OfferTimeLT(offeredBefore)
+	if includeUnoffered {
+		offered = campaigntarget.Or(offered, campaigntarget.OfferTimeIsNil())
+	}
+	return r.db.Client.CampaignTarget.Update().
+		Where(
+			campaigntarget.CampaignIDEQ(id),
+			campaigntarget.StageLTE(maxStage),
+			campaigntarget.StatusIn(unfinishedUpdates...),
+			offered,
+		).
+		SetStatus(campaigntarget.StatusFailed).
+		SetMessage("timed out").
+		Save(ctx)
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"example/internal/ent"
+	"testing"
+)
+
+func TestCampaignRollback(t *testing.T) {
+	d := newTestData(t)
+	ctx := context.Background()
+	firmware := d.Client.Firmware.Create().SetVersion("2.0").SetSize(1).SetSha256("").SetPath("2.0").SaveX(ctx)
+	statuses := []v1.TerminalUpdate_Status{
+		v1.TerminalUpdate_PENDING, v1.TerminalUpdate_DOWNLOADING, v1.TerminalUpdate_INSTALLING,
+		v1.TerminalUpdate_SUCCEEDED, v1.TerminalUpdate_FAILED, v1.TerminalUpdate_SUCCEEDED,
+	}
+	updates := make([]*biz.TerminalUpdate, 0, len(statuses))
+	for i, status := range statuses {
+		d.Client.Terminal.Create().SetID(i + 1).ExecX(ctx)
+		update := &biz.TerminalUpdate{TerminalId: int64(i + 1), Status: status, FromVersion: "1.0"}
+		updates = append(updates, update)
+	}
+	// The previous firmware of the last terminal is unknown
+	updates[len(updates)-1].FromVersion = ""
+	r := NewCampaignRepository(d)
+	c, err := r.Add(ctx, &biz.Campaign{FirmwareId: int64(firmware.ID), Stages: []int32{100}}, updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transition is guarded by the current state
+	if err = r.Rollback(ctx, int(c.Id), []v1.Campaign_Status{v1.Campaign_PAUSED}); !ent.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+	if err = r.Rollback(ctx, int(c.Id), []v1.Campaign_Status{v1.Campaign_RUNNING}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = r.FindById(ctx, int(c.Id)); err != nil || c.Status != v1.Campaign_ROLLED_BACK {
+		t.Fatalf("got campaign %v: %v", c, err)
+	}
+	found, _, err := r.FindUpdates(ctx, int(c.Id), nil, 0, len(updates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pending updates are cancelled, and the terminals which have started the update are rolled back
+	want := []v1.TerminalUpdate_Status{
+		v1.TerminalUpdate_CANCELLED, v1.TerminalUpdate_ROLLBACK_PENDING, v1.TerminalUpdate_ROLLBACK_PENDING,
+		v1.TerminalUpdate_ROLLBACK_PENDING, v1.TerminalUpdate_ROLLBACK_PENDING, v1.TerminalUpdate_SUCCEEDED,
+	}
+	for i, u := range found {
+		if u.Status != want[i] {
+			t.Errorf("got update of terminal %d %v, want %v", u.TerminalId, u.Status, want[i])
+		}
+	}
+
+	// The rolled back campaign is offered to no terminal but the rollbacks
+	offers, err := r.FindOffers(ctx, 1)
+	if err != nil || len(offers) != 0 {
+		t.Errorf("got offers %v: %v", offers, err)
+	}
+	if offers, err = r.FindOffers(ctx, 2); err != nil || len(offers) != 1 {
+		t.Errorf("got offers %v: %v", offers, err)
+	}
+}
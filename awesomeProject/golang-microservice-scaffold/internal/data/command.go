@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/command"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// commandRepo implements the interface [biz.CommandRepository]
+type commandRepo struct {
+	db *Data
+}
+
+// NewCommandRepository creates a new command repository implementation instance
+func NewCommandRepository(database *Data) biz.CommandRepository {
+	return &commandRepo{db: database}
+}
+
+func commandStatusOf(s command.Status) v1.Command_Status {
+	return v1.Command_Status(v1.Command_Status_value[strings.ToUpper(s.String())])
+}
+
+func commandStatusFrom(s v1.Command_Status) command.Status {
+	return command.Status(strings.ToLower(s.String()))
+}
+
+// timestampOf converts an optional time into its protobuf representation
+func timestampOf(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func convertToBizCommand(c *ent.Command) *biz.Command {
+	return &biz.Command{
+		Id:           c.ID,
+		TerminalId:   int64(c.TerminalID),
+		Name:         c.Name,
+		Payload:      c.Payload,
+		Status:       commandStatusOf(c.Status),
+		Attempts:     c.Attempts,
+		MaxRetries:   c.MaxRetries,
+		Result:       c.Result,
+		ExpireTime:   timestamppb.New(c.ExpireTime),
+		DeliverTime:  timestampOf(c.DeliverTime),
+		AckTime:      timestampOf(c.AckTime),
+		CompleteTime: timestampOf(c.CompleteTime),
+		CreateTime:   timestamppb.New(c.CreateTime),
+	}
+}
+
+func convertToBizCommands(cs []*ent.Command) []*biz.Command {
+	cmds := make([]*biz.Command, 0, len(cs))
+	for _, c := range cs {
+		cmds = append(cmds, convertToBizCommand(c))
+	}
+	return cmds
+}
+
+func (r *commandRepo) Add(ctx context.Context, cmd *biz.Command) (*biz.Command, error) {
+	c, err := r.db.Client.Command.Create().
+		SetTerminalID(int(cmd.TerminalId)).
+		SetName(cmd.Name).
+		SetPayload(cmd.Payload).
+		SetMaxRetries(cmd.MaxRetries).
+		SetExpireTime(cmd.ExpireTime.AsTime()).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCommand(c), nil
+}
+
+func (r *commandRepo) FindById(ctx context.Context, id int64) (*biz.Command, error) {
+	c, err := r.db.Client.Command.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCommand(c), nil
+}
+
+func (r *commandRepo) FindByTerminal(
+	ctx context.Context, terminalId int, filter *biz.CommandFilter) (cmds []*biz.Command, total int, err error) {
+	query := r.db.Client.Command.Query().Where(command.TerminalIDEQ(terminalId))
+	if len(filter.Status) > 0 {
+		status := make([]command.Status, 0, len(filter.Status))
+		for _, s := range filter.Status {
+			status = append(status, commandStatusFrom(s))
+		}
+		query.Where(command.StatusIn(status...))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var cs []*ent.Command
+	if cs, err = query.
+		Order(ent.Desc(command.FieldID)).
+		Offset(filter.Offset).
+		Limit(filter.Limit).
+		All(ctx); err != nil {
+		return
+	}
+	return convertToBizCommands(cs), total, nil
+}
+
+func (r *commandRepo) ClaimPending(ctx context.Context, terminalId int, limit int) ([]*biz.Command, error) {
+	now := time.Now()
+	ids, err := r.db.Client.Command.Query().
+		Where(
+			command.TerminalIDEQ(terminalId),
+			command.StatusEQ(command.StatusPending),
+			command.ExpireTimeGT(now),
+		).
+		Order(ent.Asc(command.FieldID)).
+		Limit(limit).
+		IDs(ctx)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	claimed := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		// Another instance may have claimed the command in the meantime, in which case nothing is updated
+		n, err := r.db.Client.Command.Update().
+			Where(command.IDEQ(id), command.StatusEQ(command.StatusPending)).
+			SetStatus(command.StatusDelivered).
+			AddAttempts(1).
+			SetDeliverTime(now).
+			ClearAckTime().
+			Save(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			claimed = append(claimed, id)
+		}
+	}
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+	cs, err := r.db.Client.Command.Query().
+		Where(command.IDIn(claimed...)).
+		Order(ent.Asc(command.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCommands(cs), nil
+}
+
+func (r *commandRepo) Acknowledge(ctx context.Context, id int64) error {
+	return r.db.Client.Command.UpdateOneID(id).
+		Where(command.StatusEQ(command.StatusDelivered)).
+		SetAckTime(time.Now()).
+		Exec(ctx)
+}
+
+func (r *commandRepo) Requeue(ctx context.Context, id int64) error {
+	return r.db.Client.Command.UpdateOneID(id).
+		Where(command.StatusEQ(command.StatusDelivered), command.AckTimeIsNil()).
+		SetStatus(command.StatusPending).
+		ClearDeliverTime().
+		Exec(ctx)
+}
+
+func (r *commandRepo) Complete(ctx context.Context, id int64, status v1.Command_Status, result string) error {
+	return r.db.Client.Command.UpdateOneID(id).
+		Where(command.StatusIn(command.StatusPending, command.StatusDelivered)).
+		SetStatus(commandStatusFrom(status)).
+		SetResult(result).
+		SetCompleteTime(time.Now()).
+		Exec(ctx)
+}
+
+func (r *commandRepo) FindUnacknowledged(ctx context.Context, deliveredBefore time.Time) ([]*biz.Command, error) {
+	cs, err := r.db.Client.Command.Query().
+		Where(
+			command.StatusEQ(command.StatusDelivered),
+			command.AckTimeIsNil(),
+			command.DeliverTimeLT(deliveredBefore),
+		).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCommands(cs), nil
+}
+
+func (r *commandRepo) ExpireOverdue(ctx context.Context) (int, error) {
+	now := time.Now()
+	return r.db.Client.Command.Update().
+		Where(
+			command.StatusIn(command.StatusPending, command.StatusDelivered),
+			command.ExpireTimeLT(now),
+		).
+		SetStatus(command.StatusExpired).
+		SetCompleteTime(now).
+		Save(ctx)
+}
@@ -4,10 +4,13 @@
 package data
 
 import (
+	"context"
+	"database/sql"
 	"example/internal/conf"
 	"example/internal/ent"
 	"github.com/redis/go-redis/v9"
 
+	entsql "entgo.io/ent/dialect/sql"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/google/wire"
 
@@ -19,11 +22,35 @@ var ProviderSet = wire.NewSet(
 	NewData,
 	NewCache,
 	NewUserRepository,
+	NewTerminalRepository,
+	NewTerminalGroupRepository,
+	NewTerminalHistoryRepository,
+	NewCommandRepository,
+	NewSensorRepository,
+	NewFirmwareRepository,
+	NewFirmwareStore,
+	NewCampaignRepository,
+	NewShadowRepository,
+	NewSensorTypeRepository,
+	NewSensorExportRepository,
+	NewExportStore,
+	NewAnomalyRepository,
+	NewCalibrationRepository,
+	NewVirtualSensorRepository,
+	NewServerRepository,
+	NewLatestValueCache,
+	NewAlertRepository,
+	NewNotificationRepository,
+	NewNotifier,
+	NewHealthChecks,
 )
 
 // Data wraps the db client
 type Data struct {
 	Client *ent.Client
+	db     *sql.DB
+	// dialect is that of the db, by which the statements ent cannot express are built
+	dialect string
 }
 
 // Cache wraps the Redis client
@@ -31,22 +58,29 @@ type Cache struct {
 	Client *redis.Client
 }
 
-// NewData establishes the connection to the db based on the configuration
+// NewData prepares the connections to the db based on the configuration. The db is not connected until it is
+// used, so an unreachable db makes the service unready rather than failing its start.
 func NewData(c *conf.Data) (data *Data, cleanup func(), err error) {
-	var dbClient *ent.Client
-	if dbClient, err = ent.Open(c.Database.Driver, c.Database.Source); err != nil {
-		log.Error(err)
+	var driver *entsql.Driver
+	if driver, err = entsql.Open(c.Database.Driver, c.Database.Source); err != nil {
+		return nil, nil, err
 	}
+	dbClient := ent.NewClient(ent.Driver(driver))
 	cleanup = func() {
 		log.Info("closing the data resources")
 		if err := dbClient.Close(); err != nil {
 			log.Error(err)
 		}
 	}
-	data = &Data{Client: dbClient}
+	data = &Data{Client: dbClient, db: driver.DB(), dialect: driver.Dialect()}
 	return
 }
 
+// Ping checks the connection to the db
+func (d *Data) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 // NewCache establishes the connection to the Redis server based on the configuration
 func NewCache(c *conf.Data) (cache *Cache, cleanup func(), err error) {
 	rdb := redis.NewClient(&redis.Options{
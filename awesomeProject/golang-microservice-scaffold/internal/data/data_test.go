@@ -0,0 +1,26 @@
+package data
+
+import (
+	"context"
+	"example/internal/ent"
+	"net/url"
+	"testing"
+
+	entsql "entgo.io/ent/dialect/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestData opens an in-memory SQLite database of its own for the test, with the schema created
+func newTestData(t *testing.T) *Data {
+	t.Helper()
+	driver, err := entsql.Open("sqlite3", "file:"+url.PathEscape(t.Name())+"?mode=memory&cache=shared&_fk=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ent.NewClient(ent.Driver(driver))
+	t.Cleanup(func() { _ = client.Close() })
+	if err = client.Schema.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &Data{Client: client, db: driver.DB(), dialect: driver.Dialect()}
+}
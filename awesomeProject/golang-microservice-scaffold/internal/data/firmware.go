@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"example/internal/biz"
+	"example/internal/conf"
+	"example/internal/ent"
+	"example/internal/ent/campaign"
+	"example/internal/ent/firmware"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// firmwareRepo implements the interface [biz.FirmwareRepository]
+type firmwareRepo struct {
+	db *Data
+}
+
+// NewFirmwareRepository creates a new firmware repository implementation instance
+func NewFirmwareRepository(database *Data) biz.FirmwareRepository {
+	return &firmwareRepo{db: database}
+}
+
+func convertToBizFirmware(f *ent.Firmware) *biz.Firmware {
+	return &biz.Firmware{
+		Id:           int64(f.ID),
+		Version:      f.Version,
+		Size:         f.Size,
+		Sha256:       f.Sha256,
+		ReleaseNotes: f.ReleaseNotes,
+		CreateTime:   timestamppb.New(f.CreateTime),
+	}
+}
+
+func (r *firmwareRepo) Add(ctx context.Context, fw *biz.Firmware, artifact string) (*biz.Firmware, error) {
+	f, err := r.db.Client.Firmware.Create().
+		SetVersion(fw.Version).
+		SetSize(fw.Size).
+		SetSha256(fw.Sha256).
+		SetPath(artifact).
+		SetReleaseNotes(fw.ReleaseNotes).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizFirmware(f), nil
+}
+
+func (r *firmwareRepo) FindById(ctx context.Context, id int) (*biz.Firmware, error) {
+	f, err := r.db.Client.Firmware.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizFirmware(f), nil
+}
+
+func (r *firmwareRepo) FindByVersion(ctx context.Context, version string) (*biz.Firmware, error) {
+	f, err := r.db.Client.Firmware.Query().Where(firmware.VersionEQ(version)).Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizFirmware(f), nil
+}
+
+func (r *firmwareRepo) FindArtifact(ctx context.Context, id int) (string, error) {
+	return r.db.Client.Firmware.Query().Where(firmware.IDEQ(id)).Select(firmware.FieldPath).String(ctx)
+}
+
+func (r *firmwareRepo) List(ctx context.Context, offset, limit int) (fws []*biz.Firmware, total int, err error) {
+	query := r.db.Client.Firmware.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var fs []*ent.Firmware
+	if fs, err = query.
+		Order(ent.Desc(firmware.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	fws = make([]*biz.Firmware, 0, len(fs))
+	for _, f := range fs {
+		fws = append(fws, convertToBizFirmware(f))
+	}
+	return fws, total, nil
+}
+
+func (r *firmwareRepo) IsUsed(ctx context.Context, id int) (bool, error) {
+	return r.db.Client.Campaign.Query().Where(campaign.FirmwareIDEQ(id)).Exist(ctx)
+}
+
+func (r *firmwareRepo) Remove(ctx context.Context, id int) error {
+	return r.db.Client.Firmware.DeleteOneID(id).Exec(ctx)
+}
+
+// defaultFirmwareMaxSize limits the size of the artifacts if it is not configured
+const defaultFirmwareMaxSize = 256 << 20
+
+// firmwareStore implements the interface [biz.FirmwareStore] on the local file system. The directory should be
+// shared by all the instances of the service, e.g. a network volume.
+type firmwareStore struct {
+	dir     string
+	maxSize int64
+}
+
+// NewFirmwareStore creates the directory of the artifacts if it does not exist yet
+func NewFirmwareStore(c *conf.Data) (biz.FirmwareStore, error) {
+	fc := c.GetFirmware()
+	dir := fc.GetDir()
+	if dir == "" {
+		dir = "./data/firmware"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	maxSize := fc.GetMaxSize()
+	if maxSize <= 0 {
+		maxSize = defaultFirmwareMaxSize
+	}
+	return &firmwareStore{dir: dir, maxSize: maxSize}, nil
+}
+
+// partSuffix marks the artifacts being written, which are renamed once they are complete
+const partSuffix = ".part"
+
+func (s *firmwareStore) Save(_ context.Context, r io.Reader) (name string, size int64, sum string, err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(s.dir, "firmware-*"+partSuffix); err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	hash := sha256.New()
+	// Read one more byte than the limit to tell an artifact of exactly the maximum size from a larger one
+	if size, err = io.Copy(io.MultiWriter(f, hash), io.LimitReader(r, s.maxSize+1)); err != nil {
+		return
+	}
+	if size > s.maxSize {
+		err = biz.ErrFirmwareTooLarge
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	name = strings.TrimSuffix(filepath.Base(f.Name()), partSuffix)
+	if err = os.Rename(f.Name(), s.path(name)); err != nil {
+		return
+	}
+	return name, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *firmwareStore) Open(_ context.Context, name string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *firmwareStore) Remove(_ context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path resolves the name of an artifact inside the directory
+func (s *firmwareStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
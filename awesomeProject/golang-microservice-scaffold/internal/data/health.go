@@ -0,0 +1,16 @@
+package data
+
+import (
+	"context"
+	"example/internal/biz"
+)
+
+// NewHealthChecks checks the database and Redis, which all the repositories rely on
+func NewHealthChecks(database *Data, cache *Cache) biz.HealthChecks {
+	return biz.HealthChecks{
+		{Name: "database", Check: database.Ping},
+		{Name: "redis", Check: func(ctx context.Context) error {
+			return cache.Client.Ping(ctx).Err()
+		}},
+	}
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"example/internal/ent"
+	"time"
+
+	"entgo.io/ent/dialect/sql"
+)
+
+// The background jobs, i.e. the exports and the calibration recomputes, share the columns id, status, attempts and
+// update_time, by which the workers claim them and tell the current worker of a job from a stalled one.
+const (
+	jobFieldID         = "id"
+	jobFieldStatus     = "status"
+	jobFieldAttempts   = "attempts"
+	jobFieldUpdateTime = "update_time"
+	jobStatusPending   = "pending"
+	jobStatusRunning   = "running"
+)
+
+// claimAttempts bounds the attempts to claim a job which other workers are claiming at the same time
+const claimAttempts = 3
+
+// jobClaim is what a claim reads of the job before claiming it
+type jobClaim struct {
+	id       int
+	attempts int32
+	status   string
+}
+
+// claimable selects the jobs which are pending, or running but have not reported their progress since the time
+func claimable(stalledBefore time.Time) func(*sql.Selector) {
+	return func(s *sql.Selector) {
+		s.Where(sql.Or(
+			sql.EQ(s.C(jobFieldStatus), jobStatusPending),
+			sql.And(sql.EQ(s.C(jobFieldStatus), jobStatusRunning), sql.LT(s.C(jobFieldUpdateTime), stalledBefore)),
+		))
+	}
+}
+
+// claimedBy selects the job as long as it has the attempts and the status, i.e. no other worker has claimed it since
+func claimedBy(id int, attempts int32, status string) func(*sql.Selector) {
+	return func(s *sql.Selector) {
+		s.Where(sql.And(
+			sql.EQ(s.C(jobFieldID), id),
+			sql.EQ(s.C(jobFieldAttempts), attempts),
+			sql.EQ(s.C(jobFieldStatus), status),
+		))
+	}
+}
+
+// claimNext claims the first of the claimable jobs in the order of their ids, and returns it along with the attempts
+// it is claimed by, or the zero job if there is none. The function first finds the first job the predicate selects,
+// and claim sets the job the predicate selects running with an attempt more, and returns the number of the jobs
+// updated. The claim is guarded by the attempts read, so only one of the workers claiming at the same time wins.
+func claimNext[T any](
+	ctx context.Context, stalledBefore time.Time,
+	first func(ctx context.Context, p func(*sql.Selector)) (T, jobClaim, error),
+	claim func(ctx context.Context, p func(*sql.Selector)) (int, error),
+) (T, int32, error) {
+	var none T
+	for i := 0; i < claimAttempts; i++ {
+		job, c, err := first(ctx, claimable(stalledBefore))
+		if ent.IsNotFound(err) {
+			return none, 0, nil
+		}
+		if err != nil {
+			return none, 0, err
+		}
+		n, err := claim(ctx, claimedBy(c.id, c.attempts, c.status))
+		if err != nil {
+			return none, 0, err
+		}
+		if n > 0 {
+			return job, c.attempts + 1, nil
+		}
+	}
+	return none, 0, nil
+}
@@ -0,0 +1,420 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/alert/v1"
+	userv1 "example/api/user/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/notificationchannel"
+	"example/internal/ent/notificationdelivery"
+	"example/internal/ent/notificationroute"
+	"example/internal/ent/user"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxErrorLen is the length of the recorded errors of the deliveries at most
+const maxErrorLen = 1024
+
+// notificationRepo implements the interface [biz.NotificationRepository]
+type notificationRepo struct {
+	db *Data
+}
+
+// NewNotificationRepository creates a new notification repository implementation instance
+func NewNotificationRepository(database *Data) biz.NotificationRepository {
+	return &notificationRepo{db: database}
+}
+
+func convertToBizChannel(c *ent.NotificationChannel) *biz.Channel {
+	return &biz.Channel{
+		Id:              int64(c.ID),
+		Name:            c.Name,
+		Type:            v1.Channel_Type(v1.Channel_Type_value[strings.ToUpper(c.Type.String())]),
+		Url:             c.URL,
+		Secret:          &c.Secret,
+		Recipients:      c.Recipients,
+		SubjectTemplate: c.SubjectTemplate,
+		BodyTemplate:    c.BodyTemplate,
+		RateLimit:       c.RateLimit,
+		RateWindow:      durationpb.New(time.Duration(c.RateWindow) * time.Millisecond),
+		Disabled:        c.Disabled,
+		CreateTime:      timestamppb.New(c.CreateTime),
+		UpdateTime:      timestamppb.New(c.UpdateTime),
+	}
+}
+
+func convertToBizRoute(r *ent.NotificationRoute) *biz.Route {
+	severities := make([]v1.AlertRule_Severity, 0, len(r.Severities))
+	for _, s := range r.Severities {
+		severities = append(severities, severityOf(s))
+	}
+	return &biz.Route{
+		Id:           int64(r.ID),
+		ChannelId:    int64(r.ChannelID),
+		Severities:   severities,
+		Tags:         r.Tags,
+		UserGroupId:  r.UserGroupID,
+		SendResolved: r.SendResolved,
+		Description:  r.Description,
+		CreateTime:   timestamppb.New(r.CreateTime),
+		UpdateTime:   timestamppb.New(r.UpdateTime),
+	}
+}
+
+func convertToBizDelivery(d *ent.NotificationDelivery) *biz.Delivery {
+	return &biz.Delivery{
+		Id:              int64(d.ID),
+		AlertId:         int64(d.AlertID),
+		ChannelId:       int64(d.ChannelID),
+		Event:           v1.Alert_Status(v1.Alert_Status_value[strings.ToUpper(d.Event.String())]),
+		Recipients:      d.Recipients,
+		Subject:         d.Subject,
+		Body:            d.Body,
+		Status:          v1.Delivery_Status(v1.Delivery_Status_value[strings.ToUpper(d.Status.String())]),
+		Attempts:        d.Attempts,
+		LastError:       d.LastError,
+		NextAttemptTime: timestampOf(d.NextAttemptTime),
+		SentTime:        timestampOf(d.SentTime),
+		CreateTime:      timestamppb.New(d.CreateTime),
+		UpdateTime:      timestamppb.New(d.UpdateTime),
+	}
+}
+
+func severitiesFrom(ss []v1.AlertRule_Severity) []string {
+	severities := make([]string, 0, len(ss))
+	for _, s := range ss {
+		severities = append(severities, strings.ToLower(s.String()))
+	}
+	return severities
+}
+
+func deliveryStatusFrom(s v1.Delivery_Status) notificationdelivery.Status {
+	return notificationdelivery.Status(strings.ToLower(s.String()))
+}
+
+// timeOf converts an optional timestamp of a proto message
+func timeOf(t *timestamppb.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := t.AsTime()
+	return &v
+}
+
+func (r *notificationRepo) AddChannel(ctx context.Context, c *biz.Channel) (*biz.Channel, error) {
+	created, err := r.db.Client.NotificationChannel.Create().
+		SetName(c.Name).
+		SetType(notificationchannel.Type(strings.ToLower(c.Type.String()))).
+		SetURL(c.Url).
+		SetNillableSecret(c.Secret).
+		SetRecipients(c.Recipients).
+		SetSubjectTemplate(c.SubjectTemplate).
+		SetBodyTemplate(c.BodyTemplate).
+		SetRateLimit(c.RateLimit).
+		SetRateWindow(c.RateWindow.AsDuration().Milliseconds()).
+		SetDisabled(c.Disabled).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizChannel(created), nil
+}
+
+func (r *notificationRepo) FindChannelById(ctx context.Context, id int) (*biz.Channel, error) {
+	c, err := r.db.Client.NotificationChannel.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizChannel(c), nil
+}
+
+func (r *notificationRepo) ListChannels(
+	ctx context.Context, offset, limit int) (channels []*biz.Channel, total int, err error) {
+	query := r.db.Client.NotificationChannel.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var cs []*ent.NotificationChannel
+	if cs, err = query.
+		Order(ent.Asc(notificationchannel.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	channels = make([]*biz.Channel, 0, len(cs))
+	for _, c := range cs {
+		channels = append(channels, convertToBizChannel(c))
+	}
+	return channels, total, nil
+}
+
+func (r *notificationRepo) UpdateChannel(ctx context.Context, c *biz.Channel) (*biz.Channel, error) {
+	updated, err := r.db.Client.NotificationChannel.UpdateOneID(int(c.Id)).
+		SetName(c.Name).
+		SetType(notificationchannel.Type(strings.ToLower(c.Type.String()))).
+		SetURL(c.Url).
+		SetNillableSecret(c.Secret).
+		SetRecipients(c.Recipients).
+		SetSubjectTemplate(c.SubjectTemplate).
+		SetBodyTemplate(c.BodyTemplate).
+		SetRateLimit(c.RateLimit).
+		SetRateWindow(c.RateWindow.AsDuration().Milliseconds()).
+		SetDisabled(c.Disabled).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizChannel(updated), nil
+}
+
+func (r *notificationRepo) DeleteChannel(ctx context.Context, id int) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.NotificationDelivery.Delete().
+		Where(notificationdelivery.ChannelIDEQ(id)).
+		Exec(ctx); err != nil {
+		return
+	}
+	if _, err = tx.NotificationRoute.Delete().
+		Where(notificationroute.ChannelIDEQ(id)).
+		Exec(ctx); err != nil {
+		return
+	}
+	if err = tx.NotificationChannel.DeleteOneID(id).Exec(ctx); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (r *notificationRepo) AddRoute(ctx context.Context, route *biz.Route) (*biz.Route, error) {
+	created, err := r.db.Client.NotificationRoute.Create().
+		SetChannelID(int(route.ChannelId)).
+		SetSeverities(severitiesFrom(route.Severities)).
+		SetTags(route.Tags).
+		SetUserGroupID(route.UserGroupId).
+		SetSendResolved(route.SendResolved).
+		SetDescription(route.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizRoute(created), nil
+}
+
+func (r *notificationRepo) FindRouteById(ctx context.Context, id int) (*biz.Route, error) {
+	route, err := r.db.Client.NotificationRoute.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizRoute(route), nil
+}
+
+func (r *notificationRepo) ListRoutes(
+	ctx context.Context, channelId int, offset, limit int) (routes []*biz.Route, total int, err error) {
+	query := r.db.Client.NotificationRoute.Query()
+	if channelId > 0 {
+		query.Where(notificationroute.ChannelIDEQ(channelId))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var rs []*ent.NotificationRoute
+	if rs, err = query.
+		Order(ent.Asc(notificationroute.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	routes = make([]*biz.Route, 0, len(rs))
+	for _, route := range rs {
+		routes = append(routes, convertToBizRoute(route))
+	}
+	return routes, total, nil
+}
+
+func (r *notificationRepo) UpdateRoute(ctx context.Context, route *biz.Route) (*biz.Route, error) {
+	updated, err := r.db.Client.NotificationRoute.UpdateOneID(int(route.Id)).
+		SetChannelID(int(route.ChannelId)).
+		SetSeverities(severitiesFrom(route.Severities)).
+		SetTags(route.Tags).
+		SetUserGroupID(route.UserGroupId).
+		SetSendResolved(route.SendResolved).
+		SetDescription(route.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizRoute(updated), nil
+}
+
+func (r *notificationRepo) DeleteRoute(ctx context.Context, id int) error {
+	return r.db.Client.NotificationRoute.DeleteOneID(id).Exec(ctx)
+}
+
+func (r *notificationRepo) FindActiveRoutes(ctx context.Context) ([]*biz.Route, error) {
+	rs, err := r.db.Client.NotificationRoute.Query().
+		Where(notificationroute.HasChannelWith(notificationchannel.DisabledEQ(false))).
+		Order(ent.Asc(notificationroute.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]*biz.Route, 0, len(rs))
+	for _, route := range rs {
+		routes = append(routes, convertToBizRoute(route))
+	}
+	return routes, nil
+}
+
+func (r *notificationRepo) AddDeliveries(ctx context.Context, deliveries []*biz.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.Client.NotificationDelivery.MapCreateBulk(deliveries,
+		func(create *ent.NotificationDeliveryCreate, i int) {
+			d := deliveries[i]
+			create.
+				SetAlertID(int(d.AlertId)).
+				SetChannelID(int(d.ChannelId)).
+				SetEvent(notificationdelivery.Event(strings.ToLower(d.Event.String()))).
+				SetRecipients(d.Recipients).
+				SetSubject(truncate(d.Subject, 1024)).
+				SetBody(d.Body).
+				SetStatus(deliveryStatusFrom(d.Status)).
+				SetLastError(truncate(d.LastError, maxErrorLen)).
+				SetNillableNextAttemptTime(timeOf(d.NextAttemptTime))
+		}).
+		Exec(ctx)
+}
+
+func (r *notificationRepo) CountSince(ctx context.Context, channelId int, since time.Time) (int, error) {
+	return r.db.Client.NotificationDelivery.Query().
+		Where(
+			notificationdelivery.ChannelIDEQ(channelId),
+			notificationdelivery.CreateTimeGTE(since),
+			notificationdelivery.StatusNEQ(notificationdelivery.StatusSuppressed),
+		).
+		Count(ctx)
+}
+
+func (r *notificationRepo) FindDue(ctx context.Context, at time.Time, limit int) ([]*biz.Delivery, error) {
+	ds, err := r.db.Client.NotificationDelivery.Query().
+		Where(
+			notificationdelivery.StatusEQ(notificationdelivery.StatusPending),
+			notificationdelivery.NextAttemptTimeLTE(at),
+		).
+		Order(ent.Asc(notificationdelivery.FieldNextAttemptTime)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*biz.Delivery, 0, len(ds))
+	for _, d := range ds {
+		deliveries = append(deliveries, convertToBizDelivery(d))
+	}
+	return deliveries, nil
+}
+
+func (r *notificationRepo) Claim(ctx context.Context, d *biz.Delivery, until time.Time) (bool, error) {
+	// The attempts tell whether anyone else has claimed the delivery since it was found
+	n, err := r.db.Client.NotificationDelivery.Update().
+		Where(
+			notificationdelivery.ID(int(d.Id)),
+			notificationdelivery.StatusEQ(notificationdelivery.StatusPending),
+			notificationdelivery.AttemptsEQ(d.Attempts),
+		).
+		AddAttempts(1).
+		SetNextAttemptTime(until).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *notificationRepo) SaveAttempt(ctx context.Context, d *biz.Delivery) error {
+	update := r.db.Client.NotificationDelivery.UpdateOneID(int(d.Id)).
+		SetStatus(deliveryStatusFrom(d.Status)).
+		SetLastError(truncate(d.LastError, maxErrorLen)).
+		SetNillableSentTime(timeOf(d.SentTime))
+	if t := timeOf(d.NextAttemptTime); t != nil {
+		update.SetNextAttemptTime(*t)
+	} else {
+		update.ClearNextAttemptTime()
+	}
+	return update.Exec(ctx)
+}
+
+func (r *notificationRepo) FindDeliveryById(ctx context.Context, id int) (*biz.Delivery, error) {
+	d, err := r.db.Client.NotificationDelivery.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizDelivery(d), nil
+}
+
+func (r *notificationRepo) ListDeliveries(
+	ctx context.Context, q *biz.DeliveryQuery) (deliveries []*biz.Delivery, total int, err error) {
+	query := r.db.Client.NotificationDelivery.Query()
+	if q.AlertId > 0 {
+		query.Where(notificationdelivery.AlertIDEQ(q.AlertId))
+	}
+	if q.ChannelId > 0 {
+		query.Where(notificationdelivery.ChannelIDEQ(q.ChannelId))
+	}
+	if len(q.Statuses) > 0 {
+		statuses := make([]notificationdelivery.Status, 0, len(q.Statuses))
+		for _, s := range q.Statuses {
+			statuses = append(statuses, deliveryStatusFrom(s))
+		}
+		query.Where(notificationdelivery.StatusIn(statuses...))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var ds []*ent.NotificationDelivery
+	if ds, err = query.
+		Order(ent.Desc(notificationdelivery.FieldID)).
+		Offset(q.Offset).
+		Limit(q.Limit).
+		All(ctx); err != nil {
+		return
+	}
+	deliveries = make([]*biz.Delivery, 0, len(ds))
+	for _, d := range ds {
+		deliveries = append(deliveries, convertToBizDelivery(d))
+	}
+	return deliveries, total, nil
+}
+
+func (r *notificationRepo) FindGroupEmails(ctx context.Context, groupId int64) ([]string, error) {
+	return r.db.Client.User.Query().
+		Where(
+			user.ParentIDEQ(groupId),
+			user.TypeEQ(int16(userv1.User_NORMAL_USER)),
+			user.DeletedEQ(false),
+			user.EmailNEQ(""),
+		).
+		Select(user.FieldEmail).
+		Strings(ctx)
+}
+
+// truncate truncates the text to at most n bytes without breaking a character
+func truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	return strings.ToValidUTF8(text[:n], "")
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	v1 "example/api/alert/v1"
+	"example/internal/biz"
+	"example/internal/conf"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// notifier implements the interface [biz.Notifier] over HTTP and SMTP
+type notifier struct {
+	client *http.Client
+	smtp   *conf.Alert_Notification_SMTP
+}
+
+// NewNotifier creates a notifier sending the emails through the configured SMTP server. The webhooks are refused
+// to post to the internal addresses unless it is allowed.
+func NewNotifier(c *conf.Alert) biz.Notifier {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !c.GetNotification().GetAllowPrivateHosts() {
+		// The addresses are checked as they are dialed, which covers whatever the names resolve to as well as the
+		// redirects. A proxy would dial them on our behalf, so none is used.
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseInternal}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+	return &notifier{client: &http.Client{Transport: transport}, smtp: c.GetNotification().GetSmtp()}
+}
+
+// refuseInternal refuses to connect to the internal addresses
+func refuseInternal(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if biz.IsInternalAddr(addr) {
+		return fmt.Errorf("%w: %v is an internal address", biz.ErrUndeliverable, addr)
+	}
+	return nil
+}
+
+// webhookPayload is the document posted by a webhook channel
+type webhookPayload struct {
+	DeliveryId int64  `json:"delivery_id"`
+	Event      string `json:"event"`
+	AlertId    int64  `json:"alert_id"`
+	Subject    string `json:"subject"`
+	Text       string `json:"text"`
+}
+
+func (n *notifier) Send(ctx context.Context, channel *biz.Channel, d *biz.Delivery) error {
+	switch channel.Type {
+	case v1.Channel_WEBHOOK:
+		body, err := json.Marshal(&webhookPayload{
+			DeliveryId: d.Id,
+			Event:      strings.ToLower(d.Event.String()),
+			AlertId:    d.AlertId,
+			Subject:    d.Subject,
+			Text:       d.Body,
+		})
+		if err != nil {
+			return err
+		}
+		header := http.Header{}
+		header.Set("X-Delivery-Id", strconv.FormatInt(d.Id, 10))
+		if secret := channel.GetSecret(); secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body)
+			header.Set("X-Timestamp", timestamp)
+			header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		return n.post(ctx, channel.Url, body, header)
+	case v1.Channel_SLACK:
+		text := d.Body
+		if d.Subject != "" {
+			text = "*" + d.Subject + "*\n" + text
+		}
+		body, err := json.Marshal(map[string]string{"text": text})
+		if err != nil {
+			return err
+		}
+		return n.post(ctx, channel.Url, body, http.Header{})
+	case v1.Channel_EMAIL:
+		return n.email(ctx, d)
+	}
+	return fmt.Errorf("%w: unsupported channel type %v", biz.ErrUndeliverable, channel.Type)
+}
+
+// post posts the JSON document to the URL. The rejections other than the throttling are not worth retrying.
+func (n *notifier) post(ctx context.Context, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", biz.ErrUndeliverable, err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read a little of the response to tell why it failed, and let the connection be reused
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %v %s", biz.ErrUndeliverable, resp.Status, reply)
+	}
+	return fmt.Errorf("%v %s", resp.Status, reply)
+}
+
+// email sends the notification to the recipients of the delivery. The permanent SMTP failures are not worth
+// retrying.
+func (n *notifier) email(ctx context.Context, d *biz.Delivery) error {
+	addr := n.smtp.GetAddr()
+	if addr == "" {
+		return fmt.Errorf("%w: no SMTP server is configured", biz.ErrUndeliverable)
+	}
+	if len(d.Recipients) == 0 {
+		return fmt.Errorf("%w: no recipients", biz.ErrUndeliverable)
+	}
+	err := n.sendMail(ctx, addr, d)
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return fmt.Errorf("%w: %v", biz.ErrUndeliverable, err)
+	}
+	return err
+}
+
+func (n *notifier) sendMail(ctx context.Context, addr string, d *biz.Delivery) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	// The SMTP client knows nothing about the contexts, so the whole conversation is bounded by the deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if username := n.smtp.GetUsername(); username != "" {
+		if err = c.Auth(smtp.PlainAuth("", username, n.smtp.GetPassword(), host)); err != nil {
+			return err
+		}
+	}
+	from := n.smtp.GetFrom()
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range d.Recipients {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(d.Recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", d.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(d.Body, "\r\n", "\n"), "\n", "\r\n"))
+	if _, err = w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
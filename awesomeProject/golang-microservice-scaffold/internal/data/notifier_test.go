@@ -0,0 +1,231 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	v1 "example/api/alert/v1"
+	"example/internal/biz"
+	"example/internal/conf"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newTestNotifier creates a notifier allowed to post to the test servers listening on the loopback address
+func newTestNotifier() biz.Notifier {
+	return NewNotifier(&conf.Alert{Notification: &conf.Alert_Notification{AllowPrivateHosts: true}})
+}
+
+func TestNotifierWebhook(t *testing.T) {
+	var header http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, body = r.Header.Clone(), readAll(r)
+	}))
+	defer srv.Close()
+
+	channel := &biz.Channel{Type: v1.Channel_WEBHOOK, Url: srv.URL, Secret: proto.String("s3cret")}
+	d := &biz.Delivery{Id: 7, AlertId: 3, Event: v1.Alert_FIRING, Subject: "subject", Body: "body"}
+	if err := newTestNotifier().Send(context.Background(), channel, d); err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("X-Delivery-Id"); got != "7" {
+		t.Errorf("got delivery id %q, want 7", got)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(header.Get("X-Timestamp") + "."))
+	mac.Write(body)
+	if got, want := header.Get("X-Signature-256"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload != (webhookPayload{DeliveryId: 7, Event: "firing", AlertId: 3, Subject: "subject", Text: "body"}) {
+		t.Errorf("got payload %+v", payload)
+	}
+
+	// The notifications of the channels without a secret are not signed
+	channel.Secret = nil
+	if err := newTestNotifier().Send(context.Background(), channel, d); err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("X-Signature-256"); got != "" {
+		t.Errorf("got signature %q of an unsigned channel", got)
+	}
+}
+
+func TestNotifierStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		ok, retryable bool
+	}{
+		{status: http.StatusOK, ok: true},
+		{status: http.StatusNoContent, ok: true},
+		{status: http.StatusBadRequest},
+		{status: http.StatusNotFound},
+		{status: http.StatusTooManyRequests, retryable: true},
+		{status: http.StatusInternalServerError, retryable: true},
+		{status: http.StatusServiceUnavailable, retryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+			err := newTestNotifier().Send(context.Background(), &biz.Channel{Type: v1.Channel_SLACK, Url: srv.URL},
+				&biz.Delivery{Body: "body"})
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if err != nil && errors.Is(err, biz.ErrUndeliverable) == tt.retryable {
+				t.Errorf("got error %v, want retryable %v", err, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestNotifierTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := newTestNotifier().Send(ctx, &biz.Channel{Type: v1.Channel_WEBHOOK, Url: srv.URL}, &biz.Delivery{})
+	if err == nil || errors.Is(err, biz.ErrUndeliverable) {
+		t.Errorf("got error %v, want a retryable one", err)
+	}
+}
+
+func TestNotifierInternalHosts(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer srv.Close()
+	// The redirects to the internal addresses are refused as well
+	redirect := httptest.NewServer(http.RedirectHandler(srv.URL, http.StatusFound))
+	defer redirect.Close()
+
+	n := NewNotifier(&conf.Alert{})
+	for _, url := range []string{srv.URL, redirect.URL} {
+		err := n.Send(context.Background(), &biz.Channel{Type: v1.Channel_WEBHOOK, Url: url}, &biz.Delivery{})
+		if !errors.Is(err, biz.ErrUndeliverable) {
+			t.Errorf("got error %v posting to %v, want undeliverable", err, url)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("got %d requests to an internal address", n)
+	}
+}
+
+// deliveryRepo keeps a single channel and its due deliveries
+type deliveryRepo struct {
+	biz.NotificationRepository
+	channel *biz.Channel
+	due     []*biz.Delivery
+}
+
+func (r *deliveryRepo) FindDue(context.Context, time.Time, int) ([]*biz.Delivery, error) {
+	var due []*biz.Delivery
+	for _, d := range r.due {
+		if d.Status == v1.Delivery_PENDING {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+func (r *deliveryRepo) Claim(context.Context, *biz.Delivery, time.Time) (bool, error) {
+	return true, nil
+}
+
+func (r *deliveryRepo) FindChannelById(context.Context, int) (*biz.Channel, error) {
+	return r.channel, nil
+}
+
+func (r *deliveryRepo) SaveAttempt(context.Context, *biz.Delivery) error {
+	return nil
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are the responses to the attempts in order, where zero stands for hanging until the timeout
+		statuses []int
+		status   v1.Delivery_Status
+		attempts int32
+	}{
+		{name: "sent", statuses: []int{http.StatusOK}, status: v1.Delivery_SENT, attempts: 1},
+		{name: "server error", statuses: []int{500, 502, http.StatusOK}, status: v1.Delivery_SENT, attempts: 3},
+		{name: "timeout", statuses: []int{0, http.StatusOK}, status: v1.Delivery_SENT, attempts: 2},
+		{name: "throttled", statuses: []int{429, http.StatusOK}, status: v1.Delivery_SENT, attempts: 2},
+		{name: "rejected", statuses: []int{http.StatusBadRequest}, status: v1.Delivery_FAILED, attempts: 1},
+		{name: "out of attempts", statuses: []int{500, 500, 500}, status: v1.Delivery_FAILED, attempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			hang := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[requests.Add(1)-1]
+				if status == 0 {
+					<-hang
+					return
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+			defer close(hang)
+
+			d := &biz.Delivery{Id: 1, ChannelId: 1, Status: v1.Delivery_PENDING}
+			repo := &deliveryRepo{channel: &biz.Channel{Id: 1, Type: v1.Channel_WEBHOOK, Url: srv.URL}}
+			repo.due = []*biz.Delivery{d}
+			c := &conf.Alert{Notification: &conf.Alert_Notification{
+				MaxAttempts: 3, Backoff: durationpb.New(time.Second), Timeout: durationpb.New(100 * time.Millisecond),
+			}}
+			m := biz.NewNotificationManager(c, repo, newTestNotifier(), &biz.AlertManager{}, nil, nil, nil,
+				log.DefaultLogger)
+			for i := 0; i < len(tt.statuses); i++ {
+				before := time.Now()
+				if err := m.Deliver(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if d.Status != v1.Delivery_PENDING {
+					break
+				}
+				// The backoff doubles on each attempt
+				backoff := time.Second << (d.Attempts - 1)
+				if next := d.NextAttemptTime.AsTime(); next.Before(before.Add(backoff)) || d.LastError == "" {
+					t.Errorf("attempt %d: got next attempt at %v with error %q, want after %v", d.Attempts, next,
+						d.LastError, before.Add(backoff))
+				}
+			}
+			if d.Status != tt.status || d.Attempts != tt.attempts || int(requests.Load()) != len(tt.statuses) {
+				t.Errorf("got %v after %d attempts and %d requests, want %v after %d", d.Status, d.Attempts,
+					requests.Load(), tt.status, tt.attempts)
+			}
+		})
+	}
+}
+
+func readAll(r *http.Request) []byte {
+	b, _ := io.ReadAll(r.Body)
+	return b
+}
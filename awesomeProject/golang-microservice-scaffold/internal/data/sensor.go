@@ -0,0 +1,631 @@
+package data
+
+import (
+	"context"
+	stdsql "database/sql"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/predicate"
+	"example/internal/ent/sensor"
+	"example/internal/ent/sensordirtybucket"
+	"example/internal/ent/sensorrollup"
+	"example/internal/ent/sensorvalue"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect/sql"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sensorRepo implements the interface [biz.SensorRepository]
+type sensorRepo struct {
+	db *Data
+}
+
+// NewSensorRepository creates a new sensor repository implementation instance
+func NewSensorRepository(database *Data) biz.SensorRepository {
+	return &sensorRepo{db: database}
+}
+
+func (r *sensorRepo) IsSensorExist(ctx context.Context, id int) (bool, error) {
+	return r.db.Client.Sensor.Query().Where(sensor.IDEQ(id)).Exist(ctx)
+}
+
+func (r *sensorRepo) FindSensorTypes(ctx context.Context, ids []int) (map[int]string, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.IDIn(ids...)).
+		Select(sensor.FieldID, sensor.FieldSensorType).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[int]string, len(ss))
+	for _, s := range ss {
+		types[s.ID] = s.SensorType
+	}
+	return types, nil
+}
+
+func (r *sensorRepo) CountByType(ctx context.Context, sensorType string) (int, error) {
+	return r.db.Client.Sensor.Query().Where(sensor.SensorTypeEQ(sensorType)).Count(ctx)
+}
+
+func (r *sensorRepo) FindByIdentifiers(
+	ctx context.Context, sensorType string, identifiers []string) (map[string]int, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.SensorTypeEQ(sensorType), sensor.IdentifierIn(identifiers...)).
+		Select(sensor.FieldID, sensor.FieldIdentifier).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int, len(ss))
+	for _, s := range ss {
+		ids[s.Identifier] = s.ID
+	}
+	return ids, nil
+}
+
+func (r *sensorRepo) Add(ctx context.Context, sensorType string, identifier string) (int, error) {
+	s, err := r.db.Client.Sensor.Create().
+		SetSensorType(sensorType).
+		SetIdentifier(identifier).
+		Save(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.ID, nil
+}
+
+func convertToBizSensor(s *ent.Sensor) *biz.Sensor {
+	bs := &biz.Sensor{
+		Id:          int64(s.ID),
+		SensorType:  s.SensorType,
+		Identifier:  s.Identifier,
+		Stale:       s.Stale,
+		LastUpdated: timestamppb.New(s.LastUpdated),
+	}
+	if s.TerminalID != nil {
+		terminalId := int64(*s.TerminalID)
+		bs.TerminalId = &terminalId
+	}
+	return bs
+}
+
+func convertToBizSensorValue(v *biz.SensorReading, sensorId int) *v1.SensorValue {
+	return &v1.SensorValue{
+		SensorId:   int64(sensorId),
+		Value:      v.Value,
+		Timestamp:  timestamppb.New(v.Timestamp),
+		OutOfRange: v.OutOfRange,
+		RawValue:   v.Raw,
+	}
+}
+
+func (r *sensorRepo) FindById(ctx context.Context, id int) (*biz.Sensor, error) {
+	s, err := r.db.Client.Sensor.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensor(s), nil
+}
+
+func (r *sensorRepo) FindByTerminal(ctx context.Context, terminalId int) ([]*biz.Sensor, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.TerminalIDEQ(terminalId)).
+		Order(ent.Asc(sensor.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(ss))
+	for _, s := range ss {
+		ids = append(ids, s.ID)
+	}
+	latest, err := r.FindLatestValues(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]*biz.Sensor, 0, len(ss))
+	for _, s := range ss {
+		bs := convertToBizSensor(s)
+		if v, ok := latest[s.ID]; ok {
+			bs.Latest = convertToBizSensorValue(v, s.ID)
+		}
+		sensors = append(sensors, bs)
+	}
+	return sensors, nil
+}
+
+func (r *sensorRepo) FindByIds(ctx context.Context, ids []int) ([]*biz.Sensor, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.IDIn(ids...)).
+		Order(ent.Asc(sensor.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]*biz.Sensor, 0, len(ss))
+	for _, s := range ss {
+		sensors = append(sensors, convertToBizSensor(s))
+	}
+	return sensors, nil
+}
+
+func (r *sensorRepo) FindByTerminals(ctx context.Context, terminalIds []int, limit int) ([]*biz.Sensor, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.TerminalIDIn(terminalIds...)).
+		Order(ent.Asc(sensor.FieldID)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]*biz.Sensor, 0, len(ss))
+	for _, s := range ss {
+		sensors = append(sensors, convertToBizSensor(s))
+	}
+	return sensors, nil
+}
+
+func (r *sensorRepo) Attach(ctx context.Context, id int, terminalId int) (bool, error) {
+	// Only a detached sensor is attached, so that a sensor is never taken from another terminal silently
+	n, err := r.db.Client.Sensor.Update().
+		Where(sensor.IDEQ(id), sensor.Or(sensor.TerminalIDIsNil(), sensor.TerminalIDEQ(terminalId))).
+		SetTerminalID(terminalId).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *sensorRepo) Detach(ctx context.Context, id int, terminalId int) (bool, error) {
+	n, err := r.db.Client.Sensor.Update().
+		Where(sensor.IDEQ(id), sensor.TerminalIDEQ(terminalId)).
+		ClearTerminalID().
+		SetStale(false).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *sensorRepo) MarkStale(ctx context.Context, terminalId int) (int, error) {
+	return r.db.Client.Sensor.Update().
+		Where(sensor.TerminalIDEQ(terminalId), sensor.StaleEQ(false)).
+		SetStale(true).
+		Save(ctx)
+}
+
+// sensorValueChunk limits the rows of a bulk insert, so that the statement stays within the limit of parameters
+const sensorValueChunk = 1000
+
+// readingKey identifies a reading by its sensor and timestamp
+type readingKey struct {
+	sensorId  int
+	timestamp int64
+}
+
+func keyOf(sensorId int, ts time.Time) readingKey {
+	return readingKey{sensorId: sensorId, timestamp: ts.UnixMicro()}
+}
+
+func (r *sensorRepo) AddValues(
+	ctx context.Context, readings []*biz.SensorReading) (fresh []*biz.SensorReading, err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			fresh = nil
+		}
+	}()
+	if fresh, err = r.skipRecorded(ctx, tx, readings); err != nil {
+		return
+	}
+	for start := 0; start < len(fresh); start += sensorValueChunk {
+		chunk := fresh[start:min(start+sensorValueChunk, len(fresh))]
+		if err = tx.SensorValue.MapCreateBulk(chunk, func(c *ent.SensorValueCreate, i int) {
+			c.SetSensorID(chunk[i].SensorId).
+				SetValue(chunk[i].Value).
+				SetTimestamp(chunk[i].Timestamp).
+				SetOutOfRange(chunk[i].OutOfRange).
+				SetNillableRawValue(chunk[i].Raw)
+		}).Exec(ctx); err != nil {
+			return
+		}
+	}
+	// Only the latest reading of each sensor moves its last update time, which never goes backwards
+	latest := make(map[int]time.Time)
+	for _, reading := range fresh {
+		if reading.Timestamp.After(latest[reading.SensorId]) {
+			latest[reading.SensorId] = reading.Timestamp
+		}
+	}
+	for id, ts := range latest {
+		if err = tx.Sensor.Update().
+			Where(sensor.IDEQ(id), sensor.LastUpdatedLT(ts)).
+			SetLastUpdated(ts).
+			Exec(ctx); err != nil {
+			return
+		}
+	}
+	// Fresh readings mean the sensors are reachable again
+	ids := make([]int, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	if err = tx.Sensor.Update().
+		Where(sensor.IDIn(ids...), sensor.StaleEQ(true)).
+		SetStale(false).
+		Exec(ctx); err != nil {
+		return
+	}
+	return fresh, tx.Commit()
+}
+
+// skipRecorded drops the readings which have been stored before or repeat an earlier one of the batch. The stored
+// readings are looked up by their exact keys, i.e. the timestamps of each sensor, which are served by the unique
+// index on the sensor and the timestamp.
+func (r *sensorRepo) skipRecorded(
+	ctx context.Context, tx *ent.Tx, readings []*biz.SensorReading) ([]*biz.SensorReading, error) {
+	if len(readings) == 0 {
+		return nil, nil
+	}
+	timestamps := make(map[int][]time.Time)
+	for _, reading := range readings {
+		timestamps[reading.SensorId] = append(timestamps[reading.SensorId], reading.Timestamp)
+	}
+	predicates := make([]predicate.SensorValue, 0, len(timestamps))
+	for id, ts := range timestamps {
+		predicates = append(predicates, sensorvalue.And(sensorvalue.SensorIDEQ(id), sensorvalue.TimestampIn(ts...)))
+	}
+	recorded, err := tx.SensorValue.Query().
+		Where(sensorvalue.Or(predicates...)).
+		Select(sensorvalue.FieldSensorID, sensorvalue.FieldTimestamp).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[readingKey]struct{}, len(recorded)+len(readings))
+	for _, v := range recorded {
+		seen[keyOf(v.SensorID, v.Timestamp)] = struct{}{}
+	}
+	fresh := make([]*biz.SensorReading, 0, len(readings))
+	for _, reading := range readings {
+		key := keyOf(reading.SensorId, reading.Timestamp)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		fresh = append(fresh, reading)
+	}
+	return fresh, nil
+}
+
+func convertToBizSensorReading(v *ent.SensorValue) *biz.SensorReading {
+	return &biz.SensorReading{
+		SensorId:   v.SensorID,
+		Value:      v.Value,
+		Timestamp:  v.Timestamp,
+		OutOfRange: v.OutOfRange,
+		Raw:        v.RawValue,
+	}
+}
+
+// updateValuesChunk bounds the readings updated by a statement, whose parameters grow with the readings
+const updateValuesChunk = 500
+
+func (r *sensorRepo) UpdateValues(ctx context.Context, readings []*biz.SensorReading) (err error) {
+	var tx *stdsql.Tx
+	if tx, err = r.db.db.BeginTx(ctx, nil); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	for start := 0; start < len(readings); start += updateValuesChunk {
+		query, args := updateValuesOf(r.db.dialect, readings[start:min(start+updateValuesChunk, len(readings))]).
+			Query()
+		if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// updateValuesOf builds the statement updating the readings at once, which picks the new values of each row by its
+// sensor and timestamp
+func updateValuesOf(dialect string, readings []*biz.SensorReading) *sql.UpdateBuilder {
+	pick := func(column string, value func(r *biz.SensorReading) any) sql.Querier {
+		return sql.ExprFunc(func(b *sql.Builder) {
+			b.WriteString("CASE")
+			for _, r := range readings {
+				b.WriteString(" WHEN ").Ident(sensorvalue.FieldSensorID).WriteOp(sql.OpEQ).Arg(r.SensorId)
+				b.WriteString(" AND ").Ident(sensorvalue.FieldTimestamp).WriteOp(sql.OpEQ).Arg(r.Timestamp)
+				b.WriteString(" THEN ").Arg(value(r))
+			}
+			b.WriteString(" ELSE ").Ident(column).WriteString(" END")
+		})
+	}
+	rows := make([]*sql.Predicate, 0, len(readings))
+	for _, r := range readings {
+		rows = append(rows, sql.And(
+			sql.EQ(sensorvalue.FieldSensorID, r.SensorId),
+			sql.EQ(sensorvalue.FieldTimestamp, r.Timestamp),
+		))
+	}
+	return sql.Dialect(dialect).Update(sensorvalue.Table).
+		Set(sensorvalue.FieldValue, pick(sensorvalue.FieldValue, func(r *biz.SensorReading) any { return r.Value })).
+		Set(sensorvalue.FieldOutOfRange, pick(sensorvalue.FieldOutOfRange,
+			func(r *biz.SensorReading) any { return r.OutOfRange })).
+		Set(sensorvalue.FieldRawValue, pick(sensorvalue.FieldRawValue, func(r *biz.SensorReading) any {
+			if r.Raw == nil {
+				return nil
+			}
+			return *r.Raw
+		})).
+		Where(sql.Or(rows...))
+}
+
+func (r *sensorRepo) FindValues(
+	ctx context.Context, id int, from, to time.Time, limit int) ([]*biz.SensorReading, error) {
+	vs, err := r.db.Client.SensorValue.Query().
+		Where(
+			sensorvalue.SensorIDEQ(id),
+			sensorvalue.TimestampGTE(from),
+			sensorvalue.TimestampLT(to),
+		).
+		Order(ent.Asc(sensorvalue.FieldTimestamp)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]*biz.SensorReading, 0, len(vs))
+	for _, v := range vs {
+		readings = append(readings, convertToBizSensorReading(v))
+	}
+	return readings, nil
+}
+
+func (r *sensorRepo) FindValueBefore(ctx context.Context, id int, t time.Time) (*biz.SensorReading, error) {
+	v, err := r.db.Client.SensorValue.Query().
+		Where(sensorvalue.SensorIDEQ(id), sensorvalue.TimestampLT(t)).
+		Order(ent.Desc(sensorvalue.FieldTimestamp)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorReading(v), nil
+}
+
+func (r *sensorRepo) FindValueAfter(ctx context.Context, id int, t time.Time) (*biz.SensorReading, error) {
+	v, err := r.db.Client.SensorValue.Query().
+		Where(sensorvalue.SensorIDEQ(id), sensorvalue.TimestampGTE(t)).
+		Order(ent.Asc(sensorvalue.FieldTimestamp)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorReading(v), nil
+}
+
+// FindLatestValues finds the latest readings in a single query. The latest timestamp of each sensor is found by
+// grouping, which is served by the unique index on the sensor and the timestamp, and the readings are joined then.
+func (r *sensorRepo) FindLatestValues(ctx context.Context, ids []int) (map[int]*biz.SensorReading, error) {
+	latest := make(map[int]*biz.SensorReading, len(ids))
+	if len(ids) == 0 {
+		return latest, nil
+	}
+	vs, err := r.db.Client.SensorValue.Query().
+		Where(func(s *sql.Selector) {
+			t := sql.Table(sensorvalue.Table)
+			last := sql.Select(t.C(sensorvalue.FieldSensorID), sql.As(sql.Max(t.C(sensorvalue.FieldTimestamp)), "ts")).
+				From(t).
+				Where(sql.InInts(t.C(sensorvalue.FieldSensorID), ids...)).
+				GroupBy(t.C(sensorvalue.FieldSensorID)).
+				As("latest")
+			s.Join(last).OnP(sql.And(
+				sql.ColumnsEQ(s.C(sensorvalue.FieldSensorID), last.C(sensorvalue.FieldSensorID)),
+				sql.ColumnsEQ(s.C(sensorvalue.FieldTimestamp), last.C("ts")),
+			))
+		}).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vs {
+		latest[v.SensorID] = convertToBizSensorReading(v)
+	}
+	return latest, nil
+}
+
+func (r *sensorRepo) DeleteValuesBefore(ctx context.Context, id int, before time.Time, limit int) (int, error) {
+	// The rows are deleted by their ids, so that the statement locks only the rows it deletes
+	ids, err := r.db.Client.SensorValue.Query().
+		Where(sensorvalue.SensorIDEQ(id), sensorvalue.TimestampLT(before)).
+		Order(ent.Asc(sensorvalue.FieldTimestamp)).
+		Limit(limit).
+		IDs(ctx)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return r.db.Client.SensorValue.Delete().Where(sensorvalue.IDIn(ids...)).Exec(ctx)
+}
+
+func (r *sensorRepo) FindAfter(ctx context.Context, afterId int, limit int) ([]*biz.Sensor, error) {
+	ss, err := r.db.Client.Sensor.Query().
+		Where(sensor.IDGT(afterId)).
+		Order(ent.Asc(sensor.FieldID)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sensors := make([]*biz.Sensor, 0, len(ss))
+	for _, s := range ss {
+		sensors = append(sensors, convertToBizSensor(s))
+	}
+	return sensors, nil
+}
+
+func resolutionOf(resolution v1.Resolution) sensorrollup.Resolution {
+	return sensorrollup.Resolution(strings.ToLower(resolution.String()))
+}
+
+func convertToBizSensorRollup(v *ent.SensorRollup) *biz.SensorRollup {
+	return &biz.SensorRollup{
+		SensorId:   v.SensorID,
+		Resolution: v1.Resolution(v1.Resolution_value[strings.ToUpper(v.Resolution.String())]),
+		Bucket:     v.Bucket,
+		Count:      v.Count,
+		Sum:        v.Sum,
+		Min:        v.Min,
+		Max:        v.Max,
+		Last:       v.Last,
+	}
+}
+
+func (r *sensorRepo) AddRollups(ctx context.Context, rollups []*biz.SensorRollup) error {
+	for start := 0; start < len(rollups); start += sensorValueChunk {
+		chunk := rollups[start:min(start+sensorValueChunk, len(rollups))]
+		if err := r.db.Client.SensorRollup.MapCreateBulk(chunk, func(c *ent.SensorRollupCreate, i int) {
+			c.SetSensorID(chunk[i].SensorId).
+				SetResolution(resolutionOf(chunk[i].Resolution)).
+				SetBucket(chunk[i].Bucket).
+				SetCount(chunk[i].Count).
+				SetSum(chunk[i].Sum).
+				SetMin(chunk[i].Min).
+				SetMax(chunk[i].Max).
+				SetLast(chunk[i].Last)
+		}).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sensorRepo) UpdateRollups(ctx context.Context, rollups []*biz.SensorRollup) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	for _, rollup := range rollups {
+		if err = tx.SensorRollup.Update().
+			Where(
+				sensorrollup.SensorIDEQ(rollup.SensorId),
+				sensorrollup.ResolutionEQ(resolutionOf(rollup.Resolution)),
+				sensorrollup.BucketEQ(rollup.Bucket),
+			).
+			SetCount(rollup.Count).
+			SetSum(rollup.Sum).
+			SetMin(rollup.Min).
+			SetMax(rollup.Max).
+			SetLast(rollup.Last).
+			Exec(ctx); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sensorRepo) FindRollups(
+	ctx context.Context, id int, resolution v1.Resolution, from, to time.Time,
+	limit int) ([]*biz.SensorRollup, error) {
+	vs, err := r.db.Client.SensorRollup.Query().
+		Where(
+			sensorrollup.SensorIDEQ(id),
+			sensorrollup.ResolutionEQ(resolutionOf(resolution)),
+			sensorrollup.BucketGTE(from),
+			sensorrollup.BucketLT(to),
+		).
+		Order(ent.Asc(sensorrollup.FieldBucket)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rollups := make([]*biz.SensorRollup, 0, len(vs))
+	for _, v := range vs {
+		rollups = append(rollups, convertToBizSensorRollup(v))
+	}
+	return rollups, nil
+}
+
+func (r *sensorRepo) FindLatestRollup(
+	ctx context.Context, id int, resolution v1.Resolution) (*biz.SensorRollup, error) {
+	v, err := r.db.Client.SensorRollup.Query().
+		Where(sensorrollup.SensorIDEQ(id), sensorrollup.ResolutionEQ(resolutionOf(resolution))).
+		Order(ent.Desc(sensorrollup.FieldBucket)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorRollup(v), nil
+}
+
+func (r *sensorRepo) DeleteRollupsBefore(
+	ctx context.Context, id int, resolution v1.Resolution, before time.Time, limit int) (int, error) {
+	ids, err := r.db.Client.SensorRollup.Query().
+		Where(
+			sensorrollup.SensorIDEQ(id),
+			sensorrollup.ResolutionEQ(resolutionOf(resolution)),
+			sensorrollup.BucketLT(before),
+		).
+		Order(ent.Asc(sensorrollup.FieldBucket)).
+		Limit(limit).
+		IDs(ctx)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return r.db.Client.SensorRollup.Delete().Where(sensorrollup.IDIn(ids...)).Exec(ctx)
+}
+
+func (r *sensorRepo) MarkDirty(ctx context.Context, buckets []*biz.DirtyBucket) error {
+	for start := 0; start < len(buckets); start += sensorValueChunk {
+		chunk := buckets[start:min(start+sensorValueChunk, len(buckets))]
+		if err := r.db.Client.SensorDirtyBucket.MapCreateBulk(chunk, func(c *ent.SensorDirtyBucketCreate, i int) {
+			c.SetSensorID(chunk[i].SensorId).SetBucket(chunk[i].Bucket)
+		}).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sensorRepo) FindDirty(ctx context.Context, id int, limit int) ([]*biz.DirtyBucket, error) {
+	vs, err := r.db.Client.SensorDirtyBucket.Query().
+		Where(sensordirtybucket.SensorIDEQ(id)).
+		Order(ent.Asc(sensordirtybucket.FieldBucket), ent.Asc(sensordirtybucket.FieldID)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]*biz.DirtyBucket, 0, len(vs))
+	for _, v := range vs {
+		buckets = append(buckets, &biz.DirtyBucket{Id: v.ID, SensorId: v.SensorID, Bucket: v.Bucket})
+	}
+	return buckets, nil
+}
+
+func (r *sensorRepo) ClearDirty(ctx context.Context, ids []int) error {
+	_, err := r.db.Client.SensorDirtyBucket.Delete().Where(sensordirtybucket.IDIn(ids...)).Exec(ctx)
+	return err
+}
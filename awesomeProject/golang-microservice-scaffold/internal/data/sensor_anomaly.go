@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/sensoranomaly"
+	"example/internal/ent/sensoranomalymodel"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// anomalyRepo implements the interface [biz.AnomalyRepository]
+type anomalyRepo struct {
+	db *Data
+}
+
+// NewAnomalyRepository creates a new anomaly repository implementation instance
+func NewAnomalyRepository(database *Data) biz.AnomalyRepository {
+	return &anomalyRepo{db: database}
+}
+
+func (r *anomalyRepo) FindModels(ctx context.Context, ids []int) (map[int]*biz.AnomalyModel, error) {
+	ms, err := r.db.Client.SensorAnomalyModel.Query().
+		Where(sensoranomalymodel.SensorIDIn(ids...)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	models := make(map[int]*biz.AnomalyModel, len(ms))
+	for _, m := range ms {
+		model := &biz.AnomalyModel{}
+		if err = proto.Unmarshal(m.State, model); err != nil {
+			return nil, err
+		}
+		model.SensorId = int64(m.SensorID)
+		model.UpdateTime = timestamppb.New(m.UpdateTime)
+		models[m.SensorID] = model
+	}
+	return models, nil
+}
+
+func (r *anomalyRepo) SaveModel(ctx context.Context, model *biz.AnomalyModel) error {
+	state, err := proto.Marshal(model)
+	if err != nil {
+		return err
+	}
+	id := int(model.SensorId)
+	n, err := r.db.Client.SensorAnomalyModel.Update().
+		Where(sensoranomalymodel.SensorIDEQ(id)).
+		SetState(state).
+		Save(ctx)
+	if err != nil || n > 0 {
+		return err
+	}
+	err = r.db.Client.SensorAnomalyModel.Create().
+		SetSensorID(id).
+		SetState(state).
+		Exec(ctx)
+	if ent.IsConstraintError(err) {
+		// Another replica has created the model in the meantime, which is replaced as well
+		return r.db.Client.SensorAnomalyModel.Update().
+			Where(sensoranomalymodel.SensorIDEQ(id)).
+			SetState(state).
+			Exec(ctx)
+	}
+	return err
+}
+
+func (r *anomalyRepo) DeleteModel(ctx context.Context, sensorId int) error {
+	_, err := r.db.Client.SensorAnomalyModel.Delete().
+		Where(sensoranomalymodel.SensorIDEQ(sensorId)).
+		Exec(ctx)
+	return err
+}
+
+func (r *anomalyRepo) AddAnomalies(ctx context.Context, anomalies []*biz.SensorAnomaly) error {
+	for start := 0; start < len(anomalies); start += sensorValueChunk {
+		chunk := anomalies[start:min(start+sensorValueChunk, len(anomalies))]
+		if err := r.db.Client.SensorAnomaly.MapCreateBulk(chunk, func(c *ent.SensorAnomalyCreate, i int) {
+			c.SetSensorID(int(chunk[i].SensorId)).
+				SetTimestamp(chunk[i].Timestamp.AsTime()).
+				SetValue(chunk[i].Value).
+				SetExpected(chunk[i].Expected).
+				SetScore(chunk[i].Score).
+				SetDetector(sensoranomaly.Detector(strings.ToLower(chunk[i].Detector.String())))
+		}).Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func convertToBizSensorAnomaly(a *ent.SensorAnomaly) *biz.SensorAnomaly {
+	return &biz.SensorAnomaly{
+		Id:         int64(a.ID),
+		SensorId:   int64(a.SensorID),
+		Timestamp:  timestamppb.New(a.Timestamp),
+		Value:      a.Value,
+		Expected:   a.Expected,
+		Score:      a.Score,
+		Detector:   v1.SensorAnomaly_Detector(v1.SensorAnomaly_Detector_value[strings.ToUpper(a.Detector.String())]),
+		CreateTime: timestamppb.New(a.CreateTime),
+	}
+}
+
+func (r *anomalyRepo) ListAnomalies(
+	ctx context.Context, q *biz.AnomalyQuery) (anomalies []*biz.SensorAnomaly, total int, err error) {
+	query := r.db.Client.SensorAnomaly.Query()
+	if len(q.SensorIds) > 0 {
+		query.Where(sensoranomaly.SensorIDIn(q.SensorIds...))
+	}
+	if !q.From.IsZero() {
+		query.Where(sensoranomaly.TimestampGTE(q.From))
+	}
+	if !q.To.IsZero() {
+		query.Where(sensoranomaly.TimestampLT(q.To))
+	}
+	if q.MinScore > 0 {
+		query.Where(sensoranomaly.ScoreGTE(q.MinScore))
+	}
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var as []*ent.SensorAnomaly
+	if as, err = query.
+		Order(ent.Desc(sensoranomaly.FieldTimestamp), ent.Desc(sensoranomaly.FieldID)).
+		Offset(q.Offset).
+		Limit(q.Limit).
+		All(ctx); err != nil {
+		return
+	}
+	anomalies = make([]*biz.SensorAnomaly, 0, len(as))
+	for _, a := range as {
+		anomalies = append(anomalies, convertToBizSensorAnomaly(a))
+	}
+	return anomalies, total, nil
+}
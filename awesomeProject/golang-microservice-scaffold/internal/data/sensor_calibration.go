@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/calibrationrecompute"
+	"example/internal/ent/sensorcalibration"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect/sql"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// calibrationRepo implements the interface [biz.CalibrationRepository]
+type calibrationRepo struct {
+	db *Data
+}
+
+// NewCalibrationRepository creates a new calibration repository implementation instance
+func NewCalibrationRepository(database *Data) biz.CalibrationRepository {
+	return &calibrationRepo{db: database}
+}
+
+// marshalProfile encodes the coefficients of the profile, i.e. the profile without any other field
+func marshalProfile(c *biz.Calibration) ([]byte, error) {
+	return proto.Marshal(&v1.Calibration{Profile: c.Profile})
+}
+
+func convertToBizCalibration(c *ent.SensorCalibration) (*biz.Calibration, error) {
+	calibration := &biz.Calibration{}
+	if err := proto.Unmarshal(c.Profile, calibration); err != nil {
+		return nil, err
+	}
+	calibration.Id = int64(c.ID)
+	calibration.SensorId = int64(c.SensorID)
+	calibration.EffectiveFrom = timestamppb.New(c.EffectiveFrom)
+	calibration.Description = c.Description
+	calibration.CreateTime = timestamppb.New(c.CreateTime)
+	return calibration, nil
+}
+
+func (r *calibrationRepo) Add(ctx context.Context, c *biz.Calibration) (*biz.Calibration, error) {
+	profile, err := marshalProfile(c)
+	if err != nil {
+		return nil, err
+	}
+	created, err := r.db.Client.SensorCalibration.Create().
+		SetSensorID(int(c.SensorId)).
+		SetEffectiveFrom(c.EffectiveFrom.AsTime()).
+		SetProfile(profile).
+		SetDescription(c.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCalibration(created)
+}
+
+func (r *calibrationRepo) FindById(ctx context.Context, id int) (*biz.Calibration, error) {
+	c, err := r.db.Client.SensorCalibration.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCalibration(c)
+}
+
+func (r *calibrationRepo) FindBySensors(ctx context.Context, ids []int) (map[int][]*biz.Calibration, error) {
+	cs, err := r.db.Client.SensorCalibration.Query().
+		Where(sensorcalibration.SensorIDIn(ids...)).
+		Order(ent.Asc(sensorcalibration.FieldSensorID), ent.Asc(sensorcalibration.FieldEffectiveFrom)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	calibrations := make(map[int][]*biz.Calibration)
+	for _, c := range cs {
+		calibration, err := convertToBizCalibration(c)
+		if err != nil {
+			return nil, err
+		}
+		calibrations[c.SensorID] = append(calibrations[c.SensorID], calibration)
+	}
+	return calibrations, nil
+}
+
+func (r *calibrationRepo) Update(ctx context.Context, c *biz.Calibration) (*biz.Calibration, error) {
+	profile, err := marshalProfile(c)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := r.db.Client.SensorCalibration.UpdateOneID(int(c.Id)).
+		SetEffectiveFrom(c.EffectiveFrom.AsTime()).
+		SetProfile(profile).
+		SetDescription(c.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCalibration(updated)
+}
+
+func (r *calibrationRepo) Delete(ctx context.Context, id int) error {
+	return r.db.Client.SensorCalibration.DeleteOneID(id).Exec(ctx)
+}
+
+func convertToBizCalibrationRecompute(e *ent.CalibrationRecompute) *biz.CalibrationRecompute {
+	recompute := &biz.CalibrationRecompute{
+		Id:        int64(e.ID),
+		SensorId:  int64(e.SensorID),
+		StartTime: timestamppb.New(e.StartTime),
+		EndTime:   timestamppb.New(e.EndTime),
+		Status: v1.CalibrationRecompute_Status(
+			v1.CalibrationRecompute_Status_value[strings.ToUpper(e.Status.String())]),
+		Rows:         e.Rows,
+		StaleBuckets: e.StaleBuckets,
+		Error:        e.Error,
+		CreateTime:   timestamppb.New(e.CreateTime),
+	}
+	if e.FinishTime != nil {
+		recompute.FinishTime = timestamppb.New(*e.FinishTime)
+	}
+	return recompute
+}
+
+func (r *calibrationRepo) AddRecompute(
+	ctx context.Context, recompute *biz.CalibrationRecompute) (*biz.CalibrationRecompute, error) {
+	created, err := r.db.Client.CalibrationRecompute.Create().
+		SetSensorID(int(recompute.SensorId)).
+		SetStartTime(recompute.StartTime.AsTime()).
+		SetEndTime(recompute.EndTime.AsTime()).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCalibrationRecompute(created), nil
+}
+
+func (r *calibrationRepo) FindRecomputeById(ctx context.Context, id int) (*biz.CalibrationRecompute, error) {
+	e, err := r.db.Client.CalibrationRecompute.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizCalibrationRecompute(e), nil
+}
+
+func (r *calibrationRepo) ClaimNextRecompute(
+	ctx context.Context, stalledBefore time.Time) (*biz.CalibrationRecompute, int32, error) {
+	e, attempts, err := claimNext(ctx, stalledBefore,
+		func(ctx context.Context, p func(*sql.Selector)) (*ent.CalibrationRecompute, jobClaim, error) {
+			e, err := r.db.Client.CalibrationRecompute.Query().
+				Where(p).
+				Order(ent.Asc(calibrationrecompute.FieldID)).
+				First(ctx)
+			if err != nil {
+				return nil, jobClaim{}, err
+			}
+			return e, jobClaim{id: e.ID, attempts: e.Attempts, status: e.Status.String()}, nil
+		},
+		func(ctx context.Context, p func(*sql.Selector)) (int, error) {
+			return r.db.Client.CalibrationRecompute.Update().Where(p).
+				SetStatus(calibrationrecompute.StatusRunning).
+				AddAttempts(1).
+				Save(ctx)
+		})
+	if e == nil || err != nil {
+		return nil, 0, err
+	}
+	recompute := convertToBizCalibrationRecompute(e)
+	recompute.Status = v1.CalibrationRecompute_RUNNING
+	return recompute, attempts, nil
+}
+
+func (r *calibrationRepo) ProgressRecompute(ctx context.Context, id int, attempts int32, rows int64) (bool, error) {
+	n, err := r.db.Client.CalibrationRecompute.Update().
+		Where(claimedBy(id, attempts, jobStatusRunning)).
+		SetRows(rows).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *calibrationRepo) FinishRecompute(
+	ctx context.Context, id int, attempts int32, result *biz.CalibrationRecompute) (bool, error) {
+	n, err := r.db.Client.CalibrationRecompute.Update().
+		Where(claimedBy(id, attempts, jobStatusRunning)).
+		SetStatus(calibrationrecompute.Status(strings.ToLower(result.Status.String()))).
+		SetRows(result.Rows).
+		SetStaleBuckets(result.StaleBuckets).
+		SetError(result.Error).
+		SetFinishTime(result.FinishTime.AsTime()).
+		Save(ctx)
+	return n > 0, err
+}
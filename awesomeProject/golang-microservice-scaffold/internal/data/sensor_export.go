@@ -0,0 +1,237 @@
+package data
+
+import (
+	"context"
+	"errors"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/conf"
+	"example/internal/ent"
+	"example/internal/ent/sensorexport"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect/sql"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sensorExportRepo implements the interface [biz.SensorExportRepository]
+type sensorExportRepo struct {
+	db *Data
+}
+
+// NewSensorExportRepository creates a new sensor export repository implementation instance
+func NewSensorExportRepository(database *Data) biz.SensorExportRepository {
+	return &sensorExportRepo{db: database}
+}
+
+func convertToBizSensorExport(e *ent.SensorExport) (*biz.SensorExport, error) {
+	req := &biz.ExportRequest{}
+	if err := proto.Unmarshal(e.Request, req); err != nil {
+		return nil, err
+	}
+	export := &biz.SensorExport{
+		Id:         int64(e.ID),
+		Request:    req,
+		Status:     v1.SensorExport_Status(v1.SensorExport_Status_value[strings.ToUpper(e.Status.String())]),
+		Rows:       e.Rows,
+		Size:       e.Size,
+		Error:      e.Error,
+		CreateTime: timestamppb.New(e.CreateTime),
+	}
+	if e.FinishTime != nil {
+		export.FinishTime = timestamppb.New(*e.FinishTime)
+	}
+	if e.ExpireTime != nil {
+		export.ExpireTime = timestamppb.New(*e.ExpireTime)
+	}
+	return export, nil
+}
+
+func (r *sensorExportRepo) Add(ctx context.Context, req *biz.ExportRequest) (*biz.SensorExport, error) {
+	request, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	created, err := r.db.Client.SensorExport.Create().SetRequest(request).Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorExport(created)
+}
+
+func (r *sensorExportRepo) FindById(ctx context.Context, id int) (*biz.SensorExport, error) {
+	e, err := r.db.Client.SensorExport.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorExport(e)
+}
+
+func (r *sensorExportRepo) FindArtifact(ctx context.Context, id int) (string, error) {
+	e, err := r.db.Client.SensorExport.Query().
+		Where(sensorexport.IDEQ(id)).
+		Select(sensorexport.FieldArtifact).
+		Only(ctx)
+	if err != nil {
+		return "", err
+	}
+	return e.Artifact, nil
+}
+
+func (r *sensorExportRepo) List(
+	ctx context.Context, offset, limit int) (exports []*biz.SensorExport, total int, err error) {
+	query := r.db.Client.SensorExport.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var es []*ent.SensorExport
+	if es, err = query.
+		Order(ent.Desc(sensorexport.FieldID)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	exports = make([]*biz.SensorExport, 0, len(es))
+	for _, e := range es {
+		export, err := convertToBizSensorExport(e)
+		if err != nil {
+			return nil, 0, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, total, nil
+}
+
+func (r *sensorExportRepo) Delete(ctx context.Context, id int) error {
+	return r.db.Client.SensorExport.DeleteOneID(id).Exec(ctx)
+}
+
+func (r *sensorExportRepo) ClaimNext(
+	ctx context.Context, stalledBefore time.Time) (*biz.SensorExport, int32, error) {
+	e, attempts, err := claimNext(ctx, stalledBefore,
+		func(ctx context.Context, p func(*sql.Selector)) (*ent.SensorExport, jobClaim, error) {
+			e, err := r.db.Client.SensorExport.Query().Where(p).Order(ent.Asc(sensorexport.FieldID)).First(ctx)
+			if err != nil {
+				return nil, jobClaim{}, err
+			}
+			return e, jobClaim{id: e.ID, attempts: e.Attempts, status: e.Status.String()}, nil
+		},
+		func(ctx context.Context, p func(*sql.Selector)) (int, error) {
+			return r.db.Client.SensorExport.Update().Where(p).
+				SetStatus(sensorexport.StatusRunning).
+				AddAttempts(1).
+				Save(ctx)
+		})
+	if e == nil || err != nil {
+		return nil, 0, err
+	}
+	export, err := convertToBizSensorExport(e)
+	if err != nil {
+		return nil, 0, err
+	}
+	export.Status = v1.SensorExport_RUNNING
+	return export, attempts, nil
+}
+
+func (r *sensorExportRepo) Progress(ctx context.Context, id int, attempts int32, rows int64) (bool, error) {
+	n, err := r.db.Client.SensorExport.Update().
+		Where(claimedBy(id, attempts, jobStatusRunning)).
+		SetRows(rows).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *sensorExportRepo) Finish(
+	ctx context.Context, id int, attempts int32, result *biz.SensorExport, artifact string) (bool, error) {
+	n, err := r.db.Client.SensorExport.Update().
+		Where(claimedBy(id, attempts, jobStatusRunning)).
+		SetStatus(sensorexport.Status(strings.ToLower(result.Status.String()))).
+		SetRows(result.Rows).
+		SetSize(result.Size).
+		SetError(result.Error).
+		SetArtifact(artifact).
+		SetFinishTime(result.FinishTime.AsTime()).
+		SetExpireTime(result.ExpireTime.AsTime()).
+		Save(ctx)
+	return n > 0, err
+}
+
+func (r *sensorExportRepo) FindExpired(ctx context.Context, t time.Time, limit int) (map[int]string, error) {
+	es, err := r.db.Client.SensorExport.Query().
+		Where(sensorexport.ExpireTimeLT(t)).
+		Select(sensorexport.FieldID, sensorexport.FieldArtifact).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expired := make(map[int]string, len(es))
+	for _, e := range es {
+		expired[e.ID] = e.Artifact
+	}
+	return expired, nil
+}
+
+// exportStore implements the interface [biz.ExportStore] on the local file system. The directory should be shared
+// by all the instances of the service, e.g. a network volume.
+type exportStore struct {
+	dir string
+}
+
+// NewExportStore creates the directory of the export files if it does not exist yet
+func NewExportStore(c *conf.Data) (biz.ExportStore, error) {
+	dir := c.GetExport().GetDir()
+	if dir == "" {
+		dir = "./data/export"
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &exportStore{dir: dir}, nil
+}
+
+func (s *exportStore) Save(_ context.Context, r io.Reader) (name string, size int64, err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(s.dir, "export-*"+partSuffix); err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if size, err = io.Copy(f, r); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	name = strings.TrimSuffix(filepath.Base(f.Name()), partSuffix)
+	if err = os.Rename(f.Name(), s.path(name)); err != nil {
+		return
+	}
+	return name, size, nil
+}
+
+func (s *exportStore) Open(_ context.Context, name string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *exportStore) Remove(_ context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path resolves the name of a file inside the directory
+func (s *exportStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"fmt"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// latestValueCache implements the interface [biz.LatestValueCache]. The latest reading of each sensor is kept in a
+// Redis hash along with its timestamp, so that a reading is never replaced by an earlier one which arrives late.
+type latestValueCache struct {
+	cache *Cache
+	log   *log.Helper
+}
+
+// NewLatestValueCache creates a new cache of the latest readings
+func NewLatestValueCache(cache *Cache, logger log.Logger) biz.LatestValueCache {
+	return &latestValueCache{cache: cache, log: log.NewHelper(log.With(logger, "module", "data/sensor"))}
+}
+
+func keyLatestValue(sensorId int) string {
+	return fmt.Sprintf("sensor:latest:%d", sensorId)
+}
+
+// putLatest replaces the cached reading unless the cached one is later. KEYS[1] is the hash of the sensor, ARGV[1] is
+// the timestamp in microseconds and ARGV[2] is the reading.
+var putLatest = redis.NewScript(`
+local ts = redis.call('HGET', KEYS[1], 'ts')
+if ts and tonumber(ts) > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'ts', ARGV[1], 'reading', ARGV[2])
+return 1
+`)
+
+func (c *latestValueCache) Put(ctx context.Context, readings []*biz.SensorReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+	pipe := c.cache.Client.Pipeline()
+	for _, r := range readings {
+		raw, err := proto.Marshal(&v1.SensorValue{
+			SensorId:   int64(r.SensorId),
+			Value:      r.Value,
+			Timestamp:  timestamppb.New(r.Timestamp),
+			OutOfRange: r.OutOfRange,
+			RawValue:   r.Raw,
+		})
+		if err != nil {
+			return err
+		}
+		// Eval rather than EvalSha, since a script missing from the server cannot be loaded in the middle of a pipeline
+		putLatest.Eval(ctx, pipe, []string{keyLatestValue(r.SensorId)}, r.Timestamp.UnixMicro(), raw)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *latestValueCache) Get(ctx context.Context, ids []int) (map[int]*biz.SensorReading, error) {
+	pipe := c.cache.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(ids))
+	for _, id := range ids {
+		cmds = append(cmds, pipe.HGet(ctx, keyLatestValue(id), "reading"))
+	}
+	// The pipeline fails with redis.Nil as soon as any of the sensors is not cached, which is not an error here
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	latest := make(map[int]*biz.SensorReading, len(ids))
+	for i, cmd := range cmds {
+		raw, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		v := &v1.SensorValue{}
+		if err = proto.Unmarshal(raw, v); err != nil {
+			c.log.Warnf("malformed cache entry of the latest reading of sensor %d: %v", ids[i], err)
+			continue
+		}
+		latest[ids[i]] = &biz.SensorReading{
+			SensorId:   ids[i],
+			Value:      v.Value,
+			Timestamp:  v.Timestamp.AsTime(),
+			OutOfRange: v.OutOfRange,
+			Raw:        v.RawValue,
+		}
+	}
+	return latest, nil
+}
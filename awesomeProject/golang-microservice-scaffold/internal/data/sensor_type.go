@@ -0,0 +1,181 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/sensortype"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sensorTypeRepo implements the interface [biz.SensorTypeRepository]
+type sensorTypeRepo struct {
+	db *Data
+}
+
+// NewSensorTypeRepository creates a new sensor type repository implementation instance
+func NewSensorTypeRepository(database *Data) biz.SensorTypeRepository {
+	return &sensorTypeRepo{db: database}
+}
+
+func convertToBizSensorType(t *ent.SensorType) *biz.SensorType {
+	outOfRange := v1.SensorType_REJECT
+	if t.OutOfRange == sensortype.OutOfRangeFlag {
+		outOfRange = v1.SensorType_FLAG
+	}
+	return &biz.SensorType{
+		Id:               int64(t.ID),
+		Name:             t.Name,
+		Unit:             t.Unit,
+		Min:              t.Min,
+		Max:              t.Max,
+		Precision:        t.Precision,
+		SamplingInterval: durationpb.New(time.Duration(t.SamplingInterval) * time.Millisecond),
+		OutOfRange:       outOfRange,
+		Description:      t.Description,
+		CreateTime:       timestamppb.New(t.CreateTime),
+		UpdateTime:       timestamppb.New(t.UpdateTime),
+		Retention: &v1.SensorType_Retention{
+			Raw:    durationOfMillis(t.RawRetention),
+			Minute: durationOfMillis(t.MinuteRetention),
+			Hour:   durationOfMillis(t.HourRetention),
+		},
+	}
+}
+
+// durationOfMillis converts the nullable milliseconds, which are absent if null
+func durationOfMillis(ms *int64) *durationpb.Duration {
+	if ms == nil {
+		return nil
+	}
+	return durationpb.New(time.Duration(*ms) * time.Millisecond)
+}
+
+// millisOf converts the optional duration into the nullable milliseconds
+func millisOf(d *durationpb.Duration) *int64 {
+	if d == nil {
+		return nil
+	}
+	ms := d.AsDuration().Milliseconds()
+	return &ms
+}
+
+// outOfRangeOf converts the policy of the readings outside the valid range, which rejects them unless specified
+func outOfRangeOf(t *biz.SensorType) sensortype.OutOfRange {
+	if t.OutOfRange == v1.SensorType_FLAG {
+		return sensortype.OutOfRangeFlag
+	}
+	return sensortype.OutOfRangeReject
+}
+
+func (r *sensorTypeRepo) Add(ctx context.Context, t *biz.SensorType) (*biz.SensorType, error) {
+	created, err := r.db.Client.SensorType.Create().
+		SetName(t.Name).
+		SetUnit(t.Unit).
+		SetNillableMin(t.Min).
+		SetNillableMax(t.Max).
+		SetNillablePrecision(t.Precision).
+		SetSamplingInterval(t.SamplingInterval.AsDuration().Milliseconds()).
+		SetOutOfRange(outOfRangeOf(t)).
+		SetNillableRawRetention(millisOf(t.GetRetention().GetRaw())).
+		SetNillableMinuteRetention(millisOf(t.GetRetention().GetMinute())).
+		SetNillableHourRetention(millisOf(t.GetRetention().GetHour())).
+		SetDescription(t.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorType(created), nil
+}
+
+func (r *sensorTypeRepo) FindById(ctx context.Context, id int) (*biz.SensorType, error) {
+	t, err := r.db.Client.SensorType.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorType(t), nil
+}
+
+func (r *sensorTypeRepo) FindByNames(ctx context.Context, names []string) (map[string]*biz.SensorType, error) {
+	ts, err := r.db.Client.SensorType.Query().Where(sensortype.NameIn(names...)).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]*biz.SensorType, len(ts))
+	for _, t := range ts {
+		types[t.Name] = convertToBizSensorType(t)
+	}
+	return types, nil
+}
+
+func (r *sensorTypeRepo) List(ctx context.Context, offset, limit int) (types []*biz.SensorType, total int, err error) {
+	query := r.db.Client.SensorType.Query()
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var ts []*ent.SensorType
+	if ts, err = query.
+		Order(ent.Asc(sensortype.FieldName)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	types = make([]*biz.SensorType, 0, len(ts))
+	for _, t := range ts {
+		types = append(types, convertToBizSensorType(t))
+	}
+	return types, total, nil
+}
+
+func (r *sensorTypeRepo) Update(ctx context.Context, t *biz.SensorType) (*biz.SensorType, error) {
+	update := r.db.Client.SensorType.UpdateOneID(int(t.Id)).
+		SetUnit(t.Unit).
+		SetSamplingInterval(t.SamplingInterval.AsDuration().Milliseconds()).
+		SetOutOfRange(outOfRangeOf(t)).
+		SetDescription(t.Description)
+	// The definition is replaced as a whole, so the absent bounds and precision are cleared
+	if t.Min != nil {
+		update.SetMin(*t.Min)
+	} else {
+		update.ClearMin()
+	}
+	if t.Max != nil {
+		update.SetMax(*t.Max)
+	} else {
+		update.ClearMax()
+	}
+	if t.Precision != nil {
+		update.SetPrecision(*t.Precision)
+	} else {
+		update.ClearPrecision()
+	}
+	if ms := millisOf(t.GetRetention().GetRaw()); ms != nil {
+		update.SetRawRetention(*ms)
+	} else {
+		update.ClearRawRetention()
+	}
+	if ms := millisOf(t.GetRetention().GetMinute()); ms != nil {
+		update.SetMinuteRetention(*ms)
+	} else {
+		update.ClearMinuteRetention()
+	}
+	if ms := millisOf(t.GetRetention().GetHour()); ms != nil {
+		update.SetHourRetention(*ms)
+	} else {
+		update.ClearHourRetention()
+	}
+	updated, err := update.Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizSensorType(updated), nil
+}
+
+func (r *sensorTypeRepo) Delete(ctx context.Context, id int) error {
+	return r.db.Client.SensorType.DeleteOneID(id).Exec(ctx)
+}
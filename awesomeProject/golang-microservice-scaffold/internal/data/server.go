@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	serverv1 "example/api/server"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/predicate"
+	"example/internal/ent/server"
+	"strings"
+
+	"entgo.io/ent/dialect/sql"
+	"entgo.io/ent/dialect/sql/sqljson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// serverRepo implements the interface [biz.ServerRepository]
+type serverRepo struct {
+	db *Data
+}
+
+// NewServerRepository creates a new server inventory repository implementation instance
+func NewServerRepository(database *Data) biz.ServerRepository {
+	return &serverRepo{db: database}
+}
+
+func convertToBizServer(s *ent.Server) *biz.ServerInfo {
+	return &biz.ServerInfo{
+		Id:        int64(s.ID),
+		Hostname:  s.Hostname,
+		Addresses: s.Addresses,
+		Role:      s.Role,
+		Environment: serverv1.ServerInfo_Environment(
+			serverv1.ServerInfo_Environment_value[strings.ToUpper(s.Environment.String())]),
+		OwnerGroupId: s.OwnerGroupID,
+		Labels:       s.Labels,
+		Status: serverv1.ServerInfo_Status(
+			serverv1.ServerInfo_Status_value[strings.ToUpper(s.Status.String())]),
+		Description: s.Description,
+		CreateTime:  timestamppb.New(s.CreateTime),
+		UpdateTime:  timestamppb.New(s.UpdateTime),
+	}
+}
+
+func environmentOf(environment serverv1.ServerInfo_Environment) server.Environment {
+	return server.Environment(strings.ToLower(environment.String()))
+}
+
+func serverStatusOf(status serverv1.ServerInfo_Status) server.Status {
+	return server.Status(strings.ToLower(status.String()))
+}
+
+// nonNil replaces the absent addresses and labels with the empty ones, so that they are never stored as null
+func nonNil(s *biz.ServerInfo) ([]string, map[string]string) {
+	addresses, labels := s.Addresses, s.Labels
+	if addresses == nil {
+		addresses = []string{}
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return addresses, labels
+}
+
+func (r *serverRepo) Add(ctx context.Context, s *biz.ServerInfo) (*biz.ServerInfo, error) {
+	addresses, labels := nonNil(s)
+	created, err := r.db.Client.Server.Create().
+		SetHostname(s.Hostname).
+		SetAddresses(addresses).
+		SetRole(s.Role).
+		SetEnvironment(environmentOf(s.Environment)).
+		SetOwnerGroupID(s.OwnerGroupId).
+		SetLabels(labels).
+		SetStatus(serverStatusOf(s.Status)).
+		SetDescription(s.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizServer(created), nil
+}
+
+func (r *serverRepo) FindById(ctx context.Context, id int) (*biz.ServerInfo, error) {
+	s, err := r.db.Client.Server.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizServer(s), nil
+}
+
+// serverPredicates translates the filter into the conditions of the hosts
+func serverPredicates(filter *biz.ServerFilter) []predicate.Server {
+	var ps []predicate.Server
+	if filter.Role != "" {
+		ps = append(ps, server.RoleEQ(filter.Role))
+	}
+	if filter.Environment != serverv1.ServerInfo_ENVIRONMENT_UNSPECIFIED {
+		ps = append(ps, server.EnvironmentEQ(environmentOf(filter.Environment)))
+	}
+	if filter.Status != serverv1.ServerInfo_STATUS_UNSPECIFIED {
+		ps = append(ps, server.StatusEQ(serverStatusOf(filter.Status)))
+	}
+	if filter.OwnerGroupId > 0 {
+		ps = append(ps, server.OwnerGroupIDEQ(filter.OwnerGroupId))
+	}
+	for key, value := range filter.Labels {
+		ps = append(ps, predicate.Server(func(s *sql.Selector) {
+			s.Where(sqljson.ValueEQ(server.FieldLabels, value, sqljson.Path(key)))
+		}))
+	}
+	return ps
+}
+
+func (r *serverRepo) List(
+	ctx context.Context, filter *biz.ServerFilter, offset, limit int) (servers []*biz.ServerInfo, total int, err error) {
+	query := r.db.Client.Server.Query().Where(serverPredicates(filter)...)
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var ss []*ent.Server
+	if ss, err = query.
+		Order(ent.Asc(server.FieldHostname)).
+		Offset(offset).
+		Limit(limit).
+		All(ctx); err != nil {
+		return
+	}
+	servers = make([]*biz.ServerInfo, 0, len(ss))
+	for _, s := range ss {
+		servers = append(servers, convertToBizServer(s))
+	}
+	return servers, total, nil
+}
+
+func (r *serverRepo) Update(ctx context.Context, s *biz.ServerInfo) (*biz.ServerInfo, error) {
+	addresses, labels := nonNil(s)
+	updated, err := r.db.Client.Server.UpdateOneID(int(s.Id)).
+		SetHostname(s.Hostname).
+		SetAddresses(addresses).
+		SetRole(s.Role).
+		SetEnvironment(environmentOf(s.Environment)).
+		SetOwnerGroupID(s.OwnerGroupId).
+		SetLabels(labels).
+		SetStatus(serverStatusOf(s.Status)).
+		SetDescription(s.Description).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizServer(updated), nil
+}
+
+func (r *serverRepo) Delete(ctx context.Context, id int) error {
+	return r.db.Client.Server.DeleteOneID(id).Exec(ctx)
+}
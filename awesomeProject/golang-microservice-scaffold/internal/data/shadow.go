@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/terminalshadow"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// shadowRepo implements the interface [biz.ShadowRepository]. The documents are stored as JSON text, so that they
+// work on any database.
+type shadowRepo struct {
+	db *Data
+}
+
+// NewShadowRepository creates a new shadow repository implementation instance
+func NewShadowRepository(database *Data) biz.ShadowRepository {
+	return &shadowRepo{db: database}
+}
+
+// documentOf parses a stored JSON document
+func documentOf(raw string) (*structpb.Struct, error) {
+	doc := &structpb.Struct{}
+	if err := protojson.Unmarshal([]byte(raw), doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func convertToBizShadow(s *ent.TerminalShadow) (*biz.Shadow, error) {
+	desired, err := documentOf(s.Desired)
+	if err != nil {
+		return nil, err
+	}
+	reported, err := documentOf(s.Reported)
+	if err != nil {
+		return nil, err
+	}
+	return &biz.Shadow{
+		TerminalId:   int64(s.TerminalID),
+		Desired:      desired,
+		Reported:     reported,
+		Version:      s.Version,
+		DesiredTime:  timestampOf(s.DesiredTime),
+		ReportedTime: timestampOf(s.ReportedTime),
+	}, nil
+}
+
+func (r *shadowRepo) FindByTerminal(ctx context.Context, terminalId int) (*biz.Shadow, error) {
+	s, err := r.db.Client.TerminalShadow.Query().Where(terminalshadow.TerminalIDEQ(terminalId)).Only(ctx)
+	if ent.IsNotFound(err) {
+		return &biz.Shadow{
+			TerminalId: int64(terminalId),
+			Desired:    &structpb.Struct{},
+			Reported:   &structpb.Struct{},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizShadow(s)
+}
+
+func (r *shadowRepo) Save(ctx context.Context, shadow *biz.Shadow, version int64) (*biz.Shadow, error) {
+	desired, err := protojson.Marshal(shadow.Desired)
+	if err != nil {
+		return nil, err
+	}
+	reported, err := protojson.Marshal(shadow.Reported)
+	if err != nil {
+		return nil, err
+	}
+	current, err := r.FindByTerminal(ctx, int(shadow.TerminalId))
+	if err != nil {
+		return nil, err
+	}
+	// Only the documents which have changed get new timestamps
+	now := time.Now()
+	var desiredTime, reportedTime *time.Time
+	if !proto.Equal(shadow.Desired, current.Desired) {
+		desiredTime = &now
+	}
+	if !proto.Equal(shadow.Reported, current.Reported) {
+		reportedTime = &now
+	}
+	if version == 0 {
+		// The first write creates the shadow, and a concurrent one violates the unique terminal id
+		err = r.db.Client.TerminalShadow.Create().
+			SetTerminalID(int(shadow.TerminalId)).
+			SetDesired(string(desired)).
+			SetReported(string(reported)).
+			SetVersion(1).
+			SetNillableDesiredTime(desiredTime).
+			SetNillableReportedTime(reportedTime).
+			Exec(ctx)
+		if ent.IsConstraintError(err) {
+			return nil, biz.ErrShadowConflict
+		}
+	} else {
+		var n int
+		n, err = r.db.Client.TerminalShadow.Update().
+			Where(
+				terminalshadow.TerminalIDEQ(int(shadow.TerminalId)),
+				terminalshadow.VersionEQ(version),
+			).
+			SetDesired(string(desired)).
+			SetReported(string(reported)).
+			SetVersion(version + 1).
+			SetNillableDesiredTime(desiredTime).
+			SetNillableReportedTime(reportedTime).
+			Save(ctx)
+		if err == nil && n == 0 {
+			return nil, biz.ErrShadowConflict
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.FindByTerminal(ctx, int(shadow.TerminalId))
+}
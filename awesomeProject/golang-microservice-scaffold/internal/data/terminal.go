@@ -2,102 +2,475 @@ package data
 
 import (
 	"context"
-	"entgo.io/ent/dialect/sql"
+	"example/internal/biz"
+	"example/internal/constant"
 	"example/internal/ent"
-	"github.com/redis/go-redis/v9"
-	"log"
+	"example/internal/ent/command"
+	"example/internal/ent/predicate"
+	"example/internal/ent/terminal"
+	"example/internal/ent/terminalgroup"
+	"example/internal/ent/terminaltag"
+	"fmt"
+	"sort"
 	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-type TerminalData struct {
-	db    *sql.Driver
-	cache *redis.Client
+// terminalRepo implements the interface [biz.TerminalRepository]. Terminals are read far more often than they are
+// updated, so they are cached in Redis and the cache entry is dropped whenever the terminal changes.
+type terminalRepo struct {
+	db    *Data
+	cache *Cache
 }
 
-// NewTerminalData create a TerminalData entity
-func NewTerminalData(db *sql.Driver, cache *redis.Client) *TerminalData {
-	return &TerminalData{db: db, cache: cache}
+// NewTerminalRepository creates a new terminal repository implementation instance
+func NewTerminalRepository(database *Data, cache *Cache) biz.TerminalRepository {
+	return &terminalRepo{db: database, cache: cache}
 }
 
-// GetTerminalByID if cache don't exist query db
-func (d *TerminalData) GetTerminalByID(ctx context.Context, id int) (*ent.Terminal, error) {
-	var terminal ent.Terminal
+// terminalCacheTTL is how long a terminal stays in the cache
+const terminalCacheTTL = 5 * time.Minute
+
+func keyTerminal(id int) string {
+	return fmt.Sprintf("terminal:%d", id)
+}
+
+// convertToBizTerminal converts the terminal along with its tags, which should have been loaded eagerly
+func convertToBizTerminal(t *ent.Terminal) *biz.Terminal {
+	tags := make([]string, 0, len(t.Edges.Tags))
+	for _, tag := range t.Edges.Tags {
+		tags = append(tags, tag.Name)
+	}
+	return &biz.Terminal{
+		Id:               int64(t.ID),
+		Timeout:          int32(t.Timeout),
+		Status:           t.Status,
+		LastUpdated:      timestamppb.New(t.LastUpdated),
+		Tags:             tags,
+		DecommissionTime: timestampOf(t.DecommissionTime),
+		FirmwareVersion:  t.FirmwareVersion,
+		Location:         locationOf(t),
+	}
+}
+
+// locationOf converts the location of the terminal, which is nil if it is unknown
+func locationOf(t *ent.Terminal) *biz.Location {
+	if t.Latitude == nil || t.Longitude == nil {
+		return nil
+	}
+	return &biz.Location{Latitude: *t.Latitude, Longitude: *t.Longitude, Altitude: t.Altitude}
+}
+
+func convertToBizTerminals(ts []*ent.Terminal) []*biz.Terminal {
+	terminals := make([]*biz.Terminal, 0, len(ts))
+	for _, t := range ts {
+		terminals = append(terminals, convertToBizTerminal(t))
+	}
+	return terminals
+}
+
+// withTags loads the tags of the terminals in a stable order
+func withTags(q *ent.TerminalTagQuery) {
+	q.Order(ent.Asc(terminaltag.FieldName))
+}
 
+// GetTerminalByID if cache don't exist query db
+func (r *terminalRepo) GetTerminalByID(ctx context.Context, id int) (*biz.Terminal, error) {
 	// get from cache
-	err := d.cache.Get(ctx, "terminal:"+string(id)).Scan(&terminal)
-	if err == redis.Nil {
-		log.Println("缓存未命中，尝试从数据库中获取终端信息")
-		terminal, err := d.GetTerminalFromDB(ctx, id)
-		if err != nil {
-			return nil, err
-		}
-		// write in cache
-		err = d.cache.Set(ctx, "terminal:"+string(id), terminal, 5*time.Minute).Err()
-		if err != nil {
-			log.Println("缓存写入失败: ", err)
+	if raw, err := r.cache.Client.Get(ctx, keyTerminal(id)).Bytes(); err == nil {
+		t := &biz.Terminal{}
+		if err = proto.Unmarshal(raw, t); err == nil {
+			return t, nil
 		}
-		return &terminal, nil
-	} else if err != nil {
+		log.Warnf("malformed cache entry of terminal %d: %v", id, err)
+	} else if err != redis.Nil {
+		log.Warnf("failed to read terminal %d from the cache: %v", id, err)
+	}
+	// query db when the cache misses
+	t, err := r.db.Client.Terminal.Query().Where(terminal.IDEQ(id)).WithTags(withTags).Only(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return &terminal, nil
+	bt := convertToBizTerminal(t)
+	// write in cache
+	if raw, err := proto.Marshal(bt); err == nil {
+		if err = r.cache.Client.Set(ctx, keyTerminal(id), raw, terminalCacheTTL).Err(); err != nil {
+			log.Warnf("failed to cache terminal %d: %v", id, err)
+		}
+	}
+	return bt, nil
 }
 
-// GetTerminalFromDB
-func (d *TerminalData) GetTerminalFromDB(ctx context.Context, id int) (entity.Terminal, error) {
-	// query
-	terminal, err := d.db.Terminal.Query().Where(terminal.ID(id)).Only(ctx)
+func (r *terminalRepo) GetTerminalStatusByID(ctx context.Context, id int) (string, error) {
+	t, err := r.GetTerminalByID(ctx, id)
 	if err != nil {
-		return entity.Terminal{}, err
+		return "", err
 	}
-	return *terminal, nil
+	return t.Status, nil
 }
 
-// UpdateTerminal
-func (d *TerminalData) UpdateTerminal(ctx context.Context, id int, status string, timeout time.Duration) error {
-	// update information of terminal
-	if err := d.UpdateTerminalInDB(ctx, id, status, timeout); err != nil {
-		return err
+// UpdateTerminal records the status reported by the terminal, as well as the transition if the status changes
+func (r *terminalRepo) UpdateTerminal(ctx context.Context, t *biz.Terminal) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
 	}
-
-	// update cache
-	if err := d.cache.Del(ctx, "terminal:"+string(id)).Err(); err != nil {
-		log.Println("缓存更新失败: ", err)
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var current *ent.Terminal
+	if current, err = tx.Terminal.Get(ctx, int(t.Id)); err != nil {
+		return
 	}
-
+	now := time.Now()
+	update := tx.Terminal.UpdateOneID(int(t.Id)).
+		SetStatus(t.Status).
+		SetLastUpdated(now)
+	if t.Timeout > 0 {
+		update.SetTimeout(int(t.Timeout))
+	}
+	if t.FirmwareVersion != "" {
+		update.SetFirmwareVersion(t.FirmwareVersion)
+	}
+	if t.Location != nil {
+		setLocation(update, t.Location)
+	}
+	if err = update.Exec(ctx); err != nil {
+		return
+	}
+	if current.Status != t.Status {
+		if err = addStatusChange(ctx, tx, int(t.Id), current.Status, t.Status, now); err != nil {
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	r.invalidate(ctx, int(t.Id))
 	return nil
 }
 
-// UpdateTerminalInDB
-func (d *TerminalData) UpdateTerminalInDB(ctx context.Context, id int, status string, timeout time.Duration) error {
-	// update terminal
-	_, err := d.db.Terminal.UpdateOneID(id).SetStatus(status).SetTimeout(int(timeout.Seconds())).Save(ctx)
+// addStatusChange appends a transition to the status history of the terminal
+func addStatusChange(ctx context.Context, tx *ent.Tx, id int, from, to string, at time.Time) error {
+	return tx.TerminalStatusChange.Create().
+		SetTerminalID(id).
+		SetFromStatus(from).
+		SetToStatus(to).
+		SetChangeTime(at).
+		Exec(ctx)
+}
+
+func (r *terminalRepo) FindReporting(ctx context.Context) ([]*biz.Terminal, error) {
+	ts, err := r.db.Client.Terminal.Query().
+		Where(terminal.StatusNEQ(constant.TerminalStatusOffline), terminal.DecommissionTimeIsNil()).
+		All(ctx)
 	if err != nil {
+		return nil, err
+	}
+	return convertToBizTerminals(ts), nil
+}
+
+// MarkOffline only updates the terminal if it has neither reported nor changed its status in the meantime. A report
+// always moves the last update time forward, so the time is compared as a cutoff rather than for equality, which
+// would break once the database truncates the time to a lower precision than the one read back.
+func (r *terminalRepo) MarkOffline(
+	ctx context.Context, id int, from string, lastUpdated time.Time, at time.Time) (marked bool, err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var n int
+	if n, err = tx.Terminal.Update().
+		Where(
+			terminal.IDEQ(id),
+			terminal.StatusEQ(from),
+			terminal.LastUpdatedLTE(lastUpdated),
+			terminal.DecommissionTimeIsNil(),
+		).
+		SetStatus(constant.TerminalStatusOffline).
+		Save(ctx); err != nil {
+		return
+	}
+	if n == 0 {
+		return false, tx.Rollback()
+	}
+	if err = addStatusChange(ctx, tx, id, from, constant.TerminalStatusOffline, at); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	r.invalidate(ctx, id)
+	return true, nil
+}
+
+// SetTerminalTimeout sets the duration in seconds after which a silent terminal is regarded as offline
+func (r *terminalRepo) SetTerminalTimeout(ctx context.Context, id int, timeout int) error {
+	if err := r.db.Client.Terminal.UpdateOneID(id).SetTimeout(timeout).Exec(ctx); err != nil {
 		return err
 	}
+	r.invalidate(ctx, id)
 	return nil
 }
 
-// SetTerminalTimeout
-func (d *TerminalData) SetTerminalTimeout(ctx context.Context, id int, timeout time.Duration) error {
-	//update terminal timeout
-	if err := d.UpdateTerminalTimeoutInDB(ctx, id, timeout); err != nil {
+// SetFirmwareVersion records the firmware version running on the terminal
+func (r *terminalRepo) SetFirmwareVersion(ctx context.Context, id int, version string) error {
+	if err := r.db.Client.Terminal.UpdateOneID(id).SetFirmwareVersion(version).Exec(ctx); err != nil {
 		return err
 	}
+	r.invalidate(ctx, id)
+	return nil
+}
 
-	// delete cache to make sure next time is the latest
-	if err := d.cache.Del(ctx, "terminal:"+string(id)).Err(); err != nil {
-		log.Println("缓存删除失败: ", err)
+// setLocation replaces the whole location, so that an absent altitude clears the former one
+func setLocation(update *ent.TerminalUpdateOne, location *biz.Location) {
+	update.SetLatitude(location.Latitude).SetLongitude(location.Longitude)
+	if location.Altitude != nil {
+		update.SetAltitude(*location.Altitude)
+	} else {
+		update.ClearAltitude()
+	}
+}
+
+func (r *terminalRepo) SetLocation(ctx context.Context, id int, location *biz.Location) error {
+	update := r.db.Client.Terminal.UpdateOneID(id)
+	if location == nil {
+		update.ClearLatitude().ClearLongitude().ClearAltitude()
+	} else {
+		setLocation(update, location)
+	}
+	if err := update.Exec(ctx); err != nil {
+		return err
 	}
+	r.invalidate(ctx, id)
 	return nil
 }
 
-// UpdateTerminalTimeoutInDB
-func (d *TerminalData) UpdateTerminalTimeoutInDB(ctx context.Context, id int, timeout time.Duration) error {
+func (r *terminalRepo) IsTerminalExist(ctx context.Context, id int) (bool, error) {
+	return r.db.Client.Terminal.Query().Where(terminal.IDEQ(id)).Exist(ctx)
+}
+
+// terminalPredicates translates the query into the conditions of the terminals
+func terminalPredicates(query *biz.TerminalQuery) []predicate.Terminal {
+	var ps []predicate.Terminal
+	if len(query.GroupIds) > 0 {
+		ps = append(ps, terminal.HasGroupsWith(terminalgroup.IDIn(query.GroupIds...)))
+	}
+	if len(query.Tags) > 0 {
+		if query.MatchAnyTag {
+			ps = append(ps, terminal.HasTagsWith(terminaltag.NameIn(query.Tags...)))
+		} else {
+			for _, tag := range query.Tags {
+				ps = append(ps, terminal.HasTagsWith(terminaltag.NameEQ(tag)))
+			}
+		}
+	}
+	if box := query.Box; box != nil {
+		ps = append(ps, terminal.LatitudeGTE(box.South), terminal.LatitudeLTE(box.North))
+		if box.West <= box.East {
+			ps = append(ps, terminal.LongitudeGTE(box.West), terminal.LongitudeLTE(box.East))
+		} else {
+			// The box crosses the antimeridian
+			ps = append(ps, terminal.Or(terminal.LongitudeGTE(box.West), terminal.LongitudeLTE(box.East)))
+		}
+	}
+	if query.Located || query.Circle != nil {
+		ps = append(ps, terminal.LatitudeNotNil(), terminal.LongitudeNotNil())
+	}
+	if !query.IncludeDecommissioned {
+		ps = append(ps, terminal.DecommissionTimeIsNil())
+	}
+	return ps
+}
+
+// findWithin finds the ids of the matching terminals within the circle, ordered by their distances to the center and
+// then by their ids. The database narrows the terminals down by the bounding box of the circle, which is served by the
+// index, and the candidates are filtered by their exact distances here, since the distances need trigonometric
+// functions that some databases, e.g. SQLite, lack. Only the ids and the locations of the candidates are read.
+func (r *terminalRepo) findWithin(ctx context.Context, query *biz.TerminalQuery) ([]int, error) {
+	var candidates []struct {
+		ID        int     `json:"id"`
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	}
+	if err := r.db.Client.Terminal.Query().
+		Where(terminalPredicates(query)...).
+		Select(terminal.FieldID, terminal.FieldLatitude, terminal.FieldLongitude).
+		Scan(ctx, &candidates); err != nil {
+		return nil, err
+	}
+	circle := query.Circle
+	distances := make(map[int]float64, len(candidates))
+	ids := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		if d := biz.Distance(circle.Latitude, circle.Longitude, c.Latitude, c.Longitude); d <= circle.Radius {
+			distances[c.ID] = d
+			ids = append(ids, c.ID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if di, dj := distances[ids[i]], distances[ids[j]]; di != dj {
+			return di < dj
+		}
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+func (r *terminalRepo) FindTerminals(
+	ctx context.Context, query *biz.TerminalQuery) (terminals []*biz.Terminal, total int, err error) {
+	if query.Circle != nil {
+		return r.findPageWithin(ctx, query)
+	}
+	q := r.db.Client.Terminal.Query().Where(terminalPredicates(query)...)
+	if total, err = q.Clone().Count(ctx); err != nil {
+		return
+	}
+	var ts []*ent.Terminal
+	if ts, err = q.
+		WithTags(withTags).
+		Order(ent.Asc(terminal.FieldID)).
+		Offset(query.Offset).
+		Limit(query.Limit).
+		All(ctx); err != nil {
+		return
+	}
+	return convertToBizTerminals(ts), total, nil
+}
+
+// findPageWithin lists a page of the terminals within the circle ordered by their distances to the center
+func (r *terminalRepo) findPageWithin(
+	ctx context.Context, query *biz.TerminalQuery) (terminals []*biz.Terminal, total int, err error) {
+	var ids []int
+	if ids, err = r.findWithin(ctx, query); err != nil {
+		return
+	}
+	total = len(ids)
+	ids = ids[min(query.Offset, total):min(query.Offset+query.Limit, total)]
+	var ts []*ent.Terminal
+	if ts, err = r.db.Client.Terminal.Query().
+		Where(terminal.IDIn(ids...)).
+		WithTags(withTags).
+		All(ctx); err != nil {
+		return
+	}
+	positions := make(map[int]int, len(ids))
+	for i, id := range ids {
+		positions[id] = i
+	}
+	sort.Slice(ts, func(i, j int) bool { return positions[ts[i].ID] < positions[ts[j].ID] })
+	return convertToBizTerminals(ts), total, nil
+}
+
+func (r *terminalRepo) FindIds(ctx context.Context, query *biz.TerminalQuery) ([]int, error) {
+	if query.Circle != nil {
+		ids, err := r.findWithin(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		sort.Ints(ids)
+		return ids, nil
+	}
+	return r.db.Client.Terminal.Query().
+		Where(terminalPredicates(query)...).
+		Order(ent.Asc(terminal.FieldID)).
+		IDs(ctx)
+}
 
-	_, err := d.db.Terminal.UpdateOneID(id).SetTimeout(int(timeout.Seconds())).Save(ctx)
+func (r *terminalRepo) AddTags(ctx context.Context, id int, tags []string) error {
+	attached, err := r.db.Client.TerminalTag.Query().
+		Where(terminaltag.TerminalIDEQ(id), terminaltag.NameIn(tags...)).
+		Select(terminaltag.FieldName).
+		Strings(ctx)
 	if err != nil {
 		return err
 	}
+	skip := make(map[string]struct{}, len(attached))
+	for _, tag := range attached {
+		skip[tag] = struct{}{}
+	}
+	missing := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if _, ok := skip[tag]; !ok {
+			missing = append(missing, tag)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err = r.db.Client.TerminalTag.MapCreateBulk(missing, func(c *ent.TerminalTagCreate, i int) {
+		c.SetTerminalID(id).SetName(missing[i])
+	}).Exec(ctx); err != nil {
+		return err
+	}
+	r.invalidate(ctx, id)
+	return nil
+}
+
+func (r *terminalRepo) RemoveTags(ctx context.Context, id int, tags []string) error {
+	if _, err := r.db.Client.TerminalTag.Delete().
+		Where(terminaltag.TerminalIDEQ(id), terminaltag.NameIn(tags...)).
+		Exec(ctx); err != nil {
+		return err
+	}
+	r.invalidate(ctx, id)
 	return nil
 }
+
+// Decommission marks the terminal as decommissioned and fails its outstanding commands in a single transaction
+func (r *terminalRepo) Decommission(ctx context.Context, id int) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var current *ent.Terminal
+	if current, err = tx.Terminal.Get(ctx, id); err != nil {
+		return
+	}
+	now := time.Now()
+	if err = tx.Terminal.UpdateOneID(id).SetDecommissionTime(now).Exec(ctx); err != nil {
+		return
+	}
+	if err = addStatusChange(ctx, tx, id, current.Status, constant.TerminalStatusDecommissioned, now); err != nil {
+		return
+	}
+	if _, err = tx.Command.Update().
+		Where(
+			command.TerminalIDEQ(id),
+			command.StatusIn(command.StatusPending, command.StatusDelivered),
+		).
+		SetStatus(command.StatusFailed).
+		SetResult("terminal decommissioned").
+		SetCompleteTime(now).
+		Save(ctx); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	r.invalidate(ctx, id)
+	return nil
+}
+
+// invalidate deletes the cache entry to make sure the next read is the latest
+func (r *terminalRepo) invalidate(ctx context.Context, id int) {
+	if err := r.cache.Client.Del(ctx, keyTerminal(id)).Err(); err != nil {
+		log.Warnf("failed to invalidate the cache of terminal %d: %v", id, err)
+	}
+}
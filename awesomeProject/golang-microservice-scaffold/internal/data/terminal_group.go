@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/terminal"
+	"example/internal/ent/terminalgroup"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// terminalGroupRepo implements the interface [biz.TerminalGroupRepository]
+type terminalGroupRepo struct {
+	db *Data
+}
+
+// NewTerminalGroupRepository creates a new terminal group repository implementation instance
+func NewTerminalGroupRepository(database *Data) biz.TerminalGroupRepository {
+	return &terminalGroupRepo{db: database}
+}
+
+// convertToBizTerminalGroup converts the group, whose member ids should have been loaded eagerly
+func convertToBizTerminalGroup(g *ent.TerminalGroup) *biz.TerminalGroup {
+	group := &biz.TerminalGroup{
+		Id:            int64(g.ID),
+		Name:          g.Name,
+		Description:   g.Description,
+		TerminalCount: int32(len(g.Edges.Terminals)),
+		CreateTime:    timestamppb.New(g.CreateTime),
+	}
+	if g.ParentID != nil {
+		parentId := int64(*g.ParentID)
+		group.ParentId = &parentId
+	}
+	return group
+}
+
+// withMemberIds loads the ids of the members only, which are enough to count them
+func withMemberIds(q *ent.TerminalQuery) {
+	q.Select(terminal.FieldID)
+}
+
+// parentIdOf converts the optional parent id of the group
+func parentIdOf(group *biz.TerminalGroup) *int {
+	if group.ParentId == nil {
+		return nil
+	}
+	parentId := int(*group.ParentId)
+	return &parentId
+}
+
+func (r *terminalGroupRepo) Add(ctx context.Context, group *biz.TerminalGroup) (*biz.TerminalGroup, error) {
+	g, err := r.db.Client.TerminalGroup.Create().
+		SetName(group.Name).
+		SetDescription(group.Description).
+		SetNillableParentID(parentIdOf(group)).
+		Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizTerminalGroup(g), nil
+}
+
+func (r *terminalGroupRepo) FindById(ctx context.Context, id int) (*biz.TerminalGroup, error) {
+	g, err := r.db.Client.TerminalGroup.Query().
+		Where(terminalgroup.IDEQ(id)).
+		WithTerminals(withMemberIds).
+		Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizTerminalGroup(g), nil
+}
+
+func (r *terminalGroupRepo) FindByParent(ctx context.Context, parentId *int) ([]*biz.TerminalGroup, error) {
+	query := r.db.Client.TerminalGroup.Query()
+	if parentId == nil {
+		query.Where(terminalgroup.ParentIDIsNil())
+	} else {
+		query.Where(terminalgroup.ParentIDEQ(*parentId))
+	}
+	gs, err := query.
+		WithTerminals(withMemberIds).
+		Order(ent.Asc(terminalgroup.FieldName)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*biz.TerminalGroup, 0, len(gs))
+	for _, g := range gs {
+		groups = append(groups, convertToBizTerminalGroup(g))
+	}
+	return groups, nil
+}
+
+func (r *terminalGroupRepo) Update(ctx context.Context, group *biz.TerminalGroup) (*biz.TerminalGroup, error) {
+	update := r.db.Client.TerminalGroup.UpdateOneID(int(group.Id)).
+		SetName(group.Name).
+		SetDescription(group.Description)
+	if parentId := parentIdOf(group); parentId != nil {
+		update.SetParentID(*parentId)
+	} else {
+		update.ClearParentID()
+	}
+	if err := update.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return r.FindById(ctx, int(group.Id))
+}
+
+func (r *terminalGroupRepo) Remove(ctx context.Context, id int) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = tx.TerminalGroup.UpdateOneID(id).ClearTerminals().Exec(ctx); err != nil {
+		return
+	}
+	if err = tx.TerminalGroup.DeleteOneID(id).Exec(ctx); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (r *terminalGroupRepo) IsGroupExist(ctx context.Context, id int) (bool, error) {
+	return r.db.Client.TerminalGroup.Query().Where(terminalgroup.IDEQ(id)).Exist(ctx)
+}
+
+func (r *terminalGroupRepo) FindChildIds(ctx context.Context, ids []int) ([]int, error) {
+	return r.db.Client.TerminalGroup.Query().Where(terminalgroup.ParentIDIn(ids...)).IDs(ctx)
+}
+
+func (r *terminalGroupRepo) AddMembers(ctx context.Context, id int, terminalIds []int) error {
+	members, err := r.db.Client.TerminalGroup.Query().
+		Where(terminalgroup.IDEQ(id)).
+		QueryTerminals().
+		Where(terminal.IDIn(terminalIds...)).
+		IDs(ctx)
+	if err != nil {
+		return err
+	}
+	skip := make(map[int]struct{}, len(members))
+	for _, member := range members {
+		skip[member] = struct{}{}
+	}
+	missing := make([]int, 0, len(terminalIds))
+	for _, terminalId := range terminalIds {
+		if _, ok := skip[terminalId]; !ok {
+			missing = append(missing, terminalId)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return r.db.Client.TerminalGroup.UpdateOneID(id).AddTerminalIDs(missing...).Exec(ctx)
+}
+
+func (r *terminalGroupRepo) RemoveMembers(ctx context.Context, id int, terminalIds []int) error {
+	return r.db.Client.TerminalGroup.UpdateOneID(id).RemoveTerminalIDs(terminalIds...).Exec(ctx)
+}
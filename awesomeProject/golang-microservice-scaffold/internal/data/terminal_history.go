@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/terminalstatuschange"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// terminalHistoryRepo implements the interface [biz.TerminalHistoryRepository]. The transitions are recorded by
+// the terminal repository along with the updates of the terminals.
+type terminalHistoryRepo struct {
+	db *Data
+}
+
+// NewTerminalHistoryRepository creates a new terminal history repository implementation instance
+func NewTerminalHistoryRepository(database *Data) biz.TerminalHistoryRepository {
+	return &terminalHistoryRepo{db: database}
+}
+
+func convertToBizStatusChange(c *ent.TerminalStatusChange) *biz.TerminalStatusChange {
+	return &biz.TerminalStatusChange{
+		Id:         c.ID,
+		TerminalId: int64(c.TerminalID),
+		FromStatus: c.FromStatus,
+		ToStatus:   c.ToStatus,
+		ChangeTime: timestamppb.New(c.ChangeTime),
+	}
+}
+
+func convertToBizStatusChanges(cs []*ent.TerminalStatusChange) []*biz.TerminalStatusChange {
+	changes := make([]*biz.TerminalStatusChange, 0, len(cs))
+	for _, c := range cs {
+		changes = append(changes, convertToBizStatusChange(c))
+	}
+	return changes
+}
+
+// queryBetween finds the transitions of the terminal within [start, end) from the oldest to the newest
+func (r *terminalHistoryRepo) queryBetween(terminalId int, start, end time.Time) *ent.TerminalStatusChangeQuery {
+	return r.db.Client.TerminalStatusChange.Query().
+		Where(
+			terminalstatuschange.TerminalIDEQ(terminalId),
+			terminalstatuschange.ChangeTimeGTE(start),
+			terminalstatuschange.ChangeTimeLT(end),
+		).
+		Order(ent.Asc(terminalstatuschange.FieldChangeTime), ent.Asc(terminalstatuschange.FieldID))
+}
+
+func (r *terminalHistoryRepo) FindChanges(
+	ctx context.Context, terminalId int, start, end time.Time, offset, limit int,
+) (changes []*biz.TerminalStatusChange, total int, err error) {
+	query := r.queryBetween(terminalId, start, end)
+	if total, err = query.Clone().Count(ctx); err != nil {
+		return
+	}
+	var cs []*ent.TerminalStatusChange
+	if cs, err = query.Offset(offset).Limit(limit).All(ctx); err != nil {
+		return
+	}
+	return convertToBizStatusChanges(cs), total, nil
+}
+
+func (r *terminalHistoryRepo) FindAllChanges(
+	ctx context.Context, terminalId int, start, end time.Time) ([]*biz.TerminalStatusChange, error) {
+	cs, err := r.queryBetween(terminalId, start, end).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizStatusChanges(cs), nil
+}
+
+func (r *terminalHistoryRepo) FindLastChangeBefore(
+	ctx context.Context, terminalId int, t time.Time) (*biz.TerminalStatusChange, error) {
+	c, err := r.db.Client.TerminalStatusChange.Query().
+		Where(
+			terminalstatuschange.TerminalIDEQ(terminalId),
+			terminalstatuschange.ChangeTimeLT(t),
+		).
+		Order(ent.Desc(terminalstatuschange.FieldChangeTime), ent.Desc(terminalstatuschange.FieldID)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizStatusChange(c), nil
+}
+
+func (r *terminalHistoryRepo) FindLastChangeFromBefore(
+	ctx context.Context, terminalId int, status string, t time.Time) (*biz.TerminalStatusChange, error) {
+	c, err := r.db.Client.TerminalStatusChange.Query().
+		Where(
+			terminalstatuschange.TerminalIDEQ(terminalId),
+			terminalstatuschange.FromStatusEQ(status),
+			terminalstatuschange.ChangeTimeLT(t),
+		).
+		Order(ent.Desc(terminalstatuschange.FieldChangeTime), ent.Desc(terminalstatuschange.FieldID)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizStatusChange(c), nil
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newLocatedTerminals creates the terminals 1 to n at the locations, given as latitudes and longitudes
+func newLocatedTerminals(t *testing.T, d *Data, locations ...[2]float64) {
+	t.Helper()
+	for i, l := range locations {
+		d.Client.Terminal.Create().SetID(i + 1).SetLatitude(l[0]).SetLongitude(l[1]).ExecX(context.Background())
+	}
+}
+
+func idsOf(terminals []*biz.Terminal) []int64 {
+	ids := make([]int64, 0, len(terminals))
+	for _, t := range terminals {
+		ids = append(ids, t.Id)
+	}
+	return ids
+}
+
+func TestFindTerminalsWithin(t *testing.T) {
+	d := newTestData(t)
+	ctx := context.Background()
+	// A degree of longitude on the equator is about 111 km
+	newLocatedTerminals(t, d, [2]float64{0, 0.5}, [2]float64{0, 2}, [2]float64{0, 0.1}, [2]float64{0.9, 0.9},
+		[2]float64{0, -0.5}, [2]float64{0, 0.3})
+	d.Client.Terminal.Create().SetID(7).ExecX(ctx) // not located
+	d.Client.Terminal.Create().SetID(8).SetLatitude(0).SetLongitude(0.2).SetDecommissionTime(time.Now()).ExecX(ctx)
+	r := &terminalRepo{db: d}
+	// The terminal 4 is inside the bounding box of the circle but 141 km away from the center
+	circle := &v1.GeoCircle{Latitude: 0, Longitude: 0, Radius: 120000}
+	box := &v1.GeoBox{South: -1.1, North: 1.1, West: -1.1, East: 1.1}
+
+	// The terminals are ordered by their distances, and those at the same distance by their ids
+	want := []int64{3, 6, 1, 5}
+	for offset := 0; offset < 5; offset += 2 {
+		query := &biz.TerminalQuery{Box: box, Circle: circle, Offset: offset, Limit: 2}
+		terminals, total, err := r.FindTerminals(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page := want[min(offset, len(want)):min(offset+2, len(want))]; total != 4 ||
+			!slices.Equal(idsOf(terminals), page) {
+			t.Errorf("got %v of %d at offset %d, want %v of 4", idsOf(terminals), total, offset, page)
+		}
+	}
+	ids, err := r.FindIds(ctx, &biz.TerminalQuery{Box: box, Circle: circle, IncludeDecommissioned: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []int{1, 3, 5, 6, 8}) {
+		t.Errorf("got ids %v, want [1 3 5 6 8]", ids)
+	}
+}
+
+func TestFindTerminalsAcrossAntimeridian(t *testing.T) {
+	d := newTestData(t)
+	ctx := context.Background()
+	newLocatedTerminals(t, d, [2]float64{10, 179.5}, [2]float64{10, -179.5}, [2]float64{10, 0}, [2]float64{10, 178})
+	r := &terminalRepo{db: d}
+
+	box := &v1.GeoBox{South: 9, North: 11, West: 179, East: -179}
+	terminals, total, err := r.FindTerminals(ctx, &biz.TerminalQuery{Box: box, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || !slices.Equal(idsOf(terminals), []int64{1, 2}) {
+		t.Errorf("got %v of %d in the box, want [1 2]", idsOf(terminals), total)
+	}
+
+	// The terminal to the east of the antimeridian is nearer to the center than the one to the west
+	circle := &v1.GeoCircle{Latitude: 10, Longitude: -179.9, Radius: 200000}
+	box = &v1.GeoBox{South: 8, North: 12, West: 178.1, East: -178}
+	if terminals, total, err = r.FindTerminals(ctx, &biz.TerminalQuery{Box: box, Circle: circle, Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || !slices.Equal(idsOf(terminals), []int64{2, 1}) {
+		t.Errorf("got %v of %d within the circle, want [2 1]", idsOf(terminals), total)
+	}
+}
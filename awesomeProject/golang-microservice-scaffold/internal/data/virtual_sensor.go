@@ -0,0 +1,206 @@
+package data
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"example/internal/ent"
+	"example/internal/ent/virtualsensor"
+	"example/internal/ent/virtualsensorinput"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// virtualSensorRepo implements the interface [biz.VirtualSensorRepository]
+type virtualSensorRepo struct {
+	db *Data
+}
+
+// NewVirtualSensorRepository creates a new virtual sensor repository implementation instance
+func NewVirtualSensorRepository(database *Data) biz.VirtualSensorRepository {
+	return &virtualSensorRepo{db: database}
+}
+
+// convertToBizVirtualSensor converts the definition, whose sensor and inputs are loaded
+func convertToBizVirtualSensor(v *ent.VirtualSensor) *biz.VirtualSensor {
+	virtual := &biz.VirtualSensor{
+		SensorId:   int64(v.SensorID),
+		Expression: v.Expression,
+		Inputs:     make(map[string]int64, len(v.Edges.Inputs)),
+		Evaluation: v1.VirtualSensor_Evaluation(
+			v1.VirtualSensor_Evaluation_value[strings.ToUpper(v.Evaluation.String())]),
+		Window:      durationpb.New(time.Duration(v.Window) * time.Millisecond),
+		Description: v.Description,
+		CreateTime:  timestamppb.New(v.CreateTime),
+		UpdateTime:  timestamppb.New(v.UpdateTime),
+	}
+	if s := v.Edges.Sensor; s != nil {
+		virtual.SensorType = s.SensorType
+		virtual.Identifier = s.Identifier
+	}
+	for _, input := range v.Edges.Inputs {
+		virtual.Inputs[input.Name] = int64(input.SensorID)
+	}
+	return virtual
+}
+
+func evaluationOf(evaluation v1.VirtualSensor_Evaluation) virtualsensor.Evaluation {
+	return virtualsensor.Evaluation(strings.ToLower(evaluation.String()))
+}
+
+// addInputs binds the variables of the definition to their sensors
+func addInputs(ctx context.Context, tx *ent.Tx, id int, inputs map[string]int64) error {
+	builders := make([]*ent.VirtualSensorInputCreate, 0, len(inputs))
+	for name, sensorId := range inputs {
+		builders = append(builders, tx.VirtualSensorInput.Create().
+			SetVirtualSensorID(id).
+			SetName(name).
+			SetSensorID(int(sensorId)))
+	}
+	return tx.VirtualSensorInput.CreateBulk(builders...).Exec(ctx)
+}
+
+func (r *virtualSensorRepo) Add(ctx context.Context, v *biz.VirtualSensor) (created *biz.VirtualSensor, err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var s *ent.Sensor
+	if s, err = tx.Sensor.Create().SetSensorType(v.SensorType).SetIdentifier(v.Identifier).Save(ctx); err != nil {
+		return
+	}
+	var definition *ent.VirtualSensor
+	if definition, err = tx.VirtualSensor.Create().
+		SetSensorID(s.ID).
+		SetExpression(v.Expression).
+		SetEvaluation(evaluationOf(v.Evaluation)).
+		SetWindow(v.Window.AsDuration().Milliseconds()).
+		SetDescription(v.Description).
+		Save(ctx); err != nil {
+		return
+	}
+	if err = addInputs(ctx, tx, definition.ID, v.Inputs); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return r.FindById(ctx, s.ID)
+}
+
+// query queries the definitions along with their sensors and inputs
+func (r *virtualSensorRepo) query() *ent.VirtualSensorQuery {
+	return r.db.Client.VirtualSensor.Query().WithSensor().WithInputs()
+}
+
+func (r *virtualSensorRepo) FindById(ctx context.Context, sensorId int) (*biz.VirtualSensor, error) {
+	v, err := r.query().Where(virtualsensor.SensorIDEQ(sensorId)).Only(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return convertToBizVirtualSensor(v), nil
+}
+
+func (r *virtualSensorRepo) FindBySensors(ctx context.Context, ids []int) (map[int]*biz.VirtualSensor, error) {
+	vs, err := r.query().Where(virtualsensor.SensorIDIn(ids...)).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	virtuals := make(map[int]*biz.VirtualSensor, len(vs))
+	for _, v := range vs {
+		virtuals[v.SensorID] = convertToBizVirtualSensor(v)
+	}
+	return virtuals, nil
+}
+
+func (r *virtualSensorRepo) FindByInputs(ctx context.Context, ids []int) ([]*biz.VirtualSensor, error) {
+	vs, err := r.query().
+		Where(virtualsensor.HasInputsWith(virtualsensorinput.SensorIDIn(ids...))).
+		Order(ent.Asc(virtualsensor.FieldSensorID)).
+		All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	virtuals := make([]*biz.VirtualSensor, 0, len(vs))
+	for _, v := range vs {
+		virtuals = append(virtuals, convertToBizVirtualSensor(v))
+	}
+	return virtuals, nil
+}
+
+func (r *virtualSensorRepo) FindAll(ctx context.Context) ([]*biz.VirtualSensor, error) {
+	vs, err := r.query().Order(ent.Asc(virtualsensor.FieldSensorID)).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	virtuals := make([]*biz.VirtualSensor, 0, len(vs))
+	for _, v := range vs {
+		virtuals = append(virtuals, convertToBizVirtualSensor(v))
+	}
+	return virtuals, nil
+}
+
+func (r *virtualSensorRepo) Update(ctx context.Context, v *biz.VirtualSensor) (updated *biz.VirtualSensor, err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var id int
+	if id, err = tx.VirtualSensor.Query().Where(virtualsensor.SensorIDEQ(int(v.SensorId))).OnlyID(ctx); err != nil {
+		return
+	}
+	if err = tx.VirtualSensor.UpdateOneID(id).
+		SetExpression(v.Expression).
+		SetEvaluation(evaluationOf(v.Evaluation)).
+		SetWindow(v.Window.AsDuration().Milliseconds()).
+		SetDescription(v.Description).
+		Exec(ctx); err != nil {
+		return
+	}
+	if _, err = tx.VirtualSensorInput.Delete().Where(virtualsensorinput.VirtualSensorIDEQ(id)).Exec(ctx); err != nil {
+		return
+	}
+	if err = addInputs(ctx, tx, id, v.Inputs); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return r.FindById(ctx, int(v.SensorId))
+}
+
+func (r *virtualSensorRepo) Delete(ctx context.Context, sensorId int) (err error) {
+	var tx *ent.Tx
+	if tx, err = r.db.Client.Tx(ctx); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var id int
+	if id, err = tx.VirtualSensor.Query().Where(virtualsensor.SensorIDEQ(sensorId)).OnlyID(ctx); err != nil {
+		return
+	}
+	if _, err = tx.VirtualSensorInput.Delete().Where(virtualsensorinput.VirtualSensorIDEQ(id)).Exec(ctx); err != nil {
+		return
+	}
+	if err = tx.VirtualSensor.DeleteOneID(id).Exec(ctx); err != nil {
+		return
+	}
+	return tx.Commit()
+}
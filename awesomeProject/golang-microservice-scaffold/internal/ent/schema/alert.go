@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// Alert holds the schema definition for the Alert entity, which is an occurrence of the condition of a rule
+type Alert struct {
+	ent.Schema
+}
+
+// Fields of the Alert.
+func (Alert) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("rule_id").
+			Immutable().
+			Comment("The rule whose condition holds"),
+		field.Enum("status").
+			Values("firing", "resolved").
+			Default("firing").
+			Comment("State of the alert"),
+		field.Enum("severity").
+			Values("info", "warning", "critical").
+			Immutable().
+			Comment("Severity of the rule when the alert fired"),
+		field.Float("value").
+			Optional().
+			Nillable().
+			Comment("The latest value violating the rule"),
+		field.String("message").
+			MaxLen(255).
+			Default("").
+			Comment("Description of the violation"),
+		field.Time("start_time").
+			Immutable().
+			Comment("Time when the condition started to hold"),
+		field.Time("fire_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Time when the alert fired"),
+		field.Time("resolve_time").
+			Optional().
+			Nillable().
+			Comment("Time when the condition no longer held"),
+		field.String("dedup_key").
+			MaxLen(64).
+			Optional().
+			Nillable().
+			Unique().
+			Comment("Set while the alert is firing, so that a rule has at most one firing alert"),
+		field.Bool("silenced").
+			Default(false).
+			Comment("Whether the alert fired while a silence was in effect"),
+		field.Bool("acknowledged").
+			Default(false),
+		field.Time("ack_time").
+			Optional().
+			Nillable(),
+		field.String("ack_by").
+			MaxLen(64).
+			Default("").
+			Comment("Who acknowledged the alert"),
+		field.String("ack_comment").
+			MaxLen(1024).
+			Default(""),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last change, which is refreshed while the alert is firing"),
+	}
+}
+
+// Edges of the Alert.
+func (Alert) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("rule", AlertRule.Type).
+			Ref("alerts").
+			Field("rule_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the Alert.
+func (Alert) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("status").
+			StorageKey("idx_alert_status"),
+	}
+}
+
+func (Alert) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Alerts fired by the rules"),
+	}
+}
@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// AlertRule holds the schema definition for the AlertRule entity, which is a condition on the readings of a sensor
+// or on the status of a terminal. The state of the evaluation is kept along with the rule, so that the conditions
+// holding for a duration survive the restarts.
+type AlertRule struct {
+	ent.Schema
+}
+
+// Fields of the AlertRule.
+func (AlertRule) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("name").
+			MaxLen(128).
+			NotEmpty().
+			Comment("Name of the rule"),
+		field.Enum("kind").
+			Values("threshold", "no_data", "rate_of_change", "terminal_offline", "anomaly").
+			Comment("Kind of the condition"),
+		field.Int("sensor_id").
+			Optional().
+			Nillable().
+			Comment("The watched sensor, null for terminal_offline"),
+		field.Int("terminal_id").
+			Optional().
+			Nillable().
+			Comment("The watched terminal, null except for terminal_offline"),
+		field.Enum("operator").
+			Values("gt", "gte", "lt", "lte").
+			Optional().
+			Nillable().
+			Comment("Comparison with the threshold, null if the kind does not compare"),
+		field.Float("threshold").
+			Default(0).
+			Comment("Threshold of the readings, of their change per second or of their anomaly score"),
+		field.Int64("duration").
+			Default(0).
+			Comment("How long the condition must hold before the alert fires in milliseconds"),
+		field.Enum("severity").
+			Values("info", "warning", "critical").
+			Default("warning").
+			Comment("Severity of the alerts"),
+		field.Bool("disabled").
+			Default(false).
+			Comment("Disabled rules are not evaluated"),
+		field.String("description").
+			MaxLen(1024).
+			Default("").
+			Comment("Description of the rule"),
+		field.Time("pending_since").
+			Optional().
+			Nillable().
+			Comment("Time since which the condition holds, null if it does not hold"),
+		field.Float("last_value").
+			Optional().
+			Nillable().
+			Comment("The latest reading evaluated, which the rate of change is computed from"),
+		field.Time("last_time").
+			Optional().
+			Nillable().
+			Comment("Time of the latest reading evaluated"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			Comment("Time of the last change of the definition, when the evaluation starts over"),
+	}
+}
+
+// Edges of the AlertRule.
+func (AlertRule) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("alerts", Alert.Type),
+		edge.To("silences", AlertSilence.Type),
+	}
+}
+
+func (AlertRule) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Alert rules on the sensors and the terminals"),
+	}
+}
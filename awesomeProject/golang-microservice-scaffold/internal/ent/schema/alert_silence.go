@@ -0,0 +1,75 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// AlertSilence holds the schema definition for the AlertSilence entity, which marks the alerts fired within its
+// time range as silenced
+type AlertSilence struct {
+	ent.Schema
+}
+
+// Fields of the AlertSilence.
+func (AlertSilence) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("rule_id").
+			Optional().
+			Nillable().
+			Immutable().
+			Comment("The silenced rule, null for all the rules"),
+		field.Time("start_time").
+			Immutable().
+			Comment("Start of the silence"),
+		field.Time("end_time").
+			Immutable().
+			Comment("End of the silence"),
+		field.String("comment").
+			MaxLen(1024).
+			Default(""),
+		field.String("created_by").
+			MaxLen(64).
+			Comment("Who created the silence"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+	}
+}
+
+// Edges of the AlertSilence.
+func (AlertSilence) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("rule", AlertRule.Type).
+			Ref("silences").
+			Field("rule_id").
+			Immutable().
+			Unique(),
+	}
+}
+
+// Indexes of the AlertSilence.
+func (AlertSilence) Indexes() []ent.Index {
+	return []ent.Index{
+		// The silences in effect are looked up by their ends
+		index.Fields("end_time").
+			StorageKey("idx_alert_silence_end"),
+	}
+}
+
+func (AlertSilence) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Silences of the alerts"),
+	}
+}
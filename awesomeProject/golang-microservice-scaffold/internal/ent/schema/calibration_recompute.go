@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// CalibrationRecompute holds the schema definition for the CalibrationRecompute entity, which is a background job
+// calibrating the stored readings of a sensor within a time range again.
+type CalibrationRecompute struct {
+	ent.Schema
+}
+
+// Fields of the CalibrationRecompute.
+func (CalibrationRecompute) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("sensor_id").
+			Immutable().
+			Comment("Identifier of the sensor, whose readings are left alone once it is deleted"),
+		field.Time("start_time").
+			Immutable().
+			Comment("Inclusive start of the time range of the readings"),
+		field.Time("end_time").
+			Immutable().
+			Comment("Exclusive end of the time range of the readings"),
+		field.Enum("status").
+			Values("pending", "running", "succeeded", "failed").
+			Default("pending").
+			Comment("Status of the job"),
+		field.Int32("attempts").
+			Default(0).
+			Comment("Number of the times the job has been claimed, which tells the current worker from a stalled one"),
+		field.Int64("rows").
+			Default(0).
+			Comment("Number of the readings calibrated so far"),
+		field.Int64("stale_buckets").
+			Default(0).
+			Comment("Number of the rollups left as they are since some of their readings have expired"),
+		field.String("error").
+			MaxLen(1024).
+			Default("").
+			Comment("Why the job failed"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last progress, by which the stalled jobs are found"),
+		field.Time("finish_time").
+			Optional().
+			Nillable().
+			Comment("Time the job succeeded or failed"),
+	}
+}
+
+// Indexes of the CalibrationRecompute.
+func (CalibrationRecompute) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("status", "update_time"),
+	}
+}
+
+func (CalibrationRecompute) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Background jobs calibrating the stored sensor readings again"),
+	}
+}
@@ -0,0 +1,90 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// Campaign holds the schema definition for the Campaign entity, which rolls out a firmware to the members of a group
+// in stages.
+type Campaign struct {
+	ent.Schema
+}
+
+// Fields of the Campaign.
+func (Campaign) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("firmware_id").
+			Immutable().
+			Comment("Identifier of the firmware being rolled out"),
+		// The targets are resolved when the campaign is created, so the group may change or vanish afterwards
+		field.Int("group_id").
+			Immutable().
+			Comment("Identifier of the targeted group"),
+		field.JSON("stages", []int32{}).
+			Immutable().
+			Comment("Cumulative percentages of the targets covered by the stages"),
+		field.Int("current_stage").
+			Default(0).
+			Comment("Zero-based index of the stage being rolled out"),
+		field.Enum("status").
+			Values("running", "paused", "completed", "rolled_back").
+			Default("running").
+			Comment("State of the campaign"),
+		field.Float32("failure_threshold").
+			Comment("Percentage of the failed updates beyond which the campaign is paused"),
+		field.String("pause_reason").
+			MaxLen(255).
+			Default("").
+			Comment("Reason why the campaign is paused"),
+		field.Time("stage_start_time").
+			Default(time.Now).
+			Comment("Time when the current stage started"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last change of the state"),
+	}
+}
+
+// Edges of the Campaign.
+func (Campaign) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("firmware", Firmware.Type).
+			Ref("campaigns").
+			Field("firmware_id").
+			Immutable().
+			Required().
+			Unique(),
+		edge.To("targets", CampaignTarget.Type),
+	}
+}
+
+// Indexes of the Campaign.
+func (Campaign) Indexes() []ent.Index {
+	return []ent.Index{
+		// The maintenance job looks for the running campaigns
+		index.Fields("status").
+			StorageKey("idx_campaign_status"),
+	}
+}
+
+func (Campaign) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Firmware update campaigns"),
+	}
+}
@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// CampaignTarget holds the schema definition for the CampaignTarget entity, which is a terminal targeted by a campaign
+// along with the progress of its firmware update.
+type CampaignTarget struct {
+	ent.Schema
+}
+
+// Fields of the CampaignTarget.
+func (CampaignTarget) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("campaign_id").
+			Immutable().
+			Comment("Identifier of the campaign"),
+		field.Int("terminal_id").
+			Immutable().
+			Comment("Identifier of the terminal to update"),
+		field.Int("stage").
+			Immutable().
+			Comment("Zero-based index of the stage the terminal belongs to"),
+		field.Enum("status").
+			Values("pending", "downloading", "installing", "succeeded", "failed", "cancelled",
+				"rollback_pending", "rolled_back").
+			Default("pending").
+			Comment("State of the update"),
+		field.Int32("progress").
+			Default(0).
+			Comment("Progress in percentage reported by the terminal"),
+		field.String("from_version").
+			MaxLen(64).
+			Default("").
+			Immutable().
+			Comment("Firmware version before the update"),
+		field.String("message").
+			MaxLen(1024).
+			Default("").
+			Comment("Error message reported by the terminal"),
+		field.Time("offer_time").
+			Optional().
+			Nillable().
+			Comment("Time when the update was first offered to the terminal"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last progress report"),
+	}
+}
+
+// Edges of the CampaignTarget.
+func (CampaignTarget) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("campaign", Campaign.Type).
+			Ref("targets").
+			Field("campaign_id").
+			Immutable().
+			Required().
+			Unique(),
+		edge.From("terminal", Terminal.Type).
+			Ref("campaign_targets").
+			Field("terminal_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the CampaignTarget.
+func (CampaignTarget) Indexes() []ent.Index {
+	return []ent.Index{
+		// Terminals look for their updates whenever they check for one
+		index.Fields("terminal_id", "status").
+			StorageKey("idx_campaign_target_terminal"),
+		// The progress of the campaigns is counted per stage
+		index.Fields("campaign_id", "stage", "status").
+			StorageKey("idx_campaign_target_stage"),
+	}
+}
+
+func (CampaignTarget) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Firmware updates of the terminals in the campaigns"),
+	}
+}
@@ -0,0 +1,100 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// Command holds the schema definition for the Command entity, which is an instruction queued for a terminal.
+type Command struct {
+	ent.Schema
+}
+
+// Fields of the Command.
+func (Command) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("terminal_id").
+			Immutable().
+			Comment("Identifier of the terminal the command is sent to"),
+		field.String("name").
+			MaxLen(64).
+			NotEmpty().
+			Immutable().
+			Comment("Name of the command, e.g. reboot, set_config or run_diagnostics"),
+		field.Text("payload").
+			Default("").
+			Immutable().
+			Comment("Arguments of the command as a JSON document"),
+		field.Enum("status").
+			Values("pending", "delivered", "succeeded", "failed", "expired").
+			Default("pending").
+			Comment("Delivery state of the command"),
+		field.Int32("attempts").
+			Default(0).
+			Comment("Number of times the command has been delivered"),
+		field.Int32("max_retries").
+			Default(0).
+			Comment("Number of redeliveries allowed if the terminal does not acknowledge the command"),
+		field.Text("result").
+			Default("").
+			Comment("Output of the command or the reason of the failure"),
+		field.Time("expire_time").
+			Comment("The command expires if it is not completed before this time"),
+		field.Time("deliver_time").
+			Optional().
+			Nillable().
+			Comment("Time of the last delivery"),
+		field.Time("ack_time").
+			Optional().
+			Nillable().
+			Comment("Time of the acknowledgement of the last delivery"),
+		field.Time("complete_time").
+			Optional().
+			Nillable().
+			Comment("Time when the command reached a final state"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+	}
+}
+
+// Edges of the Command.
+func (Command) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("terminal", Terminal.Type).
+			Ref("commands").
+			Field("terminal_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the Command.
+func (Command) Indexes() []ent.Index {
+	return []ent.Index{
+		// Terminals fetch their pending commands, and the history is listed per terminal
+		index.Fields("terminal_id", "status").
+			StorageKey("idx_command_terminal"),
+		// The maintenance job looks for the overdue commands
+		index.Fields("status", "expire_time").
+			StorageKey("idx_command_expire"),
+	}
+}
+
+func (Command) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Commands queued for the terminals"),
+	}
+}
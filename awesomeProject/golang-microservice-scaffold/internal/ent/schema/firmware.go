@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// Firmware holds the schema definition for the Firmware entity, which is an artifact in the version catalog.
+// The artifact itself is kept in the firmware store, and only its metadata is stored in the database.
+type Firmware struct {
+	ent.Schema
+}
+
+// Fields of the Firmware.
+func (Firmware) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("version").
+			MaxLen(64).
+			NotEmpty().
+			Unique().
+			Immutable().
+			Comment("Version of the firmware"),
+		field.Int64("size").
+			Immutable().
+			Comment("Size of the artifact in bytes"),
+		field.String("sha256").
+			MaxLen(64).
+			Immutable().
+			Comment("Hex encoded SHA-256 checksum of the artifact"),
+		field.String("path").
+			MaxLen(255).
+			Immutable().
+			Comment("Name of the artifact in the firmware store"),
+		field.Text("release_notes").
+			Default("").
+			Comment("Release notes of the firmware"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Upload time of the artifact"),
+	}
+}
+
+// Edges of the Firmware.
+func (Firmware) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("campaigns", Campaign.Type), // campaigns rolling out the firmware
+	}
+}
+
+func (Firmware) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Firmware catalog of the terminals"),
+	}
+}
@@ -0,0 +1,84 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// NotificationChannel holds the schema definition for the NotificationChannel entity, which is where the
+// notifications of the alerts are sent to
+type NotificationChannel struct {
+	ent.Schema
+}
+
+// Fields of the NotificationChannel.
+func (NotificationChannel) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("name").
+			MaxLen(128).
+			NotEmpty().
+			Comment("Name of the channel"),
+		field.Enum("type").
+			Values("webhook", "email", "slack").
+			Comment("How the notifications are sent"),
+		field.String("url").
+			MaxLen(1024).
+			Default("").
+			Comment("URL of the webhook"),
+		field.String("secret").
+			MaxLen(256).
+			Default("").
+			Sensitive().
+			Comment("Key signing the webhook notifications"),
+		field.JSON("recipients", []string{}).
+			Optional().
+			Comment("Email addresses of the email notifications"),
+		field.String("subject_template").
+			MaxLen(1024).
+			Default("").
+			Comment("Template of the subject, the configured default if empty"),
+		field.Text("body_template").
+			Default("").
+			Comment("Template of the text, the configured default if empty"),
+		field.Int32("rate_limit").
+			Default(0).
+			Comment("Maximum number of the notifications within the rate window, unlimited if zero"),
+		field.Int64("rate_window").
+			Default(0).
+			Comment("Window of the rate limit in milliseconds"),
+		field.Bool("disabled").
+			Default(false).
+			Comment("Nothing is routed to the disabled channels"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Last update time of this record for audit purposes"),
+	}
+}
+
+// Edges of the NotificationChannel.
+func (NotificationChannel) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("routes", NotificationRoute.Type),
+		edge.To("deliveries", NotificationDelivery.Type),
+	}
+}
+
+func (NotificationChannel) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Channels of the notifications of the alerts"),
+	}
+}
@@ -0,0 +1,105 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// NotificationDelivery holds the schema definition for the NotificationDelivery entity, which is a notification of
+// an alert through a channel along with the attempts to send it
+type NotificationDelivery struct {
+	ent.Schema
+}
+
+// Fields of the NotificationDelivery.
+func (NotificationDelivery) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		// The deliveries are kept as the history of the notifications even if their alerts are deleted
+		field.Int("alert_id").
+			Immutable().
+			Comment("The notified alert"),
+		field.Int("channel_id").
+			Immutable().
+			Comment("The channel which the notification is sent through"),
+		field.Enum("event").
+			Values("firing", "resolved").
+			Immutable().
+			Comment("Whether the alert fired or was resolved"),
+		field.JSON("recipients", []string{}).
+			Optional().
+			Comment("Email addresses of an email notification"),
+		field.String("subject").
+			MaxLen(1024).
+			Default(""),
+		field.Text("body").
+			Default(""),
+		field.Enum("status").
+			Values("pending", "sent", "failed", "suppressed").
+			Default("pending").
+			Comment("State of the delivery"),
+		field.Int32("attempts").
+			Default(0).
+			Comment("Number of the attempts so far"),
+		field.String("last_error").
+			MaxLen(1024).
+			Default("").
+			Comment("Why the last attempt failed"),
+		field.Time("next_attempt_time").
+			Optional().
+			Nillable().
+			Comment("Time of the next attempt of a pending delivery"),
+		field.Time("sent_time").
+			Optional().
+			Nillable(),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Last update time of this record for audit purposes"),
+	}
+}
+
+// Edges of the NotificationDelivery.
+func (NotificationDelivery) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("channel", NotificationChannel.Type).
+			Ref("deliveries").
+			Field("channel_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the NotificationDelivery.
+func (NotificationDelivery) Indexes() []ent.Index {
+	return []ent.Index{
+		// The due deliveries are looked up by the delivery job
+		index.Fields("status", "next_attempt_time").
+			StorageKey("idx_notification_delivery_due"),
+		index.Fields("alert_id").
+			StorageKey("idx_notification_delivery_alert"),
+		// The recent deliveries of a channel are counted by the rate limit
+		index.Fields("channel_id", "create_time").
+			StorageKey("idx_notification_delivery_rate"),
+	}
+}
+
+func (NotificationDelivery) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Deliveries of the notifications of the alerts"),
+	}
+}
@@ -0,0 +1,69 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// NotificationRoute holds the schema definition for the NotificationRoute entity, which sends the matching alerts
+// to a channel
+type NotificationRoute struct {
+	ent.Schema
+}
+
+// Fields of the NotificationRoute.
+func (NotificationRoute) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("channel_id").
+			Comment("The channel which the matching alerts are sent to"),
+		field.JSON("severities", []string{}).
+			Optional().
+			Comment("Matches the alerts of any of the severities, all of them if empty"),
+		field.JSON("tags", []string{}).
+			Optional().
+			Comment("Matches the alerts concerning a terminal having any of the tags, all of them if empty"),
+		field.Int64("user_group_id").
+			Default(0).
+			Comment("The user group whose members are emailed as well, none if zero"),
+		field.Bool("send_resolved").
+			Default(false).
+			Comment("Whether the resolutions are notified as well"),
+		field.String("description").
+			MaxLen(1024).
+			Default(""),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Last update time of this record for audit purposes"),
+	}
+}
+
+// Edges of the NotificationRoute.
+func (NotificationRoute) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("channel", NotificationChannel.Type).
+			Ref("routes").
+			Field("channel_id").
+			Required().
+			Unique(),
+	}
+}
+
+func (NotificationRoute) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Routes of the alerts to the notification channels"),
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"entgo.io/ent"
 	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
 	"time"
 )
 
@@ -17,7 +18,7 @@ type Sensor struct {
 	ent.Schema
 }
 
-func (Sensor *Sensor) Fields() []ent.Field {
+func (Sensor) Fields() []ent.Field {
 	return []ent.Field{
 		field.Int("id").
 			Unique(), // id primery key
@@ -27,11 +28,41 @@ func (Sensor *Sensor) Fields() []ent.Field {
 			NotEmpty(),
 		field.Time("last_updated"). // latest_time
 			Default(time.Now),
+		field.Int("terminal_id").Optional().Nillable(), // the terminal the sensor hangs off, null if detached
+		field.Bool("stale").Default(false),             // readings are out of date since the terminal has gone offline
 	}
 
 }
 func (Sensor) Edges() []ent.Edge {
 	return []ent.Edge{
-		edge.To("values", SensorValue.Type)} //one sensor could have multiple values
+		edge.To("values", SensorValue.Type), //one sensor could have multiple values
+		// the values aggregated by minute and hour
+		edge.To("rollups", SensorRollup.Type),
+		// the minutes to be rolled up again, since they have received late readings
+		edge.To("dirty_buckets", SensorDirtyBucket.Type),
+		// the readings deviating from the baselines, and what the anomaly detectors have learned
+		edge.To("anomalies", SensorAnomaly.Type),
+		edge.To("anomaly_model", SensorAnomalyModel.Type).
+			Unique(),
+		// the calibration profiles converting the raw readings, each of which is in effect from a point in time
+		edge.To("calibrations", SensorCalibration.Type),
+		// the definition computing the readings if the sensor is virtual, and the virtual sensors it is an input of
+		edge.To("virtual", VirtualSensor.Type).
+			Unique(),
+		edge.To("dependents", VirtualSensorInput.Type),
+		edge.From("terminal", Terminal.Type).
+			Ref("sensors").
+			Field("terminal_id").
+			Unique(),
+	}
 	// can add more edge
 }
+
+// Indexes of the Sensor.
+func (Sensor) Indexes() []ent.Index {
+	return []ent.Index{
+		// A sensor is identified by its type and identifier, e.g. when the agents push the samples of a series
+		index.Fields("sensor_type", "identifier").
+			Unique(),
+	}
+}
@@ -0,0 +1,75 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// SensorAnomaly holds the schema definition for the SensorAnomaly entity, which is a reading deviating from the
+// baseline of an anomaly detector.
+type SensorAnomaly struct {
+	ent.Schema
+}
+
+// Fields of the SensorAnomaly.
+func (SensorAnomaly) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("sensor_id").
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.Time("timestamp").
+			Immutable().
+			SchemaType(map[string]string{dialect.MySQL: "datetime(6)"}).
+			Comment("Time of the reading"),
+		field.Float("value").
+			Immutable().
+			Comment("The reading"),
+		field.Float("expected").
+			Immutable().
+			Comment("The baseline of the detector the reading deviates from"),
+		field.Float("score").
+			Immutable().
+			Comment("The deviation in the standard deviations"),
+		field.Enum("detector").
+			Values("rolling_zscore", "ewma", "seasonal").
+			Immutable().
+			Comment("The detector which scores the reading the highest"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+	}
+}
+
+// Edges of the SensorAnomaly.
+func (SensorAnomaly) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("anomalies").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+	}
+}
+
+// Indexes of the SensorAnomaly.
+func (SensorAnomaly) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("sensor_id", "timestamp"),
+		index.Fields("timestamp"),
+	}
+}
+
+func (SensorAnomaly) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Readings detected as anomalies"),
+	}
+}
@@ -0,0 +1,51 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// SensorAnomalyModel holds the schema definition for the SensorAnomalyModel entity, which is what the anomaly
+// detectors have learned from the readings of a sensor, so that the learning survives the restarts.
+type SensorAnomalyModel struct {
+	ent.Schema
+}
+
+// Fields of the SensorAnomalyModel.
+func (SensorAnomalyModel) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("sensor_id").
+			Unique().
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.Bytes("state").
+			Comment("The model encoded in protobuf, which is only interpreted by the detectors"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time the model last learned"),
+	}
+}
+
+// Edges of the SensorAnomalyModel.
+func (SensorAnomalyModel) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("anomaly_model").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+	}
+}
+
+func (SensorAnomalyModel) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("What the anomaly detectors have learned from the sensor readings"),
+	}
+}
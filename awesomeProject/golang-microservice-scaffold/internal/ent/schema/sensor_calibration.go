@@ -0,0 +1,72 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// SensorCalibration holds the schema definition for the SensorCalibration entity, which is a calibration profile of
+// a sensor in effect from a point in time until the next one.
+type SensorCalibration struct {
+	ent.Schema
+}
+
+// Fields of the SensorCalibration.
+func (SensorCalibration) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("sensor_id").
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.Time("effective_from").
+			SchemaType(map[string]string{dialect.MySQL: "datetime(6)"}).
+			Comment("Time from which the profile is in effect"),
+		field.Bytes("profile").
+			Comment("The coefficients encoded in protobuf, which are only interpreted by the calibration"),
+		field.String("description").
+			MaxLen(1024).
+			Default("").
+			Comment("Where the coefficients come from"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+	}
+}
+
+// Edges of the SensorCalibration.
+func (SensorCalibration) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("calibrations").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+	}
+}
+
+// Indexes of the SensorCalibration.
+func (SensorCalibration) Indexes() []ent.Index {
+	return []ent.Index{
+		// A reading is calibrated by a single profile at a time
+		index.Fields("sensor_id", "effective_from").
+			Unique(),
+	}
+}
+
+func (SensorCalibration) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Calibration profiles of the sensors"),
+	}
+}
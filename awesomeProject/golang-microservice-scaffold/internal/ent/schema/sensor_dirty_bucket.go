@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// SensorDirtyBucket holds the schema definition for the SensorDirtyBucket entity, which marks a minute of a sensor
+// receiving readings after it may have been rolled up. The compaction job rolls up the minute and its hour again,
+// and then deletes the mark.
+type SensorDirtyBucket struct {
+	ent.Schema
+}
+
+// Fields of the SensorDirtyBucket.
+func (SensorDirtyBucket) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("sensor_id").
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.Time("bucket").
+			Immutable().
+			Comment("Start of the minute bucket"),
+	}
+}
+
+// Edges of the SensorDirtyBucket.
+func (SensorDirtyBucket) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("dirty_buckets").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+	}
+}
+
+// Indexes of the SensorDirtyBucket.
+func (SensorDirtyBucket) Indexes() []ent.Index {
+	return []ent.Index{
+		// A minute may be marked several times, which is harmless, so the marks are not unique
+		index.Fields("sensor_id", "bucket"),
+	}
+}
+
+func (SensorDirtyBucket) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Minutes of the sensors to be rolled up again, since they have received late readings"),
+	}
+}
@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// SensorExport holds the schema definition for the SensorExport entity, which is a background job exporting the
+// readings of the sensors to a file in the store.
+type SensorExport struct {
+	ent.Schema
+}
+
+// Fields of the SensorExport.
+func (SensorExport) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Bytes("request").
+			Immutable().
+			Comment("The export request encoded in protobuf, which is only interpreted by the job"),
+		field.Enum("status").
+			Values("pending", "running", "succeeded", "failed").
+			Default("pending").
+			Comment("Status of the job"),
+		field.Int32("attempts").
+			Default(0).
+			Comment("Number of the times the job has been claimed, which tells the current worker from a stalled one"),
+		field.Int64("rows").
+			Default(0).
+			Comment("Number of the rows written so far"),
+		field.Int64("size").
+			Default(0).
+			Comment("Size of the file in bytes"),
+		field.String("artifact").
+			Optional().
+			Comment("Name of the file in the store once the job succeeds"),
+		field.String("error").
+			MaxLen(1024).
+			Default("").
+			Comment("Why the job failed"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last progress, by which the stalled jobs are found"),
+		field.Time("finish_time").
+			Optional().
+			Nillable().
+			Comment("Time the job succeeded or failed"),
+		field.Time("expire_time").
+			Optional().
+			Nillable().
+			Comment("Time after which the job is removed along with its file"),
+	}
+}
+
+// Indexes of the SensorExport.
+func (SensorExport) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("status", "update_time"),
+		index.Fields("expire_time"),
+	}
+}
+
+func (SensorExport) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Background jobs exporting the sensor readings"),
+	}
+}
@@ -0,0 +1,70 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// SensorRollup holds the schema definition for the SensorRollup entity, which aggregates the readings of a sensor
+// within a minute or an hour. The rollups outlive the raw readings, so that the long time ranges remain queryable.
+type SensorRollup struct {
+	ent.Schema
+}
+
+// Fields of the SensorRollup.
+func (SensorRollup) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("sensor_id").
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.Enum("resolution").
+			Values("minute", "hour").
+			Immutable().
+			Comment("Width of the bucket"),
+		field.Time("bucket").
+			Immutable().
+			Comment("Start of the bucket, aligned to the Unix epoch"),
+		field.Int64("count").
+			Comment("Number of the readings within the bucket"),
+		field.Float("sum").
+			Comment("Sum of the readings"),
+		field.Float("min").
+			Comment("Minimum of the readings"),
+		field.Float("max").
+			Comment("Maximum of the readings"),
+		field.Float("last").
+			Comment("The latest reading within the bucket"),
+	}
+}
+
+// Edges of the SensorRollup.
+func (SensorRollup) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("rollups").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+	}
+}
+
+// Indexes of the SensorRollup.
+func (SensorRollup) Indexes() []ent.Index {
+	return []ent.Index{
+		// A bucket is rolled up once, even if two replicas compact at the same time
+		index.Fields("sensor_id", "resolution", "bucket").
+			Unique(),
+	}
+}
+
+func (SensorRollup) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Aggregates of the sensor readings at the coarser resolutions"),
+	}
+}
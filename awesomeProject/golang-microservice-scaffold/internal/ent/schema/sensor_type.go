@@ -0,0 +1,86 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// SensorType holds the schema definition for the SensorType entity, which describes the readings of the sensors of
+// a type. A sensor refers to its type by the name rather than a foreign key, since the sensor types were free
+// strings before the catalog existed.
+type SensorType struct {
+	ent.Schema
+}
+
+// Fields of the SensorType.
+func (SensorType) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("name").
+			MaxLen(64).
+			NotEmpty().
+			Unique().
+			Immutable().
+			Comment("Name of the sensor type, which the sensors refer to"),
+		field.String("unit").
+			MaxLen(32).
+			NotEmpty().
+			Comment("UCUM code of the unit of the readings"),
+		field.Float("min").
+			Optional().
+			Nillable().
+			Comment("Inclusive lower bound of the valid readings, null if unbounded"),
+		field.Float("max").
+			Optional().
+			Nillable().
+			Comment("Inclusive upper bound of the valid readings, null if unbounded"),
+		field.Int32("precision").
+			Optional().
+			Nillable().
+			Comment("Number of the decimal places the readings are rounded to, null if not rounded"),
+		field.Int64("sampling_interval").
+			Default(0).
+			Comment("Expected interval between the readings of a sensor in milliseconds"),
+		field.Enum("out_of_range").
+			Values("reject", "flag").
+			Default("reject").
+			Comment("Whether a reading outside the valid range is rejected or stored with a flag"),
+		field.Int64("raw_retention").
+			Optional().
+			Nillable().
+			Comment("Retention of the raw readings in milliseconds, zero if forever, null if the default"),
+		field.Int64("minute_retention").
+			Optional().
+			Nillable().
+			Comment("Retention of the 1-minute rollups in milliseconds, zero if forever, null if the default"),
+		field.Int64("hour_retention").
+			Optional().
+			Nillable().
+			Comment("Retention of the hourly rollups in milliseconds, zero if forever, null if the default"),
+		field.String("description").
+			MaxLen(1024).
+			Default("").
+			Comment("Description of the sensor type"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last change of the definition"),
+	}
+}
+
+func (SensorType) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Catalog of the sensor types"),
+	}
+}
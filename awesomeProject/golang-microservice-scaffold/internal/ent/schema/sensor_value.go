@@ -7,16 +7,17 @@
 package schema
 
 import (
-	"ariga.io/atlas/sql/schema"
 	"entgo.io/ent"
+	"entgo.io/ent/dialect"
 	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
 	"time"
 )
 
 // SensorValue
 type SensorValue struct {
-	schema.Schema
+	ent.Schema
 }
 
 // Fields of the SensorValue.
@@ -25,7 +26,16 @@ func (SensorValue) Fields() []ent.Field {
 		field.Float("value").
 			Optional(), // 传感器值
 		field.Time("timestamp").
-			Default(time.Now), // 时间戳
+			Default(time.Now).
+			// Keep the microseconds on MySQL as well, since a reading is identified by its sensor and timestamp
+			SchemaType(map[string]string{dialect.MySQL: "datetime(6)"}), // 时间戳
+		field.Int("sensor_id").
+			StorageKey("sensor_values"), // the column of the sensor edge, exposed for the bulk queries
+		field.Bool("out_of_range").
+			Default(false), // outside the valid range of the sensor type, flagged rather than rejected
+		field.Float("raw_value").
+			Optional().
+			Nillable(), // the value before calibration, absent if the value is not calibrated
 	}
 }
 
@@ -34,7 +44,18 @@ func (SensorValue) Edges() []ent.Edge {
 	return []ent.Edge{
 		edge.From("sensor", Sensor.Type).
 			Ref("values").
+			Field("sensor_id").
 			Required().
 			Unique(),
 	}
 }
+
+// Indexes of the SensorValue.
+func (SensorValue) Indexes() []ent.Index {
+	return []ent.Index{
+		// A reading recorded again is skipped rather than duplicated. The existing duplicates must be removed before
+		// the index is created on an existing database, see the upgrade notes in the README.
+		index.Fields("sensor_id", "timestamp").
+			Unique(),
+	}
+}
@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// Server holds the schema definition for the Server entity, which is a host in the server inventory. The owner
+// refers to a user group by its id rather than a foreign key, since the users are soft-deleted.
+type Server struct {
+	ent.Schema
+}
+
+// Fields of the Server.
+func (Server) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("hostname").
+			MaxLen(253).
+			NotEmpty().
+			Unique().
+			Comment("Fully qualified hostname, which is stored in lower case"),
+		field.JSON("addresses", []string{}).
+			Comment("IPv4 or IPv6 addresses of the host"),
+		field.String("role").
+			MaxLen(32).
+			NotEmpty().
+			Comment("What the host serves as, e.g. gateway"),
+		field.Enum("environment").
+			Values("development", "testing", "staging", "production").
+			Comment("Deployment environment the host belongs to"),
+		field.Int64("owner_group_id").
+			Comment("Identifier of the user group owning the host"),
+		field.JSON("labels", map[string]string{}).
+			Comment("Free-form key-value pairs describing the host"),
+		field.Enum("status").
+			Values("provisioning", "active", "maintenance", "decommissioned").
+			Default("provisioning").
+			Comment("Lifecycle state of the host"),
+		field.String("description").
+			MaxLen(1024).
+			Default("").
+			Comment("Description of the host"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last change of the host"),
+	}
+}
+
+// Indexes of the Server.
+func (Server) Indexes() []ent.Index {
+	return []ent.Index{
+		// The hosts are usually listed by their roles within an environment
+		index.Fields("environment", "role"),
+		index.Fields("owner_group_id"),
+	}
+}
+
+func (Server) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Inventory of the hosts the platform runs on"),
+	}
+}
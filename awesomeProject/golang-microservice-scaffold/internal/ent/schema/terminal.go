@@ -2,7 +2,9 @@ package schema
 
 import (
 	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
 	"time"
 )
 
@@ -16,7 +18,34 @@ func (Terminal) Fields() []ent.Field {
 	return []ent.Field{
 		field.Int("id").Unique(),
 		field.String("status").Default("offline"),
-		field.Int("timeout").Default(60),             // default timeout time is 60s
-		field.Time("last_updated").Default(time.Now), // former update time
+		field.Int("timeout").Default(0),                       // 0 follows terminal.default_timeout
+		field.Time("last_updated").Default(time.Now),          // former update time
+		field.Time("decommission_time").Optional().Nillable(), // null if the terminal is in service
+		field.String("firmware_version").Default(""),          // as last reported by the terminal
+		field.Float("latitude").Optional().Nillable(),         // null if the location is unknown
+		field.Float("longitude").Optional().Nillable(),
+		field.Float("altitude").Optional().Nillable(), // meters above the sea level
+	}
+}
+
+// Edges of the Terminal.
+func (Terminal) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("commands", Command.Type), // commands queued for the terminal
+		edge.To("tags", TerminalTag.Type),
+		edge.To("status_changes", TerminalStatusChange.Type),
+		edge.To("sensors", Sensor.Type), // sensors hanging off the terminal
+		edge.To("campaign_targets", CampaignTarget.Type),
+		edge.To("shadow", TerminalShadow.Type).Unique(),
+		edge.From("groups", TerminalGroup.Type).Ref("terminals"),
+	}
+}
+
+// Indexes of the Terminal.
+func (Terminal) Indexes() []ent.Index {
+	return []ent.Index{
+		// The spatial queries narrow down the terminals by a bounding box, which works on any database
+		index.Fields("latitude", "longitude").
+			StorageKey("idx_terminal_location"),
 	}
 }
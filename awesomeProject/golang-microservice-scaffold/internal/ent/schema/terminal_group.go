@@ -0,0 +1,73 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+	"time"
+)
+
+// TerminalGroup holds the schema definition for the TerminalGroup entity, which is a named collection of terminals.
+// Groups may be nested, e.g. a region containing the sites.
+type TerminalGroup struct {
+	ent.Schema
+}
+
+// Fields of the TerminalGroup.
+func (TerminalGroup) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.String("name").
+			MaxLen(64).
+			NotEmpty().
+			Comment("Name of the group, unique among its siblings"),
+		field.String("description").
+			MaxLen(255).
+			Default("").
+			Comment("Description of the group"),
+		field.Int("parent_id").
+			Optional().
+			Nillable().
+			Comment("Identifier of the parent group, null for the top level groups"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+	}
+}
+
+// Edges of the TerminalGroup.
+func (TerminalGroup) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.To("children", TerminalGroup.Type).
+			From("parent").
+			Field("parent_id").
+			Unique(),
+		// A terminal may belong to several groups, e.g. its site and its model
+		edge.To("terminals", Terminal.Type),
+	}
+}
+
+// Indexes of the TerminalGroup.
+func (TerminalGroup) Indexes() []ent.Index {
+	return []ent.Index{
+		// The top level groups are not covered, since their null parents are distinct from each other. Their names
+		// are checked by the business logic instead.
+		index.Fields("parent_id", "name").
+			Unique().
+			StorageKey("uk_terminal_group_name"),
+	}
+}
+
+func (TerminalGroup) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Groups of the terminals"),
+	}
+}
@@ -0,0 +1,65 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+)
+
+// TerminalShadow holds the schema definition for the TerminalShadow entity, which is the shadow document of a
+// terminal. The row is created on the first write to the shadow.
+type TerminalShadow struct {
+	ent.Schema
+}
+
+// Fields of the TerminalShadow.
+func (TerminalShadow) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("terminal_id").
+			Unique().
+			Immutable().
+			Comment("Identifier of the terminal"),
+		field.Text("desired").
+			Default("{}").
+			Comment("Desired state as a JSON document"),
+		field.Text("reported").
+			Default("{}").
+			Comment("Reported state as a JSON document"),
+		field.Int64("version").
+			Default(0).
+			Comment("Version of the shadow for the optimistic concurrency control"),
+		field.Time("desired_time").
+			Optional().
+			Nillable().
+			Comment("Time of the last update of the desired state"),
+		field.Time("reported_time").
+			Optional().
+			Nillable().
+			Comment("Time of the last update of the reported state"),
+	}
+}
+
+// Edges of the TerminalShadow.
+func (TerminalShadow) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("terminal", Terminal.Type).
+			Ref("shadow").
+			Field("terminal_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+func (TerminalShadow) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Shadow documents of the terminals"),
+	}
+}
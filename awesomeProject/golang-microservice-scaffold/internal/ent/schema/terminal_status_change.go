@@ -0,0 +1,66 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// TerminalStatusChange holds the schema definition for the TerminalStatusChange entity, which records a status
+// transition of a terminal. The history is append-only.
+type TerminalStatusChange struct {
+	ent.Schema
+}
+
+// Fields of the TerminalStatusChange.
+func (TerminalStatusChange) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("terminal_id").
+			Immutable().
+			Comment("Identifier of the terminal"),
+		field.String("from_status").
+			Immutable().
+			Comment("Status before the transition"),
+		field.String("to_status").
+			Immutable().
+			Comment("Status after the transition"),
+		field.Time("change_time").
+			Immutable().
+			Comment("Time of the transition"),
+	}
+}
+
+// Edges of the TerminalStatusChange.
+func (TerminalStatusChange) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("terminal", Terminal.Type).
+			Ref("status_changes").
+			Field("terminal_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the TerminalStatusChange.
+func (TerminalStatusChange) Indexes() []ent.Index {
+	return []ent.Index{
+		// The history is always read per terminal within a time range
+		index.Fields("terminal_id", "change_time").
+			StorageKey("idx_terminal_status_change"),
+	}
+}
+
+func (TerminalStatusChange) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Status history of the terminals"),
+	}
+}
@@ -0,0 +1,60 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// TerminalTag holds the schema definition for the TerminalTag entity, which is a free-form label of a terminal.
+type TerminalTag struct {
+	ent.Schema
+}
+
+// Fields of the TerminalTag.
+func (TerminalTag) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("terminal_id").
+			Immutable().
+			Comment("Identifier of the tagged terminal"),
+		field.String("name").
+			MaxLen(64).
+			NotEmpty().
+			Immutable().
+			Comment("The tag, e.g. site:berlin or model=x200"),
+	}
+}
+
+// Edges of the TerminalTag.
+func (TerminalTag) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("terminal", Terminal.Type).
+			Ref("tags").
+			Field("terminal_id").
+			Immutable().
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the TerminalTag.
+func (TerminalTag) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("terminal_id", "name").
+			Unique().
+			StorageKey("uk_terminal_tag"),
+		// Terminals are selected by their tags
+		index.Fields("name").
+			StorageKey("idx_terminal_tag_name"),
+	}
+}
+
+func (TerminalTag) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Tags of the terminals"),
+	}
+}
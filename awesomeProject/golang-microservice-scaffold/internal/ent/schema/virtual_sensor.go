@@ -0,0 +1,73 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"time"
+)
+
+// VirtualSensor holds the schema definition for the VirtualSensor entity, which is the definition of a sensor whose
+// readings are computed from the readings of other sensors by an expression.
+type VirtualSensor struct {
+	ent.Schema
+}
+
+// Fields of the VirtualSensor.
+func (VirtualSensor) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("sensor_id").
+			Unique().
+			Immutable().
+			Comment("Identifier of the sensor"),
+		field.String("expression").
+			NotEmpty().
+			MaxLen(1024).
+			Comment("The expression computing the readings from the variables of the inputs"),
+		field.Enum("evaluation").
+			Values("ingestion", "query").
+			Default("ingestion").
+			Comment("Whether the readings are computed and stored on ingestion, or computed on query"),
+		field.Int64("window").
+			Comment("How much earlier than a computed reading the readings of the inputs may be in milliseconds"),
+		field.String("description").
+			MaxLen(1024).
+			Default("").
+			Comment("Description of the definition"),
+		field.Time("create_time").
+			Default(time.Now).
+			Immutable().
+			Comment("Creation time for audit purposes"),
+		field.Time("update_time").
+			Default(time.Now).
+			UpdateDefault(time.Now).
+			Comment("Time of the last change of the definition"),
+	}
+}
+
+// Edges of the VirtualSensor.
+func (VirtualSensor) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("sensor", Sensor.Type).
+			Ref("virtual").
+			Field("sensor_id").
+			Required().
+			Immutable().
+			Unique(),
+		// the sensors the variables of the expression refer to
+		edge.To("inputs", VirtualSensorInput.Type),
+	}
+}
+
+func (VirtualSensor) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Definitions of the virtual sensors"),
+	}
+}
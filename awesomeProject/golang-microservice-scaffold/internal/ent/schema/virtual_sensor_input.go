@@ -0,0 +1,68 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
+	"entgo.io/ent/schema"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// VirtualSensorInput holds the schema definition for the VirtualSensorInput entity, which binds a variable of the
+// expression of a virtual sensor to the sensor it refers to. The inputs are kept in a table of their own, so that
+// the virtual sensors depending on a sensor are found by the index.
+type VirtualSensorInput struct {
+	ent.Schema
+}
+
+// Fields of the VirtualSensorInput.
+func (VirtualSensorInput) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("id").
+			Unique().
+			Immutable().
+			Comment("Unique identifier"),
+		field.Int("virtual_sensor_id").
+			Comment("Identifier of the definition of the virtual sensor"),
+		field.String("name").
+			NotEmpty().
+			MaxLen(64).
+			Comment("Name of the variable in the expression"),
+		field.Int("sensor_id").
+			Comment("Identifier of the sensor the variable refers to"),
+	}
+}
+
+// Edges of the VirtualSensorInput.
+func (VirtualSensorInput) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("virtual_sensor", VirtualSensor.Type).
+			Ref("inputs").
+			Field("virtual_sensor_id").
+			Required().
+			Unique(),
+		edge.From("sensor", Sensor.Type).
+			Ref("dependents").
+			Field("sensor_id").
+			Required().
+			Unique(),
+	}
+}
+
+// Indexes of the VirtualSensorInput.
+func (VirtualSensorInput) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("virtual_sensor_id", "name").
+			Unique(),
+		// The virtual sensors are computed as the readings of their inputs are written
+		index.Fields("sensor_id"),
+	}
+}
+
+func (VirtualSensorInput) Annotations() []schema.Annotation {
+	return []schema.Annotation{
+		entsql.WithComments(true),
+		schema.Comment("Variables of the expressions of the virtual sensors"),
+	}
+}
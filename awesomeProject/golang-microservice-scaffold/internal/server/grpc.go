@@ -1,10 +1,15 @@
 package server
 
 import (
+	alertv1 "example/api/alert/v1"
+	sensorv1 "example/api/sensor/v1"
+	serverv1 "example/api/server"
+	terminalv1 "example/api/terminal"
 	v1 "example/api/user/v1"
 	"example/internal/conf"
 	"example/internal/service"
 	"github.com/go-kratos/kratos/v2/transport/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // NewGRPCServer news a gRPC server. For the HTTP server references, check the documentation of [NewHTTPServer].
@@ -12,9 +17,15 @@ import (
 // The server only handles the gRPC calls, which are more commonly used among services, reducing the overall
 // overhead cost and communication cost.
 func NewGRPCServer(
-	c *conf.Server, s *service.UserService, m Middlewares) *grpc.Server {
+	c *conf.Server, s *service.UserService, ts *service.TerminalService, tgs *service.TerminalGroupService,
+	cs *service.CommandService, fs *service.FirmwareService, ss *service.ShadowService, sns *service.SensorService,
+	sts *service.SensorTypeService, sxs *service.SensorExportService, sas *service.SensorAnomalyService,
+	scs *service.SensorCalibrationService, vss *service.VirtualSensorService, as *service.AlertService,
+	ns *service.NotificationService, svs *service.ServerService, h *Health, m Middlewares) *grpc.Server {
 	var opts = []grpc.ServerOption{
 		grpc.Middleware(m...),
+		// The builtin health service always serves, while ours follows the checks of the dependencies
+		grpc.CustomHealth(),
 	}
 	if c.Grpc.Network != "" {
 		opts = append(opts, grpc.Network(c.Grpc.Network))
@@ -27,5 +38,20 @@ func NewGRPCServer(
 	}
 	srv := grpc.NewServer(opts...)
 	v1.RegisterUserManagementServer(srv, s)
+	terminalv1.RegisterTerminalManagementServer(srv, ts)
+	terminalv1.RegisterTerminalGroupsServer(srv, tgs)
+	terminalv1.RegisterTerminalCommandServer(srv, cs)
+	terminalv1.RegisterFirmwareUpdateServer(srv, fs)
+	terminalv1.RegisterTerminalShadowServer(srv, ss)
+	sensorv1.RegisterSensorServiceServer(srv, sns)
+	sensorv1.RegisterSensorTypesServer(srv, sts)
+	sensorv1.RegisterSensorExportsServer(srv, sxs)
+	sensorv1.RegisterSensorAnomaliesServer(srv, sas)
+	sensorv1.RegisterSensorCalibrationsServer(srv, scs)
+	sensorv1.RegisterVirtualSensorsServer(srv, vss)
+	alertv1.RegisterAlertingServer(srv, as)
+	alertv1.RegisterNotificationsServer(srv, ns)
+	serverv1.RegisterServerServer(srv, svs)
+	grpc_health_v1.RegisterHealthServer(srv, h.grpc)
 	return srv
 }
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"example/internal/biz"
+	"example/internal/conf"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	etcdclient "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var healthCheckUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "health_check_up",
+	Help: "Whether the last health check of a dependency has passed",
+}, []string{"check"})
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+)
+
+// checkResult is the outcome of a health check. The error is logged rather than served, since it may tell the
+// addresses and the internals of the dependencies.
+type checkResult struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"-"`
+}
+
+// Health reports the liveness and the readiness of the service. The service is live as long as it answers, and
+// ready if all the checks of its dependencies pass. The checks run in the background every interval, so that the
+// probes are answered by the cached results rather than loading the dependencies. The gRPC health service follows
+// the readiness, so that the load balancers drain the instance which is not ready.
+type Health struct {
+	checks  biz.HealthChecks
+	timeout time.Duration
+	// drainDelay is how long the instance reports not serving before the servers stop
+	drainDelay time.Duration
+	loop       *Loop
+	grpc       *health.Server
+	log        *log.Helper
+
+	mu      sync.RWMutex
+	results []checkResult
+	ready   bool
+	stopped bool
+}
+
+// NewHealth collects the checks of the data layer, the registry and the MQTT bridge if it is enabled
+func NewHealth(
+	c *conf.Server, checks biz.HealthChecks, etcdClient *etcdclient.Client, ms *MQTTServer,
+	logger log.Logger) *Health {
+	h := &Health{
+		checks:     append(biz.HealthChecks{}, checks...),
+		timeout:    durationOf(c.GetHealth().GetTimeout(), defaultHealthTimeout),
+		drainDelay: c.GetHealth().GetDrainDelay().AsDuration(),
+		grpc:       health.NewServer(),
+		log:        log.NewHelper(log.With(logger, "module", "server/health")),
+	}
+	h.checks = append(h.checks, biz.HealthCheck{Name: "registry", Check: func(ctx context.Context) error {
+		_, err := etcdClient.Get(ctx, "health")
+		return err
+	}})
+	if ms != nil {
+		h.checks = append(h.checks, biz.HealthCheck{Name: "mqtt", Check: ms.Check})
+	}
+	h.loop = NewLoop("health-check", durationOf(c.GetHealth().GetInterval(), defaultHealthInterval), h.check, logger)
+	// Nothing is served until the dependencies are checked
+	h.grpc.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// Start checks the dependencies right away, and then every interval until the health is stopped
+func (h *Health) Start(ctx context.Context) error {
+	_ = h.check(ctx)
+	return h.loop.Start(ctx)
+}
+
+// Drain reports the instance as not serving, and then waits for the drain delay before the servers stop, so that
+// the load balancers and the probes take the instance out of rotation while it still answers. It is called before
+// the application stops, since the servers stop all at once.
+func (h *Health) Drain(ctx context.Context) error {
+	h.mu.Lock()
+	drained := h.stopped
+	h.ready, h.stopped = false, true
+	h.mu.Unlock()
+	h.grpc.Shutdown()
+	if drained || h.drainDelay <= 0 {
+		return nil
+	}
+	h.log.Infof("not serving, draining for %v before stopping", h.drainDelay)
+	select {
+	case <-time.After(h.drainDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop stops the checks. The instance is drained first unless it has been.
+func (h *Health) Stop(ctx context.Context) error {
+	_ = h.Drain(ctx)
+	return h.loop.Stop(ctx)
+}
+
+// check runs all the checks concurrently, and caches their results
+func (h *Health) check(ctx context.Context) error {
+	results := make([]checkResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			err := c.Check(checkCtx)
+			results[i] = checkResult{Name: c.Name, Healthy: err == nil}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	ready := true
+	for _, r := range results {
+		if r.Healthy {
+			healthCheckUp.WithLabelValues(r.Name).Set(1)
+			continue
+		}
+		healthCheckUp.WithLabelValues(r.Name).Set(0)
+		ready = false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		// The instance stays drained
+		return nil
+	}
+	switch {
+	case ready && !h.ready:
+		h.log.Info("all the dependencies are available, serving")
+	case !ready && (h.ready || h.results == nil):
+		h.log.Warnf("some dependencies are unavailable, not serving: %v", failedChecks(results))
+	case !ready:
+		// The failures are logged again only as they change
+		if changed := changedFailures(h.results, results); len(changed) > 0 {
+			h.log.Warnf("some dependencies are still unavailable: %v", failedChecks(changed))
+		}
+	}
+	h.results, h.ready = results, ready
+	if ready {
+		h.grpc.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	} else {
+		h.grpc.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+	return nil
+}
+
+// changedFailures returns the failed results whose errors differ from the previous results of the same checks
+func changedFailures(previous, results []checkResult) []checkResult {
+	var changed []checkResult
+	for i, r := range results {
+		if !r.Healthy && (i >= len(previous) || previous[i].Healthy || previous[i].Error != r.Error) {
+			changed = append(changed, r)
+		}
+	}
+	return changed
+}
+
+func failedChecks(results []checkResult) error {
+	var errs []error
+	for _, r := range results {
+		if !r.Healthy {
+			errs = append(errs, errors.New(r.Name+": "+r.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Live answers the liveness probes at /healthz, which pass as long as the service answers
+func (h *Health) Live(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]any{"status": "alive"})
+}
+
+// Ready answers the readiness probes at /readyz by the cached results of the checks, i.e. whether each of the
+// checks has passed, while the errors are in the logs
+func (h *Health) Ready(w http.ResponseWriter, _ *http.Request) {
+	h.mu.RLock()
+	ready, results := h.ready, h.results
+	h.mu.RUnlock()
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unready", http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, map[string]any{"status": status, "checks": results})
+}
+
+func writeHealth(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"example/internal/biz"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newTestHealth runs the checks without the registry and the MQTT bridge
+func newTestHealth(checks biz.HealthChecks, drainDelay time.Duration) *Health {
+	h := NewHealth(nil, nil, nil, nil, log.DefaultLogger)
+	h.checks, h.drainDelay = checks, drainDelay
+	return h
+}
+
+func TestReadyHidesErrors(t *testing.T) {
+	h := newTestHealth(biz.HealthChecks{
+		{Name: "database", Check: func(context.Context) error { return nil }},
+		{Name: "redis", Check: func(context.Context) error { return errors.New("dial tcp 10.0.0.7:6379: refused") }},
+	}, 0)
+	_ = h.check(context.Background())
+
+	w := httptest.NewRecorder()
+	h.Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "10.0.0.7") {
+		t.Errorf("got the error served: %s", w.Body)
+	}
+	var body struct {
+		Status string
+		Checks []map[string]any
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "unready" || len(body.Checks) != 2 {
+		t.Fatalf("got %s", w.Body)
+	}
+	for i, want := range []bool{true, false} {
+		if c := body.Checks[i]; len(c) != 2 || c["healthy"] != want {
+			t.Errorf("got check %v, want only its name and healthy %v", c, want)
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	h := newTestHealth(biz.HealthChecks{{Name: "database", Check: func(context.Context) error { return nil }}},
+		100*time.Millisecond)
+	_ = h.check(context.Background())
+	status := func() grpc_health_v1.HealthCheckResponse_ServingStatus {
+		resp, err := h.grpc.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	if status() != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatal("got the instance not serving")
+	}
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- h.Drain(context.Background()) }()
+	// The instance reports not serving during the delay, and stays so as the checks pass
+	time.Sleep(20 * time.Millisecond)
+	_ = h.check(context.Background())
+	if status() != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Error("got the instance serving while it drains")
+	}
+	if err := <-done; err != nil || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("got drained in %v: %v", time.Since(start), err)
+	}
+
+	// The instance is drained once
+	start = time.Now()
+	if err := h.Drain(context.Background()); err != nil || time.Since(start) >= 100*time.Millisecond {
+		t.Errorf("got drained again in %v: %v", time.Since(start), err)
+	}
+}
@@ -1,6 +1,10 @@
 package server
 
 import (
+	alertv1 "example/api/alert/v1"
+	sensorv1 "example/api/sensor/v1"
+	serverv1 "example/api/server"
+	terminalv1 "example/api/terminal"
 	v1 "example/api/user/v1"
 	"example/internal/conf"
 	"example/internal/service"
@@ -13,7 +17,12 @@ import (
 //
 // This function would read the configuration to configure the HTTP server well,
 // and then register the service to the HTTP server.
-func NewHTTPServer(c *conf.Server, s *service.TerminalService, m Middlewares) *http.Server {
+func NewHTTPServer(
+	c *conf.Server, s *service.UserService, ts *service.TerminalService, tgs *service.TerminalGroupService,
+	cs *service.CommandService, fs *service.FirmwareService, ss *service.ShadowService, sns *service.SensorService,
+	sts *service.SensorTypeService, sxs *service.SensorExportService, sas *service.SensorAnomalyService,
+	scs *service.SensorCalibrationService, vss *service.VirtualSensorService, as *service.AlertService,
+	ns *service.NotificationService, svs *service.ServerService, h *Health, m Middlewares) *http.Server {
 	// Here we tell the framework that we need these middlewares, and the framework would provide them automatically.
 	opts := []http.ServerOption{
 		http.Middleware(m...),
@@ -32,5 +41,33 @@ func NewHTTPServer(c *conf.Server, s *service.TerminalService, m Middlewares) *h
 	srv := http.NewServer(opts...)
 	srv.Handle("/metrics", promhttp.Handler())  // We shall register the Prometheus handler to the server as well
 	v1.RegisterUserManagementHTTPServer(srv, s) // Register the service handlers as well
+	terminalv1.RegisterTerminalManagementHTTPServer(srv, ts)
+	terminalv1.RegisterTerminalGroupsHTTPServer(srv, tgs)
+	terminalv1.RegisterTerminalCommandHTTPServer(srv, cs)
+	terminalv1.RegisterFirmwareUpdateHTTPServer(srv, fs)
+	terminalv1.RegisterTerminalShadowHTTPServer(srv, ss)
+	sensorv1.RegisterSensorServiceHTTPServer(srv, sns)
+	sensorv1.RegisterSensorTypesHTTPServer(srv, sts)
+	sensorv1.RegisterSensorExportsHTTPServer(srv, sxs)
+	sensorv1.RegisterSensorAnomaliesHTTPServer(srv, sas)
+	sensorv1.RegisterSensorCalibrationsHTTPServer(srv, scs)
+	sensorv1.RegisterVirtualSensorsHTTPServer(srv, vss)
+	alertv1.RegisterAlertingHTTPServer(srv, as)
+	alertv1.RegisterNotificationsHTTPServer(srv, ns)
+	serverv1.RegisterServerHTTPServer(srv, svs)
+	// The artifacts are streamed by plain handlers, since they are too large to be carried in a single message
+	r := srv.Route("/")
+	r.POST("/firmware/upload", fs.Upload)
+	r.GET("/firmware/{id}/download", fs.Download)
+	r.GET("/sensor/values/export", sxs.Export)
+	r.GET("/sensor/export/{id}/download", sxs.Download)
+	// The agents push the samples in their own formats, e.g. Telegraf by the InfluxDB 1.x or 2.x outputs, or
+	// Prometheus by the remote write
+	r.POST("/sensor/influx/write", sns.WriteInflux)
+	r.POST("/sensor/influx/api/v2/write", sns.WriteInflux)
+	r.POST("/sensor/prometheus/write", sns.WritePrometheus)
+	// Liveness and readiness probes of the orchestrator, e.g. Kubernetes
+	srv.HandleFunc("/healthz", h.Live)
+	srv.HandleFunc("/readyz", h.Ready)
 	return srv
 }
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"example/internal/conf"
+	"sync/atomic"
+
+	"github.com/go-kratos/aegis/ratelimit"
+	"github.com/go-kratos/aegis/ratelimit/bbr"
+	"google.golang.org/protobuf/proto"
+)
+
+// reloadableLimiter is the BBR limiter of the requests, which is rebuilt as its settings are reloaded
+type reloadableLimiter struct {
+	// limiter is nil if the rate limiting is disabled
+	limiter atomic.Pointer[bbr.BBR]
+}
+
+func newReloadableLimiter(live *conf.Live) *reloadableLimiter {
+	l := &reloadableLimiter{}
+	l.reset(live.Get().GetServer().GetRateLimit())
+	live.Observe(func(prev, next *conf.Bootstrap) {
+		if !proto.Equal(prev.GetServer().GetRateLimit(), next.GetServer().GetRateLimit()) {
+			l.reset(next.GetServer().GetRateLimit())
+		}
+	})
+	return l
+}
+
+func (l *reloadableLimiter) reset(c *conf.Server_RateLimit) {
+	if c.GetDisabled() {
+		l.limiter.Store(nil)
+		return
+	}
+	var opts []bbr.Option
+	if c.GetWindow().AsDuration() > 0 {
+		opts = append(opts, bbr.WithWindow(c.GetWindow().AsDuration()))
+	}
+	if c.GetBucket() > 0 {
+		opts = append(opts, bbr.WithBucket(int(c.GetBucket())))
+	}
+	if c.GetCpuThreshold() > 0 {
+		opts = append(opts, bbr.WithCPUThreshold(c.GetCpuThreshold()))
+	}
+	if c.GetCpuQuota() > 0 {
+		opts = append(opts, bbr.WithCPUQuota(c.GetCpuQuota()))
+	}
+	l.limiter.Store(bbr.NewLimiter(opts...))
+}
+
+// Allow implements the interface [ratelimit.Limiter]
+func (l *reloadableLimiter) Allow() (ratelimit.DoneFunc, error) {
+	limiter := l.limiter.Load()
+	if limiter == nil {
+		return func(ratelimit.DoneInfo) {}, nil
+	}
+	return limiter.Allow()
+}
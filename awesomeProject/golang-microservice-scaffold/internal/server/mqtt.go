@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	terminalv1 "example/api/terminal"
+	"example/internal/biz"
+	"example/internal/conf"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// MQTTServer bridges the MQTT broker with the business logic, so that the field devices speaking MQTT are managed
+// just like the ones calling the gRPC or HTTP APIs. The bridge subscribes to the following topics:
+//
+//   - terminals/{id}/status: status reports of the terminals, either a bare status, i.e. online or offline, or a
+//     JSON object with the status, the firmware version and the location, each of which is optional
+//   - sensors/{id}/values: readings of the sensors, either a bare value, a JSON object with the value and the
+//     timestamp, or a JSON array of such objects
+//   - terminals/{id}/cmd/ack and terminals/{id}/cmd/result: acknowledgements and results of the commands
+//
+// and publishes the commands queued for the terminals on terminals/{id}/cmd. Commands are only pushed to the
+// terminals which have published their status recently, since the others may be polling over HTTP instead.
+type MQTTServer struct {
+	client          mqtt.Client
+	qos             byte
+	prefix          string
+	connectTimeout  time.Duration
+	presenceTimeout time.Duration
+
+	terminals *biz.TerminalManager
+	commands  *biz.CommandManager
+	sensors   *biz.SensorManager
+	log       *log.Helper
+
+	mu       sync.Mutex
+	presence map[int]chan struct{} // Terminals known to speak MQTT, notified on each status report
+	stop     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+const (
+	defaultMQTTConnectTimeout  = 5 * time.Second
+	defaultMQTTPresenceTimeout = 5 * time.Minute
+	// Timeout of handling a single message or publishing a command
+	mqttHandleTimeout = 10 * time.Second
+)
+
+// NewMQTTServer creates the MQTT bridge. It returns nil if no broker is configured, in which case the bridge is
+// disabled.
+func NewMQTTServer(
+	c *conf.Server, terminals *biz.TerminalManager, commands *biz.CommandManager, sensors *biz.SensorManager,
+	logger log.Logger) *MQTTServer {
+	mc := c.GetMqtt()
+	if mc.GetBroker() == "" {
+		return nil
+	}
+	s := &MQTTServer{
+		qos:             byte(mc.Qos),
+		prefix:          mc.TopicPrefix,
+		connectTimeout:  durationOf(mc.ConnectTimeout, defaultMQTTConnectTimeout),
+		presenceTimeout: durationOf(mc.PresenceTimeout, defaultMQTTPresenceTimeout),
+		terminals:       terminals,
+		commands:        commands,
+		sensors:         sensors,
+		log:             log.NewHelper(log.With(logger, "module", "server/mqtt")),
+		presence:        make(map[int]chan struct{}),
+		stop:            make(chan struct{}),
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(mc.Broker).
+		SetClientID(mc.ClientId).
+		SetUsername(mc.Username).
+		SetPassword(mc.Password).
+		SetConnectTimeout(s.connectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		// Handle the messages concurrently, otherwise a slow database write would stall the whole bridge
+		SetOrderMatters(false).
+		// Subscriptions are renewed on every (re)connection
+		SetOnConnectHandler(s.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			s.log.Warnf("lost the connection to the broker: %v", err)
+		})
+	s.client = mqtt.NewClient(opts)
+	return s
+}
+
+// Start connects to the broker and blocks until the bridge is stopped. The client keeps retrying in the background
+// if the broker is unreachable, so that the service can start without it.
+func (s *MQTTServer) Start(context.Context) error {
+	if token := s.client.Connect(); !token.WaitTimeout(s.connectTimeout) {
+		s.log.Warn("the broker is unreachable, retrying in the background")
+	} else if err := token.Error(); err != nil {
+		s.log.Warnf("failed to connect to the broker: %v", err)
+	}
+	<-s.stop
+	return nil
+}
+
+// Stop disconnects from the broker after the command publishers exit
+func (s *MQTTServer) Stop(context.Context) error {
+	s.once.Do(func() { close(s.stop) })
+	s.wg.Wait()
+	s.client.Disconnect(uint(s.connectTimeout.Milliseconds()))
+	return nil
+}
+
+// Check tells whether the bridge is connected to the broker
+func (s *MQTTServer) Check(context.Context) error {
+	if !s.client.IsConnectionOpen() {
+		return errors.New("not connected to the broker")
+	}
+	return nil
+}
+
+func (s *MQTTServer) topic(format string, args ...any) string {
+	return s.prefix + fmt.Sprintf(format, args...)
+}
+
+func (s *MQTTServer) subscribe(client mqtt.Client) {
+	s.log.Info("connected to the broker")
+	filters := map[string]byte{
+		s.topic("terminals/+/status"):     s.qos,
+		s.topic("terminals/+/cmd/ack"):    s.qos,
+		s.topic("terminals/+/cmd/result"): s.qos,
+		s.topic("sensors/+/values"):       s.qos,
+	}
+	token := client.SubscribeMultiple(filters, s.route)
+	if token.WaitTimeout(s.connectTimeout) && token.Error() != nil {
+		s.log.Errorf("failed to subscribe to the topics: %v", token.Error())
+	}
+}
+
+// route dispatches a message to its handler according to the topic
+func (s *MQTTServer) route(_ mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), s.prefix), "/")
+	if len(parts) < 3 {
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id <= 0 {
+		s.log.Warnf("malformed id in topic %s", msg.Topic())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqttHandleTimeout)
+	defer cancel()
+	payload := bytes.TrimSpace(msg.Payload())
+	// Strip the id from the topic, e.g. terminals/42/cmd/ack becomes terminals/cmd/ack
+	switch parts[0] + "/" + strings.Join(parts[2:], "/") {
+	case "terminals/status":
+		err = s.handleStatus(ctx, id, payload)
+	case "terminals/cmd/ack":
+		err = s.handleAck(ctx, id, payload)
+	case "terminals/cmd/result":
+		err = s.handleResult(ctx, id, payload)
+	case "sensors/values":
+		err = s.handleValues(ctx, id, payload)
+	}
+	if err != nil {
+		s.log.Warnf("failed to handle the message on %s: %v", msg.Topic(), err)
+	}
+}
+
+// mqttStatus is the JSON representation of a status report. Only the fields reported by the terminal are decoded,
+// so that the terminal cannot change the settings owned by the server, e.g. its timeout. The stored status is kept
+// if the report has none, e.g. a heartbeat carrying the location only.
+type mqttStatus struct {
+	Status          *string         `json:"status"`
+	FirmwareVersion string          `json:"firmwareVersion"`
+	Location        json.RawMessage `json:"location"`
+}
+
+func (s *MQTTServer) handleStatus(ctx context.Context, id int, payload []byte) error {
+	stored, err := s.terminals.GetTerminalById(ctx, id)
+	if err != nil {
+		return err
+	}
+	t := &terminalv1.Terminal{Id: int64(id), Status: stored.Status}
+	if len(payload) > 0 && payload[0] == '{' {
+		var status mqttStatus
+		if err = json.Unmarshal(payload, &status); err != nil {
+			return err
+		}
+		if status.Status != nil {
+			t.Status = *status.Status
+		}
+		t.FirmwareVersion = status.FirmwareVersion
+		if len(status.Location) > 0 && string(status.Location) != "null" {
+			t.Location = &terminalv1.Location{}
+			if err = protojson.Unmarshal(status.Location, t.Location); err != nil {
+				return err
+			}
+		}
+	} else {
+		t.Status = string(payload)
+	}
+	if err = s.terminals.Update(ctx, t); err != nil {
+		return err
+	}
+	s.markPresent(id)
+	return nil
+}
+
+func (s *MQTTServer) handleAck(ctx context.Context, id int, payload []byte) error {
+	ack := &terminalv1.AckCommandRequest{}
+	if err := protojson.Unmarshal(payload, ack); err != nil {
+		return err
+	}
+	return s.commands.Acknowledge(ctx, id, ack.Id)
+}
+
+func (s *MQTTServer) handleResult(ctx context.Context, id int, payload []byte) error {
+	res := &terminalv1.CommandResult{}
+	if err := protojson.Unmarshal(payload, res); err != nil {
+		return err
+	}
+	return s.commands.Report(ctx, id, res.Id, res.Success, res.Result)
+}
+
+// mqttReading is the JSON representation of a sensor reading. The timestamp is optional.
+type mqttReading struct {
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (s *MQTTServer) handleValues(ctx context.Context, id int, payload []byte) error {
+	var raw []mqttReading
+	switch {
+	case len(payload) == 0:
+		return nil
+	case payload[0] == '[':
+		if err := json.Unmarshal(payload, &raw); err != nil {
+			return err
+		}
+	case payload[0] == '{':
+		raw = make([]mqttReading, 1)
+		if err := json.Unmarshal(payload, &raw[0]); err != nil {
+			return err
+		}
+	default:
+		v, err := strconv.ParseFloat(string(payload), 64)
+		if err != nil {
+			return err
+		}
+		raw = []mqttReading{{Value: v}}
+	}
+	readings := make([]*biz.SensorReading, 0, len(raw))
+	for _, r := range raw {
+		readings = append(readings, &biz.SensorReading{SensorId: id, Value: r.Value, Timestamp: r.Timestamp})
+	}
+	// The messages are handled one by one, so the readings are not waited for until they are flushed
+	_, err := s.sensors.Submit(ctx, readings...)
+	return err
+}
+
+// markPresent records that the terminal speaks MQTT and starts pushing the commands to it
+func (s *MQTTServer) markPresent(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.stop: // No more publishers once the bridge is stopping
+		return
+	default:
+	}
+	if seen, ok := s.presence[id]; ok {
+		select {
+		case seen <- struct{}{}:
+		default:
+		}
+		return
+	}
+	seen := make(chan struct{}, 1)
+	s.presence[id] = seen
+	s.wg.Add(1)
+	go s.pushCommands(id, seen)
+}
+
+// pushCommands publishes the commands queued for the terminal until it stops reporting its status
+func (s *MQTTServer) pushCommands(id int, seen chan struct{}) {
+	defer s.wg.Done()
+	notify, cancel := s.commands.Watch(id)
+	defer cancel()
+	recheck := time.NewTicker(s.commands.RecheckInterval())
+	defer recheck.Stop()
+	absent := time.NewTimer(s.presenceTimeout)
+	defer absent.Stop()
+	for {
+		if s.client.IsConnectionOpen() {
+			s.publishCommands(id)
+		}
+		select {
+		case <-notify:
+		case <-recheck.C:
+		case <-seen:
+			absent.Reset(s.presenceTimeout)
+		case <-absent.C:
+			s.mu.Lock()
+			select {
+			case <-seen: // Reported right before the timer fired
+				s.mu.Unlock()
+				absent.Reset(s.presenceTimeout)
+				continue
+			default:
+			}
+			delete(s.presence, id)
+			s.mu.Unlock()
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *MQTTServer) publishCommands(id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttHandleTimeout)
+	defer cancel()
+	cmds, err := s.commands.Claim(ctx, id, 0)
+	if err != nil {
+		s.log.Errorf("failed to claim the commands of terminal %d: %v", id, err)
+		return
+	}
+	for _, cmd := range cmds {
+		payload, err := protojson.Marshal(cmd)
+		if err != nil {
+			s.log.Errorf("failed to encode command %d: %v", cmd.Id, err)
+			continue
+		}
+		// A command which fails to be published is delivered again once its acknowledgement times out
+		token := s.client.Publish(s.topic("terminals/%d/cmd", id), s.qos, false, payload)
+		if !token.WaitTimeout(mqttHandleTimeout) {
+			s.log.Warnf("timed out publishing command %d", cmd.Id)
+		} else if err = token.Error(); err != nil {
+			s.log.Warnf("failed to publish command %d: %v", cmd.Id, err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	terminalv1 "example/api/terminal"
+	"example/internal/biz"
+	"example/internal/conf"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kratos/kratos/v2/log"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The fakes implement the methods used by the bridge only, and the others panic
+
+type fakeTerminals struct {
+	biz.TerminalRepository
+	mu      sync.Mutex
+	updates []*biz.Terminal
+}
+
+func (r *fakeTerminals) GetTerminalByID(_ context.Context, id int) (*biz.Terminal, error) {
+	return &biz.Terminal{Id: int64(id), Status: "offline", Timeout: 30}, nil
+}
+
+func (r *fakeTerminals) IsTerminalExist(context.Context, int) (bool, error) {
+	return true, nil
+}
+
+func (r *fakeTerminals) UpdateTerminal(_ context.Context, t *biz.Terminal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updates = append(r.updates, t)
+	return nil
+}
+
+func (r *fakeTerminals) lastUpdate() *biz.Terminal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.updates) == 0 {
+		return nil
+	}
+	return r.updates[len(r.updates)-1]
+}
+
+func (r *fakeTerminals) updated() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.updates)
+}
+
+type fakeSensors struct {
+	biz.SensorRepository
+	mu       sync.Mutex
+	readings []*biz.SensorReading
+}
+
+func (r *fakeSensors) FindSensorTypes(_ context.Context, ids []int) (map[int]string, error) {
+	types := make(map[int]string, len(ids))
+	for _, id := range ids {
+		types[id] = "temperature"
+	}
+	return types, nil
+}
+
+func (r *fakeSensors) AddValues(_ context.Context, readings []*biz.SensorReading) ([]*biz.SensorReading, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readings = append(r.readings, readings...)
+	return readings, nil
+}
+
+func (r *fakeSensors) MarkDirty(context.Context, []*biz.DirtyBucket) error {
+	return nil
+}
+
+func (r *fakeSensors) stored() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.readings)
+}
+
+type fakeSensorTypes struct{ biz.SensorTypeRepository }
+
+func (fakeSensorTypes) FindByNames(context.Context, []string) (map[string]*biz.SensorType, error) {
+	return nil, nil
+}
+
+type fakeCalibrations struct{ biz.CalibrationRepository }
+
+func (fakeCalibrations) FindBySensors(context.Context, []int) (map[int][]*biz.Calibration, error) {
+	return nil, nil
+}
+
+type fakeVirtuals struct{ biz.VirtualSensorRepository }
+
+func (fakeVirtuals) FindBySensors(context.Context, []int) (map[int]*biz.VirtualSensor, error) {
+	return nil, nil
+}
+
+type fakeLatest struct{}
+
+func (fakeLatest) Put(context.Context, []*biz.SensorReading) error {
+	return nil
+}
+
+func (fakeLatest) Get(context.Context, []int) (map[int]*biz.SensorReading, error) {
+	return nil, nil
+}
+
+type fakeCommands struct {
+	biz.CommandRepository
+	mu       sync.Mutex
+	commands map[int64]*biz.Command
+}
+
+func (r *fakeCommands) FindById(_ context.Context, id int64) (*biz.Command, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commands[id], nil
+}
+
+func (r *fakeCommands) ClaimPending(_ context.Context, terminalId int, _ int) ([]*biz.Command, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var claimed []*biz.Command
+	for _, cmd := range r.commands {
+		if cmd.TerminalId == int64(terminalId) && cmd.Status == terminalv1.Command_PENDING {
+			cmd.Status = terminalv1.Command_DELIVERED
+			claimed = append(claimed, cmd)
+		}
+	}
+	return claimed, nil
+}
+
+func (r *fakeCommands) Acknowledge(_ context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[id].AckTime = timestamppb.Now()
+	return nil
+}
+
+func (r *fakeCommands) Complete(_ context.Context, id int64, status terminalv1.Command_Status, result string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[id].Status, r.commands[id].Result = status, result
+	return nil
+}
+
+func (r *fakeCommands) statusOf(id int64) (terminalv1.Command_Status, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commands[id].Status, r.commands[id].AckTime != nil
+}
+
+type mqttFixture struct {
+	terminals *fakeTerminals
+	sensors   *fakeSensors
+	commands  *fakeCommands
+	device    mqtt.Client
+}
+
+// newMQTTFixture runs an embedded broker and the bridge connected to it, along with a device client
+func newMQTTFixture(t *testing.T) *mqttFixture {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	broker := mochi.New(&mochi.Options{})
+	_ = broker.AddHook(new(auth.AllowHook), nil)
+	if err = broker.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	if err = broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	f := &mqttFixture{
+		terminals: &fakeTerminals{},
+		sensors:   &fakeSensors{},
+		commands:  &fakeCommands{commands: make(map[int64]*biz.Command)},
+	}
+	logger := log.DefaultLogger
+	terminals := biz.NewTerminalManager(f.terminals, nil, nil, f.sensors, nil)
+	commands := biz.NewCommandManager(&conf.Terminal{}, f.commands, f.terminals, logger)
+	sensors := biz.NewSensorManager(
+		&conf.Sensor{}, f.sensors, fakeSensorTypes{}, fakeCalibrations{}, fakeVirtuals{}, fakeLatest{}, f.terminals,
+		logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = sensors.Write(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	s := NewMQTTServer(&conf.Server{Mqtt: &conf.Server_MQTT{Broker: "tcp://" + addr, ClientId: "bridge", Qos: 1}},
+		terminals, commands, sensors, logger)
+	go func() { _ = s.Start(context.Background()) }()
+	t.Cleanup(func() { _ = s.Stop(context.Background()) })
+	eventually(t, func() bool { return s.Check(context.Background()) == nil })
+
+	f.device = mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("device"))
+	if token := f.device.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to connect the device: %v", token.Error())
+	}
+	t.Cleanup(func() { f.device.Disconnect(0) })
+	return f
+}
+
+func (f *mqttFixture) publish(t *testing.T, topic string, payload string) {
+	t.Helper()
+	if token := f.device.Publish(topic, 1, false, payload); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to publish on %s: %v", topic, token.Error())
+	}
+}
+
+// eventually waits for the condition, since the messages are handled asynchronously
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTStatus(t *testing.T) {
+	f := newMQTTFixture(t)
+	tests := []struct {
+		name     string
+		payload  string
+		status   string
+		firmware string
+		located  bool
+	}{
+		{name: "bare status", payload: "online", status: "online"},
+		{
+			name:     "json",
+			payload:  `{"status":"online","firmwareVersion":"1.2.3","location":{"latitude":1.5,"longitude":2.5}}`,
+			status:   "online",
+			firmware: "1.2.3",
+			located:  true,
+		},
+		// The terminal cannot change the settings owned by the server
+		{name: "server-owned fields", payload: `{"status":"offline","timeout":1,"id":99}`, status: "offline"},
+		// The stored status is kept if the report has none
+		{
+			name:    "location only",
+			payload: `{"location":{"latitude":1.5,"longitude":2.5}}`,
+			status:  "offline",
+			located: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := f.terminals.updated()
+			f.publish(t, "terminals/42/status", tt.payload)
+			eventually(t, func() bool { return f.terminals.updated() > before })
+			u := f.terminals.lastUpdate()
+			if u.Status != tt.status {
+				t.Errorf("got status %q, want %q", u.Status, tt.status)
+			}
+			if u.Id != 42 || u.Timeout != 0 {
+				t.Errorf("got id %d and timeout %d, want 42 and 0", u.Id, u.Timeout)
+			}
+			if u.FirmwareVersion != tt.firmware {
+				t.Errorf("got firmware %q, want %q", u.FirmwareVersion, tt.firmware)
+			}
+			if (u.Location != nil) != tt.located {
+				t.Errorf("got location %v, want located %v", u.Location, tt.located)
+			}
+		})
+	}
+}
+
+func TestMQTTUnknownStatus(t *testing.T) {
+	f := newMQTTFixture(t)
+	// The messages are handled in order, so the unknown statuses have been dropped once the last one is recorded.
+	// A null status is absent, which keeps the stored one.
+	for _, payload := range []string{"busy", "", `{"status":"decommissioned"}`, `{"status":null}`, "online"} {
+		f.publish(t, "terminals/42/status", payload)
+	}
+	eventually(t, func() bool {
+		u := f.terminals.lastUpdate()
+		return u != nil && u.Status == "online"
+	})
+	if n := f.terminals.updated(); n != 2 {
+		t.Errorf("got %d updates, want 2", n)
+	}
+}
+
+func TestMQTTReadings(t *testing.T) {
+	f := newMQTTFixture(t)
+	f.publish(t, "sensors/7/values", "21.5")
+	f.publish(t, "sensors/7/values", `{"value":22,"timestamp":"2024-01-01T00:00:00Z"}`)
+	f.publish(t, "sensors/7/values", `[{"value":23},{"value":24}]`)
+	eventually(t, func() bool { return f.sensors.stored() == 4 })
+	f.sensors.mu.Lock()
+	defer f.sensors.mu.Unlock()
+	for _, r := range f.sensors.readings {
+		if r.SensorId != 7 || r.Timestamp.IsZero() {
+			t.Errorf("got reading of sensor %d at %v", r.SensorId, r.Timestamp)
+		}
+	}
+}
+
+func TestMQTTCommandRoundTrip(t *testing.T) {
+	f := newMQTTFixture(t)
+	f.commands.commands[5] = &biz.Command{
+		Id: 5, TerminalId: 42, Name: "reboot", Status: terminalv1.Command_PENDING,
+	}
+	received := make(chan *biz.Command, 1)
+	token := f.device.Subscribe("terminals/42/cmd", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		cmd := &biz.Command{}
+		if err := protojson.Unmarshal(msg.Payload(), cmd); err == nil {
+			received <- cmd
+		}
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("failed to subscribe: %v", token.Error())
+	}
+	// The commands are pushed once the terminal has shown up
+	f.publish(t, "terminals/42/status", "online")
+	var cmd *biz.Command
+	select {
+	case cmd = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the command")
+	}
+	if cmd.Id != 5 || cmd.Name != "reboot" {
+		t.Fatalf("got command %d %q, want 5 reboot", cmd.Id, cmd.Name)
+	}
+
+	f.publish(t, "terminals/42/cmd/ack", `{"id":"5"}`)
+	eventually(t, func() bool {
+		_, acked := f.commands.statusOf(5)
+		return acked
+	})
+	f.publish(t, "terminals/42/cmd/result", `{"id":"5","success":true,"result":"done"}`)
+	eventually(t, func() bool {
+		status, _ := f.commands.statusOf(5)
+		return status == terminalv1.Command_SUCCEEDED
+	})
+}
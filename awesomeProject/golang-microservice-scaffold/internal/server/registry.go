@@ -8,7 +8,8 @@ import (
 	etcdclient "go.etcd.io/etcd/client/v3"
 )
 
-func NewRegistry(c *conf.Registry) registry.Registrar {
+// NewEtcdClient connects to etcd, which serves as the registry
+func NewEtcdClient(c *conf.Registry) (*etcdclient.Client, func(), error) {
 	etcdClient, err := etcdclient.New(etcdclient.Config{ // Here we instantiate an etcd client
 		Endpoints:            c.Endpoints,
 		Username:             c.Username,
@@ -18,7 +19,11 @@ func NewRegistry(c *conf.Registry) registry.Registrar {
 		DialKeepAliveTimeout: c.DialKeepAliveTimeout.AsDuration(),
 	})
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	return etcdClient, func() { _ = etcdClient.Close() }, nil
+}
+
+func NewRegistry(etcdClient *etcdclient.Client) registry.Registrar {
 	return etcd.New(etcdClient)
 }
@@ -6,17 +6,28 @@ import (
 	"github.com/go-kratos/kratos/v2/middleware/ratelimit"
 	"github.com/go-kratos/kratos/v2/middleware/recovery"
 	"github.com/google/wire"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"time"
 )
 
 // ProviderSet is server providers.
 var ProviderSet = wire.NewSet(
 	NewGRPCServer, NewHTTPServer,
-	NewRegistry, NewMiddlewares,
+	NewEtcdClient, NewRegistry, NewMiddlewares,
+	NewWorkers, NewMQTTServer, NewHealth,
 )
 
+// durationOf returns the configured duration if it is set to a positive value, otherwise the default value
+func durationOf(d *durationpb.Duration, def time.Duration) time.Duration {
+	if d.AsDuration() <= 0 {
+		return def
+	}
+	return d.AsDuration()
+}
+
 type Middlewares []middleware.Middleware
 
-func NewMiddlewares(c *conf.Telemetry) (m Middlewares) {
+func NewMiddlewares(c *conf.Telemetry, live *conf.Live) (m Middlewares) {
 	m = make(Middlewares, 0, 4)
 	m = append(m,
 		// In a normal application, calling the function panic() would make the app exit.
@@ -24,8 +35,8 @@ func NewMiddlewares(c *conf.Telemetry) (m Middlewares) {
 		// by using the recovery middleware.
 		recovery.Recovery(),
 		// If the amount of requests exceeded the server's capabilities, we will reduce the number of requests
-		// sent to this service.
-		ratelimit.Server(),
+		// sent to this service. The limiter follows server.rate_limit as it is reloaded.
+		ratelimit.Server(ratelimit.WithLimiter(newReloadableLimiter(live))),
 	)
 	// Provide the metric capabilities to the framework. Metrics include the usage of hardware, runtime-related
 	// information (e.g. GC STW duration, number of goroutines, etc.), and many other aspects to help the
@@ -34,7 +45,7 @@ func NewMiddlewares(c *conf.Telemetry) (m Middlewares) {
 		m = append(m, NewMetricsMiddleware(c.Metrics))
 	}
 	if c.Traces.Enabled {
-		m = append(m, NewTracingMiddleware(c.Traces))
+		m = append(m, NewTracingMiddleware(c.Traces, live))
 	}
 	return
 }
@@ -8,14 +8,46 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/semconv/v1.4.0"
+	"sync/atomic"
 )
 
+// reloadableSampler samples the traces by the ratio which is reloaded at runtime. The traces whose parents are
+// sampled are always sampled.
+type reloadableSampler struct {
+	sampler atomic.Value
+}
+
+func newReloadableSampler(live *conf.Live) *reloadableSampler {
+	s := &reloadableSampler{}
+	s.reset(live.Get().GetTelemetry().GetTraces())
+	live.Observe(func(_, next *conf.Bootstrap) {
+		s.reset(next.GetTelemetry().GetTraces())
+	})
+	return s
+}
+
+func (s *reloadableSampler) reset(c *conf.Traces) {
+	rate := 1.0
+	if c != nil && c.SampleRate != nil {
+		rate = c.GetSampleRate()
+	}
+	s.sampler.Store(trace.ParentBased(trace.TraceIDRatioBased(rate)))
+}
+
+func (s *reloadableSampler) ShouldSample(p trace.SamplingParameters) trace.SamplingResult {
+	return s.sampler.Load().(trace.Sampler).ShouldSample(p)
+}
+
+func (s *reloadableSampler) Description() string {
+	return "Reloadable{" + s.sampler.Load().(trace.Sampler).Description() + "}"
+}
+
 // NewTracingMiddleware initializes the connection to tracing service endpoints.
 //
 // The objective of using distributed calling path tracer is to minimize the difficulty of debugging problems of
 // intro-service calls. Administrators can easily locate where the problem occurs via user-friendly graphic interfaces
 // with the help of tracer framework.
-func NewTracingMiddleware(traces *conf.Traces) middleware.Middleware {
+func NewTracingMiddleware(traces *conf.Traces, live *conf.Live) middleware.Middleware {
 	// Create a Jaeger exporter
 	exp, err := jaeger.New(
 		jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(traces.Endpoint)),
@@ -24,7 +56,7 @@ func NewTracingMiddleware(traces *conf.Traces) middleware.Middleware {
 		panic(err)
 	}
 	tp := trace.NewTracerProvider(
-		trace.WithSampler(trace.AlwaysSample()),
+		trace.WithSampler(newReloadableSampler(live)),
 		trace.WithBatcher(exp),
 		trace.WithResource(resource.NewSchemaless(
 			semconv.ServiceNameKey.String("example-service-trace"),
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"example/internal/biz"
+	"example/internal/conf"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/transport"
+)
+
+// Workers are the background jobs of the service. They are started and stopped along with the gRPC and HTTP servers,
+// since the application manages anything implementing [transport.Server] in the same way.
+type Workers []transport.Server
+
+// NewWorkers collects the background jobs of the business logic, as well as the optional transports which are
+// not part of the gRPC or HTTP servers.
+func NewWorkers(
+	c *conf.Terminal, tm *biz.TerminalManager, cmd *biz.CommandManager, fm *biz.FirmwareManager,
+	sc *conf.Sensor, sm *biz.SensorManager, xm *biz.SensorExportManager, cm *biz.CalibrationManager,
+	vm *biz.VirtualSensorManager, an *biz.AnomalyManager, ac *conf.Alert, am *biz.AlertManager,
+	nm *biz.NotificationManager, ms *MQTTServer, h *Health, logger log.Logger) Workers {
+	ws := Workers{
+		NewLoop("command-maintenance", c.GetCommand().GetSweepInterval().AsDuration(), cmd.Maintain, logger),
+		NewLoop("terminal-offline-sweep", c.GetOfflineSweepInterval().AsDuration(), tm.SweepOffline, logger),
+		NewLoop("campaign-maintenance", c.GetCampaign().GetSweepInterval().AsDuration(), fm.Maintain, logger),
+		NewRoutine("sensor-writer", sm.Write, logger),
+		NewLoop("sensor-compaction", sc.GetRetention().GetCompactionInterval().AsDuration(), sm.Compact, logger),
+		NewLoop("sensor-export", sc.GetExport().GetPollInterval().AsDuration(), xm.Run, logger),
+		NewLoop("sensor-recalibration", sc.GetCalibration().GetPollInterval().AsDuration(), cm.Run, logger),
+		NewRoutine("virtual-sensor-compute", vm.Run, logger),
+		NewRoutine("anomaly-detector", an.Run, logger),
+		NewRoutine("alert-evaluator", am.Run, logger),
+		NewLoop("alert-evaluation", ac.GetEvaluationInterval().AsDuration(), am.Evaluate, logger),
+		NewLoop("notification-delivery", ac.GetNotification().GetDeliveryInterval().AsDuration(), nm.Deliver, logger),
+	}
+	if sc.GetSnapshot().GetRebuildOnStart() {
+		ws = append(ws, NewRoutine("sensor-latest-rebuild", sm.RebuildLatest, logger))
+	}
+	if ms != nil {
+		ws = append(ws, ms)
+	}
+	// The dependencies are checked in the background, so that the probes are answered by the cached results
+	ws = append(ws, h)
+	return ws
+}
+
+// defaultLoopInterval is used when the interval of a loop is not configured
+const defaultLoopInterval = 10 * time.Second
+
+// Loop runs a job periodically until the application stops. An error returned by the job is logged, and the job
+// runs again on the next tick.
+type Loop struct {
+	name     string
+	interval time.Duration
+	job      func(ctx context.Context) error
+	log      *log.Helper
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewLoop(name string, interval time.Duration, job func(ctx context.Context) error, logger log.Logger) *Loop {
+	if interval <= 0 {
+		interval = defaultLoopInterval
+	}
+	return &Loop{
+		name:     name,
+		interval: interval,
+		job:      job,
+		log:      log.NewHelper(log.With(logger, "worker", name)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the job every interval and blocks until the loop is stopped
+func (l *Loop) Start(context.Context) error {
+	defer close(l.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.stop:
+			cancel() // Abort the running job
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.job(ctx); err != nil && ctx.Err() == nil {
+				l.log.Errorf("job failed: %v", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Stop stops the loop and waits for the running job to return
+func (l *Loop) Stop(ctx context.Context) error {
+	l.once.Do(func() { close(l.stop) })
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Routine runs a job which schedules itself until the application stops. The job is expected to return once its
+// context is done, and an error returned before that stops the application.
+type Routine struct {
+	name string
+	job  func(ctx context.Context) error
+	log  *log.Helper
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewRoutine(name string, job func(ctx context.Context) error, logger log.Logger) *Routine {
+	return &Routine{
+		name: name,
+		job:  job,
+		log:  log.NewHelper(log.With(logger, "worker", name)),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Start runs the job and blocks until it returns
+func (r *Routine) Start(context.Context) error {
+	defer close(r.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := r.job(ctx); err != nil && ctx.Err() == nil {
+		r.log.Errorf("job failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Stop asks the job to return and waits for it
+func (r *Routine) Stop(ctx context.Context) error {
+	r.once.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/alert/v1"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// AlertService maintains the alert rules and the silences, and exposes the alerts fired by the rules
+type AlertService struct {
+	v1.UnimplementedAlertingServer
+	mgr *biz.AlertManager
+}
+
+func NewAlertService(mgr *biz.AlertManager) *AlertService {
+	return &AlertService{mgr: mgr}
+}
+
+func (s *AlertService) CreateAlertRule(ctx context.Context, rule *v1.AlertRule) (*v1.AlertRule, error) {
+	if valid := rule.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert rule: %v", valid)
+	}
+	return s.mgr.CreateRule(ctx, rule)
+}
+
+func (s *AlertService) GetAlertRule(ctx context.Context, id *v1.AlertRuleId) (*v1.AlertRule, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert rule id: %v", valid)
+	}
+	return s.mgr.GetRule(ctx, int(id.Id))
+}
+
+func (s *AlertService) ListAlertRules(
+	ctx context.Context, req *v1.ListAlertRulesRequest) (*v1.ListAlertRulesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	rules, total, err := s.mgr.ListRules(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListAlertRulesReply{Rules: rules, Total: int32(total)}, nil
+}
+
+func (s *AlertService) UpdateAlertRule(ctx context.Context, rule *v1.AlertRule) (*v1.AlertRule, error) {
+	if valid := rule.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert rule: %v", valid)
+	}
+	if rule.Id <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed alert rule id %v", rule.Id)
+	}
+	return s.mgr.UpdateRule(ctx, rule)
+}
+
+func (s *AlertService) DeleteAlertRule(ctx context.Context, id *v1.AlertRuleId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert rule id: %v", valid)
+	}
+	err = s.mgr.DeleteRule(ctx, int(id.Id))
+	return
+}
+
+func (s *AlertService) CreateSilence(ctx context.Context, silence *v1.Silence) (*v1.Silence, error) {
+	if valid := silence.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed silence: %v", valid)
+	}
+	return s.mgr.CreateSilence(ctx, silence)
+}
+
+func (s *AlertService) ListSilences(ctx context.Context, req *v1.ListSilencesRequest) (*v1.ListSilencesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	silences, total, err := s.mgr.ListSilences(
+		ctx, req.IncludeExpired, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListSilencesReply{Silences: silences, Total: int32(total)}, nil
+}
+
+func (s *AlertService) DeleteSilence(ctx context.Context, id *v1.SilenceId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed silence id: %v", valid)
+	}
+	err = s.mgr.DeleteSilence(ctx, int(id.Id))
+	return
+}
+
+func (s *AlertService) ListAlerts(ctx context.Context, req *v1.ListAlertsRequest) (*v1.ListAlertsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	alerts, total, err := s.mgr.ListAlerts(ctx, &biz.AlertQuery{
+		Statuses:        req.Status,
+		RuleId:          int(req.RuleId),
+		IncludeSilenced: req.IncludeSilenced,
+		Offset:          int(req.Page * req.PageSize),
+		Limit:           int(req.PageSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListAlertsReply{Alerts: alerts, Total: int32(total)}, nil
+}
+
+func (s *AlertService) GetAlert(ctx context.Context, id *v1.AlertId) (*v1.Alert, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert id: %v", valid)
+	}
+	return s.mgr.GetAlert(ctx, int(id.Id))
+}
+
+func (s *AlertService) AcknowledgeAlert(ctx context.Context, req *v1.AcknowledgeAlertRequest) (*v1.Alert, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.Acknowledge(ctx, int(req.Id), req.By, req.Comment)
+}
+
+func (s *AlertService) DeleteAlert(ctx context.Context, id *v1.AlertId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed alert id: %v", valid)
+	}
+	err = s.mgr.DeleteAlert(ctx, int(id.Id))
+	return
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"io"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// CommandService is the command-and-control channel of the terminals. The operators queue the commands, while the
+// terminals fetch them by long polling or over a bidirectional stream.
+type CommandService struct {
+	v1.UnimplementedTerminalCommandServer
+	mgr       *biz.CommandManager
+	terminals *biz.TerminalManager
+	log       *log.Helper
+}
+
+func NewCommandService(mgr *biz.CommandManager, terminals *biz.TerminalManager, logger log.Logger) *CommandService {
+	return &CommandService{
+		mgr:       mgr,
+		terminals: terminals,
+		log:       log.NewHelper(log.With(logger, "module", "service/command")),
+	}
+}
+
+func (s *CommandService) SendCommand(ctx context.Context, req *v1.SendCommandRequest) (*v1.Command, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed command: %v", valid)
+	}
+	return s.mgr.Send(ctx, req)
+}
+
+// BulkSendCommand queues a command for each of the selected terminals
+func (s *CommandService) BulkSendCommand(ctx context.Context, req *v1.BulkSendCommandRequest) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed command: %v", valid)
+	}
+	return s.terminals.Bulk(ctx, req.Selector, func(ctx context.Context, t *biz.Terminal, res *biz.BulkResult) error {
+		cmd, err := s.mgr.Send(ctx, &v1.SendCommandRequest{
+			TerminalId: t.Id,
+			Name:       req.Name,
+			Payload:    req.Payload,
+			Ttl:        req.Ttl,
+			MaxRetries: req.MaxRetries,
+		})
+		if err != nil {
+			return err
+		}
+		res.CommandId = cmd.Id
+		return nil
+	})
+}
+
+func (s *CommandService) GetCommand(ctx context.Context, id *v1.CommandId) (*v1.Command, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed command id: %v", valid)
+	}
+	return s.mgr.GetById(ctx, id.Id)
+}
+
+func (s *CommandService) ListCommands(ctx context.Context, req *v1.ListCommandsRequest) (*v1.ListCommandsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	filter := &biz.CommandFilter{
+		Status: req.Status,
+		Offset: int(req.Page * req.PageSize),
+		Limit:  int(req.PageSize),
+	}
+	cmds, total, err := s.mgr.List(ctx, int(req.TerminalId), filter)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListCommandsReply{Commands: cmds, Total: int32(total)}, nil
+}
+
+func (s *CommandService) PollCommands(ctx context.Context, req *v1.PollCommandsRequest) (*v1.PollCommandsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	if _, err := s.terminals.GetTerminalById(ctx, int(req.TerminalId)); err != nil {
+		return nil, err
+	}
+	var wait time.Duration
+	if req.Wait != nil {
+		wait = req.Wait.AsDuration()
+	}
+	cmds, err := s.mgr.Poll(ctx, int(req.TerminalId), wait, int(req.Limit))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.PollCommandsReply{Commands: cmds}, nil
+}
+
+func (s *CommandService) AckCommand(ctx context.Context, req *v1.AckCommandRequest) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed acknowledgement: %v", valid)
+	}
+	err = s.mgr.Acknowledge(ctx, int(req.TerminalId), req.Id)
+	return
+}
+
+func (s *CommandService) ReportCommandResult(
+	ctx context.Context, res *v1.CommandResult) (empty *emptypb.Empty, err error) {
+	if valid := res.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed result: %v", valid)
+	}
+	err = s.mgr.Report(ctx, int(res.TerminalId), res.Id, res.Success, res.Result)
+	return
+}
+
+// CommandChannel pushes the commands to the terminal as soon as they are queued, and receives the acknowledgements
+// and the results on the same stream.
+func (s *CommandService) CommandChannel(stream v1.TerminalCommand_CommandChannelServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if valid := first.Validate(); valid != nil {
+		return v1.ErrorMalformedInput("Malformed message: %v", valid)
+	}
+	hello := first.GetHello()
+	if hello == nil {
+		return v1.ErrorMalformedInput("The first message on the stream must be a hello message")
+	}
+	terminalId := int(hello.TerminalId)
+	if _, err = s.terminals.GetTerminalById(ctx, terminalId); err != nil {
+		return err
+	}
+
+	// Subscribe before the first delivery so that no command queued in between is missed
+	notify, cancel := s.mgr.Watch(terminalId)
+	defer cancel()
+	recheck := time.NewTicker(s.mgr.RecheckInterval())
+	defer recheck.Stop()
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err == nil {
+				err = s.handleDeviceMessage(ctx, terminalId, msg)
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		cmds, err := s.mgr.Claim(ctx, terminalId, 0)
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			// A command lost on a broken stream is delivered again once its acknowledgement times out
+			if err = stream.Send(cmd); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-notify:
+		case <-recheck.C:
+		case err = <-received:
+			if err == io.EOF { // The terminal closed the stream
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// handleDeviceMessage handles an acknowledgement or a result sent on the stream. Rejected messages, e.g. a late
+// acknowledgement of an expired command, are logged without breaking the stream.
+func (s *CommandService) handleDeviceMessage(ctx context.Context, terminalId int, msg *v1.DeviceMessage) (err error) {
+	if valid := msg.Validate(); valid != nil {
+		s.log.Warnf("malformed message from terminal %d: %v", terminalId, valid)
+		return nil
+	}
+	switch m := msg.Message.(type) {
+	case *v1.DeviceMessage_Ack:
+		err = s.mgr.Acknowledge(ctx, terminalId, m.Ack.Id)
+	case *v1.DeviceMessage_Result:
+		err = s.mgr.Report(ctx, terminalId, m.Result.Id, m.Result.Success, m.Result.Result)
+	default:
+		s.log.Warnf("unexpected message from terminal %d: %T", terminalId, m)
+	}
+	if e := errors.FromError(err); e != nil && e.Code < 500 {
+		s.log.Warnf("rejected message from terminal %d: %v", terminalId, err)
+		return nil
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+	"fmt"
+	"io"
+	"mime/multipart"
+	nethttp "net/http"
+	"strconv"
+
+	"github.com/go-kratos/kratos/v2/transport/http"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// FirmwareService maintains the firmware catalog and rolls out the firmware to the terminals. Besides the gRPC and
+// HTTP APIs, the artifacts are uploaded and downloaded by the plain HTTP handlers [FirmwareService.Upload] and
+// [FirmwareService.Download].
+type FirmwareService struct {
+	v1.UnimplementedFirmwareUpdateServer
+	mgr *biz.FirmwareManager
+}
+
+func NewFirmwareService(mgr *biz.FirmwareManager) *FirmwareService {
+	return &FirmwareService{mgr: mgr}
+}
+
+// maxFormFieldSize limits the size of the text fields of the upload form
+const maxFormFieldSize = 64 << 10
+
+// Upload adds a firmware to the catalog from a multipart form carrying the fields "version" and "release_notes",
+// followed by the artifact in the field "file". The artifact is streamed into the store without being buffered, so
+// the text fields must precede it.
+func (s *FirmwareService) Upload(ctx http.Context) error {
+	reader, err := ctx.Request().MultipartReader()
+	if err != nil {
+		return v1.ErrorMalformedInput("Malformed upload form: %v", err)
+	}
+	var version, releaseNotes string
+	for {
+		var part *multipart.Part
+		if part, err = reader.NextPart(); err == io.EOF {
+			return v1.ErrorMalformedInput("The upload form has no file")
+		} else if err != nil {
+			return v1.ErrorMalformedInput("Malformed upload form: %v", err)
+		}
+		switch part.FormName() {
+		case "version", "release_notes":
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			if err != nil {
+				return v1.ErrorMalformedInput("Malformed upload form: %v", err)
+			}
+			if part.FormName() == "version" {
+				version = string(value)
+			} else {
+				releaseNotes = string(value)
+			}
+		case "file":
+			firmware, err := s.mgr.Upload(ctx, version, releaseNotes, part)
+			if err != nil {
+				return err
+			}
+			return ctx.Result(nethttp.StatusOK, firmware)
+		}
+	}
+}
+
+// Download serves the artifact of a firmware. Range requests are supported, so that the terminals may resume an
+// interrupted download.
+func (s *FirmwareService) Download(ctx http.Context) error {
+	id, err := strconv.Atoi(ctx.Vars().Get("id"))
+	if err != nil || id <= 0 {
+		return v1.ErrorMalformedInput("Malformed firmware id %v", ctx.Vars().Get("id"))
+	}
+	firmware, artifact, err := s.mgr.OpenArtifact(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer artifact.Close()
+	header := ctx.Response().Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "firmware-"+firmware.Version+".bin"))
+	header.Set("ETag", strconv.Quote(firmware.Sha256))
+	nethttp.ServeContent(ctx.Response(), ctx.Request(), "", firmware.CreateTime.AsTime(), artifact)
+	return nil
+}
+
+func (s *FirmwareService) GetFirmware(ctx context.Context, id *v1.FirmwareId) (*v1.Firmware, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed firmware id: %v", valid)
+	}
+	return s.mgr.GetFirmware(ctx, int(id.Id))
+}
+
+func (s *FirmwareService) ListFirmware(
+	ctx context.Context, req *v1.ListFirmwareRequest) (*v1.ListFirmwareReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	firmware, total, err := s.mgr.ListFirmware(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListFirmwareReply{Firmware: firmware, Total: int32(total)}, nil
+}
+
+func (s *FirmwareService) DeleteFirmware(ctx context.Context, id *v1.FirmwareId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed firmware id: %v", valid)
+	}
+	err = s.mgr.DeleteFirmware(ctx, int(id.Id))
+	return
+}
+
+func (s *FirmwareService) CreateCampaign(ctx context.Context, req *v1.CreateCampaignRequest) (*v1.Campaign, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed campaign: %v", valid)
+	}
+	return s.mgr.CreateCampaign(ctx, req)
+}
+
+func (s *FirmwareService) GetCampaign(ctx context.Context, id *v1.CampaignId) (*v1.Campaign, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed campaign id: %v", valid)
+	}
+	return s.mgr.GetCampaign(ctx, int(id.Id))
+}
+
+func (s *FirmwareService) ListCampaigns(
+	ctx context.Context, req *v1.ListCampaignsRequest) (*v1.ListCampaignsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	campaigns, total, err := s.mgr.ListCampaigns(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListCampaignsReply{Campaigns: campaigns, Total: int32(total)}, nil
+}
+
+func (s *FirmwareService) ListCampaignUpdates(
+	ctx context.Context, req *v1.ListCampaignUpdatesRequest) (*v1.ListCampaignUpdatesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	updates, total, err := s.mgr.ListUpdates(
+		ctx, int(req.CampaignId), req.Status, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListCampaignUpdatesReply{Updates: updates, Total: int32(total)}, nil
+}
+
+func (s *FirmwareService) PauseCampaign(ctx context.Context, id *v1.CampaignId) (*v1.Campaign, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed campaign id: %v", valid)
+	}
+	return s.mgr.Pause(ctx, int(id.Id))
+}
+
+func (s *FirmwareService) ResumeCampaign(ctx context.Context, id *v1.CampaignId) (*v1.Campaign, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed campaign id: %v", valid)
+	}
+	return s.mgr.Resume(ctx, int(id.Id))
+}
+
+func (s *FirmwareService) RollbackCampaign(ctx context.Context, id *v1.CampaignId) (*v1.Campaign, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed campaign id: %v", valid)
+	}
+	return s.mgr.Rollback(ctx, int(id.Id))
+}
+
+func (s *FirmwareService) CheckForUpdate(
+	ctx context.Context, req *v1.CheckForUpdateRequest) (*v1.CheckForUpdateReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.CheckForUpdate(ctx, int(req.TerminalId), req.CurrentVersion)
+}
+
+func (s *FirmwareService) ReportUpdateProgress(
+	ctx context.Context, progress *v1.UpdateProgress) (empty *emptypb.Empty, err error) {
+	if valid := progress.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed progress: %v", valid)
+	}
+	err = s.mgr.ReportProgress(ctx, progress)
+	return
+}
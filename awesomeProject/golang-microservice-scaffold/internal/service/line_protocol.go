@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"example/internal/biz"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// influxPrecisions convert the timestamps of the InfluxDB line protocol by the precision parameters of both the
+// 1.x and 2.x write endpoints, where nanoseconds are the default
+var influxPrecisions = map[string]func(int64) time.Time{
+	"":   func(ts int64) time.Time { return time.Unix(0, ts) },
+	"n":  func(ts int64) time.Time { return time.Unix(0, ts) },
+	"ns": func(ts int64) time.Time { return time.Unix(0, ts) },
+	"u":  time.UnixMicro,
+	"us": time.UnixMicro,
+	"ms": time.UnixMilli,
+	"s":  func(ts int64) time.Time { return time.Unix(ts, 0) },
+	"m":  func(ts int64) time.Time { return time.Unix(ts*60, 0) },
+	"h":  func(ts int64) time.Time { return time.Unix(ts*3600, 0) },
+}
+
+// influxValueField is the field whose series is named after the measurement alone
+const influxValueField = "value"
+
+// parseLineProtocol parses the points of the InfluxDB line protocol, each numeric or boolean field of which is a
+// sample of the series named after the measurement and the field. The string fields are skipped.
+func parseLineProtocol(data []byte, timeOf func(int64) time.Time) ([]*biz.SensorSample, error) {
+	var samples []*biz.SensorSample
+	for n := 1; len(data) > 0; n++ {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var err error
+		if samples, err = parseLine(samples, line, timeOf); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	return samples, nil
+}
+
+// parseLine appends the samples of a line, i.e. measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(
+	samples []*biz.SensorSample, line []byte, timeOf func(int64) time.Time) ([]*biz.SensorSample, error) {
+	measurement, i := scanToken(line, 0, ", ")
+	if measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+	tags := make(map[string]string)
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		if key, i = scanToken(line, i+1, "="); i >= len(line) || key == "" {
+			return nil, errors.New("malformed tag")
+		}
+		if value, i = scanToken(line, i+1, ", "); value == "" {
+			return nil, fmt.Errorf("missing value of tag %s", key)
+		}
+		tags[key] = value
+	}
+	i = skipSpaces(line, i)
+	first := len(samples)
+	for {
+		var key string
+		if key, i = scanToken(line, i, "="); i >= len(line) || key == "" {
+			return nil, errors.New("malformed field")
+		}
+		i++
+		if i < len(line) && line[i] == '"' {
+			// A string field may hold any of the delimiters, and is skipped as it is no reading
+			if i = skipString(line, i+1); i < 0 {
+				return nil, fmt.Errorf("unterminated string of field %s", key)
+			}
+		} else {
+			var raw string
+			raw, i = scanToken(line, i, ", ")
+			value, err := parseFieldValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("malformed value of field %s: %w", key, err)
+			}
+			name := measurement
+			if key != influxValueField {
+				name += "_" + key
+			}
+			samples = append(samples, &biz.SensorSample{Name: name, Tags: tags, Value: value})
+		}
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+	if i = skipSpaces(line, i); i < len(line) {
+		ts, err := strconv.ParseInt(string(bytes.TrimSpace(line[i:])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed timestamp: %w", err)
+		}
+		t := timeOf(ts)
+		for _, s := range samples[first:] {
+			s.Timestamp = t
+		}
+	}
+	return samples, nil
+}
+
+// scanToken reads the token from the offset up to any of the unescaped delimiters, and returns it unescaped along
+// with the offset of the delimiter
+func scanToken(line []byte, i int, delimiters string) (string, int) {
+	var b []byte
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			// Only the delimiters and the backslash itself are escaped, otherwise the backslash is kept as it is
+			if next := line[i+1]; next == '\\' || next == ',' || next == '=' || next == ' ' || next == '"' {
+				b = append(b, next)
+				i++
+				continue
+			}
+		}
+		if bytes.IndexByte([]byte(delimiters), c) >= 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b), i
+}
+
+// skipString skips a string from the offset after its opening quote, and returns the offset after its closing one,
+// which is negative if it is unterminated
+func skipString(line []byte, i int) int {
+	for ; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func skipSpaces(line []byte, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// parseFieldValue parses a float, an integer suffixed by i, an unsigned integer suffixed by u, or a boolean, which is
+// either 1 or 0
+func parseFieldValue(raw string) (float64, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	case "":
+		return 0, errors.New("missing value")
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(raw, 64)
+}
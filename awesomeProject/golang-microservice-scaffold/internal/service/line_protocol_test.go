@@ -0,0 +1,124 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example/internal/biz"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	ts := time.Unix(0, 1700000000000000000)
+	tests := []struct {
+		name  string
+		input string
+		want  []*biz.SensorSample
+	}{
+		{name: "value field", input: "temperature value=21.5",
+			want: []*biz.SensorSample{{Name: "temperature", Tags: map[string]string{}, Value: 21.5}}},
+		{name: "fields and tags", input: "weather,station=a,room=b temp=1,hum=2i 1700000000000000000",
+			want: []*biz.SensorSample{
+				{Name: "weather_temp", Tags: map[string]string{"station": "a", "room": "b"}, Value: 1, Timestamp: ts},
+				{Name: "weather_hum", Tags: map[string]string{"station": "a", "room": "b"}, Value: 2, Timestamp: ts},
+			}},
+		{name: "types", input: "m a=3u,b=t,c=FALSE,d=-1.5e2", want: []*biz.SensorSample{
+			{Name: "m_a", Tags: map[string]string{}, Value: 3},
+			{Name: "m_b", Tags: map[string]string{}, Value: 1},
+			{Name: "m_c", Tags: map[string]string{}, Value: 0},
+			{Name: "m_d", Tags: map[string]string{}, Value: -150},
+		}},
+		{name: "escaping", input: `my\ room,the\,tag=a\=b\ c value=1`, want: []*biz.SensorSample{
+			{Name: "my room", Tags: map[string]string{"the,tag": "a=b c"}, Value: 1},
+		}},
+		{name: "backslash kept", input: `path,dir=C:\temp value=1`, want: []*biz.SensorSample{
+			{Name: "path", Tags: map[string]string{"dir": `C:\temp`}, Value: 1},
+		}},
+		// The string fields may hold the delimiters and escaped quotes, and are skipped
+		{name: "quoted fields", input: `m note="a, b=\"c\" d",value=2 1700000000000000000`, want: []*biz.SensorSample{
+			{Name: "m", Tags: map[string]string{}, Value: 2, Timestamp: ts},
+		}},
+		{name: "comments and blank lines", input: "# comment\n\n  m value=1  \r\nm value=2\n",
+			want: []*biz.SensorSample{
+				{Name: "m", Tags: map[string]string{}, Value: 1},
+				{Name: "m", Tags: map[string]string{}, Value: 2},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples, err := parseLineProtocol([]byte(tt.input), influxPrecisions[""])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(samples, tt.want) {
+				t.Errorf("got %v, want %v", samples, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLineProtocolPrecision(t *testing.T) {
+	tests := map[string]time.Time{
+		"":   time.Unix(0, 1700000000),
+		"ns": time.Unix(0, 1700000000),
+		"us": time.UnixMicro(1700000000),
+		"ms": time.UnixMilli(1700000000),
+		"s":  time.Unix(1700000000, 0),
+		"m":  time.Unix(1700000000*60, 0),
+		"h":  time.Unix(1700000000*3600, 0),
+	}
+	for precision, want := range tests {
+		samples, err := parseLineProtocol([]byte("m value=1 1700000000"), influxPrecisions[precision])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samples[0].Timestamp.Equal(want) {
+			t.Errorf("precision %q: got %v, want %v", precision, samples[0].Timestamp, want)
+		}
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing measurement":  ",a=b value=1",
+		"malformed tag":        "m,a value=1",
+		"missing tag value":    "m,a= value=1",
+		"missing field":        "m",
+		"malformed field":      "m value",
+		"missing value":        "m value=",
+		"malformed value":      "m value=abc",
+		"malformed integer":    "m value=1.5i",
+		"unterminated string":  `m note="abc`,
+		"malformed timestamp":  "m value=1 12:00",
+		"second line":          "m value=1\nm value=x",
+		"integer out of range": "m value=99999999999999999999i",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if samples, err := parseLineProtocol([]byte(input), influxPrecisions[""]); err == nil {
+				t.Errorf("got %v, want an error", samples)
+			}
+		})
+	}
+	if _, err := parseLineProtocol([]byte("m value=1\nm value=x"), influxPrecisions[""]); err == nil ||
+		!strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("got error %v, want it on line 2", err)
+	}
+}
+
+func FuzzParseLineProtocol(f *testing.F) {
+	f.Add("weather,station=a temp=1,hum=2i,ok=t,note=\"x, y\" 1700000000000000000")
+	f.Add(`my\ room,the\,tag=a\=b value=1`)
+	f.Fuzz(func(t *testing.T, input string) {
+		samples, err := parseLineProtocol([]byte(input), influxPrecisions[""])
+		if err != nil {
+			return
+		}
+		for _, s := range samples {
+			if s.Name == "" || s.Tags == nil {
+				t.Fatalf("got sample %+v", s)
+			}
+		}
+	})
+}
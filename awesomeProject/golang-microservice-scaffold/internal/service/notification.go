@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/alert/v1"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// NotificationService maintains the notification channels and routes, and exposes the deliveries
+type NotificationService struct {
+	v1.UnimplementedNotificationsServer
+	mgr *biz.NotificationManager
+}
+
+func NewNotificationService(mgr *biz.NotificationManager) *NotificationService {
+	return &NotificationService{mgr: mgr}
+}
+
+func (s *NotificationService) CreateChannel(ctx context.Context, channel *v1.Channel) (*v1.Channel, error) {
+	if valid := channel.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed channel: %v", valid)
+	}
+	return s.mgr.CreateChannel(ctx, channel)
+}
+
+func (s *NotificationService) GetChannel(ctx context.Context, id *v1.ChannelId) (*v1.Channel, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed channel id: %v", valid)
+	}
+	return s.mgr.GetChannel(ctx, int(id.Id))
+}
+
+func (s *NotificationService) ListChannels(
+	ctx context.Context, req *v1.ListChannelsRequest) (*v1.ListChannelsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	channels, total, err := s.mgr.ListChannels(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListChannelsReply{Channels: channels, Total: int32(total)}, nil
+}
+
+func (s *NotificationService) UpdateChannel(ctx context.Context, channel *v1.Channel) (*v1.Channel, error) {
+	if valid := channel.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed channel: %v", valid)
+	}
+	if channel.Id <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed channel id %v", channel.Id)
+	}
+	return s.mgr.UpdateChannel(ctx, channel)
+}
+
+func (s *NotificationService) DeleteChannel(ctx context.Context, id *v1.ChannelId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed channel id: %v", valid)
+	}
+	err = s.mgr.DeleteChannel(ctx, int(id.Id))
+	return
+}
+
+func (s *NotificationService) TestChannel(ctx context.Context, id *v1.ChannelId) (*v1.TestChannelReply, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed channel id: %v", valid)
+	}
+	return s.mgr.TestChannel(ctx, int(id.Id))
+}
+
+func (s *NotificationService) CreateRoute(ctx context.Context, route *v1.Route) (*v1.Route, error) {
+	if valid := route.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed route: %v", valid)
+	}
+	return s.mgr.CreateRoute(ctx, route)
+}
+
+func (s *NotificationService) GetRoute(ctx context.Context, id *v1.RouteId) (*v1.Route, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed route id: %v", valid)
+	}
+	return s.mgr.GetRoute(ctx, int(id.Id))
+}
+
+func (s *NotificationService) ListRoutes(ctx context.Context, req *v1.ListRoutesRequest) (*v1.ListRoutesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	routes, total, err := s.mgr.ListRoutes(
+		ctx, int(req.ChannelId), int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListRoutesReply{Routes: routes, Total: int32(total)}, nil
+}
+
+func (s *NotificationService) UpdateRoute(ctx context.Context, route *v1.Route) (*v1.Route, error) {
+	if valid := route.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed route: %v", valid)
+	}
+	if route.Id <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed route id %v", route.Id)
+	}
+	return s.mgr.UpdateRoute(ctx, route)
+}
+
+func (s *NotificationService) DeleteRoute(ctx context.Context, id *v1.RouteId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed route id: %v", valid)
+	}
+	err = s.mgr.DeleteRoute(ctx, int(id.Id))
+	return
+}
+
+func (s *NotificationService) GetDelivery(ctx context.Context, id *v1.DeliveryId) (*v1.Delivery, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed delivery id: %v", valid)
+	}
+	return s.mgr.GetDelivery(ctx, int(id.Id))
+}
+
+func (s *NotificationService) ListDeliveries(
+	ctx context.Context, req *v1.ListDeliveriesRequest) (*v1.ListDeliveriesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	deliveries, total, err := s.mgr.ListDeliveries(ctx, &biz.DeliveryQuery{
+		AlertId:   int(req.AlertId),
+		ChannelId: int(req.ChannelId),
+		Statuses:  req.Status,
+		Offset:    int(req.Page * req.PageSize),
+		Limit:     int(req.PageSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListDeliveriesReply{Deliveries: deliveries, Total: int32(total)}, nil
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"example/internal/biz"
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// This file decodes the requests of the Prometheus remote write 1.0, i.e. a WriteRequest message compressed by the
+// block format of Snappy. Only the samples are read, while the exemplars, histograms and metadata are skipped.
+
+// prometheusNameLabel is the label holding the name of the metric
+const prometheusNameLabel = "__name__"
+
+// Field numbers of the messages of the remote write protocol
+const (
+	writeRequestTimeseries = 1
+	timeseriesLabels       = 1
+	timeseriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+// decodeSnappy decompresses a block of the Snappy format, which is rejected if it would be larger than the limit
+func decodeSnappy(src []byte, limit int64) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errSnappyCorrupt
+	}
+	if size > uint64(limit) {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", limit)
+	}
+	dst := make([]byte, 0, size)
+	for s := n; s < len(src); {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0x00:
+			// A literal, whose length is either in the tag or in the following 1 to 4 bytes
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				bytes := length - 59
+				if s+bytes > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := bytes - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += bytes
+			}
+			length++
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(size) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 0x01:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case 0x02:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 0x03:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(size) {
+			return nil, errSnappyCorrupt
+		}
+		// The copy may overlap the bytes it produces, which repeats them
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// parseRemoteWrite parses the samples of a WriteRequest, each time series of which is named after its metric
+func parseRemoteWrite(data []byte) ([]*biz.SensorSample, error) {
+	var samples []*biz.SensorSample
+	err := scanMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		if num == writeRequestTimeseries && typ == protowire.BytesType {
+			samples, err = parseTimeseries(samples, v)
+		}
+		return
+	})
+	return samples, err
+}
+
+func parseTimeseries(samples []*biz.SensorSample, data []byte) ([]*biz.SensorSample, error) {
+	tags := make(map[string]string)
+	var name string
+	first := len(samples)
+	err := scanMessage(data, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case timeseriesLabels:
+			var key, value string
+			if err := scanMessage(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == labelName && typ == protowire.BytesType:
+					key = string(v)
+				case num == labelValue && typ == protowire.BytesType:
+					value = string(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if key == prometheusNameLabel {
+				name = value
+			} else {
+				tags[key] = value
+			}
+		case timeseriesSamples:
+			sample := &biz.SensorSample{Tags: tags}
+			if err := scanMessage(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					sample.Value = math.Float64frombits(binary.LittleEndian.Uint64(v))
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					ts, _ := protowire.ConsumeVarint(v)
+					sample.Timestamp = time.UnixMilli(int64(ts))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errors.New("time series without the name label")
+	}
+	// The labels may come after the samples
+	for _, s := range samples[first:] {
+		s.Name = name
+	}
+	return samples, nil
+}
+
+// scanMessage calls the function with the raw value of each field of the message, i.e. the payload of a field of the
+// bytes type, the little-endian bytes of a fixed field, or the encoded varint
+func scanMessage(data []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			var m int
+			if v, m = protowire.ConsumeBytes(data); m < 0 {
+				return protowire.ParseError(m)
+			}
+			n = m
+		default:
+			if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+				return protowire.ParseError(n)
+			}
+			v = data[:n]
+		}
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"bytes"
+	"example/internal/biz"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecodeSnappy(t *testing.T) {
+	text := bytes.Repeat([]byte("the readings of the sensors "), 100)
+	tests := []struct {
+		name  string
+		src   []byte
+		limit int64
+		want  []byte
+		ok    bool
+	}{
+		{name: "empty", src: snappy.Encode(nil, nil), limit: 10, want: []byte{}, ok: true},
+		{name: "literal", src: snappy.Encode(nil, []byte("abc")), limit: 10, want: []byte("abc"), ok: true},
+		{name: "copies", src: snappy.Encode(nil, text), limit: int64(len(text)), want: text, ok: true},
+		// A literal of 61 bytes takes its length from the byte after the tag
+		{name: "long literal", src: append([]byte{61, 60 << 2, 60}, bytes.Repeat([]byte{'x'}, 61)...), limit: 100,
+			want: bytes.Repeat([]byte{'x'}, 61), ok: true},
+		// A copy overlapping the bytes it produces repeats them
+		{name: "overlapping copy", src: []byte{6, 0 << 2, 'a', 1<<2 | 1, 1}, limit: 10, want: []byte("aaaaaa"), ok: true},
+		{name: "over the limit", src: snappy.Encode(nil, text), limit: int64(len(text)) - 1},
+		{name: "truncated length", src: []byte{0x80}, limit: 10},
+		{name: "oversize length", src: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, limit: 1 << 20},
+		{name: "truncated literal", src: []byte{3, 2 << 2, 'a'}, limit: 10},
+		{name: "truncated literal length", src: []byte{100, 61 << 2, 1}, limit: 200},
+		{name: "literal beyond the length", src: []byte{1, 1 << 2, 'a', 'b'}, limit: 10},
+		{name: "truncated copy", src: []byte{4, 0, 'a', 0x01}, limit: 10},
+		{name: "copy before the start", src: []byte{5, 0, 'a', 0x01, 2}, limit: 10},
+		{name: "zero offset", src: []byte{5, 0, 'a', 0x01, 0}, limit: 10},
+		{name: "short of the length", src: []byte{3, 0, 'a'}, limit: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSnappy(tt.src, tt.limit)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecodeSnappy(f *testing.F) {
+	f.Add(snappy.Encode(nil, []byte("abcabcabcabcabcabc")))
+	f.Add(snappy.Encode(nil, bytes.Repeat([]byte("0123456789"), 20)))
+	f.Add([]byte{6, 0, 'a', 0x05, 1})
+	f.Fuzz(func(t *testing.T, src []byte) {
+		const limit = 1 << 16
+		got, err := decodeSnappy(src, limit)
+		// The block is decoded as the reference decoder does, unless it exceeds the limit
+		if n, err := snappy.DecodedLen(src); err != nil || n > limit {
+			if got != nil {
+				t.Fatalf("got %q, want an error", got)
+			}
+			return
+		}
+		want, werr := snappy.Decode(nil, src)
+		if werr == nil {
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("got %q with error %v, want %q", got, err, want)
+			}
+		} else if err == nil {
+			t.Fatalf("got %q, want an error", got)
+		}
+	})
+}
+
+// writeRequest encodes a WriteRequest of the time series, each of which is a list of the labels followed by the
+// samples, where a sample is a pair of a value and a timestamp in milliseconds
+type series struct {
+	labels  []string
+	samples [][2]float64
+}
+
+func writeRequest(all ...series) []byte {
+	var b []byte
+	for _, s := range all {
+		var ts []byte
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			var l []byte
+			l = protowire.AppendTag(l, labelName, protowire.BytesType)
+			l = protowire.AppendString(l, s.labels[i])
+			l = protowire.AppendTag(l, labelValue, protowire.BytesType)
+			l = protowire.AppendString(l, s.labels[i+1])
+			ts = protowire.AppendTag(ts, timeseriesLabels, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		for _, sample := range s.samples {
+			var v []byte
+			v = protowire.AppendTag(v, sampleValue, protowire.Fixed64Type)
+			v = protowire.AppendFixed64(v, math.Float64bits(sample[0]))
+			v = protowire.AppendTag(v, sampleTimestamp, protowire.VarintType)
+			v = protowire.AppendVarint(v, uint64(int64(sample[1])))
+			ts = protowire.AppendTag(ts, timeseriesSamples, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, v)
+		}
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
+
+func TestParseRemoteWrite(t *testing.T) {
+	data := writeRequest(
+		series{labels: []string{"__name__", "temperature", "room", "kitchen"}, samples: [][2]float64{{21.5, 1000}, {22, 2000}}},
+		series{labels: []string{"__name__", "humidity"}, samples: [][2]float64{{40, 3000}}},
+	)
+	// Unknown fields, e.g. the metadata, are skipped
+	data = protowire.AppendTag(data, 3, protowire.BytesType)
+	data = protowire.AppendBytes(data, []byte("metadata"))
+	samples, err := parseRemoteWrite(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kitchen := map[string]string{"room": "kitchen"}
+	want := []*biz.SensorSample{
+		{Name: "temperature", Tags: kitchen, Value: 21.5, Timestamp: time.UnixMilli(1000)},
+		{Name: "temperature", Tags: kitchen, Value: 22, Timestamp: time.UnixMilli(2000)},
+		{Name: "humidity", Tags: map[string]string{}, Value: 40, Timestamp: time.UnixMilli(3000)},
+	}
+	if !reflect.DeepEqual(samples, want) {
+		t.Errorf("got %v, want %v", samples, want)
+	}
+}
+
+func TestParseRemoteWriteErrors(t *testing.T) {
+	valid := writeRequest(series{labels: []string{"__name__", "x"}, samples: [][2]float64{{1, 1}}})
+	tests := map[string][]byte{
+		"truncated tag":     {0x80},
+		"truncated varint":  {writeRequestTimeseries<<3 | 0, 0x80, 0x80},
+		"oversize length":   {writeRequestTimeseries<<3 | 2, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		"truncated message": valid[:len(valid)-1],
+		"without a name":    writeRequest(series{labels: []string{"room", "kitchen"}, samples: [][2]float64{{1, 1}}}),
+		"truncated sample": protowire.AppendBytes(protowire.AppendTag(nil, writeRequestTimeseries,
+			protowire.BytesType), []byte{timeseriesSamples<<3 | 2, 2, sampleValue<<3 | 1, 0}),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if samples, err := parseRemoteWrite(data); err == nil {
+				t.Errorf("got %v, want an error", samples)
+			}
+		})
+	}
+}
+
+func FuzzParseRemoteWrite(f *testing.F) {
+	f.Add(writeRequest(series{labels: []string{"__name__", "x", "a", "b"}, samples: [][2]float64{{1, 1}, {2, 2}}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		samples, err := parseRemoteWrite(data)
+		if err != nil {
+			return
+		}
+		for _, s := range samples {
+			if s.Name == "" || s.Tags == nil {
+				t.Fatalf("got sample %+v", s)
+			}
+		}
+	})
+}
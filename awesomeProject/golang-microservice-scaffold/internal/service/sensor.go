@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"io"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// SensorService ingests the readings of the sensors over gRPC and HTTP
+type SensorService struct {
+	v1.UnimplementedSensorServiceServer
+	mgr       *biz.SensorManager
+	terminals *biz.TerminalManager
+}
+
+func NewSensorService(mgr *biz.SensorManager, terminals *biz.TerminalManager) *SensorService {
+	return &SensorService{mgr: mgr, terminals: terminals}
+}
+
+// readingsOf converts the readings of the request, leaving the timestamp zero if it is absent
+func readingsOf(values []*v1.SensorValue) []*biz.SensorReading {
+	readings := make([]*biz.SensorReading, 0, len(values))
+	for _, v := range values {
+		reading := &biz.SensorReading{SensorId: int(v.SensorId), Value: v.Value}
+		if v.Timestamp != nil {
+			reading.Timestamp = v.Timestamp.AsTime()
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+func (s *SensorService) RecordValue(ctx context.Context, value *v1.SensorValue) (empty *emptypb.Empty, err error) {
+	if valid := value.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed reading: %v", valid)
+	}
+	err = s.mgr.Record(ctx, readingsOf([]*v1.SensorValue{value})...)
+	return
+}
+
+func (s *SensorService) RecordValues(ctx context.Context, req *v1.RecordValuesRequest) (*v1.RecordValuesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	if err := s.mgr.Record(ctx, readingsOf(req.Values)...); err != nil {
+		return nil, err
+	}
+	return &v1.RecordValuesReply{Accepted: int64(len(req.Values))}, nil
+}
+
+// StreamValues submits the readings as they arrive without waiting for each flush, and fails the stream as soon
+// as a flush fails. The submissions are written in order, so only the oldest ones are checked for completion.
+func (s *SensorService) StreamValues(stream v1.SensorService_StreamValuesServer) error {
+	ctx := stream.Context()
+	var pending []*biz.PendingReadings
+	var accepted int64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if valid := req.Validate(); valid != nil {
+			return v1.ErrorMalformedInput("Malformed request: %v", valid)
+		}
+		p, err := s.mgr.Submit(ctx, readingsOf(req.Values)...)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, p)
+		accepted += int64(len(req.Values))
+		for len(pending) > 0 && isDone(pending[0]) {
+			if err = pending[0].Err(); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+	}
+	for _, p := range pending {
+		if err := p.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return stream.SendAndClose(&v1.RecordValuesReply{Accepted: accepted})
+}
+
+func (s *SensorService) QuerySensorValues(
+	ctx context.Context, req *v1.QuerySensorValuesRequest) (*v1.QuerySensorValuesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed query: %v", valid)
+	}
+	series, err := s.mgr.Query(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.QuerySensorValuesReply{Series: series}, nil
+}
+
+func (s *SensorService) GetSensorSnapshot(
+	ctx context.Context, req *v1.GetSensorSnapshotRequest) (*v1.SensorSnapshot, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	var ids, terminalIds []int
+	switch {
+	case len(req.SensorIds) > 0:
+		ids = make([]int, 0, len(req.SensorIds))
+		for _, id := range req.SensorIds {
+			ids = append(ids, int(id))
+		}
+	case req.TerminalId > 0:
+		if _, err := s.terminals.GetTerminalById(ctx, int(req.TerminalId)); err != nil {
+			return nil, err
+		}
+		terminalIds = []int{int(req.TerminalId)}
+	case req.GroupId > 0:
+		var err error
+		if terminalIds, err = s.terminals.GroupMemberIds(ctx, int(req.GroupId), req.Recursive); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, v1.ErrorMalformedInput("Either the sensors, the terminal or the group must be specified")
+	}
+	return s.mgr.Snapshot(ctx, ids, terminalIds)
+}
+
+// isDone reports whether the submission has been written without blocking
+func isDone(p *biz.PendingReadings) bool {
+	select {
+	case <-p.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"time"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// SensorAnomalyService exposes the anomalies detected on the readings and the models of the sensors
+type SensorAnomalyService struct {
+	v1.UnimplementedSensorAnomaliesServer
+	mgr *biz.AnomalyManager
+}
+
+func NewSensorAnomalyService(mgr *biz.AnomalyManager) *SensorAnomalyService {
+	return &SensorAnomalyService{mgr: mgr}
+}
+
+func (s *SensorAnomalyService) ListAnomalies(
+	ctx context.Context, req *v1.ListAnomaliesRequest) (*v1.ListAnomaliesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	query := &biz.AnomalyQuery{
+		SensorIds: make([]int, 0, len(req.SensorIds)),
+		MinScore:  req.MinScore,
+		Offset:    int(req.Page * req.PageSize),
+		Limit:     int(req.PageSize),
+	}
+	for _, id := range req.SensorIds {
+		query.SensorIds = append(query.SensorIds, int(id))
+	}
+	if req.StartTime != nil {
+		query.From = req.StartTime.AsTime()
+	}
+	if req.EndTime != nil {
+		query.To = req.EndTime.AsTime()
+	}
+	anomalies, total, err := s.mgr.ListAnomalies(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListAnomaliesReply{Anomalies: anomalies, Total: int32(total)}, nil
+}
+
+func (s *SensorAnomalyService) GetAnomalyModel(
+	ctx context.Context, req *v1.AnomalyModelRequest) (*v1.AnomalyModel, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.GetModel(ctx, int(req.SensorId))
+}
+
+func (s *SensorAnomalyService) ResetAnomalyModel(
+	ctx context.Context, req *v1.AnomalyModelRequest) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.mgr.ResetModel(ctx, int(req.SensorId))
+	return
+}
+
+func (s *SensorAnomalyService) RetrainAnomalyModel(
+	ctx context.Context, req *v1.RetrainAnomalyModelRequest) (*v1.AnomalyModel, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	var from, to time.Time
+	if req.StartTime != nil {
+		from = req.StartTime.AsTime()
+	}
+	if req.EndTime != nil {
+		to = req.EndTime.AsTime()
+	}
+	return s.mgr.RetrainModel(ctx, int(req.SensorId), from, to)
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// SensorCalibrationService maintains the calibration profiles of the sensors and recomputes the stored readings
+type SensorCalibrationService struct {
+	v1.UnimplementedSensorCalibrationsServer
+	mgr *biz.CalibrationManager
+}
+
+func NewSensorCalibrationService(mgr *biz.CalibrationManager) *SensorCalibrationService {
+	return &SensorCalibrationService{mgr: mgr}
+}
+
+func (s *SensorCalibrationService) CreateCalibration(
+	ctx context.Context, req *v1.Calibration) (*v1.Calibration, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed calibration: %v", valid)
+	}
+	return s.mgr.CreateCalibration(ctx, req)
+}
+
+func (s *SensorCalibrationService) ListCalibrations(
+	ctx context.Context, req *v1.ListCalibrationsRequest) (*v1.ListCalibrationsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	calibrations, err := s.mgr.ListCalibrations(ctx, int(req.SensorId))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListCalibrationsReply{Calibrations: calibrations}, nil
+}
+
+func (s *SensorCalibrationService) GetCalibration(ctx context.Context, req *v1.CalibrationId) (*v1.Calibration, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.GetCalibration(ctx, int(req.Id))
+}
+
+func (s *SensorCalibrationService) UpdateCalibration(
+	ctx context.Context, req *v1.Calibration) (*v1.Calibration, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed calibration: %v", valid)
+	}
+	if req.Id <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed calibration: missing id")
+	}
+	return s.mgr.UpdateCalibration(ctx, req)
+}
+
+func (s *SensorCalibrationService) DeleteCalibration(
+	ctx context.Context, req *v1.CalibrationId) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.mgr.DeleteCalibration(ctx, int(req.Id))
+	return
+}
+
+func (s *SensorCalibrationService) RecomputeCalibration(
+	ctx context.Context, req *v1.RecomputeCalibrationRequest) (*v1.CalibrationRecompute, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.Recompute(ctx, int(req.SensorId), req.StartTime.AsTime(), req.EndTime.AsTime())
+}
+
+func (s *SensorCalibrationService) GetCalibrationRecompute(
+	ctx context.Context, req *v1.CalibrationRecomputeId) (*v1.CalibrationRecompute, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.GetRecompute(ctx, int(req.Id))
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"compress/gzip"
+	v1 "example/api/sensor/v1"
+	"io"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/go-kratos/kratos/v2/transport/http"
+)
+
+// readBody reads the request body of an agent, which may be compressed by gzip, within the limit of the size
+func (s *SensorService) readBody(ctx http.Context) ([]byte, error) {
+	limit := s.mgr.MaxCollectBodySize()
+	req := ctx.Request()
+	var body io.Reader = nethttp.MaxBytesReader(ctx.Response(), req.Body, limit)
+	if strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, v1.ErrorMalformedInput("Malformed gzip body: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, v1.ErrorMalformedInput("Malformed body: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, v1.ErrorMalformedInput("The body exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// WriteInflux records the points of the InfluxDB line protocol. It is compatible with the write endpoints of both
+// InfluxDB 1.x and 2.x, so that the agents such as Telegraf may point their InfluxDB outputs to the service. The
+// database, bucket and organization are ignored.
+func (s *SensorService) WriteInflux(ctx http.Context) error {
+	timeOf, ok := influxPrecisions[ctx.Request().URL.Query().Get("precision")]
+	if !ok {
+		return v1.ErrorMalformedInput("Unknown precision %v", ctx.Request().URL.Query().Get("precision"))
+	}
+	data, err := s.readBody(ctx)
+	if err != nil {
+		return err
+	}
+	samples, err := parseLineProtocol(data, timeOf)
+	if err != nil {
+		return v1.ErrorMalformedInput("Malformed line protocol: %v", err)
+	}
+	if _, err = s.mgr.Collect(ctx, samples); err != nil {
+		return err
+	}
+	ctx.Response().WriteHeader(nethttp.StatusNoContent)
+	return nil
+}
+
+// WritePrometheus records the samples of the Prometheus remote write 1.0, so that Prometheus or its agents may
+// forward the scraped metrics to the service. The samples rejected are not retried by the senders.
+func (s *SensorService) WritePrometheus(ctx http.Context) error {
+	req := ctx.Request()
+	if contentType := req.Header.Get("Content-Type"); strings.Contains(contentType, "io.prometheus.write.v2") {
+		return v1.ErrorMalformedInput("Unsupported remote write protocol %v", contentType)
+	}
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "snappy") {
+		return v1.ErrorMalformedInput("Unsupported content encoding %v", encoding)
+	}
+	limit := s.mgr.MaxCollectBodySize()
+	compressed, err := io.ReadAll(io.LimitReader(nethttp.MaxBytesReader(ctx.Response(), req.Body, limit), limit))
+	if err != nil {
+		return v1.ErrorMalformedInput("Malformed body: %v", err)
+	}
+	data, err := decodeSnappy(compressed, limit)
+	if err != nil {
+		return v1.ErrorMalformedInput("Malformed body: %v", err)
+	}
+	samples, err := parseRemoteWrite(data)
+	if err != nil {
+		return v1.ErrorMalformedInput("Malformed write request: %v", err)
+	}
+	if _, err = s.mgr.Collect(ctx, samples); err != nil {
+		return err
+	}
+	ctx.Response().WriteHeader(nethttp.StatusNoContent)
+	return nil
+}
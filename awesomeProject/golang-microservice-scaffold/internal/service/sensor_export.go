@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+	"fmt"
+	nethttp "net/http"
+	"strconv"
+
+	"github.com/go-kratos/kratos/v2/transport/http"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// SensorExportService exports the sensor readings as files. Besides the gRPC and HTTP APIs, the files are
+// downloaded by the plain HTTP handlers [SensorExportService.Export] and [SensorExportService.Download].
+type SensorExportService struct {
+	v1.UnimplementedSensorExportsServer
+	mgr *biz.SensorExportManager
+}
+
+func NewSensorExportService(mgr *biz.SensorExportManager) *SensorExportService {
+	return &SensorExportService{mgr: mgr}
+}
+
+// exportChunkSize is the size of the chunks the file is streamed in
+const exportChunkSize = 64 << 10
+
+// chunkSender sends whatever is written to it as the chunks of the stream
+type chunkSender struct {
+	stream v1.SensorExports_ExportSensorValuesServer
+}
+
+func (c *chunkSender) Write(p []byte) (int, error) {
+	if err := c.stream.Send(&v1.ExportSensorValuesChunk{Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *SensorExportService) ExportSensorValues(
+	req *v1.ExportSensorValuesRequest, stream v1.SensorExports_ExportSensorValuesServer) error {
+	if valid := req.Validate(); valid != nil {
+		return v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	w := bufio.NewWriterSize(&chunkSender{stream: stream}, exportChunkSize)
+	if _, err := s.mgr.Export(stream.Context(), req, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// exportFileOf returns the media type of the file of the request along with its suggested name
+func exportFileOf(req *v1.ExportSensorValuesRequest) (contentType string, name string) {
+	switch req.Format {
+	case v1.ExportSensorValuesRequest_NDJSON:
+		contentType, name = "application/x-ndjson", "sensor-values.ndjson"
+	case v1.ExportSensorValuesRequest_PARQUET:
+		contentType, name = "application/vnd.apache.parquet", "sensor-values.parquet"
+	default:
+		contentType, name = "text/csv", "sensor-values.csv"
+	}
+	return
+}
+
+// attachmentWriter writes the headers of the attachment right before the first byte of the file, so that an error
+// before that is still replied as usual
+type attachmentWriter struct {
+	w           nethttp.ResponseWriter
+	contentType string
+	name        string
+	started     bool
+}
+
+func (a *attachmentWriter) begin() {
+	if !a.started {
+		a.started = true
+		header := a.w.Header()
+		header.Set("Content-Type", a.contentType)
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.name))
+		a.w.WriteHeader(nethttp.StatusOK)
+	}
+}
+
+func (a *attachmentWriter) Write(p []byte) (int, error) {
+	a.begin()
+	return a.w.Write(p)
+}
+
+// Export streams the file of the readings, taking the fields of [v1.ExportSensorValuesRequest] as the query
+// parameters, e.g. ?sensor_ids=1&sensor_ids=2&start_time=2024-01-01T00:00:00Z&end_time=2024-01-02T00:00:00Z&format=CSV
+func (s *SensorExportService) Export(ctx http.Context) error {
+	req := &v1.ExportSensorValuesRequest{}
+	if err := ctx.BindQuery(req); err != nil {
+		return v1.ErrorMalformedInput("Malformed request: %v", err)
+	}
+	if valid := req.Validate(); valid != nil {
+		return v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	contentType, name := exportFileOf(req)
+	w := &attachmentWriter{w: ctx.Response(), contentType: contentType, name: name}
+	if _, err := s.mgr.Export(ctx, req, w); err != nil {
+		if !w.started {
+			return err
+		}
+		// Break off the response, so that the client does not take the truncated file for a complete one
+		panic(nethttp.ErrAbortHandler)
+	}
+	w.begin()
+	return nil
+}
+
+// Download serves the file of a succeeded export job. Range requests are supported, so that a client may resume an
+// interrupted download.
+func (s *SensorExportService) Download(ctx http.Context) error {
+	id, err := strconv.Atoi(ctx.Vars().Get("id"))
+	if err != nil || id <= 0 {
+		return v1.ErrorMalformedInput("Malformed export id %v", ctx.Vars().Get("id"))
+	}
+	export, file, err := s.mgr.OpenExport(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	contentType, name := exportFileOf(export.Request)
+	header := ctx.Response().Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	nethttp.ServeContent(ctx.Response(), ctx.Request(), "", export.FinishTime.AsTime(), file)
+	return nil
+}
+
+func (s *SensorExportService) CreateSensorExport(
+	ctx context.Context, req *v1.ExportSensorValuesRequest) (*v1.SensorExport, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.CreateExport(ctx, req)
+}
+
+func (s *SensorExportService) GetSensorExport(ctx context.Context, id *v1.SensorExportId) (*v1.SensorExport, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed export id: %v", valid)
+	}
+	return s.mgr.GetExport(ctx, int(id.Id))
+}
+
+func (s *SensorExportService) ListSensorExports(
+	ctx context.Context, req *v1.ListSensorExportsRequest) (*v1.ListSensorExportsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	exports, total, err := s.mgr.ListExports(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListSensorExportsReply{Exports: exports, Total: int32(total)}, nil
+}
+
+func (s *SensorExportService) DeleteSensorExport(
+	ctx context.Context, id *v1.SensorExportId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed export id: %v", valid)
+	}
+	err = s.mgr.DeleteExport(ctx, int(id.Id))
+	return
+}
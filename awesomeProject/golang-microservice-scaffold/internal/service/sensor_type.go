@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// SensorTypeService maintains the sensor type catalog
+type SensorTypeService struct {
+	v1.UnimplementedSensorTypesServer
+	mgr *biz.SensorTypeManager
+}
+
+func NewSensorTypeService(mgr *biz.SensorTypeManager) *SensorTypeService {
+	return &SensorTypeService{mgr: mgr}
+}
+
+func (s *SensorTypeService) CreateSensorType(ctx context.Context, t *v1.SensorType) (*v1.SensorType, error) {
+	if valid := t.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed sensor type: %v", valid)
+	}
+	return s.mgr.Create(ctx, t)
+}
+
+func (s *SensorTypeService) GetSensorType(ctx context.Context, id *v1.SensorTypeId) (*v1.SensorType, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed sensor type id: %v", valid)
+	}
+	return s.mgr.Get(ctx, int(id.Id))
+}
+
+func (s *SensorTypeService) ListSensorTypes(
+	ctx context.Context, req *v1.ListSensorTypesRequest) (*v1.ListSensorTypesReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	types, total, err := s.mgr.List(ctx, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListSensorTypesReply{SensorTypes: types, Total: int32(total)}, nil
+}
+
+func (s *SensorTypeService) UpdateSensorType(ctx context.Context, t *v1.SensorType) (*v1.SensorType, error) {
+	if valid := t.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed sensor type: %v", valid)
+	}
+	if t.Id <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed sensor type id %v", t.Id)
+	}
+	return s.mgr.Update(ctx, t)
+}
+
+func (s *SensorTypeService) DeleteSensorType(
+	ctx context.Context, id *v1.SensorTypeId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed sensor type id: %v", valid)
+	}
+	err = s.mgr.Delete(ctx, int(id.Id))
+	return
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	serverv1 "example/api/server"
+	"example/internal/biz"
+	"strings"
+)
+
+// ServerService maintains the server inventory
+type ServerService struct {
+	serverv1.UnimplementedServerServer
+	mgr *biz.ServerManager
+}
+
+func NewServerService(mgr *biz.ServerManager) *ServerService {
+	return &ServerService{mgr: mgr}
+}
+
+func (s *ServerService) CreateServer(
+	ctx context.Context, req *serverv1.CreateServerRequest) (*serverv1.CreateServerReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, serverv1.ErrorMalformedInput("Malformed server: %v", valid)
+	}
+	created, err := s.mgr.Create(ctx, req.Server)
+	if err != nil {
+		return nil, err
+	}
+	return &serverv1.CreateServerReply{Server: created}, nil
+}
+
+func (s *ServerService) UpdateServer(
+	ctx context.Context, req *serverv1.UpdateServerRequest) (*serverv1.UpdateServerReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, serverv1.ErrorMalformedInput("Malformed server: %v", valid)
+	}
+	if req.Server.Id <= 0 {
+		return nil, serverv1.ErrorMalformedInput("Malformed server id %v", req.Server.Id)
+	}
+	updated, err := s.mgr.Update(ctx, req.Server)
+	if err != nil {
+		return nil, err
+	}
+	return &serverv1.UpdateServerReply{Server: updated}, nil
+}
+
+func (s *ServerService) DeleteServer(
+	ctx context.Context, req *serverv1.DeleteServerRequest) (*serverv1.DeleteServerReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, serverv1.ErrorMalformedInput("Malformed server id: %v", valid)
+	}
+	if err := s.mgr.Delete(ctx, int(req.Id)); err != nil {
+		return nil, err
+	}
+	return &serverv1.DeleteServerReply{}, nil
+}
+
+func (s *ServerService) GetServer(
+	ctx context.Context, req *serverv1.GetServerRequest) (*serverv1.GetServerReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, serverv1.ErrorMalformedInput("Malformed server id: %v", valid)
+	}
+	server, err := s.mgr.Get(ctx, int(req.Id))
+	if err != nil {
+		return nil, err
+	}
+	return &serverv1.GetServerReply{Server: server}, nil
+}
+
+func (s *ServerService) ListServer(
+	ctx context.Context, req *serverv1.ListServerRequest) (*serverv1.ListServerReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, serverv1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	filter := &biz.ServerFilter{
+		Role:         req.Role,
+		Environment:  req.Environment,
+		Status:       req.Status,
+		OwnerGroupId: req.OwnerGroupId,
+		Labels:       make(map[string]string, len(req.Labels)),
+	}
+	for _, label := range req.Labels {
+		// The pattern of the labels guarantees the separator
+		key, value, _ := strings.Cut(label, "=")
+		filter.Labels[key] = value
+	}
+	servers, total, err := s.mgr.List(ctx, filter, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &serverv1.ListServerReply{Servers: servers, Total: int32(total)}, nil
+}
@@ -7,5 +7,19 @@ import "github.com/google/wire"
 
 // ProviderSet is service providers.
 var ProviderSet = wire.NewSet(
+	NewUserService,
 	NewTerminalService,
+	NewTerminalGroupService,
+	NewCommandService,
+	NewFirmwareService,
+	NewShadowService,
+	NewSensorService,
+	NewSensorTypeService,
+	NewSensorExportService,
+	NewSensorAnomalyService,
+	NewSensorCalibrationService,
+	NewVirtualSensorService,
+	NewServerService,
+	NewAlertService,
+	NewNotificationService,
 )
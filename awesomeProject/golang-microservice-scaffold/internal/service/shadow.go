@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+)
+
+// ShadowService exposes the shadow documents of the terminals to the operators and the terminals
+type ShadowService struct {
+	v1.UnimplementedTerminalShadowServer
+	mgr *biz.ShadowManager
+}
+
+func NewShadowService(mgr *biz.ShadowManager) *ShadowService {
+	return &ShadowService{mgr: mgr}
+}
+
+func (s *ShadowService) GetShadow(ctx context.Context, id *v1.ShadowId) (*v1.Shadow, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed terminal id: %v", valid)
+	}
+	return s.mgr.Get(ctx, int(id.TerminalId))
+}
+
+func (s *ShadowService) UpdateDesiredState(ctx context.Context, req *v1.UpdateShadowRequest) (*v1.Shadow, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.UpdateDesired(ctx, int(req.TerminalId), req.State, req.Version)
+}
+
+func (s *ShadowService) ReportState(ctx context.Context, req *v1.UpdateShadowRequest) (*v1.Shadow, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.ReportState(ctx, int(req.TerminalId), req.State, req.Version)
+}
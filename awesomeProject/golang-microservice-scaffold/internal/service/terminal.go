@@ -2,67 +2,136 @@ package service
 
 import (
 	"context"
-	v1 "example/api/terminal_server"
+	v1 "example/api/terminal"
 	"example/internal/biz"
-	"time"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type TerminalService struct {
 	v1.UnimplementedTerminalManagementServer
-	mgr *biz.TerminalManager
+	mgr     *biz.TerminalManager
+	sensors *biz.SensorManager
 }
 
-func NewTerminalService(mgr *biz.TerminalManager) *TerminalService {
-	return &TerminalService{mgr: mgr}
+func NewTerminalService(mgr *biz.TerminalManager, sensors *biz.SensorManager) *TerminalService {
+	return &TerminalService{mgr: mgr, sensors: sensors}
 }
 
-// GetTerminalStatusById
-func (s *TerminalService) GetTerminalStatus(ctx context.Context, id *v1.TerminalId (*pb.TerminalResponse, error) {
-	terminal, err := s.mgr.GetTerminalByID(ctx, int(req.Id))
+// UpdateTerminalStatus records the status reported by the terminal
+func (s *TerminalService) UpdateTerminalStatus(ctx context.Context, t *v1.Terminal) (empty *emptypb.Empty, err error) {
+	if valid := t.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed terminal: %v", valid)
+	}
+	err = s.mgr.Update(ctx, t)
+	return
+}
+
+func (s *TerminalService) ListTerminals(
+	ctx context.Context, req *v1.ListTerminalsRequest) (*v1.ListTerminalsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	terminals, total, err := s.mgr.List(
+		ctx, req.Area, req.IncludeDecommissioned, int(req.Page*req.PageSize), int(req.PageSize))
 	if err != nil {
 		return nil, err
 	}
+	return &v1.ListTerminalsReply{Terminals: terminals, Total: int32(total)}, nil
+}
 
-	// check timeout
-	isTimeout := time.Since(terminal.LastUpdated).Seconds() > float64(terminal.Timeout)
-	status := terminal.Status
-	if isTimeout {
-		status = "offline"
+func (s *TerminalService) GetTerminalFeatures(
+	ctx context.Context, req *v1.GetTerminalFeaturesRequest) (*v1.FeatureCollection, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
 	}
+	return s.mgr.Features(ctx, req.Area, req.IncludeDecommissioned)
+}
 
-	return &v1.TerminalResponse{
-		Id:      int32(terminal.ID),
-		Status:  status,
-		Timeout: int32(terminal.Timeout),
-	}, nil
+func (s *TerminalService) SetTerminalLocation(
+	ctx context.Context, req *v1.SetTerminalLocationRequest) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.mgr.SetLocation(ctx, int(req.Id), req.Location)
+	return
 }
 
-// UpdateTerminal
-func (s *TerminalService) UpdateTerminal(ctx context.Context, req *pb.TerminalUpdateRequest) (*v1.TerminalResponse, error) {
-	err := s.mgr.UpdateTerminal(ctx, int(req.Id), req.Status, int(req.Timeout))
+// GetTerminalStatus returns the terminal whose status turns offline if it has not reported in time
+func (s *TerminalService) GetTerminalStatus(ctx context.Context, id *v1.TerminalId) (*v1.Terminal, error) {
+	terminal, err := s.mgr.GetTerminalById(ctx, int(id.Id))
 	if err != nil {
 		return nil, err
 	}
+	if terminal.Status, err = s.mgr.GetTerminalStatus(ctx, int(id.Id)); err != nil {
+		return nil, err
+	}
+	return terminal, nil
+}
 
-	return &v1.TerminalResponse{
-		Id:      req.Id,
-		Status:  req.Status,
-		Timeout: req.Timeout,
-		Message: "Terminal updated successfully",
-	}, nil
+func (s *TerminalService) GetTerminal(ctx context.Context, req *v1.GetTerminalRequest) (*v1.Terminal, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.GetTerminal(ctx, int(req.Id), req.IncludeSensors)
 }
 
-// SetTerminalTimeout
-func (s *TerminalService) SetTerminalTimeout(ctx context.Context, req *v1.TerminalTimeoutRequest) (*pb.TerminalResponse, error) {
-	err := s.mgr.SetTerminalTimeout(ctx, int(req.Id), int(req.Timeout))
+func (s *TerminalService) AttachSensor(ctx context.Context, req *v1.TerminalSensor) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.sensors.Attach(ctx, int(req.SensorId), int(req.TerminalId))
+	return
+}
+
+func (s *TerminalService) DetachSensor(ctx context.Context, req *v1.TerminalSensor) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.sensors.Detach(ctx, int(req.SensorId), int(req.TerminalId))
+	return
+}
+
+func (s *TerminalService) GetTerminalHistory(
+	ctx context.Context, req *v1.GetTerminalHistoryRequest) (*v1.GetTerminalHistoryReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	changes, total, err := s.mgr.History(
+		ctx, int(req.TerminalId), req.StartTime, req.EndTime, int(req.Page*req.PageSize), int(req.PageSize))
 	if err != nil {
 		return nil, err
 	}
+	return &v1.GetTerminalHistoryReply{Changes: changes, Total: int32(total)}, nil
+}
+
+func (s *TerminalService) GetUptimeReport(
+	ctx context.Context, req *v1.GetUptimeReportRequest) (*v1.UptimeReport, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.UptimeReport(ctx, int(req.TerminalId), int(req.GroupId), req.Recursive, req.StartTime, req.EndTime)
+}
+
+func (s *TerminalService) SetTerminalTimeout(
+	ctx context.Context, req *v1.SetTerminalTimeoutRequest) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.mgr.SetTimeOut(ctx, int(req.Id), int(req.Timeout))
+	return
+}
 
-	return &v1.TerminalResponse{
-		Id:      req.Id,
-		Timeout: req.Timeout,
-		Status:  req.Status,
-		Message: "Timeout updated successfully",
-	}, nil
+func (s *TerminalService) BulkSetTerminalTimeout(
+	ctx context.Context, req *v1.BulkSetTerminalTimeoutRequest) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.BulkSetTimeOut(ctx, req.Selector, int(req.Timeout))
+}
+
+func (s *TerminalService) DecommissionTerminals(ctx context.Context, sel *v1.TerminalSelector) (*v1.BulkReply, error) {
+	if valid := sel.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed selector: %v", valid)
+	}
+	return s.mgr.Decommission(ctx, sel)
 }
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/terminal"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// TerminalGroupService organizes the terminals by groups and tags
+type TerminalGroupService struct {
+	v1.UnimplementedTerminalGroupsServer
+	groups    *biz.TerminalGroupManager
+	terminals *biz.TerminalManager
+}
+
+func NewTerminalGroupService(groups *biz.TerminalGroupManager, terminals *biz.TerminalManager) *TerminalGroupService {
+	return &TerminalGroupService{groups: groups, terminals: terminals}
+}
+
+// idsOf converts the ids in the requests into the ones used by the business logic
+func idsOf(ids []int64) []int {
+	converted := make([]int, 0, len(ids))
+	for _, id := range ids {
+		converted = append(converted, int(id))
+	}
+	return converted
+}
+
+func (s *TerminalGroupService) CreateGroup(ctx context.Context, group *v1.TerminalGroup) (*v1.TerminalGroup, error) {
+	if valid := group.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed group: %v", valid)
+	}
+	return s.groups.Create(ctx, group)
+}
+
+func (s *TerminalGroupService) GetGroup(ctx context.Context, id *v1.GroupId) (*v1.TerminalGroup, error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed group id: %v", valid)
+	}
+	return s.groups.GetById(ctx, int(id.Id))
+}
+
+func (s *TerminalGroupService) ListGroups(ctx context.Context, req *v1.ListGroupsRequest) (*v1.ListGroupsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	var parentId *int
+	if req.ParentId != nil {
+		id := int(*req.ParentId)
+		parentId = &id
+	}
+	groups, err := s.groups.List(ctx, parentId)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListGroupsReply{Groups: groups}, nil
+}
+
+func (s *TerminalGroupService) UpdateGroup(ctx context.Context, group *v1.TerminalGroup) (*v1.TerminalGroup, error) {
+	if valid := group.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed group: %v", valid)
+	}
+	return s.groups.Update(ctx, group)
+}
+
+func (s *TerminalGroupService) DeleteGroup(ctx context.Context, id *v1.GroupId) (empty *emptypb.Empty, err error) {
+	if valid := id.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed group id: %v", valid)
+	}
+	err = s.groups.Delete(ctx, int(id.Id))
+	return
+}
+
+func (s *TerminalGroupService) AssignTerminals(ctx context.Context, req *v1.GroupMembers) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.terminals.Assign(ctx, int(req.GroupId), idsOf(req.TerminalIds))
+}
+
+func (s *TerminalGroupService) UnassignTerminals(ctx context.Context, req *v1.GroupMembers) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.terminals.Unassign(ctx, int(req.GroupId), idsOf(req.TerminalIds))
+}
+
+func (s *TerminalGroupService) ListGroupTerminals(
+	ctx context.Context, req *v1.ListGroupTerminalsRequest) (*v1.ListTerminalsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	terminals, total, err := s.terminals.ListGroupMembers(
+		ctx, int(req.GroupId), req.Recursive, int(req.Page*req.PageSize), int(req.PageSize))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListTerminalsReply{Terminals: terminals, Total: int32(total)}, nil
+}
+
+func (s *TerminalGroupService) TagTerminals(ctx context.Context, req *v1.TagTerminalsRequest) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.terminals.Tag(ctx, idsOf(req.TerminalIds), req.Tags)
+}
+
+func (s *TerminalGroupService) UntagTerminals(ctx context.Context, req *v1.TagTerminalsRequest) (*v1.BulkReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.terminals.Untag(ctx, idsOf(req.TerminalIds), req.Tags)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	v1 "example/api/sensor/v1"
+	"example/internal/biz"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// VirtualSensorService maintains the definitions of the virtual sensors
+type VirtualSensorService struct {
+	v1.UnimplementedVirtualSensorsServer
+	mgr *biz.VirtualSensorManager
+}
+
+func NewVirtualSensorService(mgr *biz.VirtualSensorManager) *VirtualSensorService {
+	return &VirtualSensorService{mgr: mgr}
+}
+
+func (s *VirtualSensorService) CreateVirtualSensor(
+	ctx context.Context, req *v1.VirtualSensor) (*v1.VirtualSensor, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed virtual sensor: %v", valid)
+	}
+	return s.mgr.CreateVirtualSensor(ctx, req)
+}
+
+func (s *VirtualSensorService) ListVirtualSensors(
+	ctx context.Context, req *v1.ListVirtualSensorsRequest) (*v1.ListVirtualSensorsReply, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	virtuals, err := s.mgr.ListVirtualSensors(ctx, int(req.InputSensorId))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListVirtualSensorsReply{VirtualSensors: virtuals}, nil
+}
+
+func (s *VirtualSensorService) GetVirtualSensor(
+	ctx context.Context, req *v1.VirtualSensorId) (*v1.VirtualSensor, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	return s.mgr.GetVirtualSensor(ctx, int(req.SensorId))
+}
+
+func (s *VirtualSensorService) UpdateVirtualSensor(
+	ctx context.Context, req *v1.VirtualSensor) (*v1.VirtualSensor, error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed virtual sensor: %v", valid)
+	}
+	if req.SensorId <= 0 {
+		return nil, v1.ErrorMalformedInput("Malformed virtual sensor: missing sensor id")
+	}
+	return s.mgr.UpdateVirtualSensor(ctx, req)
+}
+
+func (s *VirtualSensorService) DeleteVirtualSensor(
+	ctx context.Context, req *v1.VirtualSensorId) (empty *emptypb.Empty, err error) {
+	if valid := req.Validate(); valid != nil {
+		return nil, v1.ErrorMalformedInput("Malformed request: %v", valid)
+	}
+	err = s.mgr.DeleteVirtualSensor(ctx, int(req.SensorId))
+	return
+}